@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+
+	filaddr "github.com/filecoin-project/go-address"
+	filcrypto "github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	blst "github.com/supranational/blst/bindings/go"
+	"golang.org/x/xerrors"
+)
+
+// lotus/lib/sigs/bls needs the filecoin-ffi, which this build does not link. Register
+// an equivalent BLS implementation backed directly by blst instead: the same library the
+// ffi uses underneath, with the same little-endian private key serialization, so keys
+// exported from a lotus wallet sign identically.
+const blsDST = "BLS_SIG_BLS12381G2_XMD:SHA-256_SSWU_RO_NUL_"
+
+type blsSigner struct{}
+
+func init() {
+	sigs.RegisterSignature(filcrypto.SigTypeBLS, blsSigner{})
+}
+
+func blsSecretKey(priv []byte) (*blst.SecretKey, error) {
+	if len(priv) != blst.BLST_SCALAR_BYTES {
+		return nil, xerrors.New("bls signature invalid private key")
+	}
+	sk := new(blst.SecretKey).FromLEndian(priv)
+	if sk == nil || !sk.Valid() {
+		return nil, xerrors.New("bls signature invalid private key")
+	}
+	return sk, nil
+}
+
+func (blsSigner) GenPrivate() ([]byte, error) {
+	var ikm [32]byte
+	if _, err := rand.Read(ikm[:]); err != nil {
+		return nil, xerrors.Errorf("bls signature error generating random data: %w", err)
+	}
+	return blst.KeyGen(ikm[:]).ToLEndian(), nil
+}
+
+func (blsSigner) ToPublic(priv []byte) ([]byte, error) {
+	sk, err := blsSecretKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return new(blst.P1Affine).From(sk).Compress(), nil
+}
+
+func (blsSigner) Sign(priv []byte, msg []byte) ([]byte, error) {
+	sk, err := blsSecretKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return new(blst.P2Affine).Sign(sk, msg, []byte(blsDST)).Compress(), nil
+}
+
+func (blsSigner) Verify(sig []byte, a filaddr.Address, msg []byte) error {
+	if !new(blst.P2Affine).VerifyCompressed(sig, true, a.Payload(), true, msg, []byte(blsDST)) {
+		return xerrors.New("bls signature failed to verify")
+	}
+	return nil
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/ipfs/go-cid"
+	bsmsg "github.com/ipfs/go-libipfs/bitswap/message"
+	bsmsgpb "github.com/ipfs/go-libipfs/bitswap/message/pb"
+	bsnet "github.com/ipfs/go-libipfs/bitswap/network"
+	lp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	lp2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"github.com/ribasushi/go-toolbox-interplanetary/lp2p"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+)
+
+type sampledDeal struct {
+	ProviderID   fil.ActorID
+	DealID       int64
+	PieceCid     string
+	DecodedLabel *string
+	HTTPAddrs    []string // as found in the polled spInfo.RetrievalProtocols
+	BitswapAddrs []string
+	Transports   []string
+}
+
+type retrievalCheckMeta struct {
+	URL        string `json:"url,omitempty"`
+	PeerID     string `json:"peerid,omitempty"`
+	Cid        string `json:"cid,omitempty"`
+	HTTPStatus int    `json:"http_status,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type retrievalCheck struct {
+	transport     string
+	retrieved     *bool // nil when the check could not be attempted
+	tookMsecs     *int64
+	bytesReceived *int64
+	meta          retrievalCheckMeta
+}
+
+var (
+	retrievalDealsPerSP     int
+	retrievalTimeout        int
+	retrievalConcurrency    int
+	retrievalRangeKiB       int
+	retrievalAllowPrivateIP bool
+)
+var checkRetrievals = &ufcli.Command{
+	Usage: "Attempt retrievals of a random sample of every provider's active deals",
+	Name:  "check-retrievals",
+	Description: strings.Join([]string{
+		"Over HTTP a range of the piece is requested first, and when that fails the CAR of the",
+		"deal label root. Providers not advertising HTTP are asked for the label root block over",
+		"Bitswap instead. Providers advertising exclusively Graphsync have their checks recorded",
+		"as not attempted, and are not penalized for it.",
+	}, "\n"),
+	Flags: []ufcli.Flag{
+		&ufcli.IntFlag{
+			Name:        "deals-per-provider",
+			Usage:       "Amount of active deals to sample from every provider",
+			Value:       3,
+			Destination: &retrievalDealsPerSP,
+		},
+		&ufcli.IntFlag{
+			Name:        "check-timeout",
+			Usage:       "Amount of seconds before aborting a specific retrieval attempt",
+			Value:       30,
+			Destination: &retrievalTimeout,
+		},
+		&ufcli.IntFlag{
+			Name:        "check-concurrency",
+			Usage:       "How many providers to check concurrently",
+			Value:       16,
+			Destination: &retrievalConcurrency,
+		},
+		&ufcli.IntFlag{
+			Name:        "range-kib",
+			Usage:       "Amount of KiB to retrieve from the start of every sampled deal",
+			Value:       1024,
+			Destination: &retrievalRangeKiB,
+		},
+		&ufcli.BoolFlag{
+			Name:        "allow-private-targets",
+			Usage:       "Permit retrieving from loopback/private network addresses ( for testing only )",
+			Destination: &retrievalAllowPrivateIP,
+		},
+	},
+	Action: func(cctx *ufcli.Context) error {
+		ctx, log, db, _ := app.UnpackCtx(cctx.Context)
+
+		sample := make([]sampledDeal, 0, 4096)
+		if err := pgxscan.Select(
+			ctx,
+			db,
+			&sample,
+			`
+			SELECT
+					pi.provider_id,
+					pd.deal_id,
+					pd.piece_cid,
+					pd.decoded_label,
+					ARRAY( SELECT JSONB_ARRAY_ELEMENTS_TEXT( COALESCE( pi.info->'retrieval_protocols'->'http', '[]' ) ) ) AS http_addrs,
+					ARRAY( SELECT JSONB_ARRAY_ELEMENTS_TEXT( COALESCE( pi.info->'retrieval_protocols'->'bitswap', '[]' ) ) ) AS bitswap_addrs,
+					ARRAY( SELECT JSONB_OBJECT_KEYS( COALESCE( pi.info->'retrieval_protocols', '{}' ) ) ORDER BY 1 ) AS transports
+				FROM spd.providers_info pi
+				JOIN LATERAL (
+					SELECT d.deal_id, d.piece_cid, d.decoded_label
+						FROM spd.published_deals d
+						JOIN spd.clients c USING ( client_id )
+					WHERE
+						d.provider_id = pi.provider_id
+							AND
+						d.status = 'active'
+							AND
+						c.tenant_id IS NOT NULL
+					ORDER BY RANDOM()
+					LIMIT $1
+				) pd ON true
+			ORDER BY pi.provider_id
+			`,
+			retrievalDealsPerSP,
+		); err != nil {
+			return cmn.WrErr(err)
+		}
+
+		perSP := make(map[fil.ActorID][]sampledDeal, 256)
+		for _, d := range sample {
+			perSP[d.ProviderID] = append(perSP[d.ProviderID], d)
+		}
+
+		totals := struct {
+			retrieved   *int32
+			failed      *int32
+			unsupported *int32
+		}{
+			retrieved:   new(int32),
+			failed:      new(int32),
+			unsupported: new(int32),
+		}
+		t0 := time.Now()
+		defer func() {
+			log.Infow("summary",
+				"providers", len(perSP),
+				"deals", len(sample),
+				"retrieved", atomic.LoadInt32(totals.retrieved),
+				"failed", atomic.LoadInt32(totals.failed),
+				"unsupported", atomic.LoadInt32(totals.unsupported),
+			)
+			recordRunMetrics(cctx.Context, "check-retrievals", t0,
+				app.Metric{Name: "providers", Description: "Amount of providers checked during the last run", Value: int64(len(perSP))},
+				app.Metric{Name: "retrieved", Description: "Amount of sampled deals successfully retrieved during the last run", Value: int64(atomic.LoadInt32(totals.retrieved))},
+				app.Metric{Name: "failed", Description: "Amount of sampled deals which could not be retrieved during the last run", Value: int64(atomic.LoadInt32(totals.failed))},
+				app.Metric{Name: "unsupported", Description: "Amount of sampled deals advertised only over transports the checker does not support during the last run", Value: int64(atomic.LoadInt32(totals.unsupported))},
+			)
+		}()
+
+		client := &http.Client{
+			Timeout: time.Duration(retrievalTimeout) * time.Second,
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{
+					Timeout: time.Duration(retrievalTimeout) * time.Second,
+					Control: retrievalDialControl,
+				}).DialContext,
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     30 * time.Second,
+			},
+			// a redirect could point anywhere, including places the provider can not reach directly
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+
+		eg, ctx := errgroup.WithContext(ctx)
+		eg.SetLimit(retrievalConcurrency)
+		for _, deals := range perSP {
+			deals := deals
+			eg.Go(func() error {
+				// one deal at a time: a check should not look like a load test to the provider
+				for _, d := range deals {
+					rc := checkDealRetrieval(ctx, client, d)
+
+					// do not penalize the provider for our own shutdown
+					if ctx.Err() != nil {
+						return nil
+					}
+
+					switch {
+					case rc.retrieved == nil:
+						atomic.AddInt32(totals.unsupported, 1)
+					case *rc.retrieved:
+						atomic.AddInt32(totals.retrieved, 1)
+					default:
+						atomic.AddInt32(totals.failed, 1)
+						log.Infow("retrieval failed",
+							"provider", d.ProviderID.String(),
+							"dealID", d.DealID,
+							"transport", rc.transport,
+							"url", rc.meta.URL,
+							"peerid", rc.meta.PeerID,
+							"error", rc.meta.Error,
+						)
+					}
+
+					if _, err := db.Exec(
+						ctx,
+						`
+						INSERT INTO spd.retrieval_checks
+							( provider_id, deal_id, transport, retrieved, took_msecs, bytes_received, check_meta )
+							VALUES ( $1, $2, $3, $4, $5, $6, $7 )
+						`,
+						d.ProviderID,
+						d.DealID,
+						rc.transport,
+						rc.retrieved,
+						rc.tookMsecs,
+						rc.bytesReceived,
+						rc.meta,
+					); err != nil {
+						return cmn.WrErr(err)
+					}
+				}
+				return nil
+			})
+		}
+		return eg.Wait()
+	},
+}
+
+// checkDealRetrieval checks over HTTP when the provider advertises it, and over Bitswap otherwise
+func checkDealRetrieval(ctx context.Context, client *http.Client, d sampledDeal) retrievalCheck {
+	var rootCid *cid.Cid
+	if d.DecodedLabel != nil {
+		if c, err := cid.Parse(*d.DecodedLabel); err == nil && c.Prefix().Codec != cid.FilCommitmentUnsealed {
+			rootCid = &c
+		}
+	}
+
+	switch {
+	case len(d.HTTPAddrs) > 0:
+		return checkHTTPRetrieval(ctx, client, d, rootCid)
+	case len(d.BitswapAddrs) > 0:
+		return checkBitswapRetrieval(ctx, d, rootCid)
+	case len(d.Transports) == 0:
+		no := false
+		return retrievalCheck{
+			transport: "none",
+			retrieved: &no,
+			meta:      retrievalCheckMeta{Error: "provider does not advertise any retrieval transports"},
+		}
+	default:
+		// graphsync retrievals go through a full data-transfer negotiation, checking them is not
+		// worth the weight: such providers are not counted towards retrievability
+		return retrievalCheck{
+			transport: strings.Join(d.Transports, ","),
+			meta:      retrievalCheckMeta{Error: "none of the advertised retrieval transports are supported by the checker"},
+		}
+	}
+}
+
+// checkHTTPRetrieval tries every advertised HTTP endpoint for the piece itself, and only then
+// for a CAR of the label root, stopping at the first success
+func checkHTTPRetrieval(ctx context.Context, client *http.Client, d sampledDeal, rootCid *cid.Cid) retrievalCheck {
+	pieceURLs := make([]string, 0, len(d.HTTPAddrs))
+	carURLs := make([]string, 0, len(d.HTTPAddrs))
+	var addrErrs []string
+	for _, a := range d.HTTPAddrs {
+		base, err := httpBaseURL(a)
+		if err != nil {
+			addrErrs = append(addrErrs, err.Error())
+			continue
+		}
+		pieceURLs = append(pieceURLs, base+"/piece/"+d.PieceCid)
+		if rootCid != nil {
+			carURLs = append(carURLs, base+"/ipfs/"+rootCid.String()+"?format=car")
+		}
+	}
+
+	rc := retrievalCheck{transport: "http"}
+	no := false
+	rc.retrieved = &no
+	if len(pieceURLs) == 0 {
+		rc.meta.Error = strings.Join(addrErrs, "; ")
+		return rc
+	}
+
+	for _, u := range append(pieceURLs, carURLs...) {
+		t0 := time.Now()
+		status, n, err := fetchRetrievalRange(ctx, client, u)
+		took := time.Since(t0).Milliseconds()
+
+		rc.tookMsecs = &took
+		rc.bytesReceived = &n
+		rc.meta = retrievalCheckMeta{URL: u, HTTPStatus: status}
+		if err == nil {
+			yes := true
+			rc.retrieved = &yes
+			return rc
+		}
+		rc.meta.Error = err.Error()
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return rc
+}
+
+// fetchRetrievalRange returns the HTTP status code if one was received, and the amount of bytes read
+func fetchRetrievalRange(ctx context.Context, client *http.Client, url string) (int, int64, error) {
+	rangeBytes := int64(retrievalRangeKiB) << 10
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", app.AppName+"-retrieval-check")
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", rangeBytes-1))
+	if strings.HasSuffix(url, "?format=car") {
+		req.Header.Set("Accept", "application/vnd.ipld.car")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, 0, xerrors.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, bytes.TrimSpace(snippet))
+	}
+
+	// servers ignoring Range ( e.g. for CARs ) are simply cut off once we have enough
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, rangeBytes))
+	if err != nil {
+		return resp.StatusCode, n, err
+	}
+	if n == 0 {
+		return resp.StatusCode, 0, xerrors.New("empty response body")
+	}
+	return resp.StatusCode, n, nil
+}
+
+// httpBaseURL converts the multiaddrs Boost advertises for its http transport
+// ( e.g. /dns/sp.example.com/tcp/443/https ) into a URL without a trailing /
+func httpBaseURL(ma string) (string, error) {
+	m, err := multiaddr.NewMultiaddr(ma)
+	if err != nil {
+		return "", xerrors.Errorf("malformed http retrieval multiaddr '%s': %w", ma, err)
+	}
+
+	var host, port, scheme string
+	multiaddr.ForEach(m, func(c multiaddr.Component) bool {
+		switch c.Protocol().Code {
+		case multiaddr.P_IP4, multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6:
+			host = c.Value()
+		case multiaddr.P_IP6:
+			host = "[" + c.Value() + "]"
+		case multiaddr.P_TCP:
+			port = c.Value()
+		case multiaddr.P_TLS, multiaddr.P_HTTPS:
+			scheme = "https"
+		case multiaddr.P_HTTP:
+			if scheme == "" {
+				scheme = "http"
+			}
+		}
+		return true
+	})
+	if host == "" || scheme == "" {
+		return "", xerrors.Errorf("http retrieval multiaddr '%s' lacks a host or an http component", ma)
+	}
+
+	if port == "" || (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		return scheme + "://" + host, nil
+	}
+	return scheme + "://" + host + ":" + port, nil
+}
+
+// checkBitswapRetrieval asks the first advertised Bitswap peer for the block of the label root
+func checkBitswapRetrieval(ctx context.Context, d sampledDeal, rootCid *cid.Cid) retrievalCheck {
+	if rootCid == nil {
+		// the label is up to the client: not something to hold against the provider
+		return retrievalCheck{
+			transport: "bitswap",
+			meta:      retrievalCheckMeta{Error: "deal label does not contain a root CID to request over bitswap"},
+		}
+	}
+
+	rc := retrievalCheck{transport: "bitswap", meta: retrievalCheckMeta{Cid: rootCid.String()}}
+	no := false
+	rc.retrieved = &no
+
+	ai, err := bitswapAddrInfo(d.BitswapAddrs)
+	if err != nil {
+		rc.meta.Error = err.Error()
+		return rc
+	}
+	rc.meta.PeerID = ai.ID.String()
+
+	timeOut := time.Duration(retrievalTimeout) * time.Second
+	nodeHost, _, releaseNode, err := acquireTaskNode(ctx, "check-retrievals", timeOut, ai.ID)
+	if err != nil {
+		rc.meta.Error = err.Error()
+		return rc
+	}
+	defer releaseNode()
+	bsr, releaseReceiver := acquireBitswapReceiver(nodeHost)
+	defer releaseReceiver()
+
+	ctx, cancel := context.WithTimeout(ctx, timeOut)
+	defer cancel()
+
+	t0 := time.Now()
+	n, err := bsr.fetchBlock(ctx, nodeHost, ai, *rootCid)
+	took := time.Since(t0).Milliseconds()
+
+	rc.tookMsecs = &took
+	rc.bytesReceived = &n
+	if err != nil {
+		rc.meta.Error = err.Error()
+		return rc
+	}
+	yes := true
+	rc.retrieved = &yes
+	return rc
+}
+
+// bitswapAddrInfo picks the peer of the first multiaddr Boost advertises for its bitswap
+// transport ( e.g. /ip4/1.2.3.4/tcp/8888/p2p/12D3KooW... ), with all its dialable addresses
+func bitswapAddrInfo(mas []string) (lp2p.AddrInfo, error) {
+	var ai lp2p.AddrInfo
+	var addrErrs []string
+	for _, s := range mas {
+		ma, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			addrErrs = append(addrErrs, fmt.Sprintf("malformed bitswap retrieval multiaddr '%s': %s", s, err))
+			continue
+		}
+		tr, pid := lp2ppeer.SplitAddr(ma)
+		if pid == "" || tr == nil {
+			addrErrs = append(addrErrs, fmt.Sprintf("bitswap retrieval multiaddr '%s' lacks a peer ID or a transport", s))
+			continue
+		}
+		if ai.ID != "" && pid != ai.ID {
+			continue
+		}
+		if !retrievalAllowPrivateIP {
+			if na, err := manet.ToNetAddr(tr); err == nil {
+				if err := refuseNonPublicAddress(na.String()); err != nil {
+					addrErrs = append(addrErrs, err.Error())
+					continue
+				}
+			}
+		}
+		ai.ID = pid
+		ai.Addrs = append(ai.Addrs, tr)
+	}
+	if ai.ID == "" {
+		if len(addrErrs) == 0 {
+			addrErrs = append(addrErrs, "no usable bitswap retrieval multiaddrs")
+		}
+		return ai, xerrors.New(strings.Join(addrErrs, "; "))
+	}
+	return ai, nil
+}
+
+// Bitswap blocks arrive over streams the provider opens back to us, not as responses on the
+// stream carrying our want. Every node checking over bitswap therefore runs a single receiver,
+// dispatching incoming messages to the check waiting on the sending peer.
+var bitswapReceivers = struct {
+	mu     sync.Mutex
+	byNode map[lp2p.PeerID]*bitswapReceiver
+}{byNode: make(map[lp2p.PeerID]*bitswapReceiver)}
+
+type bitswapReceiver struct {
+	network bsnet.BitSwapNetwork
+	refs    int
+	mu      sync.Mutex
+	waiting map[lp2p.PeerID]chan bsmsg.BitSwapMessage
+}
+
+var bitswapProtocols = []lp2pprotocol.ID{
+	bsnet.ProtocolBitswap,
+	bsnet.ProtocolBitswapOneOne,
+	bsnet.ProtocolBitswapOneZero,
+	bsnet.ProtocolBitswapNoVers,
+}
+
+// acquireBitswapReceiver returns the receiver of the given node, starting it if needed, and a
+// function to invoke once done with it: the last release stops the receiver
+func acquireBitswapReceiver(h lp2p.Host) (*bitswapReceiver, func()) {
+	bitswapReceivers.mu.Lock()
+	defer bitswapReceivers.mu.Unlock()
+
+	r := bitswapReceivers.byNode[h.ID()]
+	if r == nil {
+		r = &bitswapReceiver{
+			network: bsnet.NewFromIpfsHost(h, nil, bsnet.SupportedProtocols(bitswapProtocols)),
+			waiting: make(map[lp2p.PeerID]chan bsmsg.BitSwapMessage),
+		}
+		r.network.Start(r)
+		bitswapReceivers.byNode[h.ID()] = r
+	}
+	r.refs++
+
+	return r, func() {
+		bitswapReceivers.mu.Lock()
+		defer bitswapReceivers.mu.Unlock()
+		r.refs--
+		if r.refs == 0 {
+			r.network.Stop()
+			for _, p := range bitswapProtocols {
+				h.RemoveStreamHandler(p)
+			}
+			delete(bitswapReceivers.byNode, h.ID())
+		}
+	}
+}
+
+// fetchBlock asks the peer for a single block, returning the amount of bytes received
+func (r *bitswapReceiver) fetchBlock(ctx context.Context, h lp2p.Host, ai lp2p.AddrInfo, c cid.Cid) (int64, error) {
+	incoming := make(chan bsmsg.BitSwapMessage, 8)
+	r.mu.Lock()
+	if _, busy := r.waiting[ai.ID]; busy {
+		r.mu.Unlock()
+		return 0, xerrors.Errorf("another bitswap check of peer %s is already in progress", ai.ID)
+	}
+	r.waiting[ai.ID] = incoming
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.waiting, ai.ID)
+		r.mu.Unlock()
+	}()
+
+	pTag := "retrieval-check"
+	h.ConnManager().Protect(ai.ID, pTag)
+	defer h.ConnManager().Unprotect(ai.ID, pTag)
+	if err := h.Connect(ctx, ai); err != nil {
+		return 0, err
+	}
+
+	want := bsmsg.New(false)
+	want.AddEntry(c, 1, bsmsgpb.Message_Wantlist_Block, true)
+	if err := r.network.SendMessage(ctx, ai.ID, want); err != nil {
+		return 0, err
+	}
+	defer func() {
+		cancel := bsmsg.New(false)
+		cancel.Cancel(c)
+		r.network.SendMessage(ctx, ai.ID, cancel) //nolint:errcheck
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, xerrors.Errorf("block %s not received over bitswap: %w", c, ctx.Err())
+		case msg := <-incoming:
+			// the block CID is recomputed from the received data: a multihash match verifies it
+			for _, b := range msg.Blocks() {
+				if bytes.Equal(b.Cid().Hash(), c.Hash()) {
+					return int64(len(b.RawData())), nil
+				}
+			}
+			for _, dh := range msg.DontHaves() {
+				if bytes.Equal(dh.Hash(), c.Hash()) {
+					return 0, xerrors.Errorf("peer %s does not have block %s", ai.ID, c)
+				}
+			}
+		}
+	}
+}
+
+func (r *bitswapReceiver) ReceiveMessage(_ context.Context, sender lp2p.PeerID, msg bsmsg.BitSwapMessage) {
+	r.mu.Lock()
+	incoming := r.waiting[sender]
+	r.mu.Unlock()
+	if incoming != nil {
+		select {
+		case incoming <- msg:
+		default:
+		}
+	}
+}
+
+func (*bitswapReceiver) ReceiveError(error)           {}
+func (*bitswapReceiver) PeerConnected(lp2p.PeerID)    {}
+func (*bitswapReceiver) PeerDisconnected(lp2p.PeerID) {}
+
+func retrievalDialControl(_, address string, _ syscall.RawConn) error {
+	if retrievalAllowPrivateIP {
+		return nil
+	}
+	return refuseNonPublicAddress(address)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	fslock "github.com/ipfs/go-fs-lock"
+	infomempeerstore "github.com/ribasushi/go-libp2p-infomempeerstore"
+	"github.com/ribasushi/go-toolbox-interplanetary/lp2p"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/xerrors"
+)
+
+type daemonTask struct {
+	cmd             *ufcli.Command
+	intervalSeconds int
+}
+
+// The list of tasks scheduled by the daemon, with their default run intervals
+var daemonTasks = []*daemonTask{
+	{cmd: pollProviders, intervalSeconds: 60},
+	{cmd: trackDeals, intervalSeconds: 300},
+	{cmd: signPending, intervalSeconds: 60},
+	{cmd: proposePending, intervalSeconds: 60},
+	{cmd: deliverWebhooks, intervalSeconds: 60},
+	{cmd: checkRetrievals, intervalSeconds: 3600},
+	{cmd: scoreProviders, intervalSeconds: 3600},
+}
+
+var daemonState struct {
+	mu       sync.Mutex
+	started  bool
+	stopping chan struct{}
+	inflight sync.WaitGroup
+}
+
+var daemonShutdownGrace int
+
+// libp2p nodes shared by all runs of a task in daemon mode, keyed by task name
+var daemonNodes struct {
+	mu    sync.Mutex
+	nodes map[string]*taskNode
+}
+
+type taskNode struct {
+	host      lp2p.Host
+	peerStore *infomempeerstore.PeerStore
+}
+
+// populated once at daemon start, before any task runs: nil in one-shot mode
+var daemonTriggers map[string]chan struct{}
+
+// triggerTask requests an immediate out-of-schedule run of the named task.
+// It is a no-op outside of daemon mode, and never blocks: multiple triggers
+// arriving while a run is in progress collapse into a single subsequent run.
+func triggerTask(name string) {
+	if trigger, known := daemonTriggers[name]; known {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// daemonBeforeShutdown is invoked before the top context is cancelled: it
+// stops scheduling new runs and gives the ones in progress a chance to finish
+func daemonBeforeShutdown() error {
+	daemonState.mu.Lock()
+	if !daemonState.started {
+		daemonState.mu.Unlock()
+		return nil
+	}
+	select {
+	case <-daemonState.stopping:
+	default:
+		close(daemonState.stopping)
+	}
+	daemonState.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		daemonState.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(time.Duration(daemonShutdownGrace) * time.Second):
+		return xerrors.Errorf("tasks still running after %d seconds, cancelling them", daemonShutdownGrace)
+	}
+}
+
+var daemon = &ufcli.Command{
+	Usage: "Run all periodic tasks from a single long-lived process",
+	Name:  "daemon",
+	Flags: func() []ufcli.Flag {
+		flags := []ufcli.Flag{
+			&ufcli.IntFlag{
+				Name:        "shutdown-grace",
+				Usage:       "Amount of seconds to wait for running tasks to finish on shutdown",
+				Value:       120,
+				Destination: &daemonShutdownGrace,
+			},
+		}
+		for _, t := range daemonTasks {
+			flags = append(flags, &ufcli.IntFlag{
+				Name:        t.cmd.Name + "-interval",
+				Category:    t.cmd.Name,
+				Usage:       fmt.Sprintf("Amount of seconds between scheduled runs of %s ( 0 disables the task )", t.cmd.Name),
+				Value:       t.intervalSeconds,
+				Destination: &t.intervalSeconds,
+			})
+			flags = append(flags, daemonTaskFlags(t.cmd)...)
+		}
+		return flags
+	}(),
+	Action: func(cctx *ufcli.Context) error {
+		ctx, log, _, _ := app.UnpackCtx(cctx.Context)
+
+		triggers := make(map[string]chan struct{}, len(daemonTasks))
+		for _, t := range daemonTasks {
+			triggers[t.cmd.Name] = make(chan struct{}, 1)
+		}
+		daemonTriggers = triggers
+
+		daemonNodes.mu.Lock()
+		daemonNodes.nodes = make(map[string]*taskNode, len(daemonTasks))
+		daemonNodes.mu.Unlock()
+		defer closeDaemonNodes(log)
+
+		daemonState.mu.Lock()
+		daemonState.started = true
+		daemonState.stopping = make(chan struct{})
+		daemonState.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for _, t := range daemonTasks {
+			if t.intervalSeconds <= 0 {
+				log.Infow("task disabled", "task", t.cmd.Name)
+				continue
+			}
+			t := t
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				tick := time.NewTicker(time.Duration(t.intervalSeconds) * time.Second)
+				defer tick.Stop()
+
+				for {
+					if !runDaemonTask(cctx, t) {
+						return
+					}
+					select {
+					case <-daemonState.stopping:
+						return
+					case <-ctx.Done():
+						return
+					case <-tick.C:
+					case <-triggers[t.cmd.Name]:
+					}
+				}
+			}()
+		}
+
+		log.Infof("daemon started, scheduling %d tasks", len(daemonTasks))
+		wg.Wait()
+		log.Info("daemon stopped")
+		return nil
+	},
+}
+
+// returns false when the daemon is shutting down and no further runs should be attempted
+func runDaemonTask(cctx *ufcli.Context, t *daemonTask) bool {
+	log := app.GetGlobalCtx(cctx.Context).Logger
+
+	daemonState.mu.Lock()
+	select {
+	case <-daemonState.stopping:
+		daemonState.mu.Unlock()
+		return false
+	default:
+	}
+	daemonState.inflight.Add(1)
+	daemonState.mu.Unlock()
+	defer daemonState.inflight.Done()
+
+	// same lock as the one taken by a standalone invocation of the command: never run both at once
+	lock, err := fslock.Lock(os.TempDir(), daemonPathStr(cctx.App.Name)+"-"+daemonPathStr(t.cmd.Name))
+	if err != nil {
+		if errors.As(err, new(fslock.LockedError)) {
+			log.Infow("skipping run: task is already running in another process", "task", t.cmd.Name)
+		} else {
+			log.Errorf("unable to lock task %s: %+v", t.cmd.Name, err)
+		}
+		return true
+	}
+	defer lock.Close() //nolint:errcheck
+
+	t0 := time.Now()
+	log.Infow(fmt.Sprintf("=== BEGIN '%s' run", t.cmd.Name))
+
+	err = func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = xerrors.Errorf("panic encountered: %s\n%s", r, debug.Stack())
+			}
+		}()
+		return t.cmd.Action(cctx)
+	}()
+
+	took := time.Since(t0).Truncate(time.Millisecond).String()
+	if err != nil {
+		log.Errorf("%+v", err)
+		log.Warnw(fmt.Sprintf("=== FINISH '%s' run", t.cmd.Name), "success", false, "took", took)
+	} else {
+		log.Infow(fmt.Sprintf("=== FINISH '%s' run", t.cmd.Name), "success", true, "took", took)
+	}
+
+	return true
+}
+
+// acquireTaskNode returns a libp2p node for use by the named task to talk to the given peer,
+// and a function to invoke once done with it. Outside of daemon mode every call creates a
+// fresh node, shut down on release. In daemon mode a single node per task is created on
+// first use and kept for the lifetime of the process: release only disconnects the peer
+// and forgets everything learned about it, so that the next run starts from scratch.
+func acquireTaskNode(ctx context.Context, task string, dialTimeout time.Duration, peer lp2p.PeerID) (lp2p.Host, *infomempeerstore.PeerStore, func(), error) {
+	log := app.GetGlobalCtx(ctx).Logger
+
+	daemonNodes.mu.Lock()
+	defer daemonNodes.mu.Unlock()
+
+	if daemonNodes.nodes == nil {
+		h, ps, err := lp2p.NewPlainNodeTCP(dialTimeout)
+		if err != nil {
+			return nil, nil, nil, cmn.WrErr(err)
+		}
+		return h, ps, func() {
+			if err := h.Close(); err != nil {
+				log.Warnf("unexpected error shutting down node %s: %s", h.ID().String(), err)
+			}
+		}, nil
+	}
+
+	n := daemonNodes.nodes[task]
+	if n == nil {
+		h, ps, err := lp2p.NewPlainNodeTCP(dialTimeout)
+		if err != nil {
+			return nil, nil, nil, cmn.WrErr(err)
+		}
+		n = &taskNode{host: h, peerStore: ps}
+		daemonNodes.nodes[task] = n
+	}
+	return n.host, n.peerStore, func() {
+		n.host.Network().ClosePeer(peer) //nolint:errcheck
+		n.peerStore.RemovePeer(peer)
+	}, nil
+}
+
+func closeDaemonNodes(log ufcli.Logger) {
+	daemonNodes.mu.Lock()
+	defer daemonNodes.mu.Unlock()
+	for task, n := range daemonNodes.nodes {
+		if err := n.host.Close(); err != nil {
+			log.Warnf("unexpected error shutting down node %s of task %s: %s", n.host.ID().String(), task, err)
+		}
+	}
+	daemonNodes.nodes = nil
+}
+
+// The individual command flags are never parsed in daemon mode: expose each of them
+// on the daemon instead, prefixed with the command name and sharing its Destination.
+func daemonTaskFlags(cmd *ufcli.Command) []ufcli.Flag {
+	flags := make([]ufcli.Flag, 0, len(cmd.Flags))
+	for _, f := range cmd.Flags {
+		switch tf := f.(type) {
+		case *ufcli.IntFlag:
+			pf := *tf
+			pf.Name, pf.Category, pf.Aliases, pf.Required = cmd.Name+"-"+tf.Name, cmd.Name, nil, false
+			flags = append(flags, &pf)
+		case *ufcli.UintFlag:
+			pf := *tf
+			pf.Name, pf.Category, pf.Aliases, pf.Required = cmd.Name+"-"+tf.Name, cmd.Name, nil, false
+			flags = append(flags, &pf)
+		case *ufcli.BoolFlag:
+			pf := *tf
+			pf.Name, pf.Category, pf.Aliases, pf.Required = cmd.Name+"-"+tf.Name, cmd.Name, nil, false
+			flags = append(flags, &pf)
+		case *ufcli.StringFlag:
+			pf := *tf
+			pf.Name, pf.Category, pf.Aliases, pf.Required = cmd.Name+"-"+tf.Name, cmd.Name, nil, false
+			flags = append(flags, &pf)
+		default:
+			panic(fmt.Sprintf("flag %s of command %s is of unsupported type %T", f.Names()[0], cmd.Name, f))
+		}
+	}
+	return flags
+}
+
+// must match the lock naming within ufcli
+var nonAlphanumericRun = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+func daemonPathStr(s string) string {
+	return nonAlphanumericRun.ReplaceAllString(s, "_")
+}
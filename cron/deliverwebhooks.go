@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+)
+
+const (
+	webhookSignatureHeader = "X-Spade-Signature"
+	webhookDeliveryHeader  = "X-Spade-Delivery-Id"
+	webhookEventHeader     = "X-Spade-Event"
+	webhookMaxBackoffMins  = 12 * 60
+)
+
+type webhookDelivery struct {
+	DeliveryID    int64
+	WebhookID     int32
+	WebhookURL    string
+	WebhookSecret string
+	EventType     string
+	EventPayload  []byte
+	Attempts      int16
+}
+
+var (
+	webhookMaxAttempts    int
+	webhookTimeout        int
+	webhookConcurrency    int
+	webhookAllowPrivateIP bool
+)
+var deliverWebhooks = &ufcli.Command{
+	Usage: "Deliver queued proposal lifecycle events to registered webhooks",
+	Name:  "deliver-webhooks",
+	Flags: []ufcli.Flag{
+		&ufcli.IntFlag{
+			Name:        "max-attempts",
+			Usage:       "Amount of failed attempts after which a delivery is abandoned",
+			Value:       12,
+			Destination: &webhookMaxAttempts,
+		},
+		&ufcli.IntFlag{
+			Name:        "delivery-timeout",
+			Usage:       "Amount of seconds before aborting a specific delivery attempt",
+			Value:       10,
+			Destination: &webhookTimeout,
+		},
+		&ufcli.IntFlag{
+			Name:        "delivery-concurrency",
+			Usage:       "How many webhooks to deliver to concurrently",
+			Value:       16,
+			Destination: &webhookConcurrency,
+		},
+		&ufcli.BoolFlag{
+			Name:        "allow-private-targets",
+			Usage:       "Permit delivery to loopback/private network addresses ( for testing only )",
+			Destination: &webhookAllowPrivateIP,
+		},
+	},
+	Action: func(cctx *ufcli.Context) error {
+		ctx, log, db, _ := app.UnpackCtx(cctx.Context)
+
+		totals := struct {
+			delivered *int32
+			failed    *int32
+			abandoned *int32
+		}{
+			delivered: new(int32),
+			failed:    new(int32),
+			abandoned: new(int32),
+		}
+
+		pending := make([]webhookDelivery, 0, 1024)
+		if err := pgxscan.Select(
+			ctx,
+			db,
+			&pending,
+			`
+			SELECT
+					d.delivery_id,
+					d.webhook_id,
+					w.webhook_url,
+					w.webhook_secret,
+					d.event_type,
+					d.event_payload,
+					d.attempts
+				FROM spd.webhook_deliveries d
+				JOIN spd.webhooks w USING ( webhook_id )
+			WHERE
+				d.delivered IS NULL
+					AND
+				d.abandoned IS NULL
+					AND
+				d.next_attempt <= NOW()
+					AND
+				NOT COALESCE( ( w.webhook_meta->'inactivated' )::BOOL, false )
+					AND
+				-- an earlier event still backing off holds up everything after it
+				NOT EXISTS (
+					SELECT 42
+						FROM spd.webhook_deliveries prev
+					WHERE
+						prev.webhook_id = d.webhook_id
+							AND
+						prev.delivery_id < d.delivery_id
+							AND
+						prev.delivered IS NULL
+							AND
+						prev.abandoned IS NULL
+							AND
+						prev.next_attempt > NOW()
+				)
+			ORDER BY d.delivery_id
+			LIMIT 8192
+			`,
+		); err != nil {
+			return cmn.WrErr(err)
+		}
+
+		t0 := time.Now()
+		defer func() {
+			log.Infow("summary",
+				"pending", len(pending),
+				"delivered", atomic.LoadInt32(totals.delivered),
+				"failed", atomic.LoadInt32(totals.failed),
+				"abandoned", atomic.LoadInt32(totals.abandoned),
+			)
+			recordRunMetrics(cctx.Context, "deliver-webhooks", t0,
+				app.Metric{Name: "pending", Description: "Amount of deliveries due at the start of the last run", Value: int64(len(pending))},
+				app.Metric{Name: "delivered_total", Description: "Amount of successful webhook deliveries", Type: app.MetricCounter, Value: int64(atomic.LoadInt32(totals.delivered))},
+				app.Metric{Name: "failed_total", Description: "Amount of failed webhook delivery attempts, subject to retry", Type: app.MetricCounter, Value: int64(atomic.LoadInt32(totals.failed))},
+				app.Metric{Name: "abandoned_total", Description: "Amount of webhook deliveries abandoned after exhausting all attempts", Type: app.MetricCounter, Value: int64(atomic.LoadInt32(totals.abandoned))},
+			)
+		}()
+
+		// deliveries for the same webhook go out sequentially in event order: the first failure
+		// stops the rest of that webhook's queue until the failed event is retried
+		perWebhook := make(map[int32][]webhookDelivery, 64)
+		for _, d := range pending {
+			perWebhook[d.WebhookID] = append(perWebhook[d.WebhookID], d)
+		}
+
+		client := &http.Client{
+			Timeout: time.Duration(webhookTimeout) * time.Second,
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{
+					Timeout: time.Duration(webhookTimeout) * time.Second,
+					Control: webhookDialControl,
+				}).DialContext,
+				MaxIdleConnsPerHost: 2,
+				IdleConnTimeout:     30 * time.Second,
+			},
+			// a redirect could point anywhere, including places a registrant can not reach directly
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+
+		eg, ctx := errgroup.WithContext(ctx)
+		eg.SetLimit(webhookConcurrency)
+		for _, deliveries := range perWebhook {
+			deliveries := deliveries
+			eg.Go(func() error {
+				for _, d := range deliveries {
+					httpStatus, deliveryErr := postWebhook(ctx, client, d)
+
+					if deliveryErr == nil {
+						atomic.AddInt32(totals.delivered, 1)
+						if _, err := db.Exec(
+							ctx,
+							`
+							UPDATE spd.webhook_deliveries SET
+								attempts = attempts + 1,
+								last_attempt = NOW(),
+								delivered = NOW(),
+								delivery_meta = delivery_meta - 'last_error' || JSONB_BUILD_OBJECT( 'last_http_status', $1::INTEGER )
+							WHERE
+								delivery_id = $2
+							`,
+							httpStatus,
+							d.DeliveryID,
+						); err != nil {
+							return cmn.WrErr(err)
+						}
+						continue
+					}
+
+					// do not penalize the registrant for our own shutdown
+					if ctx.Err() != nil {
+						return nil
+					}
+
+					giveUp := int(d.Attempts)+1 >= webhookMaxAttempts
+					if giveUp {
+						atomic.AddInt32(totals.abandoned, 1)
+					} else {
+						atomic.AddInt32(totals.failed, 1)
+					}
+					log.Warnw("webhook delivery failed",
+						"deliveryID", d.DeliveryID,
+						"webhookID", d.WebhookID,
+						"attempt", d.Attempts+1,
+						"abandoned", giveUp,
+						"error", deliveryErr.Error(),
+					)
+
+					var status *int
+					if httpStatus != 0 {
+						status = &httpStatus
+					}
+					if _, err := db.Exec(
+						ctx,
+						`
+						UPDATE spd.webhook_deliveries SET
+							attempts = attempts + 1,
+							last_attempt = NOW(),
+							next_attempt = NOW() + LEAST( POWER( 2, attempts ), $1::INTEGER ) * '1 minute'::INTERVAL,
+							abandoned = ( CASE WHEN $2 THEN NOW() ELSE NULL END ),
+							delivery_meta = JSONB_STRIP_NULLS( delivery_meta || JSONB_BUILD_OBJECT(
+								'last_error', $3::TEXT,
+								'last_http_status', $4::INTEGER
+							) )
+						WHERE
+							delivery_id = $5
+						`,
+						webhookMaxBackoffMins,
+						giveUp,
+						deliveryErr.Error(),
+						status,
+						d.DeliveryID,
+					); err != nil {
+						return cmn.WrErr(err)
+					}
+
+					// an abandoned event is never coming, so what follows it may proceed
+					if !giveUp {
+						return nil
+					}
+				}
+				return nil
+			})
+		}
+		return eg.Wait()
+	},
+}
+
+// postWebhook returns the HTTP status code if one was received, and an error on anything but a 2xx
+func postWebhook(ctx context.Context, client *http.Client, d webhookDelivery) (int, error) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// same scheme as e.g. Stripe: HMAC-SHA256( secret, "{timestamp}.{body}" )
+	mac := hmac.New(sha256.New, []byte(d.WebhookSecret))
+	mac.Write([]byte(ts + ".")) //nolint:errcheck
+	mac.Write(d.EventPayload)   //nolint:errcheck
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.WebhookURL, bytes.NewReader(d.EventPayload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", app.AppName+"-webhooks")
+	req.Header.Set(webhookEventHeader, d.EventType)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(d.DeliveryID, 10))
+	req.Header.Set(webhookSignatureHeader, fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil))))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) //nolint:errcheck
+		return resp.StatusCode, nil
+	}
+
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return resp.StatusCode, xerrors.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, bytes.TrimSpace(snippet))
+}
+
+func webhookDialControl(_, address string, _ syscall.RawConn) error {
+	if webhookAllowPrivateIP {
+		return nil
+	}
+	return refuseNonPublicAddress(address)
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math/bits"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/go-cid"
+	"github.com/jackc/pgx/v4"
+	"github.com/multiformats/go-multihash"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/xerrors"
+)
+
+const (
+	manifestMinLog2Size = 7  // 128 bytes: smallest possible padded piece
+	manifestMaxLog2Size = 36 // 64GiB: largest sector size
+)
+
+// (!) must match the source_valid_url constraint in the schema
+var manifestSourceURLRe = regexp.MustCompile(`^(https?|s3)://[^/]+`)
+
+type manifestEntry struct {
+	PieceCid   string   `json:"piece_cid"`
+	PaddedSize uint64   `json:"padded_size"`
+	PayloadCid string   `json:"payload_cid"`
+	SourceURLs []string `json:"source_urls"`
+}
+
+type manifestRow struct {
+	pieceCid      string
+	pieceLog2Size int16
+	proposalLabel *string
+	sourceURLs    []string
+}
+
+type ingestTotals struct {
+	entries            int
+	duplicates         int
+	batches            int
+	piecesNew          int64
+	piecesUpdated      int64
+	datasetMembersNew  int64
+	sourcesNew         int64
+	entriesWithSources int
+}
+
+var (
+	ingestDatasetSlug string
+	ingestFormat      string
+	ingestBatchSize   int
+)
+var ingestManifest = &ufcli.Command{
+	Usage:     "Load a CSV or NDJSON dataset manifest into the piece registry",
+	Name:      "ingest-manifest",
+	ArgsUsage: "<manifest file, optionally .gz, or - for STDIN>",
+	Description: strings.Join([]string{
+		"Every manifest entry describes a single piece belonging to the target dataset:",
+		"",
+		"  piece_cid    PieceCID ( CommP ) of the piece, required",
+		"  padded_size  padded size of the piece in bytes ( a power of 2 ), required",
+		"  payload_cid  root CID of the .car payload, used as the deal proposal label",
+		"  source_url   HTTP(S)/S3 location of the entire .car",
+		"",
+		"CSV manifests must contain a header row naming the columns: source_url may appear",
+		"multiple times. NDJSON entries carry the same keys, with source URLs provided as a",
+		"source_urls array. Entries are upserted in batches: re-ingesting the same manifest is",
+		"a no-op, while supplying a piece_cid with a different payload_cid or proven size is",
+		"an error.",
+	}, "\n"),
+	Flags: []ufcli.Flag{
+		&ufcli.StringFlag{
+			Name:        "dataset",
+			Usage:       "Slug of the (existing) dataset the manifest pieces are attached to",
+			Required:    true,
+			Destination: &ingestDatasetSlug,
+		},
+		&ufcli.StringFlag{
+			Name:        "format",
+			Usage:       "Manifest format: csv or ndjson ( determined from the file extension when not specified )",
+			Destination: &ingestFormat,
+		},
+		&ufcli.IntFlag{
+			Name:        "batch-size",
+			Usage:       "Amount of manifest entries to COPY and upsert within a single transaction",
+			Value:       25_000,
+			Destination: &ingestBatchSize,
+		},
+	},
+	Action: func(cctx *ufcli.Context) error {
+		ctx, log, db, _ := app.UnpackCtx(cctx.Context)
+
+		if cctx.NArg() != 1 {
+			return xerrors.Errorf("exactly one manifest file argument expected, got %d", cctx.NArg())
+		}
+		if ingestBatchSize < 1 {
+			return xerrors.Errorf("batch-size must be a positive integer, got %d", ingestBatchSize)
+		}
+
+		var datasetID int16
+		if err := db.QueryRow(
+			ctx,
+			`SELECT dataset_id FROM spd.datasets WHERE dataset_slug = $1`,
+			ingestDatasetSlug,
+		).Scan(&datasetID); err == pgx.ErrNoRows {
+			return xerrors.Errorf("dataset '%s' does not exist: create it via the /admin/datasets API first", ingestDatasetSlug)
+		} else if err != nil {
+			return cmn.WrErr(err)
+		}
+
+		fn := cctx.Args().First()
+		var fh io.ReadCloser
+		if fn == "-" {
+			fh = os.Stdin
+		} else {
+			var err error
+			if fh, err = os.Open(fn); err != nil {
+				return cmn.WrErr(err)
+			}
+			defer fh.Close() //nolint:errcheck
+		}
+
+		var r io.Reader = fh
+		if strings.HasSuffix(fn, ".gz") {
+			gz, err := gzip.NewReader(fh)
+			if err != nil {
+				return cmn.WrErr(err)
+			}
+			defer gz.Close() //nolint:errcheck
+			r = gz
+			fn = strings.TrimSuffix(fn, ".gz")
+		}
+
+		format := strings.ToLower(ingestFormat)
+		if format == "" {
+			switch {
+			case strings.HasSuffix(fn, ".csv"):
+				format = "csv"
+			case strings.HasSuffix(fn, ".ndjson"), strings.HasSuffix(fn, ".jsonl"):
+				format = "ndjson"
+			default:
+				return xerrors.Errorf("unable to determine format of manifest '%s': specify it via --format", cctx.Args().First())
+			}
+		}
+
+		var nextEntry func() (*manifestEntry, error)
+		switch format {
+		case "csv":
+			var err error
+			if nextEntry, err = csvManifestReader(r); err != nil {
+				return cmn.WrErr(err)
+			}
+		case "ndjson":
+			nextEntry = ndjsonManifestReader(r)
+		default:
+			return xerrors.Errorf("unknown manifest format '%s'", format)
+		}
+
+		var tot ingestTotals
+		defer func() {
+			log.Infow("summary",
+				"dataset", ingestDatasetSlug,
+				"entries", tot.entries,
+				"duplicateEntries", tot.duplicates,
+				"entriesWithSources", tot.entriesWithSources,
+				"batches", tot.batches,
+				"newPieces", tot.piecesNew,
+				"updatedPieces", tot.piecesUpdated,
+				"newDatasetMembers", tot.datasetMembersNew,
+				"newSources", tot.sourcesNew,
+			)
+		}()
+
+		// a manifest is expected to describe every piece exactly once, but tolerate verbatim repeats
+		seen := make(map[string]*manifestRow, 1<<16)
+		batch := make([]*manifestRow, 0, ingestBatchSize)
+
+		for {
+			e, err := nextEntry()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return xerrors.Errorf("manifest entry #%d: %w", tot.entries+tot.duplicates+1, err)
+			}
+
+			row, err := e.validate()
+			if err != nil {
+				return xerrors.Errorf("manifest entry #%d: %w", tot.entries+tot.duplicates+1, err)
+			}
+
+			if prev, isDupe := seen[row.pieceCid]; isDupe {
+				if !prev.equal(row) {
+					return xerrors.Errorf("manifest entry #%d: piece %s appears multiple times with differing contents", tot.entries+tot.duplicates+1, row.pieceCid)
+				}
+				tot.duplicates++
+				continue
+			}
+			seen[row.pieceCid] = row
+
+			tot.entries++
+			if len(row.sourceURLs) > 0 {
+				tot.entriesWithSources++
+			}
+
+			batch = append(batch, row)
+			if len(batch) >= ingestBatchSize {
+				if err := ingestManifestBatch(ctx, datasetID, batch, &tot); err != nil {
+					return cmn.WrErr(err)
+				}
+				batch = batch[:0]
+			}
+		}
+
+		if len(batch) > 0 {
+			if err := ingestManifestBatch(ctx, datasetID, batch, &tot); err != nil {
+				return cmn.WrErr(err)
+			}
+		}
+
+		return nil
+	},
+}
+
+func (e *manifestEntry) validate() (*manifestRow, error) {
+	pCid, err := cid.Parse(e.PieceCid)
+	if err != nil {
+		return nil, xerrors.Errorf("piece_cid '%s' is not valid: %w", e.PieceCid, err)
+	}
+	if pCid.Prefix().Codec != cid.FilCommitmentUnsealed || pCid.Prefix().MhType != multihash.SHA2_256_TRUNC254_PADDED {
+		return nil, xerrors.Errorf(
+			"piece_cid '%s' does not have expected codec (%x) and multihash (%x)",
+			pCid,
+			cid.FilCommitmentUnsealed,
+			multihash.SHA2_256_TRUNC254_PADDED,
+		)
+	}
+
+	if bits.OnesCount64(e.PaddedSize) != 1 {
+		return nil, xerrors.Errorf("padded_size %d of piece %s is not a power of 2", e.PaddedSize, pCid)
+	}
+	log2Size := bits.TrailingZeros64(e.PaddedSize)
+	if log2Size < manifestMinLog2Size || log2Size > manifestMaxLog2Size {
+		return nil, xerrors.Errorf(
+			"padded_size %d of piece %s is out of bounds ( %d ~ %d )",
+			e.PaddedSize,
+			pCid,
+			uint64(1)<<manifestMinLog2Size,
+			uint64(1)<<manifestMaxLog2Size,
+		)
+	}
+
+	row := &manifestRow{
+		pieceCid:      pCid.String(),
+		pieceLog2Size: int16(log2Size),
+	}
+
+	if e.PayloadCid != "" {
+		lCid, err := cid.Parse(e.PayloadCid)
+		if err != nil {
+			return nil, xerrors.Errorf("payload_cid '%s' of piece %s is not valid: %w", e.PayloadCid, pCid, err)
+		}
+		l := lCid.String()
+		row.proposalLabel = &l
+	}
+
+	for _, u := range e.SourceURLs {
+		if u == "" {
+			continue
+		}
+		if !manifestSourceURLRe.MatchString(u) {
+			return nil, xerrors.Errorf("source_url '%s' of piece %s is not a valid http(s):// or s3:// URL", u, pCid)
+		}
+		row.sourceURLs = append(row.sourceURLs, u)
+	}
+
+	return row, nil
+}
+
+func (r *manifestRow) equal(o *manifestRow) bool {
+	if r.pieceCid != o.pieceCid ||
+		r.pieceLog2Size != o.pieceLog2Size ||
+		(r.proposalLabel == nil) != (o.proposalLabel == nil) ||
+		(r.proposalLabel != nil && *r.proposalLabel != *o.proposalLabel) ||
+		len(r.sourceURLs) != len(o.sourceURLs) {
+		return false
+	}
+	for i := range r.sourceURLs {
+		if r.sourceURLs[i] != o.sourceURLs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func csvManifestReader(r io.Reader) (func() (*manifestEntry, error), error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	hdr, err := cr.Read()
+	if err == io.EOF {
+		return nil, xerrors.New("manifest is empty")
+	} else if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+
+	colIdx := make(map[string]int, len(hdr))
+	var srcCols []int
+	for i, h := range hdr {
+		h = strings.ToLower(strings.TrimSpace(h))
+		switch h {
+		case "source_url":
+			srcCols = append(srcCols, i)
+		case "piece_cid", "padded_size", "payload_cid":
+			if _, dupe := colIdx[h]; dupe {
+				return nil, xerrors.Errorf("CSV header contains column '%s' more than once", h)
+			}
+			colIdx[h] = i
+		default:
+			return nil, xerrors.Errorf("CSV header contains unrecognized column '%s'", h)
+		}
+	}
+	for _, req := range []string{"piece_cid", "padded_size"} {
+		if _, found := colIdx[req]; !found {
+			return nil, xerrors.Errorf("CSV header lacks required column '%s'", req)
+		}
+	}
+
+	return func() (*manifestEntry, error) {
+		rec, err := cr.Read()
+		if err != nil {
+			return nil, err // io.EOF must pass through unwrapped
+		}
+
+		e := manifestEntry{
+			PieceCid: rec[colIdx["piece_cid"]],
+		}
+		if e.PaddedSize, err = strconv.ParseUint(rec[colIdx["padded_size"]], 10, 64); err != nil {
+			return nil, xerrors.Errorf("padded_size '%s' is not a valid integer", rec[colIdx["padded_size"]])
+		}
+		if i, found := colIdx["payload_cid"]; found {
+			e.PayloadCid = rec[i]
+		}
+		for _, i := range srcCols {
+			e.SourceURLs = append(e.SourceURLs, rec[i])
+		}
+
+		return &e, nil
+	}, nil
+}
+
+func ndjsonManifestReader(r io.Reader) func() (*manifestEntry, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	return func() (*manifestEntry, error) {
+		var e manifestEntry
+		if err := dec.Decode(&e); err != nil {
+			return nil, err // io.EOF must pass through unwrapped
+		}
+		return &e, nil
+	}
+}
+
+func ingestManifestBatch(ctx context.Context, datasetID int16, batch []*manifestRow, tot *ingestTotals) error {
+	_, log, db, _ := app.UnpackCtx(ctx)
+
+	return db.BeginTxFunc(ctx, pgx.TxOptions{}, func(tx pgx.Tx) error {
+
+		if _, err := tx.Exec(
+			ctx,
+			`
+			CREATE TEMPORARY TABLE ingest_manifest (
+				piece_cid TEXT NOT NULL UNIQUE,
+				piece_log2_size SMALLINT NOT NULL,
+				proposal_label TEXT,
+				source_urls TEXT[]
+			) ON COMMIT DROP
+			`,
+		); err != nil {
+			return cmn.WrErr(err)
+		}
+
+		if _, err := tx.CopyFrom(
+			ctx,
+			pgx.Identifier{"ingest_manifest"},
+			[]string{"piece_cid", "piece_log2_size", "proposal_label", "source_urls"},
+			pgx.CopyFromSlice(len(batch), func(i int) ([]interface{}, error) {
+				return []interface{}{
+					batch[i].pieceCid,
+					batch[i].pieceLog2Size,
+					batch[i].proposalLabel,
+					batch[i].sourceURLs,
+				}, nil
+			}),
+		); err != nil {
+			return cmn.WrErr(err)
+		}
+
+		// refuse to silently override information we already trust
+		var conflictPcid, conflictReason string
+		err := tx.QueryRow(
+			ctx,
+			`
+			SELECT
+					m.piece_cid,
+					CASE
+						WHEN p.proposal_label != m.proposal_label
+							THEN 'known payload_cid ' || p.proposal_label || ' differs from manifest ' || m.proposal_label
+						ELSE 'proven padded_size ' || ( 1::BIGINT << p.piece_log2_size ) || ' differs from manifest ' || ( 1::BIGINT << m.piece_log2_size )
+					END
+				FROM ingest_manifest m
+				JOIN spd.pieces p USING ( piece_cid )
+			WHERE
+				p.proposal_label != m.proposal_label
+					OR
+				(
+					p.piece_log2_size != m.piece_log2_size
+						AND
+					COALESCE( (p.piece_meta->'size_proven_correct')::BOOL, false )
+				)
+			LIMIT 1
+			`,
+		).Scan(&conflictPcid, &conflictReason)
+		if err == nil {
+			return xerrors.Errorf("manifest entry for piece %s conflicts with existing state: %s", conflictPcid, conflictReason)
+		} else if err != pgx.ErrNoRows {
+			return cmn.WrErr(err)
+		}
+
+		// pieces previously discovered via track-deals carry a claimed ( unproven ) size and no label
+		res, err := tx.Exec(
+			ctx,
+			`
+			UPDATE spd.pieces p SET
+				proposal_label = COALESCE( p.proposal_label, m.proposal_label ),
+				piece_log2_size = m.piece_log2_size
+			FROM ingest_manifest m
+			WHERE
+				p.piece_cid = m.piece_cid
+					AND
+				(
+					( p.proposal_label IS NULL AND m.proposal_label IS NOT NULL )
+						OR
+					p.piece_log2_size != m.piece_log2_size
+				)
+			`,
+		)
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+		updated := res.RowsAffected()
+
+		res, err = tx.Exec(
+			ctx,
+			`
+			INSERT INTO spd.pieces ( piece_cid, piece_log2_size, proposal_label )
+				SELECT piece_cid, piece_log2_size, proposal_label
+					FROM ingest_manifest
+				ORDER BY piece_cid
+			ON CONFLICT ( piece_cid ) DO NOTHING
+			`,
+		)
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+		inserted := res.RowsAffected()
+
+		res, err = tx.Exec(
+			ctx,
+			`
+			INSERT INTO spd.datasets_pieces ( piece_id, dataset_id )
+				SELECT p.piece_id, $1
+					FROM ingest_manifest m
+					JOIN spd.pieces p USING ( piece_cid )
+			ON CONFLICT ( piece_id, dataset_id ) DO NOTHING
+			`,
+			datasetID,
+		)
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+		members := res.RowsAffected()
+
+		res, err = tx.Exec(
+			ctx,
+			`
+			INSERT INTO spd.sources_http ( piece_id, source_url )
+				SELECT p.piece_id, UNNEST( m.source_urls )
+					FROM ingest_manifest m
+					JOIN spd.pieces p USING ( piece_cid )
+				WHERE
+					m.source_urls IS NOT NULL
+			ON CONFLICT ( piece_id, source_url ) WHERE ( piece_id IS NOT NULL ) DO NOTHING
+			`,
+		)
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+		sources := res.RowsAffected()
+
+		tot.batches++
+		tot.piecesNew += inserted
+		tot.piecesUpdated += updated
+		tot.datasetMembersNew += members
+		tot.sourcesNew += sources
+
+		log.Infof(
+			"batch %d: ingested %s entries, %s new pieces, %s updated pieces, %s new dataset members, %s new sources",
+			tot.batches,
+			humanize.Comma(int64(len(batch))),
+			humanize.Comma(inserted),
+			humanize.Comma(updated),
+			humanize.Comma(members),
+			humanize.Comma(sources),
+		)
+
+		return nil
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/xerrors"
+)
+
+// interactive-grade scrypt parameters: decryption happens once per client per sign-pending run
+const (
+	keystoreScryptN = 1 << 18
+	keystoreScryptR = 8
+	keystoreScryptP = 1
+)
+
+var (
+	keystorePassphraseFile string
+	keystoreOutputDir      string
+	keystoreSetSigner      bool
+)
+var keystoreImport = &ufcli.Command{
+	Usage: "Encrypt a private key exported via `lotus wallet export` into a keystore signer file",
+	Name:  "keystore-import",
+	Description: strings.Join([]string{
+		"Reads the hex-encoded output of `lotus wallet export <address>` from STDIN and writes",
+		"<output-dir>/<address>.key, encrypted with the contents of --passphrase-file. The same",
+		"passphrase file must be readable by sign-pending when the key is used.",
+	}, "\n"),
+	Flags: []ufcli.Flag{
+		&ufcli.StringFlag{
+			Name:        "passphrase-file",
+			Usage:       "File containing the passphrase protecting the key at rest",
+			Required:    true,
+			Destination: &keystorePassphraseFile,
+		},
+		&ufcli.StringFlag{
+			Name:        "output-dir",
+			Usage:       "Directory to write the encrypted keyfile into",
+			Value:       ".",
+			Destination: &keystoreOutputDir,
+		},
+		&ufcli.BoolFlag{
+			Name:        "set-client-signer",
+			Usage:       "Configure the matching spd.clients entry to sign with the written keyfile",
+			Destination: &keystoreSetSigner,
+		},
+	},
+	Action: func(cctx *ufcli.Context) error {
+		ctx, log, db, _ := app.UnpackCtx(cctx.Context)
+
+		exported, err := io.ReadAll(io.LimitReader(os.Stdin, 1<<16))
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+		rawKI, err := hex.DecodeString(strings.TrimSpace(string(exported)))
+		if err != nil {
+			return xerrors.Errorf("STDIN does not contain a hex-encoded exported key: %w", err)
+		}
+		var ki struct {
+			Type       string
+			PrivateKey []byte
+		}
+		if err := json.Unmarshal(rawKI, &ki); err != nil {
+			return xerrors.Errorf("STDIN does not contain a valid exported key: %w", err)
+		}
+		sigType, known := keyTypeSigTypes[ki.Type]
+		if !known {
+			return xerrors.Errorf("unsupported key type '%s'", ki.Type)
+		}
+		addr, err := keyAddress(sigType, ki.PrivateKey)
+		if err != nil {
+			return xerrors.Errorf("unable to derive address of the supplied %s key: %w", ki.Type, err)
+		}
+
+		pass, err := readPassphraseFile(keystorePassphraseFile)
+		if err != nil {
+			return err
+		}
+
+		kf := keystoreFile{
+			Address: addr.String(),
+			KeyType: ki.Type,
+			ScryptN: keystoreScryptN,
+			ScryptR: keystoreScryptR,
+			ScryptP: keystoreScryptP,
+			Salt:    make([]byte, 32),
+			Nonce:   make([]byte, 24),
+		}
+		if _, err := rand.Read(kf.Salt); err != nil {
+			return cmn.WrErr(err)
+		}
+		var nonce [24]byte
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return cmn.WrErr(err)
+		}
+		copy(kf.Nonce, nonce[:])
+
+		secret, err := keystoreSecret(pass, kf.Salt, kf.ScryptN, kf.ScryptR, kf.ScryptP)
+		if err != nil {
+			return err
+		}
+		kf.Ciphertext = secretbox.Seal(nil, ki.PrivateKey, &nonce, secret)
+
+		// verify roundtrip before writing anything
+		if dec, err := kf.decrypt(pass); err != nil || string(dec) != string(ki.PrivateKey) {
+			return xerrors.Errorf("encrypted key does not roundtrip: %v", err)
+		}
+
+		outDir, err := filepath.Abs(keystoreOutputDir)
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+		passFn, err := filepath.Abs(keystorePassphraseFile)
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+		keyFn := filepath.Join(outDir, addr.String()+".key")
+
+		kfJSON, err := json.MarshalIndent(kf, "", "  ")
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+		fh, err := os.OpenFile(keyFn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+		if _, err := fh.Write(append(kfJSON, '\n')); err != nil {
+			fh.Close() //nolint:errcheck
+			return cmn.WrErr(err)
+		}
+		if err := fh.Close(); err != nil {
+			return cmn.WrErr(err)
+		}
+		log.Infow("keyfile written", "address", addr.String(), "keyType", ki.Type, "keyfile", keyFn)
+
+		if keystoreSetSigner {
+			tag, err := db.Exec(
+				ctx,
+				`
+				UPDATE spd.clients SET
+					client_meta = JSONB_SET( client_meta, '{ signer }', $2 )
+				WHERE
+					client_address = $1
+				`,
+				addr.String(),
+				signerConfig{
+					Type:           signerKeystore,
+					Keyfile:        keyFn,
+					PassphraseFile: passFn,
+				},
+			)
+			if err != nil {
+				return cmn.WrErr(err)
+			}
+			if tag.RowsAffected() == 0 {
+				return xerrors.Errorf("keyfile written, but no client with address %s exists to configure", addr)
+			}
+			log.Infow("client signer configured", "address", addr.String())
+		}
+
+		return nil
+	},
+}
@@ -33,9 +33,17 @@ func main() {
 				trackDeals,
 				signPending,
 				proposePending,
+				deliverWebhooks,
+				checkRetrievals,
+				scoreProviders,
+				ingestManifest,
+				keystoreImport,
+				mockSP,
+				daemon,
 			},
 			Flags: app.CommonFlags,
 		},
-		GlobalInit: app.GlobalInit,
+		GlobalInit:     app.GlobalInit,
+		BeforeShutdown: daemonBeforeShutdown,
 	}).RunAndExit(context.Background())
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	infomempeerstore "github.com/ribasushi/go-libp2p-infomempeerstore"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/app"
+	"github.com/ribasushi/spade/internal/filtypes"
+	"github.com/ribasushi/spade/internal/mocksp"
+	"golang.org/x/xerrors"
+)
+
+var (
+	mockSpListen        string
+	mockSpProtocols     string
+	mockSpRejectMessage string
+	mockSpLatencyMsecs  int
+	mockSpDrop          bool
+	mockSpImpersonate   string
+)
+var mockSP = &ufcli.Command{
+	Usage: "Run a mock Boost storage provider, recording every proposal it receives",
+	Name:  "mock-sp",
+	Description: strings.Join([]string{
+		"Listens until interrupted, answering proposals as instructed by the flags below.",
+		"With --impersonate the providers_info of the given SP is repointed at the mock, so that",
+		"propose-pending delivers to it instead. This is refused unless the database is explicitly",
+		"marked as a development one via:",
+		`  UPDATE spd.global SET metadata = JSONB_SET( metadata, '{ non_production }', 'true' )`,
+		"A later poll-providers run of that SP restores its real info.",
+	}, "\n"),
+	Flags: []ufcli.Flag{
+		&ufcli.StringFlag{
+			Name:        "listen",
+			Usage:       "Multiaddress to listen on",
+			Value:       mocksp.DefaultListenAddr,
+			Destination: &mockSpListen,
+		},
+		&ufcli.StringFlag{
+			Name:        "protocols",
+			Usage:       "Comma-separated list of libp2p protocols to advertise",
+			Value:       strings.Join(append(append([]string{}, filtypes.StorageProposalProtocols...), filtypes.RetrievalTransports), ","),
+			Destination: &mockSpProtocols,
+		},
+		&ufcli.StringFlag{
+			Name:        "reject-message",
+			Usage:       "Reject every proposal with this message, instead of accepting it",
+			Destination: &mockSpRejectMessage,
+		},
+		&ufcli.IntFlag{
+			Name:        "latency-msecs",
+			Usage:       "Amount of milliseconds to wait before responding to a proposal",
+			Destination: &mockSpLatencyMsecs,
+		},
+		&ufcli.BoolFlag{
+			Name:        "drop",
+			Usage:       "Reset proposal streams instead of responding",
+			Destination: &mockSpDrop,
+		},
+		&ufcli.StringFlag{
+			Name:        "impersonate",
+			Usage:       "Storage provider ( f0... ) whose providers_info to repoint at the mock, development databases only",
+			Destination: &mockSpImpersonate,
+		},
+	},
+	Action: func(cctx *ufcli.Context) error {
+		ctx, log, db, _ := app.UnpackCtx(cctx.Context)
+
+		// decide before listening: a production database must never be repointed at a mock
+		var impersonateSP fil.ActorID
+		if mockSpImpersonate != "" {
+			var err error
+			if impersonateSP, err = fil.ParseActorString(mockSpImpersonate); err != nil {
+				return cmn.WrErr(err)
+			}
+			var nonProduction bool
+			if err := db.QueryRow(
+				ctx,
+				`SELECT COALESCE( ( metadata->'non_production' )::BOOL, false ) FROM spd.global`,
+			).Scan(&nonProduction); err != nil {
+				return cmn.WrErr(err)
+			}
+			if !nonProduction {
+				return xerrors.New("refusing to --impersonate: the database is not marked non_production in spd.global.metadata")
+			}
+		}
+
+		protos := make([]string, 0, 4)
+		for _, p := range strings.Split(mockSpProtocols, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protos = append(protos, p)
+			}
+		}
+
+		sp, err := mocksp.New(mocksp.Config{
+			ListenAddr: mockSpListen,
+			Protocols:  protos,
+		})
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := sp.Close(); err != nil {
+				log.Warnf("unexpected error shutting down mock node %s: %s", sp.Host.ID().String(), err)
+			}
+		}()
+
+		sp.SetBehavior(mocksp.Behavior{
+			RejectMessage: mockSpRejectMessage,
+			Latency:       time.Duration(mockSpLatencyMsecs) * time.Millisecond,
+			Drop:          mockSpDrop,
+		})
+
+		var received int32
+		sp.OnReceive(func(r mocksp.Received) {
+			atomic.AddInt32(&received, 1)
+			log.Infow("received proposal",
+				"protocol", r.Protocol,
+				"from", r.From.String(),
+				"dealUUID", r.Params.DealUUID.String(),
+				"pieceCid", r.Params.ClientDealProposal.Proposal.PieceCID.String(),
+				"provider", r.Params.ClientDealProposal.Proposal.Provider.String(),
+				"client", r.Params.ClientDealProposal.Proposal.Client.String(),
+				"startEpoch", r.Params.ClientDealProposal.Proposal.StartEpoch,
+				"rejected", r.Behavior.RejectMessage != "",
+				"dropped", r.Behavior.Drop,
+			)
+		})
+
+		ai := sp.AddrInfo()
+		log.Infow("mock provider listening", "peerid", ai.ID.String(), "multiaddrs", ai.Addrs, "protocols", protos)
+
+		if mockSpImpersonate != "" {
+			protoSet := make(map[string]struct{}, len(protos))
+			for _, p := range protos {
+				protoSet[p] = struct{}{}
+			}
+			// the rest of the real spInfo is retained, only what is needed to dial the mock is replaced
+			if _, err := db.Exec(
+				ctx,
+				`
+				INSERT INTO spd.providers_info
+					( provider_id, provider_last_polled, info )
+					VALUES ( $1, NOW(), $2 )
+				ON CONFLICT ( provider_id ) DO UPDATE SET
+					provider_last_polled = EXCLUDED.provider_last_polled,
+					info = ( COALESCE( spd.providers_info.info, '{}' ) - 'errors' ) || EXCLUDED.info
+				`,
+				impersonateSP,
+				map[string]interface{}{
+					"peerid":     ai.ID,
+					"multiaddrs": ai.Addrs,
+					"peer_info":  infomempeerstore.PeerData{Protos: protoSet},
+				},
+			); err != nil {
+				return cmn.WrErr(err)
+			}
+			log.Infof("providers_info of %s now points at the mock", impersonateSP)
+		}
+
+		<-ctx.Done()
+
+		log.Infow("summary", "received", atomic.LoadInt32(&received))
+		return nil
+	},
+}
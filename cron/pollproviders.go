@@ -93,7 +93,7 @@ var pollProviders = &ufcli.Command{
 								OR
 							pi.provider_last_polled < NOW() - $2::INTERVAL
 								OR
-							pi.info->'peer_info'->'libp2p_protocols'->$3 IS NULL
+							NOT COALESCE( pi.info->'peer_info'->'libp2p_protocols' ?| $3::TEXT[], false )
 						)
 					)
 			)
@@ -114,7 +114,7 @@ var pollProviders = &ufcli.Command{
 			`,
 			pollRequeryAll,
 			fmt.Sprintf("%d minutes", (app.PolledSPInfoStaleAfterMinutes/3*2)),
-			filtypes.StorageProposalV120,
+			filtypes.StorageProposalProtocols,
 		); err != nil {
 			return cmn.WrErr(err)
 		}
@@ -123,19 +123,26 @@ var pollProviders = &ufcli.Command{
 			totalQueried  *int32
 			unaddressable *int32
 			undialable    *int32
-			lacksV120     *int32
+			lacksProposal *int32
 		}{
 			totalQueried:  new(int32),
 			unaddressable: new(int32),
 			undialable:    new(int32),
-			lacksV120:     new(int32),
+			lacksProposal: new(int32),
 		}
+		t0 := time.Now()
 		defer func() {
 			log.Infow("summary",
 				"totalQueried", atomic.LoadInt32(totals.totalQueried),
 				"unaddressable", atomic.LoadInt32(totals.unaddressable),
 				"undialable", atomic.LoadInt32(totals.undialable),
-				"lacksV120", atomic.LoadInt32(totals.lacksV120),
+				"lacksProposal", atomic.LoadInt32(totals.lacksProposal),
+			)
+			recordRunMetrics(cctx.Context, "poll-providers", t0,
+				app.Metric{Name: "queried", Description: "Amount of providers queried during the last run", Value: int64(atomic.LoadInt32(totals.totalQueried))},
+				app.Metric{Name: "unaddressable", Description: "Amount of providers without published multiaddrs during the last run", Value: int64(atomic.LoadInt32(totals.unaddressable))},
+				app.Metric{Name: "undialable", Description: "Amount of providers which could not be dialed during the last run", Value: int64(atomic.LoadInt32(totals.undialable))},
+				app.Metric{Name: "lacks_proposal_protocol", Description: "Amount of dialable providers lacking any supported storage proposal protocol during the last run", Value: int64(atomic.LoadInt32(totals.lacksProposal))},
 			)
 		}()
 
@@ -162,8 +169,8 @@ var pollProviders = &ufcli.Command{
 					atomic.AddInt32(totals.unaddressable, 1)
 				case spi.PeerInfo == nil:
 					atomic.AddInt32(totals.undialable, 1)
-				case func() bool { _, can := spi.PeerInfo.Protos[filtypes.StorageProposalV120]; return !can }():
-					atomic.AddInt32(totals.lacksV120, 1)
+				case filtypes.NegotiateStorageProposalProtocol(spi.PeerInfo.Protos) == "":
+					atomic.AddInt32(totals.lacksProposal, 1)
 				}
 
 				_, err = db.Exec(
@@ -231,17 +238,13 @@ func getSPInfo(ctx context.Context, sp filaddr.Address, timeOut time.Duration) (
 		return spi, nil
 	}
 
-	nodeHost, peerStore, err := lp2p.NewPlainNodeTCP(timeOut)
+	nodeHost, peerStore, releaseNode, err := acquireTaskNode(ctx, "poll-providers", timeOut, *spi.PeerID)
 	if err != nil {
-		return spInfo{}, cmn.WrErr(err)
+		return spInfo{}, err
 	}
+	defer releaseNode()
 	lpid := nodeHost.ID().String()
 	spi.localPeerID = &lpid
-	defer func() {
-		if err := nodeHost.Close(); err != nil {
-			log.Warnf("unexpected error shutting down node %s: %s", spi.localPeerID, err)
-		}
-	}()
 
 	pTag := "provider-poll"
 	nodeHost.ConnManager().Protect(*spi.PeerID, pTag)
@@ -4,12 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/google/uuid"
+	lp2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
 	"github.com/ribasushi/go-toolbox-interplanetary/lp2p"
 	"github.com/ribasushi/go-toolbox/cmn"
 	"github.com/ribasushi/go-toolbox/ufcli"
@@ -31,21 +36,27 @@ type proposalPending struct {
 	ProposalCid       string
 	PeerID            *lp2p.PeerID
 	Multiaddrs        []string
+	Protocols         map[string]struct{}
+	DeliveryAttempts  int
 }
 type proposalsPerSP map[filaddr.Address][]proposalPending
 
 type runTotals struct {
 	proposals       int
 	uniqueProviders int
-	delivered120    *int32
+	delivered       map[string]*int32 // keyed by negotiated protocol
 	timedout        *int32
 	failed          *int32
+	retrying        *int32
 }
 
 var (
-	spProposalSleep int
-	proposalTimeout int
-	perSpTimeout    int
+	spProposalSleep     int
+	proposalTimeout     int
+	perSpTimeout        int
+	maxDeliveryAttempts int
+	retryBackoffBase    int
+	retryBackoffMax     int
 )
 var proposePending = &ufcli.Command{
 	Usage: "Propose pending deals to providers",
@@ -69,23 +80,62 @@ var proposePending = &ufcli.Command{
 			Value:       270, // 4.5 mins
 			Destination: &perSpTimeout,
 		},
+		&ufcli.IntFlag{
+			Name:        "max-delivery-attempts",
+			Usage:       "Amount of times delivery of a transiently failing proposal is attempted before giving up",
+			Value:       5,
+			Destination: &maxDeliveryAttempts,
+		},
+		&ufcli.IntFlag{
+			Name:        "retry-backoff-base",
+			Usage:       "Amount of seconds to wait before the first retry, doubled on every subsequent attempt",
+			Value:       60,
+			Destination: &retryBackoffBase,
+		},
+		&ufcli.IntFlag{
+			Name:        "retry-backoff-max",
+			Usage:       "Maximum amount of seconds to wait between retries",
+			Value:       3600,
+			Destination: &retryBackoffMax,
+		},
 	},
 	Action: func(cctx *ufcli.Context) error {
 		ctx, log, db, _ := app.UnpackCtx(cctx.Context)
 
 		tot := runTotals{
-			delivered120: new(int32),
-			timedout:     new(int32),
-			failed:       new(int32),
+			delivered: make(map[string]*int32, len(filtypes.StorageProposalProtocols)),
+			timedout:  new(int32),
+			failed:    new(int32),
+			retrying:  new(int32),
 		}
+		for _, proto := range filtypes.StorageProposalProtocols {
+			tot.delivered[proto] = new(int32)
+		}
+		t0 := time.Now()
 		defer func() {
-			log.Infow("summary",
+			summary := []interface{}{
 				"uniqueProviders", tot.uniqueProviders,
 				"proposals", tot.proposals,
-				"successfulV120", atomic.LoadInt32(tot.delivered120),
+			}
+			metrics := []app.Metric{
+				{Name: "unique_providers", Description: "Amount of distinct providers proposed to during the last run", Value: int64(tot.uniqueProviders)},
+				{Name: "proposals_total", Description: "Amount of proposal delivery attempts", Type: app.MetricCounter, Value: int64(tot.proposals)},
+				{Name: "failed_total", Description: "Amount of proposals rejected by or undeliverable to the provider", Type: app.MetricCounter, Value: int64(atomic.LoadInt32(tot.failed))},
+				{Name: "timedout_total", Description: "Amount of proposals which timed out during delivery", Type: app.MetricCounter, Value: int64(atomic.LoadInt32(tot.timedout))},
+				{Name: "retrying_total", Description: "Amount of proposals which failed transiently and are scheduled for another delivery attempt", Type: app.MetricCounter, Value: int64(atomic.LoadInt32(tot.retrying))},
+			}
+			for _, proto := range filtypes.StorageProposalProtocols {
+				delivered := atomic.LoadInt32(tot.delivered[proto])
+				summary = append(summary, "successful"+protoVersionTag(proto), delivered)
+				metrics = append(metrics, app.Metric{Name: "delivered_total", Description: "Amount of proposals successfully delivered", Type: app.MetricCounter, Value: int64(delivered), Dimensions: map[string]string{"protocol": proto}})
+			}
+			summary = append(summary,
 				"failed", atomic.LoadInt32(tot.failed),
 				"timedout", atomic.LoadInt32(tot.timedout),
+				"retrying", atomic.LoadInt32(tot.retrying),
 			)
+			log.Infow("summary", summary...)
+			recordRunMetrics(cctx.Context, "propose-pending", t0, metrics...)
 		}()
 
 		pending := make([]proposalPending, 0, 2048)
@@ -99,9 +149,11 @@ var proposePending = &ufcli.Command{
 					pr.proposal_meta->'filmarket_proposal' AS proposal_payload,
 					pr.proposal_meta->'signature' AS proposal_signature,
 					pr.proposal_meta->>'signed_proposal_cid' AS proposal_cid,
+					pr.delivery_attempts,
 					p.proposal_label,
 					pi.info->'peerid' AS peer_id,
-					pi.info->'multiaddrs' AS multiaddrs
+					pi.info->'multiaddrs' AS multiaddrs,
+					pi.info->'peer_info'->'libp2p_protocols' AS protocols
 				FROM spd.proposals pr
 				JOIN spd.pieces p USING ( piece_id )
 				LEFT JOIN spd.providers_info pi USING ( provider_id )
@@ -111,6 +163,8 @@ var proposePending = &ufcli.Command{
 				signature_obtained IS NOT NULL
 					AND
 				proposal_failstamp = 0
+					AND
+				( next_delivery_attempt IS NULL OR next_delivery_attempt <= NOW() )
 			ORDER BY entry_created
 			`,
 		); err != nil {
@@ -147,7 +201,14 @@ var proposePending = &ufcli.Command{
 			sp := sp
 			eg.Go(func() error { return proposeToSp(ctx, props[sp], tot) })
 		}
-		return eg.Wait()
+		if err := eg.Wait(); err != nil {
+			return err
+		}
+
+		if tot.proposals > 0 {
+			triggerTask(deliverWebhooks.Name)
+		}
+		return nil
 	},
 }
 
@@ -159,17 +220,41 @@ func proposeToSp(ctx context.Context, props []proposalPending, tot runTotals) er
 	ctx, log, db, _ := app.UnpackCtx(ctx)
 	sp := props[0].ProposalPayload.Provider
 
+	// all proposals for the same SP carry the same protocol list: negotiate once
+	proto := filtypes.NegotiateStorageProposalProtocol(props[0].Protocols)
+	if proto == "" {
+		for _, p := range props {
+			atomic.AddInt32(tot.failed, 1)
+			if _, err := db.Exec(
+				context.Background(), // deliberate: even if outer context is cancelled we still need to write to DB
+				`
+				UPDATE spd.proposals SET
+					proposal_failstamp = spd.big_now(),
+					proposal_meta = JSONB_SET( proposal_meta, '{ failure }', TO_JSONB( $2::TEXT ) )
+				WHERE
+					proposal_uuid = $1
+				`,
+				p.ProposalUUID,
+				fmt.Sprintf("provider does not advertise any supported storage proposal protocol ( %s )", strings.Join(filtypes.StorageProposalProtocols, ", ")),
+			); err != nil {
+				return cmn.WrErr(err)
+			}
+		}
+		log.Warnf("unable to propose %d deals to %s: no supported storage proposal protocol advertised", len(props), sp)
+		return nil
+	}
+
 	dealCount := len(props)
-	jobDesc := fmt.Sprintf("proposing %d deals to %s", dealCount, sp)
-	var delivered, failed, timedout int
+	jobDesc := fmt.Sprintf("proposing %d deals to %s via %s", dealCount, sp, proto)
+	var delivered, failed, timedout, retrying int
 	log.Info("START " + jobDesc)
 	t0 := time.Now()
 	defer func() {
 		log.Infof(
-			"END %s, out of %d proposals: %d succeeded, %d failed, %d timed out, took %s",
+			"END %s, out of %d proposals: %d succeeded, %d failed, %d timed out, %d will be retried, took %s",
 			jobDesc,
 			dealCount,
-			delivered, failed, timedout,
+			delivered, failed, timedout, retrying,
 			time.Since(t0).String(),
 		)
 	}()
@@ -197,21 +282,18 @@ func proposeToSp(ctx context.Context, props []proposalPending, tot runTotals) er
 		}
 
 		var proposalLoopErr error
+		var dialFailed, rejected bool
 
 		// connect if needed
 		if nodeHost == nil {
 
+			var releaseNode func()
 			var err error
-			nodeHost, _, err = lp2p.NewPlainNodeTCP(time.Duration(proposalTimeout) * time.Second)
+			nodeHost, _, releaseNode, err = acquireTaskNode(ctx, "propose-pending", time.Duration(proposalTimeout)*time.Second, *p.PeerID)
 			if err != nil {
-				return cmn.WrErr(err)
+				return err
 			}
-
-			defer func() {
-				if err := nodeHost.Close(); err != nil {
-					log.Warnf("unexpected error shutting down node %s: %s", nodeHost.ID().String(), err)
-				}
-			}()
+			defer releaseNode()
 
 			lpid := nodeHost.ID().String()
 			localPeerid = &lpid
@@ -231,18 +313,19 @@ func proposeToSp(ctx context.Context, props []proposalPending, tot runTotals) er
 			})
 			dms := time.Since(t1).Milliseconds()
 			dialTookMsecs = &dms
+			dialFailed = (proposalLoopErr != nil)
 		}
 
 		var proposingTookMsecs *int64
 		if proposalLoopErr == nil {
-			var resp filtypes.StorageProposalV120Response
+			var resp filtypes.StorageProposalV12xResponse
 			tCtx, tCtxCancel := context.WithTimeout(ctx, time.Duration(proposalTimeout)*time.Second)
 			t1 := time.Now()
 			proposalLoopErr = lp2p.DoCborRPC(
 				tCtx,
 				nodeHost,
 				*p.PeerID,
-				filtypes.StorageProposalV120,
+				lp2pprotocol.ID(proto),
 				&filtypes.StorageProposalV12xParams{
 					IsOffline:          true, // not negotiable: out-of-band-transfers forever
 					DealUUID:           p.ProposalUUID,
@@ -263,6 +346,7 @@ func proposeToSp(ctx context.Context, props []proposalPending, tot runTotals) er
 			tCtxCancel()
 			if proposalLoopErr == nil && !resp.Accepted {
 				proposalLoopErr = xerrors.New(resp.Message)
+				rejected = true
 			}
 		}
 
@@ -275,15 +359,19 @@ func proposeToSp(ctx context.Context, props []proposalPending, tot runTotals) er
 					JSONB_SET(
 						JSONB_SET(
 							JSONB_SET(
-								proposal_meta,
-								'{ dialing_peerid }',
-								COALESCE( TO_JSONB( $2::TEXT ), 'null'::JSONB )
+								JSONB_SET(
+									proposal_meta,
+									'{ dialing_peerid }',
+									COALESCE( TO_JSONB( $2::TEXT ), 'null'::JSONB )
+								),
+								'{ dial_took_msecs }',
+								COALESCE( TO_JSONB( $3::BIGINT ), 'null'::JSONB )
 							),
-							'{ dial_took_msecs }',
-							COALESCE( TO_JSONB( $3::BIGINT ), 'null'::JSONB )
+							'{ proposal_took_msecs }',
+							COALESCE( TO_JSONB( $4::BIGINT ), 'null'::JSONB )
 						),
-						'{ proposal_took_msecs }',
-						COALESCE( TO_JSONB( $4::BIGINT ), 'null'::JSONB )
+						'{ proposal_protocol }',
+						TO_JSONB( $5::TEXT )
 					)
 				)
 			WHERE
@@ -293,6 +381,7 @@ func proposeToSp(ctx context.Context, props []proposalPending, tot runTotals) er
 			localPeerid,
 			dialTookMsecs,
 			proposingTookMsecs,
+			proto,
 		); err != nil {
 			return cmn.WrErr(err)
 		}
@@ -301,7 +390,7 @@ func proposeToSp(ctx context.Context, props []proposalPending, tot runTotals) er
 		if proposalLoopErr == nil {
 
 			delivered++
-			atomic.AddInt32(tot.delivered120, 1)
+			atomic.AddInt32(tot.delivered[proto], 1)
 
 			if _, err := db.Exec(
 				context.Background(), // deliberate: even if outer context is cancelled we still need to write to DB
@@ -319,37 +408,84 @@ func proposeToSp(ctx context.Context, props []proposalPending, tot runTotals) er
 			log.Error(proposalLoopErr)
 
 			didTimeout := errors.Is(proposalLoopErr, context.DeadlineExceeded)
-			if didTimeout {
-				timedout++
-				atomic.AddInt32(tot.timedout, 1)
-			} else {
-				failed++
-				atomic.AddInt32(tot.failed, 1)
+			failClass, retryable := classifyProposalFailure(proposalLoopErr, dialFailed, rejected)
+			attempt := p.DeliveryAttempts + 1
+
+			var retryIn time.Duration
+			if retryable && attempt < maxDeliveryAttempts {
+				retryIn = deliveryBackoff(attempt)
+				// no point retrying past the deal start: it would be rejected regardless
+				if time.Now().Add(retryIn).After(fil.MainnetTime(p.ProposalPayload.StartEpoch)) {
+					retryIn = 0
+				}
 			}
 
-			if _, err := db.Exec(
-				context.Background(), // deliberate: even if outer context is cancelled we still need to write to DB
-				`
-				UPDATE spd.proposals SET
-					proposal_failstamp = spd.big_now(),
-					proposal_meta = JSONB_STRIP_NULLS(
-						JSONB_SET(
+			if retryIn > 0 {
+				retrying++
+				atomic.AddInt32(tot.retrying, 1)
+
+				if _, err := db.Exec(
+					context.Background(), // deliberate: even if outer context is cancelled we still need to write to DB
+					`
+					UPDATE spd.proposals SET
+						delivery_attempts = $2,
+						next_delivery_attempt = NOW() + MAKE_INTERVAL( secs => $3 ),
+						proposal_meta = JSONB_SET(
 							proposal_meta,
-							'{ failure }',
-							TO_JSONB( $2::TEXT )
+							'{ last_delivery_error }',
+							JSONB_BUILD_OBJECT(
+								'class', $4::TEXT,
+								'error', $5::TEXT,
+								'attempt', $2::INTEGER
+							)
 						)
-					)
-				WHERE
-					proposal_uuid = $1
-				`,
-				p.ProposalUUID,
-				proposalLoopErr.Error(),
-			); err != nil {
-				return cmn.WrErr(err)
+					WHERE
+						proposal_uuid = $1
+					`,
+					p.ProposalUUID,
+					attempt,
+					retryIn.Seconds(),
+					failClass,
+					proposalLoopErr.Error(),
+				); err != nil {
+					return cmn.WrErr(err)
+				}
+			} else {
+				if didTimeout {
+					timedout++
+					atomic.AddInt32(tot.timedout, 1)
+				} else {
+					failed++
+					atomic.AddInt32(tot.failed, 1)
+				}
+
+				if _, err := db.Exec(
+					context.Background(), // deliberate: even if outer context is cancelled we still need to write to DB
+					`
+					UPDATE spd.proposals SET
+						delivery_attempts = $3,
+						next_delivery_attempt = NULL,
+						proposal_failstamp = spd.big_now(),
+						proposal_meta = JSONB_STRIP_NULLS(
+							JSONB_SET(
+								proposal_meta,
+								'{ failure }',
+								TO_JSONB( $2::TEXT )
+							)
+						)
+					WHERE
+						proposal_uuid = $1
+					`,
+					p.ProposalUUID,
+					fmt.Sprintf("%s after %d attempt(s): %s", failClass, attempt, proposalLoopErr.Error()),
+					attempt,
+				); err != nil {
+					return cmn.WrErr(err)
+				}
 			}
 
 			// in case of a timeout or connection failure: bail after failing just one proposal, retry next time
-			if nodeHost == nil || didTimeout {
+			if dialFailed || didTimeout {
 				return nil
 			}
 		}
@@ -357,3 +493,58 @@ func proposeToSp(ctx context.Context, props []proposalPending, tot runTotals) er
 
 	return nil
 }
+
+const (
+	failClassDial              = "dial_failure"
+	failClassTimeout           = "timeout"
+	failClassTransport         = "transport_error"
+	failClassRejectedTransient = "rejected_transient"
+	failClassRejectedPermanent = "rejected_permanent"
+)
+
+// Boost rejection messages which reflect a temporary state of the SP, rather than
+// something wrong with the proposal itself
+var transientRejectionRe = regexp.MustCompile(`(?i)` + strings.Join([]string{
+	`too busy`,
+	`try again`,
+	`temporar`,
+	`insufficient funds`,
+	`not enough funds`,
+	`staging area`,
+	`sealing pipeline`,
+	`rate.?limit`,
+	`unavailable`,
+	`overloaded`,
+}, `|`))
+
+func classifyProposalFailure(err error, dialFailed, rejected bool) (class string, retryable bool) {
+	switch {
+	case dialFailed:
+		return failClassDial, true
+	case errors.Is(err, context.DeadlineExceeded):
+		return failClassTimeout, true
+	case rejected && transientRejectionRe.MatchString(err.Error()):
+		return failClassRejectedTransient, true
+	case rejected:
+		return failClassRejectedPermanent, false
+	case strings.Contains(err.Error(), "protocol not supported"):
+		// the SP stopped advertising what it claims on-chain: wait for pollproviders to catch up
+		return failClassRejectedPermanent, false
+	default:
+		return failClassTransport, true
+	}
+}
+
+// base * 2^(attempt-1), capped at max
+func deliveryBackoff(attempt int) time.Duration {
+	secs := float64(retryBackoffBase) * math.Pow(2, float64(attempt-1))
+	if secs > float64(retryBackoffMax) {
+		secs = float64(retryBackoffMax)
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// "/fil/storage/mk/1.2.1" => "V121"
+func protoVersionTag(proto string) string {
+	return "V" + strings.ReplaceAll(proto[strings.LastIndexByte(proto, '/')+1:], ".", "")
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/app"
+)
+
+// (!) the names are what tenants key their tenant_meta->'min' entries by: when modifying make
+// sure they align with webapi/apiAdminTenants::tenantMetaMin
+const (
+	scoreProposalAcceptance = "proposal_acceptance"
+	scoreProposalLatency    = "proposal_latency"
+	scoreActivation         = "activation"
+	scoreRetention          = "retention"
+	scoreDialability        = "dialability"
+	scoreRetrievability     = "retrievability"
+)
+
+// relative contribution of each component to the overall provider_score
+var scoreWeights = map[string]float64{
+	scoreProposalAcceptance: 3,
+	scoreProposalLatency:    1,
+	scoreActivation:         3,
+	scoreRetention:          2,
+	scoreDialability:        1,
+	scoreRetrievability:     2,
+}
+
+// a median proposal round-trip up to the first value scores 100, anything past the second scores 0
+const (
+	scoreLatencyBestMsecs  = 3_000
+	scoreLatencyWorstMsecs = 30_000
+)
+
+type providerHistory struct {
+	ProviderID fil.ActorID `json:"-"`
+
+	ProposalsAccepted   int64    `json:"proposals_accepted"`
+	ProposalsFailed     int64    `json:"proposals_failed"`
+	MedianProposalMsecs *float64 `json:"median_proposal_msecs,omitempty"`
+
+	ProposalsActivated   int64 `json:"proposals_activated"`
+	ProposalsMissedStart int64 `json:"proposals_missed_start"`
+
+	DealsActive     int64 `json:"deals_active"`
+	DealsTerminated int64 `json:"deals_terminated"`
+
+	DialableSeconds   float64 `json:"dialable_seconds"`
+	UndialableSeconds float64 `json:"undialable_seconds"`
+
+	RetrievalsSucceeded int64 `json:"retrievals_succeeded"`
+	RetrievalsFailed    int64 `json:"retrievals_failed"`
+}
+
+var (
+	scoreWindowDays int
+	scoreMinSamples int
+)
+var scoreProviders = &ufcli.Command{
+	Usage: "Recompute the reliability scores of every known storage provider",
+	Name:  "score-providers",
+	Flags: []ufcli.Flag{
+		&ufcli.IntFlag{
+			Name:        "window-days",
+			Usage:       "Amount of trailing days of history to take into account",
+			Value:       30,
+			Destination: &scoreWindowDays,
+		},
+		&ufcli.IntFlag{
+			Name:        "min-samples",
+			Usage:       "Amount of proposals/deals/retrieval checks below which a component is left unscored",
+			Value:       5,
+			Destination: &scoreMinSamples,
+		},
+	},
+	Action: func(cctx *ufcli.Context) error {
+		ctx, log, db, _ := app.UnpackCtx(cctx.Context)
+
+		t0 := time.Now()
+		hist := make([]providerHistory, 0, 2048)
+		if err := pgxscan.Select(
+			ctx,
+			db,
+			&hist,
+			`
+			WITH
+				cutoff AS MATERIALIZED (
+					SELECT NOW() - MAKE_INTERVAL( days => $1 ) AS ts
+				),
+				proposal_stats AS (
+					SELECT
+							pr.provider_id,
+							COUNT(*) FILTER ( WHERE pr.proposal_delivered IS NOT NULL ) AS proposals_accepted,
+							COUNT(*) FILTER ( WHERE pr.proposal_delivered IS NULL AND pr.proposal_failstamp > 0 ) AS proposals_failed,
+							PERCENTILE_CONT( 0.5 ) WITHIN GROUP ( ORDER BY ( pr.proposal_meta->>'proposal_took_msecs' )::BIGINT )
+								FILTER ( WHERE pr.proposal_delivered IS NOT NULL ) AS median_proposal_msecs,
+							COUNT(*) FILTER ( WHERE
+								pr.activated_deal_id IS NOT NULL
+									OR
+								pr.proposal_meta->>'failure' = 'sector containing deal was terminated'
+							) AS proposals_activated,
+							COUNT(*) FILTER ( WHERE
+								pr.proposal_delivered IS NOT NULL
+									AND
+								pr.proposal_meta->>'failure' = 'proposal DealStartEpoch missed without activation'
+							) AS proposals_missed_start
+						FROM spd.proposals pr, cutoff
+					WHERE
+						pr.signature_obtained IS NOT NULL
+							AND
+						pr.entry_created > cutoff.ts
+					GROUP BY pr.provider_id
+				),
+				deal_stats AS (
+					SELECT
+							pd.provider_id,
+							COUNT(*) FILTER ( WHERE pd.status = 'active' ) AS deals_active,
+							COUNT(*) FILTER ( WHERE
+								pd.status = 'terminated'
+									AND
+								pd.sector_start_epoch IS NOT NULL
+									AND
+								EXISTS (
+									SELECT 42
+										FROM spd.published_deal_transitions tr
+									WHERE
+										tr.deal_id = pd.deal_id
+											AND
+										tr.new_status = 'terminated'
+											AND
+										tr.reverted IS NULL
+											AND
+										tr.entry_created > cutoff.ts
+								)
+							) AS deals_terminated
+						FROM spd.published_deals pd, cutoff
+					WHERE
+						pd.status IN ( 'active', 'terminated' )
+					GROUP BY pd.provider_id
+				),
+				info_periods AS (
+					SELECT
+							l.provider_id,
+							( l.info->'peer_info'->'libp2p_protocols' IS NOT NULL AND l.info->'peer_info'->'libp2p_protocols' != '{}' ) AS dialable,
+							l.info_entry_created AS period_start,
+							LEAD( l.info_entry_created, 1, NOW() ) OVER ( PARTITION BY l.provider_id ORDER BY l.info_entry_created ) AS period_end
+						FROM spd.providers_info_log l
+				),
+				dial_stats AS (
+					SELECT
+							ip.provider_id,
+							COALESCE( SUM( EXTRACT( EPOCH FROM ip.period_end - GREATEST( ip.period_start, cutoff.ts ) ) ) FILTER ( WHERE ip.dialable ), 0 ) AS dialable_seconds,
+							COALESCE( SUM( EXTRACT( EPOCH FROM ip.period_end - GREATEST( ip.period_start, cutoff.ts ) ) ) FILTER ( WHERE NOT ip.dialable ), 0 ) AS undialable_seconds
+						FROM info_periods ip, cutoff
+					WHERE
+						ip.period_end > cutoff.ts
+					GROUP BY ip.provider_id
+				),
+				retrieval_stats AS (
+					SELECT
+							rc.provider_id,
+							COUNT(*) FILTER ( WHERE rc.retrieved ) AS retrievals_succeeded,
+							COUNT(*) FILTER ( WHERE NOT rc.retrieved ) AS retrievals_failed
+						FROM spd.retrieval_checks rc, cutoff
+					WHERE
+						rc.entry_created > cutoff.ts
+					GROUP BY rc.provider_id
+				)
+			SELECT
+					p.provider_id,
+					COALESCE( ps.proposals_accepted, 0 ) AS proposals_accepted,
+					COALESCE( ps.proposals_failed, 0 ) AS proposals_failed,
+					ps.median_proposal_msecs,
+					COALESCE( ps.proposals_activated, 0 ) AS proposals_activated,
+					COALESCE( ps.proposals_missed_start, 0 ) AS proposals_missed_start,
+					COALESCE( ds.deals_active, 0 ) AS deals_active,
+					COALESCE( ds.deals_terminated, 0 ) AS deals_terminated,
+					COALESCE( dl.dialable_seconds, 0 )::FLOAT8 AS dialable_seconds,
+					COALESCE( dl.undialable_seconds, 0 )::FLOAT8 AS undialable_seconds,
+					COALESCE( rs.retrievals_succeeded, 0 ) AS retrievals_succeeded,
+					COALESCE( rs.retrievals_failed, 0 ) AS retrievals_failed
+				FROM spd.providers p
+				LEFT JOIN proposal_stats ps USING ( provider_id )
+				LEFT JOIN deal_stats ds USING ( provider_id )
+				LEFT JOIN dial_stats dl USING ( provider_id )
+				LEFT JOIN retrieval_stats rs USING ( provider_id )
+			ORDER BY p.provider_id
+			`,
+			scoreWindowDays,
+		); err != nil {
+			return cmn.WrErr(err)
+		}
+
+		var countScored, countUnscored int64
+		defer func() {
+			log.Infow("summary",
+				"providers", len(hist),
+				"scored", countScored,
+				"unscored", countUnscored,
+			)
+			recordRunMetrics(cctx.Context, "score-providers", t0,
+				app.Metric{Name: "providers_scored", Description: "Amount of providers with enough history to compute an overall score", Value: countScored},
+				app.Metric{Name: "providers_unscored", Description: "Amount of providers without enough history to compute an overall score", Value: countUnscored},
+			)
+		}()
+
+		return db.BeginFunc(ctx, func(tx pgx.Tx) error {
+			for i := range hist {
+				h := &hist[i]
+				components, score := scoreProvider(h, int64(scoreMinSamples))
+				if score == nil {
+					countUnscored++
+				} else {
+					countScored++
+				}
+
+				if _, err := tx.Exec(
+					ctx,
+					`
+					INSERT INTO spd.provider_scores
+						( provider_id, score_computed, provider_score, score_components, score_meta )
+						VALUES ( $1, NOW(), $2, $3, JSONB_BUILD_OBJECT( 'window_days', $4::INTEGER, 'history', $5::JSONB ) )
+					ON CONFLICT ( provider_id ) DO UPDATE SET
+						score_computed = EXCLUDED.score_computed,
+						provider_score = EXCLUDED.provider_score,
+						score_components = EXCLUDED.score_components,
+						score_meta = EXCLUDED.score_meta
+					`,
+					h.ProviderID,
+					score,
+					components,
+					scoreWindowDays,
+					h,
+				); err != nil {
+					return cmn.WrErr(err)
+				}
+			}
+			return nil
+		})
+	},
+}
+
+// scoreProvider derives every component with sufficient history, and their weighted average
+func scoreProvider(h *providerHistory, minSamples int64) (map[string]int16, *int16) {
+	components := make(map[string]int16, len(scoreWeights))
+
+	pct := func(good, bad int64) int16 {
+		return int16(math.Round(100 * float64(good) / float64(good+bad)))
+	}
+
+	if h.ProposalsAccepted+h.ProposalsFailed >= minSamples {
+		components[scoreProposalAcceptance] = pct(h.ProposalsAccepted, h.ProposalsFailed)
+	}
+	if h.MedianProposalMsecs != nil && h.ProposalsAccepted >= minSamples {
+		m := math.Min(math.Max(*h.MedianProposalMsecs, scoreLatencyBestMsecs), scoreLatencyWorstMsecs)
+		components[scoreProposalLatency] = int16(math.Round(100 * (scoreLatencyWorstMsecs - m) / (scoreLatencyWorstMsecs - scoreLatencyBestMsecs)))
+	}
+	if h.ProposalsActivated+h.ProposalsMissedStart >= minSamples {
+		components[scoreActivation] = pct(h.ProposalsActivated, h.ProposalsMissedStart)
+	}
+	if h.DealsActive+h.DealsTerminated >= minSamples {
+		components[scoreRetention] = pct(h.DealsActive, h.DealsTerminated)
+	}
+	if h.RetrievalsSucceeded+h.RetrievalsFailed >= minSamples {
+		components[scoreRetrievability] = pct(h.RetrievalsSucceeded, h.RetrievalsFailed)
+	}
+	// a single poll is plenty to judge dialability by
+	if h.DialableSeconds+h.UndialableSeconds > 0 {
+		components[scoreDialability] = int16(math.Round(100 * h.DialableSeconds / (h.DialableSeconds + h.UndialableSeconds)))
+	}
+
+	// dialability alone says nothing about how an SP handles deals
+	if _, hasDialability := components[scoreDialability]; len(components) == 0 || (len(components) == 1 && hasDialability) {
+		return components, nil
+	}
+
+	var sum, weights float64
+	for name, val := range components {
+		sum += scoreWeights[name] * float64(val)
+		weights += scoreWeights[name]
+	}
+	score := int16(math.Round(sum / weights))
+	return components, &score
+}
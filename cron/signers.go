@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	filaddr "github.com/filecoin-project/go-address"
+	filcrypto "github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	_ "github.com/filecoin-project/lotus/lib/sigs/secp" // register secp256k1 signing for keystore keys
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/xerrors"
+)
+
+// Every client selects how its proposals are signed via spd.clients.client_meta->'signer'.
+// When absent the lotus wallet of the heavy API is used, as it has always been.
+//
+//	{ "type": "lotus" }
+//	{ "type": "keystore", "keyfile": "/path/f1xyz.key", "passphrase_file": "/path/passphrase" }
+//	{ "type": "remote", "url": "https://signer.internal/sign", "tls_cert_file": "...", "tls_key_file": "...", "tls_ca_file": "..." }
+//
+// Only file paths are ever stored in the database, never key material or passphrases.
+const (
+	signerLotus    = "lotus"
+	signerKeystore = "keystore"
+	signerRemote   = "remote"
+)
+
+type signerConfig struct {
+	Type           string `json:"type"`
+	Keyfile        string `json:"keyfile,omitempty"`
+	PassphraseFile string `json:"passphrase_file,omitempty"`
+	URL            string `json:"url,omitempty"`
+	TLSCertFile    string `json:"tls_cert_file,omitempty"`
+	TLSKeyFile     string `json:"tls_key_file,omitempty"`
+	TLSCAFile      string `json:"tls_ca_file,omitempty"`
+}
+
+type proposalSigner interface {
+	Sign(ctx context.Context, client filaddr.Address, msg []byte) (*filcrypto.Signature, error)
+}
+
+func newProposalSigner(client filaddr.Address, cfg *signerConfig) (proposalSigner, error) {
+	if cfg == nil || cfg.Type == "" || cfg.Type == signerLotus {
+		return &lotusSigner{}, nil
+	}
+
+	switch cfg.Type {
+	case signerKeystore:
+		return newKeystoreSigner(client, cfg.Keyfile, cfg.PassphraseFile)
+	case signerRemote:
+		return newRemoteSigner(cfg)
+	default:
+		return nil, xerrors.Errorf("unknown signer type '%s' configured for client %s", cfg.Type, client)
+	}
+}
+
+//
+// lotus: the wallet of the heavy lotus node
+//
+
+type lotusSigner struct{}
+
+func (*lotusSigner) Sign(ctx context.Context, client filaddr.Address, msg []byte) (*filcrypto.Signature, error) {
+	sig, err := app.GetGlobalCtx(ctx).LotusAPI[app.FilHeavy].WalletSign(ctx, client, msg)
+	return sig, cmn.WrErr(err)
+}
+
+//
+// keystore: a local file holding a single private key, encrypted at rest
+//
+
+// the on-disk format of a keystore file, as written by keystore-import
+type keystoreFile struct {
+	Address    string `json:"address"`
+	KeyType    string `json:"key_type"`
+	ScryptN    int    `json:"scrypt_n"`
+	ScryptR    int    `json:"scrypt_r"`
+	ScryptP    int    `json:"scrypt_p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// the key types as named by `lotus wallet export`
+var keyTypeSigTypes = map[string]filcrypto.SigType{
+	"secp256k1": filcrypto.SigTypeSecp256k1,
+	"bls":       filcrypto.SigTypeBLS,
+}
+
+type keystoreSigner struct {
+	sigType filcrypto.SigType
+	privKey []byte
+}
+
+func newKeystoreSigner(client filaddr.Address, keyfile, passphraseFile string) (*keystoreSigner, error) {
+	if keyfile == "" || passphraseFile == "" {
+		return nil, xerrors.Errorf("keystore signer for client %s requires both a keyfile and a passphrase_file", client)
+	}
+
+	raw, err := os.ReadFile(keyfile)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	var kf keystoreFile
+	if err := json.Unmarshal(raw, &kf); err != nil {
+		return nil, xerrors.Errorf("unable to parse keyfile %s: %w", keyfile, err)
+	}
+	if kf.Address != client.String() {
+		return nil, xerrors.Errorf("keyfile %s holds the key of %s, not of client %s", keyfile, kf.Address, client)
+	}
+	sigType, known := keyTypeSigTypes[kf.KeyType]
+	if !known {
+		return nil, xerrors.Errorf("keyfile %s holds a key of unsupported type '%s'", keyfile, kf.KeyType)
+	}
+
+	pass, err := readPassphraseFile(passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := kf.decrypt(pass)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to decrypt keyfile %s: %w", keyfile, err)
+	}
+
+	// ensure what we decrypted is what we are going to sign with
+	if addr, err := keyAddress(sigType, privKey); err != nil {
+		return nil, xerrors.Errorf("unable to use the key in %s: %w", keyfile, err)
+	} else if addr != client {
+		return nil, xerrors.Errorf("keyfile %s decrypts to the key of %s, not of client %s", keyfile, addr, client)
+	}
+
+	return &keystoreSigner{sigType: sigType, privKey: privKey}, nil
+}
+
+func (s *keystoreSigner) Sign(_ context.Context, _ filaddr.Address, msg []byte) (*filcrypto.Signature, error) {
+	sig, err := sigs.Sign(s.sigType, s.privKey, msg)
+	return sig, cmn.WrErr(err)
+}
+
+func (kf *keystoreFile) decrypt(pass []byte) ([]byte, error) {
+	var nonce [24]byte
+	if len(kf.Nonce) != len(nonce) {
+		return nil, xerrors.Errorf("unexpected nonce length %d", len(kf.Nonce))
+	}
+	copy(nonce[:], kf.Nonce)
+
+	secret, err := keystoreSecret(pass, kf.Salt, kf.ScryptN, kf.ScryptR, kf.ScryptP)
+	if err != nil {
+		return nil, err
+	}
+
+	privKey, ok := secretbox.Open(nil, kf.Ciphertext, &nonce, secret)
+	if !ok {
+		return nil, xerrors.New("incorrect passphrase or corrupted keyfile")
+	}
+	return privKey, nil
+}
+
+func keystoreSecret(pass, salt []byte, n, r, p int) (*[32]byte, error) {
+	k, err := scrypt.Key(pass, salt, n, r, p, 32)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	var secret [32]byte
+	copy(secret[:], k)
+	return &secret, nil
+}
+
+func keyAddress(sigType filcrypto.SigType, privKey []byte) (filaddr.Address, error) {
+	pub, err := sigs.ToPublic(sigType, privKey)
+	if err != nil {
+		return filaddr.Undef, cmn.WrErr(err)
+	}
+	if sigType == filcrypto.SigTypeBLS {
+		return filaddr.NewBLSAddress(pub)
+	}
+	return filaddr.NewSecp256k1Address(pub)
+}
+
+func readPassphraseFile(fn string) ([]byte, error) {
+	pass, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	pass = bytes.TrimRight(pass, "\r\n")
+	if len(pass) == 0 {
+		return nil, xerrors.Errorf("passphrase file %s is empty", fn)
+	}
+	return pass, nil
+}
+
+//
+// remote: an HTTP signing service, authenticated via mTLS
+//
+// The service receives a POST with { "address": "f1...", "message": "<base64>" }
+// and must respond with HTTP 200 + { "signature": { "Type": <int>, "Data": "<base64>" } }
+//
+
+type remoteSigner struct {
+	url    string
+	client *http.Client
+}
+
+func newRemoteSigner(cfg *signerConfig) (*remoteSigner, error) {
+	if !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, xerrors.Errorf("remote signer url '%s' must be https://", cfg.URL)
+	}
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		return nil, xerrors.Errorf("remote signer %s requires both a tls_cert_file and a tls_key_file", cfg.URL)
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	tlsCfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if cfg.TLSCAFile != "" {
+		caPem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, cmn.WrErr(err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, xerrors.Errorf("no certificates found in %s", cfg.TLSCAFile)
+		}
+	}
+
+	return &remoteSigner{
+		url: cfg.URL,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		},
+	}, nil
+}
+
+func (s *remoteSigner) Sign(ctx context.Context, client filaddr.Address, msg []byte) (*filcrypto.Signature, error) {
+	body, err := json.Marshal(struct {
+		Address string `json:"address"`
+		Message []byte `json:"message"`
+	}{
+		Address: client.String(),
+		Message: msg,
+	})
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("remote signer %s returned HTTP %d: %s", s.url, resp.StatusCode, respBody)
+	}
+
+	var res struct {
+		Signature *filcrypto.Signature `json:"signature"`
+	}
+	if err := json.Unmarshal(respBody, &res); err != nil {
+		return nil, xerrors.Errorf("unable to parse response of remote signer %s: %w", s.url, err)
+	}
+	if res.Signature == nil || len(res.Signature.Data) == 0 {
+		return nil, xerrors.Errorf("remote signer %s returned no signature", s.url)
+	}
+	if expected := expectedSigType(client); res.Signature.Type != expected {
+		return nil, xerrors.Errorf("remote signer %s returned a signature of type %d, expected %d", s.url, res.Signature.Type, expected)
+	}
+
+	return res.Signature, nil
+}
+
+func expectedSigType(a filaddr.Address) filcrypto.SigType {
+	if a.Protocol() == filaddr.BLS {
+		return filcrypto.SigTypeBLS
+	}
+	return filcrypto.SigTypeSecp256k1
+}
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	filaddr "github.com/filecoin-project/go-address"
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	filmarket "github.com/filecoin-project/go-state-types/builtin/v9/market"
 	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/ribasushi/go-toolbox/cmn"
 	"github.com/ribasushi/go-toolbox/ufcli"
 	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
 )
 
 type signTotals struct {
@@ -18,12 +26,59 @@ type signTotals struct {
 	failed  *int32
 }
 
+type signaturePending struct {
+	ProposalUUID    string
+	ProposalPayload filmarket.DealProposal
+	SignerConfig    *signerConfig
+}
+
+type signatureResult struct {
+	proposalUUID string
+	signature    []byte // JSON-encoded filcrypto.Signature
+	proposalCid  string
+	err          error
+	timedOut     bool
+}
+
+var errSignerTripped = xerrors.New("not attempted: an earlier signature by the same client failed during this run")
+
+var (
+	signWorkers    int
+	signTimeout    int
+	signWriteBatch int
+	signFlushMsecs int
+)
 var signPending = &ufcli.Command{
 	Usage: "Sign pending deal proposals",
 	Name:  "sign-pending",
-	Flags: []ufcli.Flag{},
+	Flags: []ufcli.Flag{
+		&ufcli.IntFlag{
+			Name:        "workers",
+			Usage:       "Amount of signatures to request concurrently",
+			Value:       8,
+			Destination: &signWorkers,
+		},
+		&ufcli.IntFlag{
+			Name:        "signature-timeout",
+			Usage:       "Amount of seconds before abandoning a specific signature request",
+			Value:       20,
+			Destination: &signTimeout,
+		},
+		&ufcli.IntFlag{
+			Name:        "write-batch-size",
+			Usage:       "Maximum amount of signing results written back in a single statement",
+			Value:       256,
+			Destination: &signWriteBatch,
+		},
+		&ufcli.IntFlag{
+			Name:        "write-flush-msecs",
+			Usage:       "Amount of milliseconds after which an incomplete batch of results is written regardless",
+			Value:       500,
+			Destination: &signFlushMsecs,
+		},
+	},
 	Action: func(cctx *ufcli.Context) error {
-		ctx, log, db, gctx := app.UnpackCtx(cctx.Context)
+		ctx, log, db, _ := app.UnpackCtx(cctx.Context)
 
 		totals := signTotals{
 			signed:  new(int32),
@@ -31,17 +86,24 @@ var signPending = &ufcli.Command{
 			timeout: new(int32),
 		}
 		wallets := make(map[filaddr.Address]struct{}, 16)
+		t0 := time.Now()
 		defer func() {
 			log.Infow("summary",
 				"uniqueWallets", len(wallets),
 				"successful", atomic.LoadInt32(totals.signed),
 				"failed", atomic.LoadInt32(totals.failed),
+				"timedout", atomic.LoadInt32(totals.timeout),
+			)
+			recordRunMetrics(cctx.Context, "sign-pending", t0,
+				app.Metric{Name: "unique_wallets", Description: "Amount of distinct client wallets signing during the last run", Value: int64(len(wallets))},
+				app.Metric{Name: "signed_total", Description: "Amount of proposals successfully signed", Type: app.MetricCounter, Value: int64(atomic.LoadInt32(totals.signed))},
+				app.Metric{Name: "failed_total", Description: "Amount of proposals which failed to sign", Type: app.MetricCounter, Value: int64(atomic.LoadInt32(totals.failed))},
+				app.Metric{Name: "timedout_total", Description: "Amount of proposals whose signature request timed out", Type: app.MetricCounter, Value: int64(atomic.LoadInt32(totals.timeout))},
 			)
 		}()
 
-		type signaturePending struct {
-			ProposalUUID    string
-			ProposalPayload filmarket.DealProposal
+		if signWorkers < 1 || signWriteBatch < 1 {
+			return xerrors.New("both --workers and --write-batch-size must be at least 1")
 		}
 
 		pending := make([]signaturePending, 0, 128)
@@ -52,64 +114,285 @@ var signPending = &ufcli.Command{
 			`
 			SELECT
 					pr.proposal_uuid,
-					pr.proposal_meta->'filmarket_proposal' AS proposal_payload
+					pr.proposal_meta->'filmarket_proposal' AS proposal_payload,
+					c.client_meta->'signer' AS signer_config
 				FROM spd.proposals pr
+				JOIN spd.clients c USING ( client_id )
 			WHERE
 				signature_obtained IS NULL
 					AND
 				proposal_failstamp = 0
+			ORDER BY pr.entry_created
 			`,
 		); err != nil {
 			return cmn.WrErr(err)
 		}
+		if len(pending) == 0 {
+			return nil
+		}
 
+		// interleave clients, so that a large burst from one does not starve the rest
+		perClient := make(map[filaddr.Address][]signaturePending, 16)
+		clientOrder := make([]filaddr.Address, 0, 16)
 		for _, p := range pending {
-			wallets[p.ProposalPayload.Client] = struct{}{}
+			client := p.ProposalPayload.Client
+			if _, seen := wallets[client]; !seen {
+				wallets[client] = struct{}{}
+				clientOrder = append(clientOrder, client)
+			}
+			perClient[client] = append(perClient[client], p)
+		}
+		queue := make([]signaturePending, 0, len(pending))
+		for len(queue) < len(pending) {
+			for _, client := range clientOrder {
+				if len(perClient[client]) > 0 {
+					queue = append(queue, perClient[client][0])
+					perClient[client] = perClient[client][1:]
+				}
+			}
+		}
 
-			raw, err := cborutil.Dump(&p.ProposalPayload)
+		// a misconfigured or unreachable signer only holds up the proposals of its own client
+		var signersMu sync.Mutex
+		signers := make(map[filaddr.Address]proposalSigner, len(clientOrder))
+		signerErrs := make(map[filaddr.Address]error, 4)
+		getSigner := func(p signaturePending) (proposalSigner, error) {
+			signersMu.Lock()
+			defer signersMu.Unlock()
+			client := p.ProposalPayload.Client
+			if signerErrs[client] != nil {
+				return nil, errSignerTripped
+			}
+			if s, known := signers[client]; known {
+				return s, nil
+			}
+			s, err := newProposalSigner(client, p.SignerConfig)
 			if err != nil {
-				return cmn.WrErr(err)
+				signerErrs[client] = err
+				return nil, xerrors.Errorf("unable to initialize signer: %w", err)
 			}
+			signers[client] = s
+			return s, nil
+		}
+		tripSigner := func(client filaddr.Address, err error) {
+			signersMu.Lock()
+			if signerErrs[client] == nil {
+				signerErrs[client] = err
+			}
+			signersMu.Unlock()
+		}
 
-			sig, err := gctx.LotusAPI[app.FilHeavy].WalletSign(ctx, p.ProposalPayload.Client, raw)
-			if err != nil {
-				return cmn.WrErr(err)
+		jobs := make(chan signaturePending)
+		results := make(chan signatureResult, signWriteBatch)
+
+		eg, ctx := errgroup.WithContext(ctx)
+
+		eg.Go(func() error {
+			defer close(jobs)
+			for _, p := range queue {
+				select {
+				case <-ctx.Done():
+					return nil // timeout is not an error: the rest is picked up next run
+				case jobs <- p:
+				}
 			}
+			return nil
+		})
 
-			propNode, err := cborutil.AsIpld(&filmarket.ClientDealProposal{
-				Proposal:        p.ProposalPayload,
-				ClientSignature: *sig,
+		var workersWg sync.WaitGroup
+		for i := 0; i < signWorkers; i++ {
+			workersWg.Add(1)
+			eg.Go(func() error {
+				defer workersWg.Done()
+				for p := range jobs {
+					res, err := signProposal(ctx, p, getSigner)
+					if err != nil {
+						return err
+					}
+					if res.err != nil && ctx.Err() == nil && !errors.Is(res.err, errSignerTripped) {
+						log.Errorf("unable to sign proposal %s by client %s: %s", p.ProposalUUID, p.ProposalPayload.Client, res.err)
+						tripSigner(p.ProposalPayload.Client, res.err)
+					}
+					// do not record our own shutdown as a failure
+					if res.err != nil && ctx.Err() != nil {
+						continue
+					}
+					results <- res
+				}
+				return nil
 			})
-			if err != nil {
-				return cmn.WrErr(err)
-			}
+		}
+		go func() {
+			workersWg.Wait()
+			close(results)
+		}()
 
-			if _, err := db.Exec(
-				ctx,
-				`
-				UPDATE spd.proposals SET
-					signature_obtained = NOW(),
-					proposal_meta = JSONB_SET(
-						JSONB_SET(
-							proposal_meta,
-							'{ signature }',
-							$1
-						),
-						'{ signed_proposal_cid }',
-						TO_JSONB( $2::TEXT )
-					)
-				WHERE proposal_uuid = $3
-				`,
-				sig,
-				propNode.Cid().String(),
-				p.ProposalUUID,
-			); err != nil {
-				return cmn.WrErr(err)
+		// the writer keeps draining after an error, so that no worker is left blocked
+		eg.Go(func() error {
+			batch := make([]signatureResult, 0, signWriteBatch)
+			flush := time.NewTicker(time.Duration(signFlushMsecs) * time.Millisecond)
+			defer flush.Stop()
+
+			var writeErr error
+			for {
+				select {
+				case res, open := <-results:
+					if !open {
+						if writeErr == nil {
+							writeErr = writeSignatureResults(db, batch, totals)
+						}
+						return writeErr
+					}
+					batch = append(batch, res)
+					if len(batch) < signWriteBatch {
+						continue
+					}
+				case <-flush.C:
+					if len(batch) == 0 {
+						continue
+					}
+				}
+				if writeErr == nil {
+					writeErr = writeSignatureResults(db, batch, totals)
+				}
+				batch = batch[:0]
 			}
+		})
 
-			atomic.AddInt32(totals.signed, 1)
+		if err := eg.Wait(); err != nil {
+			return err
+		}
+
+		// freshly signed proposals should go out right away
+		if atomic.LoadInt32(totals.signed) > 0 {
+			triggerTask(proposePending.Name)
+			triggerTask(deliverWebhooks.Name)
 		}
 
 		return nil
 	},
 }
+
+// only an error in our own processing is returned: signing failures are reflected in the result
+func signProposal(ctx context.Context, p signaturePending, getSigner func(signaturePending) (proposalSigner, error)) (signatureResult, error) {
+	res := signatureResult{proposalUUID: p.ProposalUUID}
+
+	signer, err := getSigner(p)
+	if err != nil {
+		res.err = err
+		return res, nil
+	}
+
+	raw, err := cborutil.Dump(&p.ProposalPayload)
+	if err != nil {
+		return res, cmn.WrErr(err)
+	}
+
+	sCtx, sCtxCancel := context.WithTimeout(ctx, time.Duration(signTimeout)*time.Second)
+	sig, err := signer.Sign(sCtx, p.ProposalPayload.Client, raw)
+	sCtxCancel()
+	if err != nil {
+		res.err = err
+		res.timedOut = errors.Is(err, context.DeadlineExceeded) || errors.Is(sCtx.Err(), context.DeadlineExceeded)
+		return res, nil
+	}
+
+	propNode, err := cborutil.AsIpld(&filmarket.ClientDealProposal{
+		Proposal:        p.ProposalPayload,
+		ClientSignature: *sig,
+	})
+	if err != nil {
+		return res, cmn.WrErr(err)
+	}
+	if res.signature, err = json.Marshal(sig); err != nil {
+		return res, cmn.WrErr(err)
+	}
+	res.proposalCid = propNode.Cid().String()
+
+	return res, nil
+}
+
+func writeSignatureResults(db *pgxpool.Pool, batch []signatureResult, totals signTotals) error {
+	var signedIDs, signatures, cids, failedIDs, failures []string
+	var timedOut []bool
+	for _, r := range batch {
+		if r.err == nil {
+			signedIDs = append(signedIDs, r.proposalUUID)
+			signatures = append(signatures, string(r.signature))
+			cids = append(cids, r.proposalCid)
+		} else {
+			failedIDs = append(failedIDs, r.proposalUUID)
+			failures = append(failures, r.err.Error())
+			timedOut = append(timedOut, r.timedOut)
+		}
+	}
+
+	if len(signedIDs) > 0 {
+		if _, err := db.Exec(
+			context.Background(), // deliberate: even if outer context is cancelled we still need to write to DB
+			`
+			UPDATE spd.proposals pr SET
+				signature_obtained = NOW(),
+				proposal_meta = JSONB_SET(
+					JSONB_SET(
+						pr.proposal_meta - 'last_signing_error',
+						'{ signature }',
+						s.signature::JSONB
+					),
+					'{ signed_proposal_cid }',
+					TO_JSONB( s.signed_proposal_cid )
+				)
+			FROM UNNEST( $1::UUID[], $2::TEXT[], $3::TEXT[] ) s( proposal_uuid, signature, signed_proposal_cid )
+			WHERE
+				pr.proposal_uuid = s.proposal_uuid
+					AND
+				pr.signature_obtained IS NULL
+			`,
+			signedIDs,
+			signatures,
+			cids,
+		); err != nil {
+			return cmn.WrErr(err)
+		}
+		atomic.AddInt32(totals.signed, int32(len(signedIDs)))
+	}
+
+	// failed signatures are not failstamped: they are retried on the next run, which
+	// is what the operator expects after fixing a wallet or signer configuration
+	if len(failedIDs) > 0 {
+		if _, err := db.Exec(
+			context.Background(), // deliberate: even if outer context is cancelled we still need to write to DB
+			`
+			UPDATE spd.proposals pr SET
+				proposal_meta = JSONB_SET(
+					pr.proposal_meta,
+					'{ last_signing_error }',
+					JSONB_BUILD_OBJECT(
+						'error', s.error,
+						'timed_out', s.timed_out,
+						'at', NOW()
+					)
+				)
+			FROM UNNEST( $1::UUID[], $2::TEXT[], $3::BOOL[] ) s( proposal_uuid, error, timed_out )
+			WHERE
+				pr.proposal_uuid = s.proposal_uuid
+					AND
+				pr.signature_obtained IS NULL
+			`,
+			failedIDs,
+			failures,
+			timedOut,
+		); err != nil {
+			return cmn.WrErr(err)
+		}
+		for _, to := range timedOut {
+			if to {
+				atomic.AddInt32(totals.timeout, 1)
+			} else {
+				atomic.AddInt32(totals.failed, 1)
+			}
+		}
+	}
+
+	return nil
+}
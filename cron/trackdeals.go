@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"math/bits"
 	"strconv"
@@ -11,10 +12,17 @@ import (
 	filabi "github.com/filecoin-project/go-state-types/abi"
 	filbig "github.com/filecoin-project/go-state-types/big"
 	filbuiltin "github.com/filecoin-project/go-state-types/builtin"
+	filprovider "github.com/filecoin-project/go-state-types/builtin/v9/miner"
 	lotusapi "github.com/filecoin-project/lotus/api"
+	lotusbs "github.com/filecoin-project/lotus/blockstore"
+	lotusadt "github.com/filecoin-project/lotus/chain/actors/adt"
+	lotusmarket "github.com/filecoin-project/lotus/chain/actors/builtin/market"
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/ipfs/go-cid"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+	blocks "github.com/ipfs/go-libipfs/blocks"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/ribasushi/go-toolbox-interplanetary/fil"
 	"github.com/ribasushi/go-toolbox/cmn"
 	"github.com/ribasushi/go-toolbox/ufcli"
@@ -22,10 +30,55 @@ import (
 	"golang.org/x/xerrors"
 )
 
+var trackDealsFullResync bool
+
+// stored in spd.global.metadata.market_state: the tipset all of spd.published_deals reflects
+type marketStateCheckpoint struct {
+	Epoch  filabi.ChainEpoch `json:"epoch"`
+	Tipset fil.LotusTSK      `json:"tipset"`
+}
+
+// the DB view of a deal, before the current run
+type filDeal struct {
+	pieceID  int64
+	pieceCid cid.Cid
+	status   string
+}
+
+type deal struct {
+	*lotusapi.MarketDeal
+	dealID            int64
+	pieceID           int64
+	providerID        fil.ActorID
+	clientID          fil.ActorID
+	pieceLog2Size     uint8
+	prevState         *filDeal
+	sectorStart       *filabi.ChainEpoch
+	status            string
+	terminationReason string
+	decodedLabel      *string
+	label             []byte
+	metaJSONB         []byte
+}
+
+// dealChanges is what either tracking mode produces, and what is then applied to the DB
+type dealChanges struct {
+	toUpsert          []*deal
+	toFail            []int64 // no longer part of the market state
+	dealCountsByState map[string]int64
+	uniques           []app.Metric // only known when the entire market state is examined
+}
+
 var trackDeals = &ufcli.Command{
 	Usage: "Track state of fil deals related to known PieceCIDs",
 	Name:  "track-deals",
-	Flags: []ufcli.Flag{},
+	Flags: []ufcli.Flag{
+		&ufcli.BoolFlag{
+			Name:        "full-resync",
+			Usage:       "Diff the entire StateMarketDeals against every known deal, instead of applying only the market actor changes since the last processed tipset",
+			Destination: &trackDealsFullResync,
+		},
+	},
 	Action: func(cctx *ufcli.Context) error {
 		ctx, log, db, gctx := app.UnpackCtx(cctx.Context)
 
@@ -34,18 +87,36 @@ var trackDeals = &ufcli.Command{
 			return cmn.WrErr(err)
 		}
 
-		var stateDeals map[string]*lotusapi.MarketDeal
-		dealQueryDone := make(chan error, 1)
-		go func() {
-			defer close(dealQueryDone)
-			log.Infow("retrieving Market Deals from", "state", curTipset.Key(), "epoch", curTipset.Height(), "wallTime", time.Unix(int64(curTipset.Blocks()[0].Timestamp), 0))
-			stateDeals, err = gctx.LotusAPI[app.FilHeavy].StateMarketDeals(ctx, curTipset.Key())
-			if err != nil {
-				dealQueryDone <- cmn.WrErr(err)
-				return
+		var prevCheckpointJSON []byte
+		if err := db.QueryRow(
+			ctx,
+			`SELECT metadata->'market_state' FROM spd.global`,
+		).Scan(&prevCheckpointJSON); err != nil {
+			return cmn.WrErr(err)
+		}
+		var prevCheckpoint *marketStateCheckpoint
+		if len(prevCheckpointJSON) > 0 && string(prevCheckpointJSON) != "null" {
+			prevCheckpoint = new(marketStateCheckpoint)
+			if err := json.Unmarshal(prevCheckpointJSON, prevCheckpoint); err != nil {
+				return cmn.WrErr(err)
 			}
-			log.Infof("retrieved %s state deal records", humanize.Comma(int64(len(stateDeals))))
-		}()
+			if prevCheckpoint.Tipset.IsEmpty() {
+				prevCheckpoint = nil
+			}
+		}
+
+		incremental := !trackDealsFullResync && prevCheckpoint != nil
+		if incremental && curTipset.Key() == prevCheckpoint.Tipset {
+			log.Infow("market state already processed", "epoch", prevCheckpoint.Epoch)
+			return nil
+		}
+
+		// find out which of the not-yet-final observations are no longer on the canonical chain
+		// before looking at the state: whatever was observed there is reconciled by this run
+		orphanedTipsets, err := orphanedProvisionalTipsets(ctx, curTipset, prevCheckpoint)
+		if err != nil {
+			return err
+		}
 
 		tenantClients := make([]fil.ActorID, 0, 32)
 		if err := pgxscan.Select(
@@ -57,221 +128,80 @@ var trackDeals = &ufcli.Command{
 			return cmn.WrErr(err)
 		}
 
-		tenantClientDatacap := make(map[filaddr.Address]*filbig.Int, len(tenantClients))
+		tenantClientIDs := make([]int64, 0, len(tenantClients))
+		tenantClientDatacap := make(map[fil.ActorID]*filbig.Int, len(tenantClients))
 		for _, c := range tenantClients {
+			tenantClientIDs = append(tenantClientIDs, int64(c))
 			dcap, err := gctx.LotusAPI[app.FilLite].StateVerifiedClientStatus(ctx, c.AsFilAddr(), curTipset.Key())
 			if err != nil {
 				return cmn.WrErr(err)
 			}
-			tenantClientDatacap[c.AsFilAddr()] = dcap
+			tenantClientDatacap[c] = dcap
 		}
 
 		log.Infof("queried datacap for %d clients", len(tenantClientDatacap))
 
-		type filDeal struct {
-			pieceID  int64
-			pieceCid cid.Cid
-			status   string
+		t0 := time.Now()
+		var changes *dealChanges
+		if incremental {
+			changes, err = incrementalDealChanges(ctx, prevCheckpoint, curTipset)
+		} else {
+			changes, err = fullDealChanges(ctx, curTipset)
 		}
-
-		// entries from this list are deleted below as we process the new state
-		initialDbDeals := make(map[int64]filDeal)
-
-		rows, err := db.Query(
-			ctx,
-			`
-			SELECT d.deal_id, d.piece_id, d.piece_cid, d.status
-				FROM spd.published_deals d
-			`,
-		)
 		if err != nil {
-			return cmn.WrErr(err)
-		}
-		defer rows.Close()
-		for rows.Next() {
-			var dID int64
-			var d filDeal
-			var pcidStr string
-
-			if err = rows.Scan(&dID, &d.pieceID, &pcidStr, &d.status); err != nil {
-				return cmn.WrErr(err)
-			}
-			if d.pieceCid, err = cid.Parse(pcidStr); err != nil {
-				return cmn.WrErr(err)
-			}
-			initialDbDeals[dID] = d
-		}
-		rows.Close()
-		if err := rows.Err(); err != nil {
-			return cmn.WrErr(err)
+			return err
 		}
 
-		log.Infof("retrieved %s existing deal records", humanize.Comma(int64(len(initialDbDeals))))
-
-		dealCountsByState := make(map[string]int64, 8)
-		seenPieces := make(map[cid.Cid]struct{}, 1<<20)
-		seenProviders := make(map[filaddr.Address]struct{}, 4096)
-		seenClients := make(map[filaddr.Address]struct{}, 4096)
-
+		var countReverted, countFinalized int64
 		defer func() {
 			log.Infow("summary",
-				"totalDeals", dealCountsByState,
-				"uniquePieces", len(seenPieces),
-				"uniqueProviders", len(seenProviders),
-				"uniqueClients", len(seenClients),
+				"incremental", incremental,
+				"dealChanges", changes.dealCountsByState,
+				"orphanedTipsets", len(orphanedTipsets),
+				"transitionsReverted", countReverted,
+				"transitionsFinalized", countFinalized,
 			)
-		}()
-
-		// wait for finish, blocking
-		if err = <-dealQueryDone; err != nil {
-			return cmn.WrErr(err)
-		}
-
-		type deal struct {
-			*lotusapi.MarketDeal
-			dealID            int64
-			pieceID           int64
-			providerID        fil.ActorID
-			clientID          fil.ActorID
-			pieceLog2Size     uint8
-			prevState         *filDeal
-			sectorStart       *filabi.ChainEpoch
-			status            string
-			terminationReason string
-			decodedLabel      *string
-			label             []byte
-			metaJSONB         []byte
-		}
-
-		toUpsert := make([]*deal, 0, 8<<10)
-
-		for dealIDString, protoDeal := range stateDeals {
-
-			d := deal{
-				MarketDeal: protoDeal,
-				status:     "published", // always begin as "published" adjust accordingly below
-			}
-
-			d.dealID, err = strconv.ParseInt(dealIDString, 10, 64)
-			if err != nil {
-				return cmn.WrErr(err)
-			}
-
-			if kd, known := initialDbDeals[d.dealID]; known {
-				d.prevState = &kd
-				delete(initialDbDeals, d.dealID) // at the end whatever remains is not in SMA list, thus will be marked "terminated"
-			}
-
-			seenPieces[d.Proposal.PieceCID] = struct{}{}
-			seenProviders[d.Proposal.Provider] = struct{}{}
-			seenClients[d.Proposal.Client] = struct{}{}
-
-			if d.State.SlashEpoch != -1 {
-				d.status = "terminated"
-				d.terminationReason = "entered on-chain final-slashed state"
-			} else if d.State.SectorStartEpoch > 0 {
-				d.sectorStart = &d.State.SectorStartEpoch
-				d.status = "active"
-			} else if d.Proposal.StartEpoch+filbuiltin.EpochsInDay < curTipset.Height() { // FIXME replace with DealUpdatesInterval
-				// if things are that late: they are never going to make it
-				d.status = "terminated"
-				d.terminationReason = "containing sector missed expected sealing epoch"
-			}
-
-			// because of how we account for datacap, the in-db value must reflect everything not-yet-activated
-			if dcap, known := tenantClientDatacap[d.Proposal.Client]; known && d.Proposal.VerifiedDeal && d.status == "published" {
-				if dcap == nil {
-					return xerrors.Errorf("client %s does not seem to have datacap yet published fil+ deal %d", d.Proposal.Client, d.dealID)
-				}
-				nv := filbig.Add(*dcap, filbig.NewInt(int64(d.Proposal.PieceSize)))
-				tenantClientDatacap[d.Proposal.Client] = &nv
-			}
-
-			dealCountsByState[d.status]++
-			if d.prevState == nil {
-				if d.status == "terminated" {
-					dealCountsByState["terminatedNewDirect"]++
-				} else if d.status == "active" {
-					dealCountsByState["activeNewDirect"]++
-				} else {
-					dealCountsByState["publishedNew"]++
-				}
-				toUpsert = append(toUpsert, &d)
-			} else if d.status != d.prevState.status {
-				dealCountsByState[d.status+"New"]++
-				toUpsert = append(toUpsert, &d)
-			}
-		}
-
-		// fill in some blanks
-		for _, d := range toUpsert {
-
-			if d.Proposal.Label.IsBytes() {
-				d.label, _ = d.Proposal.Label.ToBytes()
-			} else if d.Proposal.Label.IsString() {
-				ls, _ := d.Proposal.Label.ToString()
-				d.label = []byte(ls)
-			} else {
-				return xerrors.New("this should not happen...")
-			}
-
-			if lc, err := cid.Parse(string(d.label)); err == nil {
-				if s := lc.String(); s != "" {
-					d.decodedLabel = &s
-				}
-			}
-
-			d.metaJSONB, err = json.Marshal(
-				struct {
-					TermReason string `json:"termination_reason,omitempty"`
-				}{TermReason: d.terminationReason},
+			metrics := append([]app.Metric{}, changes.uniques...)
+			metrics = append(metrics,
+				app.Metric{Name: "transitions_reverted", Description: "Provisional deal status transitions reverted by a reorg during the last run", Value: countReverted},
+				app.Metric{Name: "transitions_finalized", Description: "Deal status transitions which reached finality during the last run", Value: countFinalized},
 			)
-			if err != nil {
-				return cmn.WrErr(err)
-			}
-
-			d.clientID, err = fil.ParseActorString(d.Proposal.Client.String())
-			if err != nil {
-				return cmn.WrErr(err)
+			for state, count := range changes.dealCountsByState {
+				metrics = append(metrics, app.Metric{
+					Name:        "deals",
+					Description: "Amount of deals by state, as observed during the last run",
+					Dimensions:  map[string]string{"state": state},
+					Value:       count,
+				})
 			}
-			d.providerID, err = fil.ParseActorString(d.Proposal.Provider.String())
-			if err != nil {
-				return cmn.WrErr(err)
-			}
-
-			if bits.OnesCount64(uint64(d.Proposal.PieceSize)) != 1 {
-				return xerrors.Errorf("deal %d size for is not a power of 2", d.Proposal.PieceSize)
-			}
-			d.pieceLog2Size = uint8(bits.TrailingZeros64(uint64(d.Proposal.PieceSize)))
-		}
+			recordRunMetrics(cctx.Context, "track-deals", t0, metrics...)
+		}()
 
-		toFail := make([]int64, 0, len(initialDbDeals))
-		// whatever remains here is gone from the state entirely
-		for dID, d := range initialDbDeals {
-			dealCountsByState["terminated"]++
-			if d.status != "terminated" {
-				dealCountsByState["terminatedNew"]++
-				toFail = append(toFail, dID)
-			}
+		if err := changes.prepare(); err != nil {
+			return err
 		}
 
 		log.Infof(
 			"about to upsert %s modified deal states, and terminate %s no longer existing deals",
-			humanize.Comma(int64(len(toUpsert))),
-			humanize.Comma(int64(len(toFail))),
+			humanize.Comma(int64(len(changes.toUpsert))),
+			humanize.Comma(int64(len(changes.toFail))),
 		)
 
-		return db.BeginTxFunc(ctx, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		observedTipset := curTipset.Key().String()
 
-			for _, d := range toUpsert {
+		if err := db.BeginTxFunc(ctx, pgx.TxOptions{}, func(tx pgx.Tx) error {
+
+			revertedActivations := make([]int64, 0)
+			for _, d := range changes.toUpsert {
 				if err = tx.QueryRow(
 					ctx,
 					`
 					INSERT INTO spd.published_deals
-						( deal_id, client_id, provider_id, piece_cid, claimed_log2_size, label, decoded_label, is_filplus, status, published_deal_meta, start_epoch, end_epoch, sector_start_epoch )
-						VALUES ( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10::JSONB, $11, $12, $13 )
+						( deal_id, client_id, provider_id, piece_cid, claimed_log2_size, label, decoded_label, is_filplus, status, published_deal_meta, start_epoch, end_epoch, sector_start_epoch, status_is_final )
+						VALUES ( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10::JSONB, $11, $12, $13, false )
 					ON CONFLICT ( deal_id ) DO UPDATE SET
 						status = EXCLUDED.status,
+						status_is_final = false,
 						published_deal_meta = spd.published_deals.published_deal_meta || EXCLUDED.published_deal_meta,
 						sector_start_epoch = COALESCE( EXCLUDED.sector_start_epoch, spd.published_deals.sector_start_epoch )
 					RETURNING piece_id
@@ -293,6 +223,28 @@ var trackDeals = &ufcli.Command{
 					return cmn.WrErr(err)
 				}
 
+				var prevStatus *string
+				if d.prevState != nil {
+					prevStatus = &d.prevState.status
+					if d.prevState.status == "active" && d.status == "published" {
+						revertedActivations = append(revertedActivations, d.dealID)
+					}
+				}
+				if _, err := tx.Exec(
+					ctx,
+					`
+					INSERT INTO spd.published_deal_transitions ( deal_id, prev_status, new_status, observed_epoch, observed_tipset )
+						VALUES ( $1, $2, $3, $4, $5 )
+					`,
+					d.dealID,
+					prevStatus,
+					d.status,
+					curTipset.Height(),
+					observedTipset,
+				); err != nil {
+					return cmn.WrErr(err)
+				}
+
 				if d.status == "active" && (d.prevState == nil || d.prevState.status != "active") {
 					if _, err := tx.Exec(
 						ctx,
@@ -322,31 +274,98 @@ var trackDeals = &ufcli.Command{
 				}
 			}
 
-			// we may have some terminations ( no longer in the market state )
-			if len(toFail) > 0 {
-				if _, err = tx.Exec(
+			// a provisional activation that did not survive a reorg: the proposal is pending once again
+			if len(revertedActivations) > 0 {
+				if _, err := tx.Exec(
 					ctx,
 					`
-					UPDATE spd.published_deals SET
-						status = 'terminated',
-						published_deal_meta = published_deal_meta || '{ "termination_reason":"deal no longer part of market-actor state" }'
+					UPDATE spd.proposals SET
+						activated_deal_id = NULL,
+						proposal_meta = proposal_meta || JSONB_BUILD_OBJECT( 'activation_reverted', JSONB_BUILD_OBJECT( 'deal_id', activated_deal_id, 'epoch', $2::INTEGER ) )
 					WHERE
-						deal_id = ANY ( $1::BIGINT[] )
+						activated_deal_id = ANY ( $1::BIGINT[] )
 							AND
-						status != 'terminated'
+						proposal_failstamp = 0
 					`,
-					toFail,
+					revertedActivations,
+					curTipset.Height(),
 				); err != nil {
 					return cmn.WrErr(err)
 				}
 			}
 
+			// we may have some terminations ( no longer in the market state )
+			if len(changes.toFail) > 0 {
+				n, err := terminateDeals(
+					ctx, tx, curTipset.Height(), observedTipset,
+					"deal no longer part of market-actor state",
+					`deal_id = ANY ( $3::BIGINT[] ) AND status != 'terminated'`,
+					changes.toFail,
+				)
+				if err != nil {
+					return err
+				}
+				changes.dealCountsByState["terminatedNew"] += n
+			}
+
+			// a deal never activated by now is never going to be: the incremental mode does not get to
+			// see these, as nothing changes on chain
+			n, err := terminateDeals(
+				ctx, tx, curTipset.Height(), observedTipset,
+				"containing sector missed expected sealing epoch",
+				`status = 'published' AND start_epoch < $3`,
+				curTipset.Height()-filbuiltin.EpochsInDay, // FIXME replace with DealUpdatesInterval
+			)
+			if err != nil {
+				return err
+			}
+			changes.dealCountsByState["terminatedNew"] += n
+
+			if countReverted, countFinalized, err = reconcileTransitions(ctx, tx, curTipset, orphanedTipsets); err != nil {
+				return err
+			}
+
+			// because of how we account for datacap, the in-db value must reflect everything not-yet-activated
+			pendingDatacap := make(map[fil.ActorID]int64, len(tenantClientDatacap))
+			rows, err := tx.Query(
+				ctx,
+				`
+				SELECT client_id, SUM( 1::BIGINT << claimed_log2_size )
+					FROM spd.published_deals
+				WHERE
+					status = 'published'
+						AND
+					is_filplus
+						AND
+					client_id = ANY ( $1::INTEGER[] )
+				GROUP BY client_id
+				`,
+				tenantClientIDs,
+			)
+			if err != nil {
+				return cmn.WrErr(err)
+			}
+			for rows.Next() {
+				var c, pending int64
+				if err := rows.Scan(&c, &pending); err != nil {
+					rows.Close()
+					return cmn.WrErr(err)
+				}
+				pendingDatacap[fil.ActorID(c)] = pending
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return cmn.WrErr(err)
+			}
+
 			// update datacap
 			for c, d := range tenantClientDatacap {
 				var di *int64
 				if d != nil {
-					v := d.Int64()
+					v := filbig.Add(*d, filbig.NewInt(pendingDatacap[c])).Int64()
 					di = &v
+				} else if pendingDatacap[c] > 0 {
+					return xerrors.Errorf("client %s does not seem to have datacap yet has published fil+ deals", c)
 				}
 				if _, err := tx.Exec(
 					ctx,
@@ -357,13 +376,13 @@ var trackDeals = &ufcli.Command{
 						client_id = $2
 					`,
 					di,
-					fil.MustParseActorString(c.String()),
+					c,
 				); err != nil {
 					return cmn.WrErr(err)
 				}
 			}
 
-			// anything that activated is obviously the correct size
+			// anything that activated is obviously the correct size
 			if _, err := tx.Exec(
 				ctx,
 				`
@@ -448,25 +467,659 @@ var trackDeals = &ufcli.Command{
 				return cmn.WrErr(err)
 			}
 
-			msJ, _ := json.Marshal(struct {
-				Epoch  filabi.ChainEpoch `json:"epoch"`
-				Tipset fil.LotusTSK      `json:"tipset"`
-			}{
+			msJ, _ := json.Marshal(marketStateCheckpoint{
 				Epoch:  curTipset.Height(),
 				Tipset: curTipset.Key(),
 			})
 
-			if _, err := tx.Exec(
+			// an overlapping run already moved the checkpoint: everything above is relative to a
+			// state that is no longer current, do not apply it
+			res, err := tx.Exec(
 				ctx,
 				`
 				UPDATE spd.global SET metadata = JSONB_SET( metadata, '{ market_state }', $1 )
+				WHERE ( metadata->'market_state' ) IS NOT DISTINCT FROM $2::JSONB
 				`,
 				msJ,
-			); err != nil {
+				prevCheckpointJSON,
+			)
+			if err != nil {
 				return cmn.WrErr(err)
 			}
+			if res.RowsAffected() == 0 {
+				return xerrors.New("market state checkpoint was advanced by a concurrent run, discarding the changes of this run")
+			}
+
+			if incremental {
+				// the changes only reflect the transitions, pull the totals from the DB
+				rows, err := tx.Query(ctx, `SELECT status, COUNT(*) FROM spd.published_deals GROUP BY status`)
+				if err != nil {
+					return cmn.WrErr(err)
+				}
+				for rows.Next() {
+					var status string
+					var cnt int64
+					if err := rows.Scan(&status, &cnt); err != nil {
+						rows.Close()
+						return cmn.WrErr(err)
+					}
+					changes.dealCountsByState[status] = cnt
+				}
+				rows.Close()
+				if err := rows.Err(); err != nil {
+					return cmn.WrErr(err)
+				}
+			}
 
 			return refreshMatviews(ctx, tx)
-		})
+		}); err != nil {
+			return err
+		}
+
+		// activations and terminations above may have queued notifications
+		triggerTask(deliverWebhooks.Name)
+		return nil
 	},
 }
+
+// fullDealChanges downloads the entire StateMarketDeals and compares it to every known deal
+func fullDealChanges(ctx context.Context, curTipset *fil.LotusTS) (*dealChanges, error) {
+	_, log, db, gctx := app.UnpackCtx(ctx)
+
+	var stateDeals map[string]*lotusapi.MarketDeal
+	var stateErr error
+	dealQueryDone := make(chan struct{})
+	go func() {
+		defer close(dealQueryDone)
+		log.Infow("retrieving Market Deals from", "state", curTipset.Key(), "epoch", curTipset.Height(), "wallTime", time.Unix(int64(curTipset.Blocks()[0].Timestamp), 0))
+		stateDeals, stateErr = gctx.LotusAPI[app.FilHeavy].StateMarketDeals(ctx, curTipset.Key())
+		if stateErr != nil {
+			return
+		}
+		log.Infof("retrieved %s state deal records", humanize.Comma(int64(len(stateDeals))))
+	}()
+
+	// entries from this list are deleted below as we process the new state
+	initialDbDeals, err := selectKnownDeals(ctx, db, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("retrieved %s existing deal records", humanize.Comma(int64(len(initialDbDeals))))
+
+	// wait for finish, blocking
+	<-dealQueryDone
+	if stateErr != nil {
+		return nil, cmn.WrErr(stateErr)
+	}
+
+	dc := &dealChanges{
+		toUpsert:          make([]*deal, 0, 8<<10),
+		dealCountsByState: make(map[string]int64, 8),
+	}
+	seenPieces := make(map[cid.Cid]struct{}, 1<<20)
+	seenProviders := make(map[filaddr.Address]struct{}, 4096)
+	seenClients := make(map[filaddr.Address]struct{}, 4096)
+
+	for dealIDString, protoDeal := range stateDeals {
+		dID, err := strconv.ParseInt(dealIDString, 10, 64)
+		if err != nil {
+			return nil, cmn.WrErr(err)
+		}
+
+		var prev *filDeal
+		if kd, known := initialDbDeals[dID]; known {
+			prev = &kd
+			delete(initialDbDeals, dID) // at the end whatever remains is not in SMA list, thus will be marked "terminated"
+		}
+
+		seenPieces[protoDeal.Proposal.PieceCID] = struct{}{}
+		seenProviders[protoDeal.Proposal.Provider] = struct{}{}
+		seenClients[protoDeal.Proposal.Client] = struct{}{}
+
+		dc.consider(dID, protoDeal, prev, curTipset.Height())
+	}
+
+	// whatever remains here is gone from the state entirely
+	dc.toFail = make([]int64, 0, len(initialDbDeals))
+	for dID, d := range initialDbDeals {
+		dc.dealCountsByState["terminated"]++
+		if d.status != "terminated" {
+			dc.toFail = append(dc.toFail, dID)
+		}
+	}
+
+	dc.uniques = []app.Metric{
+		{Name: "unique_pieces", Description: "Amount of distinct PieceCIDs within the market state", Value: int64(len(seenPieces))},
+		{Name: "unique_providers", Description: "Amount of distinct providers within the market state", Value: int64(len(seenProviders))},
+		{Name: "unique_clients", Description: "Amount of distinct clients within the market state", Value: int64(len(seenClients))},
+	}
+
+	return dc, nil
+}
+
+// readonlyChainIO is all a lotusbs.NewAPIBlockstore needs for reading state
+type readonlyChainIO struct{ app.ChainReader }
+
+func (readonlyChainIO) ChainPutObj(context.Context, blocks.Block) error {
+	return xerrors.New("the chain blockstore is read-only")
+}
+
+// incrementalDealChanges diffs the market actor state at the checkpoint against the current one.
+// Both the proposal and the state AMTs are structurally shared between tipsets, so the cost is
+// proportional to the amount of changes, not to the size of the market. The state diff subsumes
+// every chain event we care about: publishing adds proposals, activation sets a SectorStartEpoch,
+// slashing sets a SlashEpoch, and expiration/cleanup removes the deal altogether. Unlike a message
+// scan it also covers transitions driven by cron, which are not visible as messages.
+func incrementalDealChanges(ctx context.Context, prev *marketStateCheckpoint, curTipset *fil.LotusTS) (*dealChanges, error) {
+	_, log, db, gctx := app.UnpackCtx(ctx)
+	lAPI := gctx.LotusAPI[app.FilHeavy]
+
+	log.Infow("diffing market actor state", "fromEpoch", prev.Epoch, "toEpoch", curTipset.Height(), "state", curTipset.Key())
+
+	store := lotusadt.WrapStore(ctx, ipldcbor.NewCborStore(lotusbs.NewAPIBlockstore(readonlyChainIO{lAPI})))
+	loadMarket := func(tsk fil.LotusTSK) (lotusmarket.State, error) {
+		act, err := lAPI.StateGetActor(ctx, lotusmarket.Address, tsk)
+		if err != nil {
+			return nil, cmn.WrErr(err)
+		}
+		st, err := lotusmarket.Load(store, act)
+		if err != nil {
+			return nil, cmn.WrErr(err)
+		}
+		return st, nil
+	}
+
+	prevMarket, err := loadMarket(prev.Tipset)
+	if err != nil {
+		return nil, xerrors.Errorf("unable to load market state at checkpoint epoch %d, a --full-resync may be necessary: %w", prev.Epoch, err)
+	}
+	curMarket, err := loadMarket(curTipset.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	prevProps, err := prevMarket.Proposals()
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	curProps, err := curMarket.Proposals()
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	prevStates, err := prevMarket.States()
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	curStates, err := curMarket.States()
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+
+	propChanges, err := lotusmarket.DiffDealProposals(prevProps, curProps)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	stateChanges, err := lotusmarket.DiffDealStates(prevStates, curStates)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+
+	dc := &dealChanges{
+		dealCountsByState: make(map[string]int64, 8),
+		toFail:            make([]int64, 0, len(propChanges.Removed)),
+	}
+
+	touched := make(map[filabi.DealID]*lotusapi.MarketDeal, len(propChanges.Added)+len(stateChanges.Added)+len(stateChanges.Modified))
+	gone := make(map[filabi.DealID]struct{}, len(propChanges.Removed))
+	for _, r := range propChanges.Removed {
+		gone[r.ID] = struct{}{}
+		dc.toFail = append(dc.toFail, int64(r.ID))
+	}
+	for _, a := range propChanges.Added {
+		touched[a.ID] = &lotusapi.MarketDeal{
+			Proposal: a.Proposal,
+			State:    *lotusmarket.EmptyDealState(),
+		}
+	}
+
+	stateUpdate := func(id filabi.DealID, st lotusmarket.DealState) error {
+		if _, isGone := gone[id]; isGone {
+			return nil
+		}
+		md, known := touched[id]
+		if !known {
+			prop, found, err := curProps.Get(id)
+			if err != nil {
+				return cmn.WrErr(err)
+			}
+			if !found {
+				return xerrors.Errorf("market state of deal %d changed, yet its proposal is not part of the state", id)
+			}
+			md = &lotusapi.MarketDeal{Proposal: *prop}
+			touched[id] = md
+		}
+		md.State = st
+		return nil
+	}
+	for _, a := range stateChanges.Added {
+		if err := stateUpdate(a.ID, a.Deal); err != nil {
+			return nil, err
+		}
+	}
+	// a deal state can only disappear without its proposal when the checkpoint was on a fork
+	for _, r := range stateChanges.Removed {
+		if err := stateUpdate(r.ID, *lotusmarket.EmptyDealState()); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range stateChanges.Modified {
+		// the market cron bumps LastUpdatedEpoch of every deal regularly: not a transition
+		if m.From.SectorStartEpoch == m.To.SectorStartEpoch && m.From.SlashEpoch == m.To.SlashEpoch {
+			continue
+		}
+		if err := stateUpdate(m.ID, *m.To); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Infof(
+		"market actor diff: %s proposals added, %s removed, %s deal state transitions",
+		humanize.Comma(int64(len(propChanges.Added))),
+		humanize.Comma(int64(len(propChanges.Removed))),
+		humanize.Comma(int64(len(touched)-len(propChanges.Added))),
+	)
+
+	ids := make([]int64, 0, len(touched))
+	for id := range touched {
+		ids = append(ids, int64(id))
+	}
+	knownDeals, err := selectKnownDeals(ctx, db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	dc.toUpsert = make([]*deal, 0, len(touched))
+	for id, md := range touched {
+		var prev *filDeal
+		if kd, known := knownDeals[int64(id)]; known {
+			prev = &kd
+		}
+		dc.consider(int64(id), md, prev, curTipset.Height())
+	}
+
+	return dc, nil
+}
+
+// selectKnownDeals returns the current DB view of the given deals, or of all deals when dealIDs is nil
+func selectKnownDeals(ctx context.Context, db *pgxpool.Pool, dealIDs []int64) (map[int64]filDeal, error) {
+	known := make(map[int64]filDeal, len(dealIDs))
+
+	rows, err := db.Query(
+		ctx,
+		`
+		SELECT d.deal_id, d.piece_id, d.piece_cid, d.status
+			FROM spd.published_deals d
+		WHERE
+			$1::BIGINT[] IS NULL
+				OR
+			d.deal_id = ANY ( $1::BIGINT[] )
+		`,
+		dealIDs,
+	)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dID int64
+		var d filDeal
+		var pcidStr string
+
+		if err = rows.Scan(&dID, &d.pieceID, &pcidStr, &d.status); err != nil {
+			return nil, cmn.WrErr(err)
+		}
+		if d.pieceCid, err = cid.Parse(pcidStr); err != nil {
+			return nil, cmn.WrErr(err)
+		}
+		known[dID] = d
+	}
+	if err := rows.Err(); err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	return known, nil
+}
+
+// consider classifies a deal as of curEpoch, and queues it for upsert when its status changed
+func (dc *dealChanges) consider(dealID int64, md *lotusapi.MarketDeal, prev *filDeal, curEpoch filabi.ChainEpoch) {
+	d := &deal{
+		MarketDeal: md,
+		dealID:     dealID,
+		prevState:  prev,
+		status:     "published", // always begin as "published" adjust accordingly below
+	}
+
+	if d.State.SlashEpoch != -1 {
+		d.status = "terminated"
+		d.terminationReason = "entered on-chain final-slashed state"
+	} else if d.State.SectorStartEpoch > 0 {
+		d.sectorStart = &d.State.SectorStartEpoch
+		d.status = "active"
+	} else if d.Proposal.StartEpoch+filbuiltin.EpochsInDay < curEpoch { // FIXME replace with DealUpdatesInterval
+		// if things are that late: they are never going to make it
+		d.status = "terminated"
+		d.terminationReason = "containing sector missed expected sealing epoch"
+	}
+
+	dc.dealCountsByState[d.status]++
+	if d.prevState == nil {
+		if d.status == "terminated" {
+			dc.dealCountsByState["terminatedNewDirect"]++
+		} else if d.status == "active" {
+			dc.dealCountsByState["activeNewDirect"]++
+		} else {
+			dc.dealCountsByState["publishedNew"]++
+		}
+		dc.toUpsert = append(dc.toUpsert, d)
+	} else if d.status != d.prevState.status {
+		dc.dealCountsByState[d.status+"New"]++
+		dc.toUpsert = append(dc.toUpsert, d)
+	}
+}
+
+// prepare fills in the blanks of every deal about to be upserted
+func (dc *dealChanges) prepare() error {
+	var err error
+	for _, d := range dc.toUpsert {
+
+		if d.Proposal.Label.IsBytes() {
+			d.label, _ = d.Proposal.Label.ToBytes()
+		} else if d.Proposal.Label.IsString() {
+			ls, _ := d.Proposal.Label.ToString()
+			d.label = []byte(ls)
+		} else {
+			return xerrors.New("this should not happen...")
+		}
+
+		if lc, err := cid.Parse(string(d.label)); err == nil {
+			if s := lc.String(); s != "" {
+				d.decodedLabel = &s
+			}
+		}
+
+		d.metaJSONB, err = json.Marshal(
+			struct {
+				TermReason string `json:"termination_reason,omitempty"`
+			}{TermReason: d.terminationReason},
+		)
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+
+		d.clientID, err = fil.ParseActorString(d.Proposal.Client.String())
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+		d.providerID, err = fil.ParseActorString(d.Proposal.Provider.String())
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+
+		if bits.OnesCount64(uint64(d.Proposal.PieceSize)) != 1 {
+			return xerrors.Errorf("deal %d size for is not a power of 2", d.Proposal.PieceSize)
+		}
+		d.pieceLog2Size = uint8(bits.TrailingZeros64(uint64(d.Proposal.PieceSize)))
+	}
+	return nil
+}
+
+// terminateDeals marks every non-terminated deal matching cond as terminated, and records the
+// corresponding transitions. cond can refer to a single extra argument as $3
+func terminateDeals(ctx context.Context, tx pgx.Tx, epoch filabi.ChainEpoch, tipset, reason, cond string, condArg interface{}) (int64, error) {
+	res, err := tx.Exec(
+		ctx,
+		`
+		WITH
+			prev AS (
+				SELECT deal_id, status
+					FROM spd.published_deals
+				WHERE `+cond+`
+				FOR UPDATE
+			),
+			upd AS (
+				UPDATE spd.published_deals pd SET
+					status = 'terminated',
+					status_is_final = false,
+					published_deal_meta = pd.published_deal_meta || JSONB_BUILD_OBJECT( 'termination_reason', $4::TEXT )
+				FROM prev
+				WHERE
+					pd.deal_id = prev.deal_id
+						AND
+					prev.status != 'terminated'
+				RETURNING pd.deal_id, prev.status AS prev_status
+			)
+		INSERT INTO spd.published_deal_transitions ( deal_id, prev_status, new_status, observed_epoch, observed_tipset )
+			SELECT deal_id, prev_status, 'terminated', $1, $2
+				FROM upd
+		`,
+		epoch,
+		tipset,
+		condArg,
+		reason,
+	)
+	if err != nil {
+		return 0, cmn.WrErr(err)
+	}
+	return res.RowsAffected(), nil
+}
+
+// orphanedProvisionalTipsets returns the tipsets of all provisional transitions ( and of the market
+// state checkpoint ) which are no longer part of the chain leading to curTipset
+func orphanedProvisionalTipsets(ctx context.Context, curTipset *fil.LotusTS, checkpoint *marketStateCheckpoint) ([]string, error) {
+	_, log, db, gctx := app.UnpackCtx(ctx)
+
+	type observation struct {
+		ObservedEpoch  filabi.ChainEpoch
+		ObservedTipset string
+	}
+	obs := make([]observation, 0, 128)
+	if err := pgxscan.Select(
+		ctx,
+		db,
+		&obs,
+		`
+		SELECT DISTINCT observed_epoch, observed_tipset
+			FROM spd.published_deal_transitions
+		WHERE
+			finalized IS NULL
+				AND
+			reverted IS NULL
+		`,
+	); err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	if checkpoint != nil {
+		obs = append(obs, observation{ObservedEpoch: checkpoint.Epoch, ObservedTipset: checkpoint.Tipset.String()})
+	}
+
+	canonical := make(map[filabi.ChainEpoch]string, len(obs))
+	seen := make(map[string]struct{}, len(obs))
+	orphaned := make([]string, 0)
+	for _, o := range obs {
+		if _, dup := seen[o.ObservedTipset]; dup {
+			continue
+		}
+		seen[o.ObservedTipset] = struct{}{}
+
+		// not verifiable yet, the current tipset is behind it
+		if o.ObservedEpoch > curTipset.Height() {
+			continue
+		}
+
+		ck, known := canonical[o.ObservedEpoch]
+		if !known {
+			ts, err := gctx.LotusAPI[app.FilLite].ChainGetTipSetByHeight(ctx, o.ObservedEpoch, curTipset.Key())
+			if err != nil {
+				return nil, cmn.WrErr(err)
+			}
+			ck = ts.Key().String()
+			canonical[o.ObservedEpoch] = ck
+		}
+
+		if ck != o.ObservedTipset {
+			log.Warnw("reorg detected: tipset of provisional observations is no longer canonical", "epoch", o.ObservedEpoch, "orphanedTipset", o.ObservedTipset, "canonicalTipset", ck)
+			orphaned = append(orphaned, o.ObservedTipset)
+		}
+	}
+
+	return orphaned, nil
+}
+
+// reconcileTransitions runs after the current state is applied. A provisional transition observed on
+// an orphaned tipset is either reverted when the canonical state disagrees with it, or re-observed at
+// the current tipset otherwise. Provisional transitions older than ChainFinality become final.
+func reconcileTransitions(ctx context.Context, tx pgx.Tx, curTipset *fil.LotusTS, orphanedTipsets []string) (reverted, finalized int64, err error) {
+	log := app.GetGlobalCtx(ctx).Logger
+
+	touchedDeals := make([]int64, 0)
+
+	if len(orphanedTipsets) > 0 {
+		rows, err := tx.Query(
+			ctx,
+			`
+			UPDATE spd.published_deal_transitions t SET
+				reverted = NOW(),
+				transition_meta = t.transition_meta || JSONB_BUILD_OBJECT(
+					'revert_reason', 'observed tipset no longer canonical',
+					'canonical_status', pd.status,
+					'reverted_at_epoch', $2::INTEGER
+				)
+			FROM spd.published_deals pd
+			WHERE
+				t.finalized IS NULL
+					AND
+				t.reverted IS NULL
+					AND
+				t.observed_tipset = ANY ( $1::TEXT[] )
+					AND
+				pd.deal_id = t.deal_id
+					AND
+				pd.status != t.new_status
+			RETURNING t.deal_id, t.prev_status, t.new_status, t.observed_epoch, pd.status
+			`,
+			orphanedTipsets,
+			curTipset.Height(),
+		)
+		if err != nil {
+			return 0, 0, cmn.WrErr(err)
+		}
+		for rows.Next() {
+			var dealID int64
+			var prevStatus *string
+			var newStatus, canonicalStatus string
+			var epoch int64
+			if err := rows.Scan(&dealID, &prevStatus, &newStatus, &epoch, &canonicalStatus); err != nil {
+				rows.Close()
+				return 0, 0, cmn.WrErr(err)
+			}
+			from := "<new>"
+			if prevStatus != nil {
+				from = *prevStatus
+			}
+			log.Warnw("deal status transition reverted by reorg", "dealID", dealID, "transition", from+" => "+newStatus, "observedEpoch", epoch, "canonicalStatus", canonicalStatus)
+			touchedDeals = append(touchedDeals, dealID)
+			reverted++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, 0, cmn.WrErr(err)
+		}
+
+		// the same transition happened on the canonical chain as well: finality counts from now
+		if _, err := tx.Exec(
+			ctx,
+			`
+			UPDATE spd.published_deal_transitions SET
+				observed_epoch = $2,
+				observed_tipset = $3,
+				transition_meta = transition_meta || JSONB_BUILD_OBJECT( 'orphaned_observed_epoch', observed_epoch )
+			WHERE
+				finalized IS NULL
+					AND
+				reverted IS NULL
+					AND
+				observed_tipset = ANY ( $1::TEXT[] )
+			`,
+			orphanedTipsets,
+			curTipset.Height(),
+			curTipset.Key().String(),
+		); err != nil {
+			return 0, 0, cmn.WrErr(err)
+		}
+	}
+
+	rows, err := tx.Query(
+		ctx,
+		`
+		UPDATE spd.published_deal_transitions SET
+			finalized = NOW()
+		WHERE
+			finalized IS NULL
+				AND
+			reverted IS NULL
+				AND
+			observed_epoch <= $1
+				AND
+			NOT ( observed_tipset = ANY ( $2::TEXT[] ) )
+		RETURNING deal_id
+		`,
+		curTipset.Height()-filprovider.ChainFinality,
+		orphanedTipsets,
+	)
+	if err != nil {
+		return 0, 0, cmn.WrErr(err)
+	}
+	for rows.Next() {
+		var dealID int64
+		if err := rows.Scan(&dealID); err != nil {
+			rows.Close()
+			return 0, 0, cmn.WrErr(err)
+		}
+		touchedDeals = append(touchedDeals, dealID)
+		finalized++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, cmn.WrErr(err)
+	}
+
+	if len(touchedDeals) > 0 {
+		if _, err := tx.Exec(
+			ctx,
+			`
+			UPDATE spd.published_deals pd SET
+				status_is_final = true
+			WHERE
+				NOT pd.status_is_final
+					AND
+				pd.deal_id = ANY ( $1::BIGINT[] )
+					AND
+				NOT EXISTS (
+					SELECT 42
+						FROM spd.published_deal_transitions t
+					WHERE
+						t.deal_id = pd.deal_id
+							AND
+						t.finalized IS NULL
+							AND
+						t.reverted IS NULL
+				)
+			`,
+			touchedDeals,
+		); err != nil {
+			return 0, 0, cmn.WrErr(err)
+		}
+	}
+
+	return reverted, finalized, nil
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/ribasushi/go-toolbox/cmn"
 	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/xerrors"
 )
 
 func refreshMatviews(ctx context.Context, tx pgx.Tx) error {
@@ -32,3 +35,32 @@ func refreshMatviews(ctx context.Context, tx pgx.Tx) error {
 
 	return nil
 }
+
+// recordRunMetrics stores the summary of a task run in spd.metrics, prefixing every metric
+// name with the task name. Failures are only logged, they never fail the task itself.
+func recordRunMetrics(ctx context.Context, task string, t0 time.Time, metrics ...app.Metric) {
+	for i := range metrics {
+		metrics[i].Name = "cron_" + strings.ReplaceAll(task, "-", "_") + "_" + metrics[i].Name
+	}
+	if err := app.RecordMetrics(ctx, time.Since(t0), metrics...); err != nil {
+		app.GetGlobalCtx(ctx).Logger.Warnf("failed to record metrics of %s: %s", task, err)
+	}
+}
+
+// refuseNonPublicAddress is meant for use within net.Dialer.Control, when dialing targets
+// supplied by third parties: the address is already resolved at that point
+func refuseNonPublicAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return xerrors.Errorf("unexpected non-IP dial target '%s'", address)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return xerrors.Errorf("refusing to dial non-public address %s", ip)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package app //nolint:revive
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	filabi "github.com/filecoin-project/go-state-types/abi"
 	filbuiltin "github.com/filecoin-project/go-state-types/builtin"
@@ -11,6 +12,7 @@ import (
 	"github.com/ribasushi/go-toolbox-interplanetary/fil"
 	"github.com/ribasushi/go-toolbox/cmn"
 	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/migrations"
 )
 
 //nolint:revive
@@ -29,14 +31,15 @@ const (
 //nolint:revive
 const (
 	DbMain = dbtype(iota)
+	DbMetrics
 )
 
 type (
 	dbtype        int
 	DbConns       map[dbtype]*pgxpool.Pool //nolint:revive
 	filapitype    int
-	FilAPIs       map[filapitype]*fil.LotusAPIClient //nolint:revive
-	GlobalContext struct {                           //nolint:revive
+	FilAPIs       map[filapitype]FilAPI //nolint:revive
+	GlobalContext struct {              //nolint:revive
 		Db       DbConns
 		LotusAPI FilAPIs
 		Logger   ufcli.Logger
@@ -50,6 +53,12 @@ func GetGlobalCtx(ctx context.Context) GlobalContext { //nolint:revive
 	return ctx.Value(ck).(GlobalContext)
 }
 
+// WithGlobalCtx is what GlobalInit does once all connections are established, exposed for
+// harnesses assembling a GlobalContext of their own
+func WithGlobalCtx(ctx context.Context, gctx GlobalContext) context.Context { //nolint:revive
+	return context.WithValue(ctx, ck, gctx)
+}
+
 func UnpackCtx(ctx context.Context) ( //nolint:revive
 	origCtx context.Context,
 	logger ufcli.Logger,
@@ -63,7 +72,7 @@ func UnpackCtx(ctx context.Context) ( //nolint:revive
 var lotusLookbackEpochs uint
 
 func DefaultLookbackTipset(ctx context.Context) (*fil.LotusTS, error) { //nolint:revive
-	return fil.GetTipset(ctx, GetGlobalCtx(ctx).LotusAPI[FilLite], filabi.ChainEpoch(lotusLookbackEpochs))
+	return GetTipset(ctx, GetGlobalCtx(ctx).LotusAPI[FilLite], filabi.ChainEpoch(lotusLookbackEpochs))
 }
 
 var CommonFlags = []ufcli.Flag{ //nolint:revive
@@ -79,6 +88,10 @@ var CommonFlags = []ufcli.Flag{ //nolint:revive
 		Name:        "lotus-api-heavy-token",
 		DefaultText: "  {{ private, read from config file }}  ",
 	}),
+	ufcli.ConfStringFlag(&ufcli.StringFlag{
+		Name:  "lotus-api-secondary",
+		Usage: "Comma-separated list of additional Filecoin API endpoints, failed over to when both lite and heavy are unavailable",
+	}),
 	&ufcli.UintFlag{
 		Name:  "lotus-lookback-epochs",
 		Value: uint(FilDefaultLookback),
@@ -88,6 +101,11 @@ var CommonFlags = []ufcli.Flag{ //nolint:revive
 		),
 		Destination: &lotusLookbackEpochs,
 	},
+	DbFlags[0],
+	DbFlags[1],
+}
+
+var DbFlags = []ufcli.Flag{ //nolint:revive
 	ufcli.ConfStringFlag(&ufcli.StringFlag{
 		Name:  "pg-connstring",
 		Value: "postgres:///dbname?user=username&password=&host=/var/run/postgresql",
@@ -106,18 +124,92 @@ func GlobalInit(cctx *ufcli.Context, uf *ufcli.UFcli) (func() error, error) { //
 		Db:       make(DbConns, 2),
 	}
 
-	apiL, apiLiteCloser, err := fil.LotusAPIClientV0(cctx.Context, cctx.String("lotus-api-lite"), 30, "")
+	apiClosers := make([]func(), 0, 4)
+	closeAPIs := func() {
+		for _, c := range apiClosers {
+			c()
+		}
+	}
+	connectAPI := func(name, url string, timeoutSecs int, token string) (*FilEndpoint, error) {
+		api, closer, err := fil.LotusAPIClientV0(cctx.Context, url, timeoutSecs, token)
+		if err != nil {
+			return nil, cmn.WrErr(err)
+		}
+		apiClosers = append(apiClosers, closer)
+		return &FilEndpoint{Name: name, API: api}, nil
+	}
+
+	apiL, err := connectAPI("lite", cctx.String("lotus-api-lite"), 30, "")
 	if err != nil {
-		return nil, cmn.WrErr(err)
+		closeAPIs()
+		return nil, err
+	}
+	apiH, err := connectAPI("heavy", cctx.String("lotus-api-heavy"), 300, cctx.String("lotus-api-heavy-token"))
+	if err != nil {
+		closeAPIs()
+		return nil, err
+	}
+	var secondaries []*FilEndpoint
+	for _, url := range strings.Split(cctx.String("lotus-api-secondary"), ",") {
+		if url = strings.TrimSpace(url); url == "" {
+			continue
+		}
+		api, err := connectAPI(url, url, 300, "")
+		if err != nil {
+			closeAPIs()
+			return nil, err
+		}
+		secondaries = append(secondaries, api)
 	}
-	gctx.LotusAPI[FilLite] = apiL
 
-	apiH, apiHeavyCloser, err := fil.LotusAPIClientV0(cctx.Context, cctx.String("lotus-api-heavy"), 300, cctx.String("lotus-api-heavy-token"))
+	// lite calls may fall back to heavy, but never the other way around
+	gctx.LotusAPI[FilLite] = NewFilFailover(uf.Logger, append([]*FilEndpoint{apiL, apiH}, secondaries...)...)
+	gctx.LotusAPI[FilHeavy] = NewFilFailover(uf.Logger, append([]*FilEndpoint{apiH}, secondaries...)...)
+
+	dbCloser, err := connectDbs(cctx, gctx.Db)
 	if err != nil {
-		return nil, cmn.WrErr(err)
+		closeAPIs()
+		return nil, err
+	}
+
+	// never run against a schema we do not understand
+	if err := migrations.CheckSchemaVersion(cctx.Context, gctx.Db[DbMain]); err != nil {
+		dbCloser()
+		closeAPIs()
+		return nil, err
+	}
+
+	cctx.Context = WithGlobalCtx(cctx.Context, gctx)
+
+	return func() error {
+		closeAPIs()
+		dbCloser()
+		return nil
+	}, nil
+}
+
+// GlobalInitDbOnly is the GlobalInit of tooling operating exclusively on the database, regardless of
+// its schema version ( e.g. spade-migrate ): LotusAPI remains empty
+func GlobalInitDbOnly(cctx *ufcli.Context, uf *ufcli.UFcli) (func() error, error) { //nolint:revive
+	gctx := GlobalContext{
+		Logger: uf.Logger,
+		Db:     make(DbConns, 2),
+	}
+
+	dbCloser, err := connectDbs(cctx, gctx.Db)
+	if err != nil {
+		return nil, err
 	}
-	gctx.LotusAPI[FilHeavy] = apiH
 
+	cctx.Context = WithGlobalCtx(cctx.Context, gctx)
+
+	return func() error {
+		dbCloser()
+		return nil
+	}, nil
+}
+
+func connectDbs(cctx *ufcli.Context, dbs DbConns) (func(), error) {
 	dbConnCfg, err := pgxpool.ParseConfig(cctx.String("pg-connstring"))
 	if err != nil {
 		return nil, cmn.WrErr(err)
@@ -129,17 +221,24 @@ func GlobalInit(cctx *ufcli.Context, uf *ufcli.UFcli) (func() error, error) { //
 		// return WrErr(err)
 		return nil
 	}
-	gctx.Db[DbMain], err = pgxpool.ConnectConfig(cctx.Context, dbConnCfg)
+	dbs[DbMain], err = pgxpool.ConnectConfig(cctx.Context, dbConnCfg)
 	if err != nil {
 		return nil, cmn.WrErr(err)
 	}
 
-	cctx.Context = context.WithValue(cctx.Context, ck, gctx)
+	if cctx.String("pg-metrics-connstring") == "" {
+		dbs[DbMetrics] = dbs[DbMain]
+	} else {
+		dbs[DbMetrics], err = pgxpool.Connect(cctx.Context, cctx.String("pg-metrics-connstring"))
+		if err != nil {
+			return nil, cmn.WrErr(err)
+		}
+	}
 
-	return func() error {
-		apiLiteCloser()
-		apiHeavyCloser()
-		gctx.Db[DbMain].Close()
-		return nil
+	return func() {
+		if dbs[DbMetrics] != dbs[DbMain] {
+			dbs[DbMetrics].Close()
+		}
+		dbs[DbMain].Close()
 	}, nil
 }
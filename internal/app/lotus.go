@@ -0,0 +1,337 @@
+package app //nolint:revive
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	filaddr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	filbuiltin "github.com/filecoin-project/go-state-types/builtin"
+	filprovider "github.com/filecoin-project/go-state-types/builtin/v9/miner"
+	filcrypto "github.com/filecoin-project/go-state-types/crypto"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	lotusbuild "github.com/filecoin-project/lotus/build"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/go-cid"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"golang.org/x/xerrors"
+)
+
+// ChainReader is the part of a Filecoin node spade uses to navigate the chain
+type ChainReader interface {
+	ChainHead(context.Context) (*fil.LotusTS, error)
+	ChainGetTipSet(context.Context, fil.LotusTSK) (*fil.LotusTS, error)
+	ChainGetTipSetByHeight(context.Context, filabi.ChainEpoch, fil.LotusTSK) (*fil.LotusTS, error)
+	ChainReadObj(context.Context, cid.Cid) ([]byte, error)
+	ChainHasObj(context.Context, cid.Cid) (bool, error)
+	BeaconGetEntry(context.Context, filabi.ChainEpoch) (*fil.LotusBeaconEntry, error)
+}
+
+// WalletSigner is the part of a Filecoin node spade uses to produce and check signatures
+type WalletSigner interface {
+	WalletSign(context.Context, filaddr.Address, []byte) (*filcrypto.Signature, error)
+	WalletVerify(context.Context, filaddr.Address, []byte, *filcrypto.Signature) (bool, error)
+}
+
+// MarketState is the part of a Filecoin node spade uses to inspect actor state
+type MarketState interface {
+	StateMarketDeals(context.Context, fil.LotusTSK) (map[string]*fil.LotusMarketDeal, error)
+	StateGetActor(context.Context, filaddr.Address, fil.LotusTSK) (*lotustypes.Actor, error)
+	StateMinerInfo(context.Context, filaddr.Address, fil.LotusTSK) (lotusapi.MinerInfo, error)
+	StateAccountKey(context.Context, filaddr.Address, fil.LotusTSK) (filaddr.Address, error)
+	StateVerifiedClientStatus(context.Context, filaddr.Address, fil.LotusTSK) (*filabi.StoragePower, error)
+	StateDealProviderCollateralBounds(context.Context, filabi.PaddedPieceSize, bool, fil.LotusTSK) (lotusapi.DealCollateralBounds, error)
+	MinerGetBaseInfo(context.Context, filaddr.Address, filabi.ChainEpoch, fil.LotusTSK) (*lotusapi.MiningBaseInfo, error)
+}
+
+// FilAPI is everything spade needs from a Filecoin node. The Lotus JSON-RPC client
+// ( *fil.LotusAPIClient ) implements it, as does a FilFailover over several of them.
+type FilAPI interface {
+	ChainReader
+	WalletSigner
+	MarketState
+}
+
+var _ FilAPI = (*fil.LotusAPIClient)(nil)
+
+const (
+	filEndpointCooldown = 30 * time.Second
+	filCacheSize        = 8192
+)
+
+// FilEndpoint is a single node behind a FilFailover
+type FilEndpoint struct {
+	Name string
+	API  FilAPI
+
+	downUntil int64 // unixnano, accessed atomically
+}
+
+// FilFailover is a FilAPI dispatching every call to the first of its endpoints not known to be
+// down, moving on to the next one on connection failures, timeouts and gateway errors. Any other
+// error is a response by the node, and is returned as-is. An endpoint that failed is skipped for
+// a cooldown period, unless every endpoint is down. A chain head lagging walltime counts as a
+// failure of the endpoint.
+//
+// Results which can not change are cached: beacon entries, and anything requested at an
+// explicit tipset.
+type FilFailover struct {
+	Endpoints []*FilEndpoint
+	logger    ufcli.Logger
+
+	lastHeadEpoch int64 // accessed atomically
+	cacheInit     sync.Once
+	cache         *lru.Cache[filCacheKey, interface{}]
+}
+
+type filCacheKey struct {
+	method string
+	addr   filaddr.Address
+	epoch  filabi.ChainEpoch
+	size   filabi.PaddedPieceSize
+	flag   bool
+	tsk    fil.LotusTSK
+}
+
+var _ FilAPI = (*FilFailover)(nil)
+
+// NewFilFailover returns a FilFailover over the given endpoints, tried in order
+func NewFilFailover(logger ufcli.Logger, endpoints ...*FilEndpoint) *FilFailover {
+	return &FilFailover{Endpoints: endpoints, logger: logger}
+}
+
+var errOutOfSync = xerrors.New("lotus API out of sync")
+
+func isFailoverError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false // our own deadline: another endpoint will not fare better
+	}
+	// everything short of a response by the node: connection failures, timeouts, and gateways
+	// in front of the node responding with non-JSON error pages
+	var cliErr *jsonrpc.ErrClient
+	return errors.As(err, &cliErr) ||
+		errors.Is(err, errOutOfSync) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+func failoverCall[T any](ctx context.Context, f *FilFailover, method string, call func(FilAPI) (T, error)) (T, error) {
+	now := time.Now().UnixNano()
+	order := make([]*FilEndpoint, 0, len(f.Endpoints))
+	var down []*FilEndpoint
+	for _, ep := range f.Endpoints {
+		if atomic.LoadInt64(&ep.downUntil) > now {
+			down = append(down, ep)
+		} else {
+			order = append(order, ep)
+		}
+	}
+	order = append(order, down...) // better than nothing
+
+	var firstErr error
+	for i, ep := range order {
+		ret, err := call(ep.API)
+		if err == nil {
+			if atomic.LoadInt64(&ep.downUntil) != 0 {
+				atomic.StoreInt64(&ep.downUntil, 0)
+				if f.logger != nil {
+					f.logger.Infof("filecoin API endpoint %s recovered", ep.Name)
+				}
+			}
+			return ret, nil
+		}
+		if !isFailoverError(ctx, err) {
+			return ret, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		atomic.StoreInt64(&ep.downUntil, time.Now().Add(filEndpointCooldown).UnixNano())
+		if f.logger != nil && i < len(order)-1 {
+			f.logger.Warnf("%s via filecoin API endpoint %s failed, trying %s next: %s", method, ep.Name, order[i+1].Name, err)
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = xerrors.New("no filecoin API endpoints configured")
+	}
+	// the most preferred endpoint is the most relevant one to report on
+	var ret T
+	return ret, firstErr
+}
+
+func cachedCall[T any](ctx context.Context, f *FilFailover, key filCacheKey, call func(FilAPI) (T, error)) (T, error) {
+	f.cacheInit.Do(func() { f.cache, _ = lru.New[filCacheKey, interface{}](filCacheSize) })
+
+	if v, found := f.cache.Get(key); found {
+		return v.(T), nil
+	}
+	ret, err := failoverCall(ctx, f, key.method, call)
+	if err == nil {
+		f.cache.Add(key, ret)
+	}
+	return ret, err
+}
+
+// ChainHead returns the head of the first endpoint that is in sync with walltime
+func (f *FilFailover) ChainHead(ctx context.Context) (*fil.LotusTS, error) {
+	return failoverCall(ctx, f, "ChainHead", func(api FilAPI) (*fil.LotusTS, error) {
+		ts, err := api.ChainHead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkHeadInSync(ts); err != nil {
+			return nil, err
+		}
+		atomic.StoreInt64(&f.lastHeadEpoch, int64(ts.Height()))
+		return ts, nil
+	})
+}
+
+func (f *FilFailover) ChainGetTipSet(ctx context.Context, tsk fil.LotusTSK) (*fil.LotusTS, error) { //nolint:revive
+	call := func(api FilAPI) (*fil.LotusTS, error) { return api.ChainGetTipSet(ctx, tsk) }
+	if tsk == lotustypes.EmptyTSK {
+		return failoverCall(ctx, f, "ChainGetTipSet", call)
+	}
+	return cachedCall(ctx, f, filCacheKey{method: "ChainGetTipSet", tsk: tsk}, call)
+}
+
+// ChainGetTipSetByHeight results are cached when anchored at an explicit tipset, or when the
+// requested height is already final relative to the last observed chain head
+func (f *FilFailover) ChainGetTipSetByHeight(ctx context.Context, e filabi.ChainEpoch, tsk fil.LotusTSK) (*fil.LotusTS, error) {
+	call := func(api FilAPI) (*fil.LotusTS, error) { return api.ChainGetTipSetByHeight(ctx, e, tsk) }
+	if tsk == lotustypes.EmptyTSK {
+		lastHead := filabi.ChainEpoch(atomic.LoadInt64(&f.lastHeadEpoch))
+		if lastHead == 0 || e > lastHead-filprovider.ChainFinality {
+			return failoverCall(ctx, f, "ChainGetTipSetByHeight", call)
+		}
+	}
+	return cachedCall(ctx, f, filCacheKey{method: "ChainGetTipSetByHeight", epoch: e, tsk: tsk}, call)
+}
+
+func (f *FilFailover) ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error) { //nolint:revive
+	return failoverCall(ctx, f, "ChainReadObj", func(api FilAPI) ([]byte, error) { return api.ChainReadObj(ctx, c) })
+}
+
+func (f *FilFailover) ChainHasObj(ctx context.Context, c cid.Cid) (bool, error) { //nolint:revive
+	return failoverCall(ctx, f, "ChainHasObj", func(api FilAPI) (bool, error) { return api.ChainHasObj(ctx, c) })
+}
+
+func (f *FilFailover) BeaconGetEntry(ctx context.Context, e filabi.ChainEpoch) (*fil.LotusBeaconEntry, error) { //nolint:revive
+	return cachedCall(ctx, f, filCacheKey{method: "BeaconGetEntry", epoch: e}, func(api FilAPI) (*fil.LotusBeaconEntry, error) {
+		return api.BeaconGetEntry(ctx, e)
+	})
+}
+
+func (f *FilFailover) WalletSign(ctx context.Context, a filaddr.Address, msg []byte) (*filcrypto.Signature, error) { //nolint:revive
+	return failoverCall(ctx, f, "WalletSign", func(api FilAPI) (*filcrypto.Signature, error) { return api.WalletSign(ctx, a, msg) })
+}
+
+func (f *FilFailover) WalletVerify(ctx context.Context, k filaddr.Address, msg []byte, sig *filcrypto.Signature) (bool, error) { //nolint:revive
+	return failoverCall(ctx, f, "WalletVerify", func(api FilAPI) (bool, error) { return api.WalletVerify(ctx, k, msg, sig) })
+}
+
+func (f *FilFailover) StateMarketDeals(ctx context.Context, tsk fil.LotusTSK) (map[string]*fil.LotusMarketDeal, error) { //nolint:revive
+	// never cached: it is huge
+	return failoverCall(ctx, f, "StateMarketDeals", func(api FilAPI) (map[string]*fil.LotusMarketDeal, error) {
+		return api.StateMarketDeals(ctx, tsk)
+	})
+}
+
+func (f *FilFailover) StateGetActor(ctx context.Context, a filaddr.Address, tsk fil.LotusTSK) (*lotustypes.Actor, error) { //nolint:revive
+	call := func(api FilAPI) (*lotustypes.Actor, error) { return api.StateGetActor(ctx, a, tsk) }
+	if tsk == lotustypes.EmptyTSK {
+		return failoverCall(ctx, f, "StateGetActor", call)
+	}
+	return cachedCall(ctx, f, filCacheKey{method: "StateGetActor", addr: a, tsk: tsk}, call)
+}
+
+func (f *FilFailover) StateMinerInfo(ctx context.Context, a filaddr.Address, tsk fil.LotusTSK) (lotusapi.MinerInfo, error) { //nolint:revive
+	call := func(api FilAPI) (lotusapi.MinerInfo, error) { return api.StateMinerInfo(ctx, a, tsk) }
+	if tsk == lotustypes.EmptyTSK {
+		return failoverCall(ctx, f, "StateMinerInfo", call)
+	}
+	return cachedCall(ctx, f, filCacheKey{method: "StateMinerInfo", addr: a, tsk: tsk}, call)
+}
+
+func (f *FilFailover) StateAccountKey(ctx context.Context, a filaddr.Address, tsk fil.LotusTSK) (filaddr.Address, error) { //nolint:revive
+	call := func(api FilAPI) (filaddr.Address, error) { return api.StateAccountKey(ctx, a, tsk) }
+	if tsk == lotustypes.EmptyTSK {
+		return failoverCall(ctx, f, "StateAccountKey", call)
+	}
+	return cachedCall(ctx, f, filCacheKey{method: "StateAccountKey", addr: a, tsk: tsk}, call)
+}
+
+func (f *FilFailover) StateVerifiedClientStatus(ctx context.Context, a filaddr.Address, tsk fil.LotusTSK) (*filabi.StoragePower, error) { //nolint:revive
+	call := func(api FilAPI) (*filabi.StoragePower, error) { return api.StateVerifiedClientStatus(ctx, a, tsk) }
+	if tsk == lotustypes.EmptyTSK {
+		return failoverCall(ctx, f, "StateVerifiedClientStatus", call)
+	}
+	return cachedCall(ctx, f, filCacheKey{method: "StateVerifiedClientStatus", addr: a, tsk: tsk}, call)
+}
+
+func (f *FilFailover) StateDealProviderCollateralBounds(ctx context.Context, s filabi.PaddedPieceSize, verified bool, tsk fil.LotusTSK) (lotusapi.DealCollateralBounds, error) { //nolint:revive
+	call := func(api FilAPI) (lotusapi.DealCollateralBounds, error) {
+		return api.StateDealProviderCollateralBounds(ctx, s, verified, tsk)
+	}
+	if tsk == lotustypes.EmptyTSK {
+		return failoverCall(ctx, f, "StateDealProviderCollateralBounds", call)
+	}
+	return cachedCall(ctx, f, filCacheKey{method: "StateDealProviderCollateralBounds", size: s, flag: verified, tsk: tsk}, call)
+}
+
+func (f *FilFailover) MinerGetBaseInfo(ctx context.Context, a filaddr.Address, e filabi.ChainEpoch, tsk fil.LotusTSK) (*lotusapi.MiningBaseInfo, error) { //nolint:revive
+	return failoverCall(ctx, f, "MinerGetBaseInfo", func(api FilAPI) (*lotusapi.MiningBaseInfo, error) {
+		return api.MinerGetBaseInfo(ctx, a, e, tsk)
+	})
+}
+
+// same tolerances as fil.GetTipset
+func checkHeadInSync(head *fil.LotusTS) error {
+	wallUnix := time.Now().Unix()
+	filUnix := int64(head.Blocks()[0].Timestamp)
+
+	if wallUnix < filUnix-2 || // allow couple seconds clock-drift tolerance
+		wallUnix > filUnix+int64(
+			lotusbuild.PropagationDelaySecs+(fil.APIMaxTipsetsBehind*filbuiltin.EpochDurationSeconds),
+		) {
+		return xerrors.Errorf(
+			"%w: chainHead reports unixtime %d (height: %d) while walltime is %d (delta: %s)",
+			errOutOfSync,
+			filUnix,
+			head.Height(),
+			wallUnix,
+			time.Second*time.Duration(wallUnix-filUnix),
+		)
+	}
+	return nil
+}
+
+// GetTipset is fil.GetTipset over any ChainReader: the tipset lookback epochs behind the current
+// head, which must be in sync with walltime
+func GetTipset(ctx context.Context, cr ChainReader, lookback filabi.ChainEpoch) (*fil.LotusTS, error) { //nolint:revive
+	latestHead, err := cr.ChainHead(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("failed getting chain head: %w", err)
+	}
+	if err := checkHeadInSync(latestHead); err != nil {
+		return nil, err
+	}
+
+	if lookback == 0 {
+		return latestHead, nil
+	}
+
+	tipsetAtLookback, err := cr.ChainGetTipSetByHeight(ctx, latestHead.Height()-lookback, latestHead.Key())
+	if err != nil {
+		return nil, xerrors.Errorf("determining target tipset %d epochs ago failed: %w", lookback, err)
+	}
+
+	return tipsetAtLookback, nil
+}
@@ -0,0 +1,154 @@
+package app //nolint:revive
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"golang.org/x/xerrors"
+)
+
+//nolint:revive
+const (
+	MetricGauge     = "gauge"
+	MetricCounter   = "counter"
+	MetricHistogram = "histogram" // stored as separate _bucket / _sum / _count rows
+)
+
+// Metric is a single sample destined for spd.metrics
+type Metric struct { //nolint:revive
+	Name        string
+	Description string
+	Type        string
+	Dimensions  map[string]string
+	Value       int64
+}
+
+// RecordMetrics stores a set of samples collected at the same time. Gauges replace the
+// previously stored value, while counters and histogram components are increments: this
+// way multiple processes ( and multiple runs of the same process ) can contribute to the
+// same metric.
+func RecordMetrics(ctx context.Context, took time.Duration, metrics ...Metric) error { //nolint:revive
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	b := new(pgx.Batch)
+	for _, m := range metrics {
+		if m.Type == "" {
+			m.Type = MetricGauge
+		}
+
+		dimKeys := make([]string, 0, len(m.Dimensions))
+		for k := range m.Dimensions {
+			dimKeys = append(dimKeys, k)
+		}
+		sort.Strings(dimKeys)
+		dims := make([][]string, 0, len(dimKeys))
+		for _, k := range dimKeys {
+			dims = append(dims, []string{k, m.Dimensions[k]})
+		}
+
+		b.Queue(
+			`
+			INSERT INTO spd.metrics ( name, dimensions, description, metric_type, value, collection_took_seconds )
+				VALUES ( $1, $2, $3, $4, $5, $6 )
+			ON CONFLICT ( name, dimensions ) DO UPDATE SET
+				description = EXCLUDED.description,
+				metric_type = EXCLUDED.metric_type,
+				value = (
+					CASE WHEN EXCLUDED.metric_type = 'gauge'
+						THEN EXCLUDED.value
+						ELSE COALESCE( spd.metrics.value, 0 ) + EXCLUDED.value
+					END
+				),
+				collected_at = EXCLUDED.collected_at,
+				collection_took_seconds = EXCLUDED.collection_took_seconds
+			`,
+			m.Name,
+			dims,
+			m.Description,
+			m.Type,
+			m.Value,
+			took.Seconds(),
+		)
+	}
+
+	br := GetGlobalCtx(ctx).Db[DbMetrics].SendBatch(ctx, b)
+	for range metrics {
+		if _, err := br.Exec(); err != nil {
+			br.Close() //nolint:errcheck
+			return cmn.WrErr(err)
+		}
+	}
+	return cmn.WrErr(br.Close())
+}
+
+// WriteMetricsExposition renders the entire contents of spd.metrics in the
+// Prometheus text exposition format, with every metric name prefixed by AppName
+func WriteMetricsExposition(ctx context.Context, w io.Writer) error { //nolint:revive
+	rows, err := GetGlobalCtx(ctx).Db[DbMetrics].Query(
+		ctx,
+		`
+		SELECT
+				( CASE WHEN metric_type = 'histogram'
+					THEN REGEXP_REPLACE( name, '_(bucket|sum|count)$', '' )
+					ELSE name
+				END ) AS family,
+				name,
+				dimensions,
+				description,
+				metric_type,
+				value
+			FROM spd.metrics
+		WHERE
+			value IS NOT NULL
+		ORDER BY family, name, dimensions
+		`,
+	)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	defer rows.Close()
+
+	bw := bufio.NewWriter(w)
+	var curFamily string
+	for rows.Next() {
+		var family, name, desc, mType string
+		var dims [][]string
+		var val int64
+		if err := rows.Scan(&family, &name, &dims, &desc, &mType, &val); err != nil {
+			return cmn.WrErr(err)
+		}
+
+		if family != curFamily {
+			curFamily = family
+			fmt.Fprintf(bw, "# HELP %s_%s %s\n", AppName, family, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(desc))
+			fmt.Fprintf(bw, "# TYPE %s_%s %s\n", AppName, family, mType)
+		}
+
+		bw.WriteString(AppName + "_" + name) //nolint:errcheck
+		if len(dims) > 0 {
+			labels := make([]string, 0, len(dims))
+			for _, d := range dims {
+				if len(d) != 2 {
+					return xerrors.Errorf("unexpected dimension %#v of metric %s", d, name)
+				}
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, d[0], strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(d[1])))
+			}
+			bw.WriteString("{" + strings.Join(labels, ",") + "}") //nolint:errcheck
+		}
+		fmt.Fprintf(bw, " %d\n", val)
+	}
+	if err := rows.Err(); err != nil {
+		return cmn.WrErr(err)
+	}
+
+	return cmn.WrErr(bw.Flush())
+}
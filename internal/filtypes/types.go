@@ -12,15 +12,34 @@ import (
 	"github.com/ipfs/go-cid"
 )
 
-//go:generate go run github.com/hannahhoward/cbor-gen-for --map-encoding StorageProposalV12xParams StorageProposalV120Response
+//go:generate go run github.com/hannahhoward/cbor-gen-for --map-encoding StorageProposalV12xParams StorageProposalV12xResponse
 
 //nolint:revive
 const (
 	RetrievalQueryAsk   = "/fil/retrieval/qry/1.0.0"        // use the 1.0 protocol even if we do not care about PCIDs
 	RetrievalTransports = "/fil/retrieval/transports/1.0.0" // this is boost-specific, do not bring extra dependency
 	StorageProposalV120 = "/fil/storage/mk/1.2.0"           // same: boost-specific
+	StorageProposalV121 = "/fil/storage/mk/1.2.1"           // same: boost-specific
 )
 
+// StorageProposalProtocols lists all storage proposal protocols we can speak, most preferred first.
+// All of them share the same StorageProposalV12xParams / StorageProposalV12xResponse wire types.
+var StorageProposalProtocols = []string{
+	StorageProposalV121,
+	StorageProposalV120,
+}
+
+// NegotiateStorageProposalProtocol returns the most preferred storage proposal protocol
+// out of a set of protocols advertised by a provider, or "" if there is no overlap.
+func NegotiateStorageProposalProtocol(advertised map[string]struct{}) string {
+	for _, p := range StorageProposalProtocols {
+		if _, can := advertised[p]; can {
+			return p
+		}
+	}
+	return ""
+}
+
 // StorageProposalV12xParams is an amalgam of
 // https://github.com/filecoin-project/boost/blob/v1.5.0/storagemarket/types/types.go#L80-L84
 // and
@@ -34,8 +53,9 @@ type StorageProposalV12xParams struct {
 	SkipIPNIAnnounce   bool
 }
 
-// StorageProposalV120Response is a copy of https://github.com/filecoin-project/boost/blob/v1.5.0/storagemarket/types/types.go#L142-L147
-type StorageProposalV120Response struct {
+// StorageProposalV12xResponse is a copy of https://github.com/filecoin-project/boost/blob/v1.5.0/storagemarket/types/types.go#L142-L147
+// The response did not change between protocol versions 1.2.0 and 1.2.1
+type StorageProposalV12xResponse struct {
 	Accepted bool
 	// Message is the reason the deal proposal was rejected.
 	// It is empty if the deal was accepted 🤦
@@ -284,7 +284,7 @@ func (t *StorageProposalV12xParams) UnmarshalCBOR(r io.Reader) (err error) {
 
 	return nil
 }
-func (t *StorageProposalV120Response) MarshalCBOR(w io.Writer) error {
+func (t *StorageProposalV12xResponse) MarshalCBOR(w io.Writer) error {
 	if t == nil {
 		_, err := w.Write(cbg.CborNull)
 		return err
@@ -337,8 +337,8 @@ func (t *StorageProposalV120Response) MarshalCBOR(w io.Writer) error {
 	return nil
 }
 
-func (t *StorageProposalV120Response) UnmarshalCBOR(r io.Reader) (err error) {
-	*t = StorageProposalV120Response{}
+func (t *StorageProposalV12xResponse) UnmarshalCBOR(r io.Reader) (err error) {
+	*t = StorageProposalV12xResponse{}
 
 	cr := cbg.NewCborReader(r)
 
@@ -357,7 +357,7 @@ func (t *StorageProposalV120Response) UnmarshalCBOR(r io.Reader) (err error) {
 	}
 
 	if extra > cbg.MaxLength {
-		return fmt.Errorf("StorageProposalV120Response: map struct too large (%d)", extra)
+		return fmt.Errorf("StorageProposalV12xResponse: map struct too large (%d)", extra)
 	}
 
 	var name string
@@ -0,0 +1,161 @@
+// Package migrations carries the ordered, embedded schema migrations applied by spade-migrate,
+// and the schema version check every other binary performs on startup.
+//
+// Every migration is a pair of files sql/NNNN_name.up.sql and sql/NNNN_name.down.sql, with NNNN
+// strictly increasing. A missing .down.sql marks the migration as irreversible. Each file is
+// executed within a single transaction, and must not contain BEGIN/COMMIT or psql meta-commands.
+//
+// The version of the latest applied migration is mirrored into
+// spd.global.metadata->'schema_version'->'minor'. The major version is bumped only when a
+// migration makes the schema incompatible with binaries built before it.
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"golang.org/x/xerrors"
+)
+
+// SchemaMajor is the schema_version.major this tree understands
+const SchemaMajor = 1
+
+//go:embed sql/*.sql
+var sqlFiles embed.FS
+
+// Migration is a single versioned schema change
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string // empty when irreversible
+	Checksum string // of the Up script, recorded in the ledger
+}
+
+var migrationFnRe = regexp.MustCompile(`^([0-9]{4})_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+var (
+	parseOnce sync.Once
+	parsed    []Migration
+	parseErr  error
+)
+
+// All returns every embedded migration, ordered by version
+func All() ([]Migration, error) {
+	parseOnce.Do(func() { parsed, parseErr = parseMigrations() })
+	return parsed, parseErr
+}
+
+// Latest returns the version of the newest embedded migration
+func Latest() int {
+	all, err := All()
+	if err != nil || len(all) == 0 {
+		return 0
+	}
+	return all[len(all)-1].Version
+}
+
+func parseMigrations() ([]Migration, error) {
+	files, err := fs.Glob(sqlFiles, "sql/*.sql")
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+
+	byVersion := make(map[int]*Migration, len(files))
+	for _, fn := range files {
+		m := migrationFnRe.FindStringSubmatch(path.Base(fn))
+		if m == nil {
+			return nil, xerrors.Errorf("unexpected migration filename '%s'", fn)
+		}
+		ver, _ := strconv.Atoi(m[1])
+		if ver < 1 {
+			return nil, xerrors.Errorf("invalid version of migration '%s'", fn)
+		}
+
+		body, err := sqlFiles.ReadFile(fn)
+		if err != nil {
+			return nil, cmn.WrErr(err)
+		}
+
+		mig := byVersion[ver]
+		if mig == nil {
+			mig = &Migration{Version: ver, Name: m[2]}
+			byVersion[ver] = mig
+		} else if mig.Name != m[2] {
+			return nil, xerrors.Errorf("migration %04d has mismatched names '%s' and '%s'", ver, mig.Name, m[2])
+		}
+
+		if m[3] == "up" {
+			mig.Up = string(body)
+			sum := sha256.Sum256(body)
+			mig.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	if len(byVersion) == 0 {
+		return nil, xerrors.New("no embedded migrations found")
+	}
+	all := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, xerrors.Errorf("migration %04d_%s lacks an .up.sql file", mig.Version, mig.Name)
+		}
+		all = append(all, *mig)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+
+	return all, nil
+}
+
+// CheckSchemaVersion refuses a database with a schema this tree does not understand: either a
+// different major version, or a minor version other than the latest embedded migration. A database
+// migrated past what this tree knows about is refused as well: migrations are free to replace
+// functions and add columns an older build relies on not existing.
+func CheckSchemaVersion(ctx context.Context, db *pgxpool.Pool) error {
+	var major, minor *int
+	err := db.QueryRow(
+		ctx,
+		`
+		SELECT
+				( metadata->'schema_version'->'major' )::INTEGER,
+				( metadata->'schema_version'->'minor' )::INTEGER
+			FROM spd.global
+		`,
+	).Scan(&major, &minor)
+	if err == pgx.ErrNoRows || (err == nil && (major == nil || minor == nil)) {
+		return xerrors.New("database schema is not initialized: run `spade-migrate up`")
+	} else if err != nil {
+		return xerrors.Errorf("unable to determine database schema version ( run `spade-migrate up` ): %w", err)
+	}
+
+	all, err := All()
+	if err != nil {
+		return err
+	}
+	latest := all[len(all)-1].Version
+
+	if *major != SchemaMajor {
+		return xerrors.Errorf("database schema version %d.%d is incompatible with this build, which requires major version %d", *major, *minor, SchemaMajor)
+	}
+	if *minor < latest {
+		return xerrors.Errorf("database schema version %d.%d is older than %d.%d required by this build: run `spade-migrate up`", *major, *minor, SchemaMajor, latest)
+	}
+	if *minor > latest {
+		return xerrors.Errorf("database schema version %d.%d is newer than %d.%d known to this build: upgrade this binary", *major, *minor, SchemaMajor, latest)
+	}
+
+	return nil
+}
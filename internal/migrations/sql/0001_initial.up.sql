@@ -1,8 +1,10 @@
--- Currently there is no schema versioning/management
--- This entire script is intended to run against an empty DB as an initialization step
--- It is *SAFE* to run it against a live database with existing data
+-- Initial schema, identical to the final state of the former misc/pg_schema.sql
+-- It is *SAFE* to apply it against a live database initialized by that file:
+-- this is how existing deployments are brought under migration management
 --
---   psql service=XYZ < misc/pg_schema.sql
+--   spade-migrate up
+--
+-- Executed within a single transaction by spade-migrate: no BEGIN/COMMIT here
 --
 
 CREATE SCHEMA IF NOT EXISTS spd;
@@ -74,11 +76,13 @@ CREATE TABLE IF NOT EXISTS spd.metrics (
   name TEXT NOT NULL CONSTRAINT metric_name_lc CHECK ( name ~ '^[a-z0-9_]+$' ),
   dimensions TEXT[][] NOT NULL,
   description TEXT NOT NULL,
+  metric_type TEXT NOT NULL DEFAULT 'gauge' CONSTRAINT metric_valid_type CHECK ( metric_type IN ( 'gauge', 'counter', 'histogram' ) ),
   value BIGINT,
   collected_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CLOCK_TIMESTAMP(),
   collection_took_seconds NUMERIC NOT NULL,
   CONSTRAINT metric_uidx UNIQUE ( name, dimensions )
 );
+ALTER TABLE spd.metrics ADD COLUMN IF NOT EXISTS metric_type TEXT NOT NULL DEFAULT 'gauge' CONSTRAINT metric_valid_type CHECK ( metric_type IN ( 'gauge', 'counter', 'histogram' ) );
 CREATE TABLE IF NOT EXISTS spd.metrics_log (
   name TEXT NOT NULL,
   dimensions TEXT[][] NOT NULL,
@@ -162,6 +166,23 @@ CREATE TABLE IF NOT EXISTS spd.datasets_pieces (
   CONSTRAINT datasets_pieces_singleton UNIQUE ( piece_id, dataset_id )
 );
 
+-- HTTP(S)/S3 locations from which a piece .car can be fetched in its entirety
+-- Entries attached to a dataset must be templates, expanded for every piece within
+-- Recognized placeholders: {pieceCid} {payloadCid}
+CREATE TABLE IF NOT EXISTS spd.sources_http (
+  source_id SERIAL NOT NULL UNIQUE,
+  piece_id BIGINT REFERENCES spd.pieces ( piece_id ) ON UPDATE CASCADE,
+  dataset_id SMALLINT REFERENCES spd.datasets ( dataset_id ) ON UPDATE CASCADE,
+  source_url TEXT NOT NULL CONSTRAINT source_valid_url CHECK ( source_url ~ '^(https?|s3)://[^/]+' ),
+  source_priority SMALLINT NOT NULL DEFAULT 0,
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  source_meta JSONB NOT NULL DEFAULT '{}',
+  CONSTRAINT source_single_scope CHECK ( ( piece_id IS NULL ) != ( dataset_id IS NULL ) ),
+  CONSTRAINT source_dataset_templated CHECK ( dataset_id IS NULL OR source_url ~ '\{(pieceCid|payloadCid)\}' )
+);
+CREATE UNIQUE INDEX IF NOT EXISTS sources_http_piece_singleton ON spd.sources_http ( piece_id, source_url ) WHERE ( piece_id IS NOT NULL );
+CREATE UNIQUE INDEX IF NOT EXISTS sources_http_dataset_singleton ON spd.sources_http ( dataset_id, source_url ) WHERE ( dataset_id IS NOT NULL );
+
 CREATE TABLE IF NOT EXISTS spd.clients (
   client_id INTEGER UNIQUE NOT NULL,
   tenant_id SMALLINT REFERENCES spd.tenants ( tenant_id ) ON UPDATE CASCADE,
@@ -366,6 +387,110 @@ CREATE OR REPLACE TRIGGER trigger_proposal_update_ts
 CREATE INDEX IF NOT EXISTS proposals_piece_idx ON spd.proposals ( piece_id );
 CREATE INDEX IF NOT EXISTS proposals_pending ON spd.proposals ( piece_id, provider_id, client_id ) INCLUDE ( proxied_log2_size ) WHERE ( proposal_failstamp = 0 AND activated_deal_id IS NULL );
 
+-- Endpoints notified on proposal lifecycle transitions, owned by either an SP or a tenant
+CREATE TABLE IF NOT EXISTS spd.webhooks (
+  webhook_id SERIAL NOT NULL UNIQUE,
+  provider_id INTEGER REFERENCES spd.providers ( provider_id ),
+  tenant_id SMALLINT REFERENCES spd.tenants ( tenant_id ) ON UPDATE CASCADE,
+  webhook_url TEXT NOT NULL CONSTRAINT webhook_valid_url CHECK ( webhook_url ~ '^https?://[^/]+' ),
+  webhook_secret TEXT NOT NULL CONSTRAINT webhook_valid_secret CHECK ( LENGTH( webhook_secret ) >= 32 ),
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  entry_last_updated TIMESTAMP WITH TIME ZONE NOT NULL,
+  webhook_meta JSONB NOT NULL DEFAULT '{}',
+  CONSTRAINT webhook_single_owner CHECK ( ( provider_id IS NULL ) != ( tenant_id IS NULL ) )
+);
+CREATE UNIQUE INDEX IF NOT EXISTS webhooks_provider_singleton ON spd.webhooks ( provider_id ) WHERE ( provider_id IS NOT NULL );
+CREATE UNIQUE INDEX IF NOT EXISTS webhooks_tenant_singleton ON spd.webhooks ( tenant_id ) WHERE ( tenant_id IS NOT NULL );
+CREATE OR REPLACE TRIGGER trigger_webhook_update_ts
+  BEFORE INSERT OR UPDATE ON spd.webhooks
+  FOR EACH ROW
+  EXECUTE PROCEDURE spd.update_entry_timestamp()
+;
+
+CREATE TABLE IF NOT EXISTS spd.webhook_deliveries (
+  delivery_id BIGSERIAL NOT NULL UNIQUE,
+  webhook_id INTEGER NOT NULL REFERENCES spd.webhooks ( webhook_id ) ON DELETE CASCADE,
+  proposal_uuid UUID NOT NULL REFERENCES spd.proposals ( proposal_uuid ),
+  event_type TEXT NOT NULL,
+  event_payload JSONB NOT NULL,
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  attempts SMALLINT NOT NULL DEFAULT 0,
+  next_attempt TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  last_attempt TIMESTAMP WITH TIME ZONE,
+  delivered TIMESTAMP WITH TIME ZONE,
+  abandoned TIMESTAMP WITH TIME ZONE,
+  delivery_meta JSONB NOT NULL DEFAULT '{}',
+  CONSTRAINT delivery_single_outcome CHECK ( delivered IS NULL OR abandoned IS NULL )
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending ON spd.webhook_deliveries ( next_attempt ) WHERE ( delivered IS NULL AND abandoned IS NULL );
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON spd.webhook_deliveries ( webhook_id, delivery_id );
+
+CREATE OR REPLACE
+  FUNCTION spd.queue_proposal_events() RETURNS TRIGGER
+    LANGUAGE plpgsql
+AS $$
+DECLARE
+  events TEXT[] := '{}';
+BEGIN
+  IF NEW.signature_obtained IS NOT NULL AND ( TG_OP = 'INSERT' OR OLD.signature_obtained IS NULL ) THEN
+    events := events || 'proposal_signed'::TEXT;
+  END IF;
+  IF NEW.proposal_delivered IS NOT NULL AND ( TG_OP = 'INSERT' OR OLD.proposal_delivered IS NULL ) THEN
+    events := events || 'proposal_delivered'::TEXT;
+  END IF;
+  IF NEW.activated_deal_id IS NOT NULL AND ( TG_OP = 'INSERT' OR OLD.activated_deal_id IS DISTINCT FROM NEW.activated_deal_id ) THEN
+    events := events || 'deal_activated'::TEXT;
+  END IF;
+  IF NEW.proposal_failstamp > 0 AND ( TG_OP = 'INSERT' OR OLD.proposal_failstamp = 0 ) THEN
+    events := events || 'proposal_failed'::TEXT;
+  END IF;
+
+  IF CARDINALITY( events ) = 0 THEN
+    RETURN NULL;
+  END IF;
+
+  INSERT INTO spd.webhook_deliveries ( webhook_id, proposal_uuid, event_type, event_payload )
+    SELECT
+        w.webhook_id,
+        NEW.proposal_uuid,
+        e.event_type,
+        JSONB_STRIP_NULLS( JSONB_BUILD_OBJECT(
+          'event', e.event_type,
+          'event_time', NOW(),
+          'proposal_id', NEW.proposal_uuid,
+          'proposal_cid', NEW.proposal_meta->>'signed_proposal_cid',
+          'provider_id', 'f0' || NEW.provider_id,
+          'tenant_id', c.tenant_id,
+          'tenant_client', 'f0' || NEW.client_id,
+          'piece_cid', p.piece_cid,
+          'piece_size', 1::BIGINT << NEW.proxied_log2_size,
+          'start_epoch', NEW.start_epoch,
+          'end_epoch', NEW.end_epoch,
+          'deal_id', NEW.activated_deal_id,
+          'error', NEW.proposal_meta->>'failure'
+        ) )
+      FROM UNNEST( events ) WITH ORDINALITY AS e ( event_type, seq )
+      JOIN spd.pieces p ON ( p.piece_id = NEW.piece_id )
+      JOIN spd.clients c ON ( c.client_id = NEW.client_id )
+      JOIN spd.webhooks w ON (
+        w.provider_id = NEW.provider_id
+          OR
+        w.tenant_id = c.tenant_id
+      )
+    WHERE
+      NOT COALESCE( ( w.webhook_meta->'inactivated' )::BOOL, false )
+    ORDER BY e.seq, w.webhook_id
+  ;
+
+  RETURN NULL;
+END;
+$$;
+CREATE OR REPLACE TRIGGER trigger_queue_proposal_events
+  AFTER INSERT OR UPDATE ON spd.proposals
+  FOR EACH ROW
+  EXECUTE PROCEDURE spd.queue_proposal_events()
+;
+
 -- Used exclusively for the `FilDAG` portion of a `Sources` response and corresponding availability matview
 CREATE OR REPLACE VIEW spd.known_fildag_deals_ranked AS (
   SELECT
@@ -515,8 +640,6 @@ CREATE OR REPLACE VIEW spd.known_deals_ranked AS (
   ) fin
 );
 
-BEGIN;
-
 DROP FUNCTION IF EXISTS spd.pieces_eligible_head;
 DROP FUNCTION IF EXISTS spd.pieces_eligible_full;
 DROP FUNCTION IF EXISTS spd.piece_realtime_eligibility;
@@ -537,9 +660,6 @@ DROP MATERIALIZED VIEW IF EXISTS spd.mv_replicas_continent;
 DROP MATERIALIZED VIEW IF EXISTS spd.mv_deals_prefiltered_for_repcount;
 DROP MATERIALIZED VIEW IF EXISTS spd.mv_orglocal_presence;
 
-\timing
-;
-
 -- Used exclusively by the 3 functions
 CREATE MATERIALIZED VIEW IF NOT EXISTS spd.mv_pieces_availability WITH ( toast_tuple_target = 8160 ) AS (
   SELECT
@@ -574,7 +694,18 @@ CREATE MATERIALIZED VIEW IF NOT EXISTS spd.mv_pieces_availability WITH ( toast_t
           ) AS coarse_latest_active_end_epoch,
           p.piece_log2_size,
           ( p.piece_log2_size = 36 ) AS requires_64g_sector,
-          false AS http_available,
+          EXISTS (
+            SELECT 42
+              FROM spd.sources_http sh
+            WHERE
+              NOT COALESCE( ( sh.source_meta->'inactivated' )::BOOL, false )
+                AND
+              (
+                sh.piece_id = p.piece_id
+                  OR
+                sh.dataset_id IN ( SELECT dp.dataset_id FROM spd.datasets_pieces dp WHERE dp.piece_id = p.piece_id )
+              )
+          ) AS http_available,
           p.piece_cid,
           p.proposal_label,
           poi.potential_tenant_ids
@@ -2135,5 +2266,3 @@ LANGUAGE sql PARALLEL RESTRICTED STABLE STRICT AS $$
 $$;
 
 -- END SQLGEN
-
-COMMIT;
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS spd.proposals_deliverable;
+
+ALTER TABLE spd.proposals
+  DROP COLUMN IF EXISTS next_delivery_attempt,
+  DROP COLUMN IF EXISTS delivery_attempts
+;
@@ -0,0 +1,9 @@
+-- Transiently failed proposal deliveries are retried with an exponential backoff by propose-pending
+-- Only exhausted or permanent failures result in a proposal_failstamp
+
+ALTER TABLE spd.proposals
+  ADD COLUMN IF NOT EXISTS delivery_attempts SMALLINT NOT NULL DEFAULT 0 CONSTRAINT proposal_valid_delivery_attempts CHECK ( delivery_attempts >= 0 ),
+  ADD COLUMN IF NOT EXISTS next_delivery_attempt TIMESTAMP WITH TIME ZONE
+;
+
+CREATE INDEX IF NOT EXISTS proposals_deliverable ON spd.proposals ( next_delivery_attempt ) WHERE ( proposal_delivered IS NULL AND signature_obtained IS NOT NULL AND proposal_failstamp = 0 );
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS spd.provider_tokens;
@@ -0,0 +1,17 @@
+-- Scoped, expiring bearer tokens minted by an authenticated SP for hosts that must not hold any of its keys
+-- Only the SHA-256 of the token is ever stored, the token itself is returned exactly once at minting time
+
+CREATE TABLE IF NOT EXISTS spd.provider_tokens (
+  token_id UUID NOT NULL UNIQUE DEFAULT gen_random_uuid(),
+  provider_id INTEGER NOT NULL REFERENCES spd.providers ( provider_id ),
+  token_hash BYTEA NOT NULL UNIQUE CONSTRAINT provider_token_valid_hash CHECK ( LENGTH( token_hash ) = 32 ),
+  token_scopes TEXT[] NOT NULL CONSTRAINT provider_token_valid_scopes CHECK ( CARDINALITY( token_scopes ) > 0 ),
+  token_label TEXT,
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  token_expires TIMESTAMP WITH TIME ZONE NOT NULL,
+  token_revoked TIMESTAMP WITH TIME ZONE,
+  token_last_used TIMESTAMP WITH TIME ZONE,
+  token_meta JSONB NOT NULL DEFAULT '{}',
+  CONSTRAINT provider_token_valid_expiry CHECK ( token_expires > entry_created )
+);
+CREATE INDEX IF NOT EXISTS provider_tokens_provider ON spd.provider_tokens ( provider_id );
@@ -0,0 +1,67 @@
+DROP TABLE IF EXISTS spd.published_deal_transitions;
+
+ALTER TABLE spd.published_deals
+  DROP COLUMN IF EXISTS status_is_final
+;
+
+CREATE OR REPLACE
+  FUNCTION spd.queue_proposal_events() RETURNS TRIGGER
+    LANGUAGE plpgsql
+AS $$
+DECLARE
+  events TEXT[] := '{}';
+BEGIN
+  IF NEW.signature_obtained IS NOT NULL AND ( TG_OP = 'INSERT' OR OLD.signature_obtained IS NULL ) THEN
+    events := events || 'proposal_signed'::TEXT;
+  END IF;
+  IF NEW.proposal_delivered IS NOT NULL AND ( TG_OP = 'INSERT' OR OLD.proposal_delivered IS NULL ) THEN
+    events := events || 'proposal_delivered'::TEXT;
+  END IF;
+  IF NEW.activated_deal_id IS NOT NULL AND ( TG_OP = 'INSERT' OR OLD.activated_deal_id IS DISTINCT FROM NEW.activated_deal_id ) THEN
+    events := events || 'deal_activated'::TEXT;
+  END IF;
+  IF NEW.proposal_failstamp > 0 AND ( TG_OP = 'INSERT' OR OLD.proposal_failstamp = 0 ) THEN
+    events := events || 'proposal_failed'::TEXT;
+  END IF;
+
+  IF CARDINALITY( events ) = 0 THEN
+    RETURN NULL;
+  END IF;
+
+  INSERT INTO spd.webhook_deliveries ( webhook_id, proposal_uuid, event_type, event_payload )
+    SELECT
+        w.webhook_id,
+        NEW.proposal_uuid,
+        e.event_type,
+        JSONB_STRIP_NULLS( JSONB_BUILD_OBJECT(
+          'event', e.event_type,
+          'event_time', NOW(),
+          'proposal_id', NEW.proposal_uuid,
+          'proposal_cid', NEW.proposal_meta->>'signed_proposal_cid',
+          'provider_id', 'f0' || NEW.provider_id,
+          'tenant_id', c.tenant_id,
+          'tenant_client', 'f0' || NEW.client_id,
+          'piece_cid', p.piece_cid,
+          'piece_size', 1::BIGINT << NEW.proxied_log2_size,
+          'start_epoch', NEW.start_epoch,
+          'end_epoch', NEW.end_epoch,
+          'deal_id', NEW.activated_deal_id,
+          'error', NEW.proposal_meta->>'failure'
+        ) )
+      FROM UNNEST( events ) WITH ORDINALITY AS e ( event_type, seq )
+      JOIN spd.pieces p ON ( p.piece_id = NEW.piece_id )
+      JOIN spd.clients c ON ( c.client_id = NEW.client_id )
+      JOIN spd.webhooks w ON (
+        w.provider_id = NEW.provider_id
+          OR
+        w.tenant_id = c.tenant_id
+      )
+    WHERE
+      NOT COALESCE( ( w.webhook_meta->'inactivated' )::BOOL, false )
+    ORDER BY e.seq, w.webhook_id
+  ;
+
+  RETURN NULL;
+END;
+$$;
+
@@ -0,0 +1,92 @@
+-- Every deal status change observed by track-deals is logged together with the tipset it was observed at.
+-- Such transitions remain provisional until ChainFinality epochs later, and are reverted if their tipset
+-- disappears from the canonical chain while the canonical state disagrees with them.
+
+CREATE TABLE IF NOT EXISTS spd.published_deal_transitions (
+  transition_id BIGSERIAL NOT NULL UNIQUE,
+  deal_id BIGINT NOT NULL REFERENCES spd.published_deals ( deal_id ),
+  prev_status TEXT,
+  new_status TEXT NOT NULL,
+  observed_epoch INTEGER NOT NULL CONSTRAINT transition_valid_epoch CHECK ( observed_epoch > 0 ),
+  observed_tipset TEXT NOT NULL,
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  finalized TIMESTAMP WITH TIME ZONE,
+  reverted TIMESTAMP WITH TIME ZONE,
+  transition_meta JSONB NOT NULL DEFAULT '{}',
+  CONSTRAINT transition_single_outcome CHECK ( finalized IS NULL OR reverted IS NULL )
+);
+CREATE INDEX IF NOT EXISTS published_deal_transitions_deal_idx ON spd.published_deal_transitions ( deal_id, transition_id );
+CREATE INDEX IF NOT EXISTS published_deal_transitions_provisional ON spd.published_deal_transitions ( observed_epoch, observed_tipset ) WHERE ( finalized IS NULL AND reverted IS NULL );
+
+-- false while the current status rests on at least one provisional transition
+ALTER TABLE spd.published_deals
+  ADD COLUMN IF NOT EXISTS status_is_final BOOL NOT NULL DEFAULT true
+;
+
+-- a provisional activation which did not survive a reorg notifies with deal_activation_reverted
+CREATE OR REPLACE
+  FUNCTION spd.queue_proposal_events() RETURNS TRIGGER
+    LANGUAGE plpgsql
+AS $$
+DECLARE
+  events TEXT[] := '{}';
+  event_deal_id BIGINT := NEW.activated_deal_id;
+BEGIN
+  IF NEW.signature_obtained IS NOT NULL AND ( TG_OP = 'INSERT' OR OLD.signature_obtained IS NULL ) THEN
+    events := events || 'proposal_signed'::TEXT;
+  END IF;
+  IF NEW.proposal_delivered IS NOT NULL AND ( TG_OP = 'INSERT' OR OLD.proposal_delivered IS NULL ) THEN
+    events := events || 'proposal_delivered'::TEXT;
+  END IF;
+  IF NEW.activated_deal_id IS NOT NULL AND ( TG_OP = 'INSERT' OR OLD.activated_deal_id IS DISTINCT FROM NEW.activated_deal_id ) THEN
+    events := events || 'deal_activated'::TEXT;
+  END IF;
+  IF TG_OP = 'UPDATE' AND OLD.activated_deal_id IS NOT NULL AND NEW.activated_deal_id IS NULL AND NEW.proposal_failstamp = 0 THEN
+    events := events || 'deal_activation_reverted'::TEXT;
+    event_deal_id := OLD.activated_deal_id;
+  END IF;
+  IF NEW.proposal_failstamp > 0 AND ( TG_OP = 'INSERT' OR OLD.proposal_failstamp = 0 ) THEN
+    events := events || 'proposal_failed'::TEXT;
+  END IF;
+
+  IF CARDINALITY( events ) = 0 THEN
+    RETURN NULL;
+  END IF;
+
+  INSERT INTO spd.webhook_deliveries ( webhook_id, proposal_uuid, event_type, event_payload )
+    SELECT
+        w.webhook_id,
+        NEW.proposal_uuid,
+        e.event_type,
+        JSONB_STRIP_NULLS( JSONB_BUILD_OBJECT(
+          'event', e.event_type,
+          'event_time', NOW(),
+          'proposal_id', NEW.proposal_uuid,
+          'proposal_cid', NEW.proposal_meta->>'signed_proposal_cid',
+          'provider_id', 'f0' || NEW.provider_id,
+          'tenant_id', c.tenant_id,
+          'tenant_client', 'f0' || NEW.client_id,
+          'piece_cid', p.piece_cid,
+          'piece_size', 1::BIGINT << NEW.proxied_log2_size,
+          'start_epoch', NEW.start_epoch,
+          'end_epoch', NEW.end_epoch,
+          'deal_id', event_deal_id,
+          'error', NEW.proposal_meta->>'failure'
+        ) )
+      FROM UNNEST( events ) WITH ORDINALITY AS e ( event_type, seq )
+      JOIN spd.pieces p ON ( p.piece_id = NEW.piece_id )
+      JOIN spd.clients c ON ( c.client_id = NEW.client_id )
+      JOIN spd.webhooks w ON (
+        w.provider_id = NEW.provider_id
+          OR
+        w.tenant_id = c.tenant_id
+      )
+    WHERE
+      NOT COALESCE( ( w.webhook_meta->'inactivated' )::BOOL, false )
+    ORDER BY e.seq, w.webhook_id
+  ;
+
+  RETURN NULL;
+END;
+$$;
+
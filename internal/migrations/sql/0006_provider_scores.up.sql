@@ -0,0 +1,376 @@
+-- Reliability scores of every provider are periodically recomputed by score-providers from the history
+-- spade already has: proposal acceptance and latency, activation rate, sector terminations and dialability.
+-- Each component and the weighted overall provider_score are in the 0 ~ 100 range, NULL when there is not
+-- enough history to judge. Tenants set minimums in tenant_meta->'min', keyed by the same names: an SP
+-- without enough history for a given component is never held back by it.
+
+CREATE TABLE IF NOT EXISTS spd.provider_scores (
+  provider_id INTEGER UNIQUE NOT NULL REFERENCES spd.providers ( provider_id ),
+  score_computed TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  provider_score SMALLINT CONSTRAINT provider_score_valid CHECK ( provider_score BETWEEN 0 AND 100 ),
+  score_components JSONB NOT NULL DEFAULT '{}',
+  score_meta JSONB NOT NULL DEFAULT '{}'
+);
+
+CREATE OR REPLACE
+  FUNCTION spd.provider_scores_below_min( arg_provider_id INTEGER, arg_tenant_meta JSONB ) RETURNS TEXT[]
+    LANGUAGE sql PARALLEL SAFE STABLE
+AS $$
+  SELECT COALESCE( ARRAY_AGG( m.key ORDER BY m.key ), '{}' )
+    FROM JSONB_EACH( COALESCE( arg_tenant_meta->'min', '{}' ) ) m
+    JOIN spd.provider_scores ps ON ( ps.provider_id = arg_provider_id )
+  WHERE
+    ( ( ps.score_components || JSONB_BUILD_OBJECT( 'provider_score', ps.provider_score ) )->>m.key )::SMALLINT < ( m.value )::SMALLINT
+$$;
+
+DROP FUNCTION IF EXISTS spd.piece_realtime_eligibility( INTEGER, TEXT );
+
+CREATE OR REPLACE
+  FUNCTION spd.piece_realtime_eligibility(
+    arg_calling_provider_id INTEGER,
+    arg_piece_cid TEXT
+  ) RETURNS TABLE (
+
+    piece_id BIGINT,
+    proposal_label TEXT,
+    piece_size_bytes BIGINT,
+
+    tenant_id SMALLINT,
+    client_id_to_use INTEGER,
+    client_address_to_use TEXT,
+    exclusive_replication BOOL,
+
+    deal_duration_days SMALLINT,
+    start_within_hours SMALLINT,
+
+    deal_already_exists BOOL,
+    recently_used_start_epoch INTEGER,
+
+    max_in_flight_bytes BIGINT,
+    cur_in_flight_bytes BIGINT,
+
+    max_total SMALLINT,
+    cur_total SMALLINT,
+
+    max_per_org SMALLINT,
+    cur_in_org SMALLINT,
+
+    max_per_city SMALLINT,
+    cur_in_city SMALLINT,
+
+    max_per_country SMALLINT,
+    cur_in_country SMALLINT,
+
+    max_per_continent SMALLINT,
+    cur_in_continent SMALLINT,
+
+    scores_below_min TEXT[],
+
+    tenant_meta JSONB
+  )
+LANGUAGE sql PARALLEL RESTRICTED STABLE STRICT AS $$
+  WITH
+    ctx AS MATERIALIZED (
+      SELECT
+          p.piece_id,
+          ( 1::BIGINT << p.piece_log2_size ) AS piece_size_bytes,
+          spd.replica_expiration_cutoff_epoch() AS replica_expiration_cutoff_epoch,
+          sp.provider_id,
+          sp.org_id,
+          sp.city_id,
+          sp.country_id,
+          sp.continent_id,
+          p.proposal_label
+        FROM spd.pieces p, spd.providers sp
+      WHERE
+        p.piece_cid = arg_piece_cid
+          AND
+        sp.provider_id = arg_calling_provider_id
+    ),
+    tenant_addresses AS (
+      SELECT DISTINCT ON ( cda.tenant_id )
+          cda.tenant_id,
+          cda.client_id,
+          cda.client_address
+        FROM spd.clients_datacap_available cda, ctx
+      WHERE
+        cda.datacap_available >= ctx.piece_size_bytes
+      ORDER BY cda.tenant_id, cda.datacap_available
+    ),
+    available_tenants AS (
+      SELECT
+          (
+            SELECT SUM( datacap_available )
+              FROM spd.clients_datacap_available cda
+            WHERE cda.tenant_id = t.tenant_id
+          ) AS tenant_datacap_available,
+
+          ta.client_id AS client_id_to_use,
+          ta.client_address AS client_address_to_use,
+
+          COALESCE(
+            (
+              SELECT SUM( 1::BIGINT << pr.proxied_log2_size )
+                FROM ctx, spd.proposals pr
+              WHERE
+                pr.provider_id = ctx.provider_id
+                  AND
+                pr.proposal_failstamp = 0
+                  AND
+                pr.activated_deal_id IS NULL
+                  AND
+                pr.client_id IN ( SELECT client_id FROM spd.clients c WHERE c.tenant_id = t.tenant_id )
+            )::BIGINT,
+            0::BIGINT
+          ) AS cur_in_flight_bytes,
+
+          COALESCE( (tp.tenant_provider_meta->'max_in_flight_GiB')::BIGINT,  (t.tenant_meta->'max'->'default_in_flight_GiB')::BIGINT, 1024 )::BIGINT << 30 AS max_in_flight_bytes,
+
+          t.tenant_id,
+          ( t.tenant_meta->'deal_params'->'duration_days' )::SMALLINT AS deal_duration_days,
+          ( t.tenant_meta->'deal_params'->'start_within_hours' )::SMALLINT AS start_within_hours,
+
+          ( t.tenant_meta->'max'->'total_replicas' )::SMALLINT AS max_total_replicas,
+          ( t.tenant_meta->'max'->'per_org' )::SMALLINT AS max_per_org,
+          ( t.tenant_meta->'max'->'per_city' )::SMALLINT AS max_per_city,
+          ( t.tenant_meta->'max'->'per_country' )::SMALLINT AS max_per_country,
+          ( t.tenant_meta->'max'->'per_continent' )::SMALLINT AS max_per_continent,
+
+          COALESCE( ( t.tenant_meta->'max'->'filplus_exclusive' )::BOOL, false ) AS filplus_exclusive,
+          COALESCE( ( t.tenant_meta->'max'->'tenant_exclusive' )::BOOL, false ) AS tenant_exclusive,
+
+          spd.provider_scores_below_min( ctx.provider_id, t.tenant_meta ) AS scores_below_min,
+
+          t.tenant_meta
+        FROM ctx
+        JOIN spd.tenants_providers tp USING ( provider_id )
+        JOIN spd.tenants t USING ( tenant_id )
+        LEFT JOIN tenant_addresses ta USING ( tenant_id )
+      WHERE
+        NOT COALESCE( ( tp.tenant_provider_meta->'inactivated' )::BOOL, false )
+          AND
+        t.tenant_id IN (
+          SELECT UNNEST( pa.potential_tenant_ids )
+            FROM spd.mv_pieces_availability pa
+          WHERE pa.piece_id = ctx.piece_id
+        )
+    ),
+    eligibility AS MATERIALIZED (
+      SELECT
+          ctx.piece_id,
+          ctx.proposal_label,
+          ctx.piece_size_bytes,
+
+          at.tenant_id,
+          at.tenant_datacap_available,
+          at.client_id_to_use,
+          at.client_address_to_use,
+          at.tenant_exclusive,
+
+          at.deal_duration_days,
+          at.start_within_hours,
+
+          (
+            SELECT MAX( start_epoch )
+              FROM spd.proposals pr
+              JOIN spd.clients c USING ( client_id )
+            WHERE
+              pr.piece_id = ctx.piece_id
+                AND
+              pr.provider_id = ctx.provider_id
+                AND
+              ( at.tenant_id = c.tenant_id OR NOT at.tenant_exclusive )
+          ) AS previous_start_epoch,
+
+          EXISTS (
+            SELECT 42
+              FROM spd.known_deals_ranked kdr
+            WHERE
+              kdr.piece_id = ctx.piece_id
+                AND
+              kdr.provider_id = ctx.provider_id
+                AND
+              kdr.end_epoch >= ctx.replica_expiration_cutoff_epoch
+                AND
+              ( kdr.is_filplus OR NOT at.filplus_exclusive )
+                AND
+              ( at.tenant_id = ANY ( kdr.claimant_ids ) OR NOT at.tenant_exclusive  )
+          ) AS deal_already_exists,
+
+          at.max_in_flight_bytes,
+          at.cur_in_flight_bytes,
+
+          at.max_total_replicas AS max_total,
+          (
+            SELECT COUNT(DISTINCT( kdr.provider_id ))::SMALLINT
+              FROM spd.known_deals_ranked kdr
+            WHERE
+              kdr.piece_id = ctx.piece_id
+                AND
+              kdr.end_epoch >= ctx.replica_expiration_cutoff_epoch
+                AND
+              ( kdr.is_filplus OR NOT at.filplus_exclusive )
+                AND
+              ( at.tenant_id = ANY ( kdr.claimant_ids ) OR NOT at.tenant_exclusive )
+          ) AS cur_total,
+
+          -- next 4 are generated from a template
+          /*
+
+          perl -E '
+            @spatial_types = qw( org city country continent );
+            say join "\n",
+
+            ( map { "
+          at.max_per_${_},
+          (
+            SELECT COUNT(DISTINCT( kdr.provider_id ))::SMALLINT
+              FROM spd.known_deals_ranked kdr, spd.providers p
+            WHERE
+              kdr.piece_id = ctx.piece_id
+                AND
+              kdr.end_epoch >= ctx.replica_expiration_cutoff_epoch
+                AND
+              kdr.provider_id = p.provider_id
+                AND
+              p.${_}_id = ctx.${_}_id
+                AND
+              ( kdr.is_filplus OR NOT at.filplus_exclusive )
+                AND
+              ( at.tenant_id = ANY ( kdr.claimant_ids ) OR NOT at.tenant_exclusive  )
+          ) AS cur_in_${_}," }
+            @spatial_types )
+
+          ' | pbcopy
+
+          */
+
+          -- BEGIN SQLGEN
+
+          at.max_per_org,
+          (
+            SELECT COUNT(DISTINCT( kdr.provider_id ))::SMALLINT
+              FROM spd.known_deals_ranked kdr, spd.providers p
+            WHERE
+              kdr.piece_id = ctx.piece_id
+                AND
+              kdr.end_epoch >= ctx.replica_expiration_cutoff_epoch
+                AND
+              kdr.provider_id = p.provider_id
+                AND
+              p.org_id = ctx.org_id
+                AND
+              ( kdr.is_filplus OR NOT at.filplus_exclusive )
+                AND
+              ( at.tenant_id = ANY ( kdr.claimant_ids ) OR NOT at.tenant_exclusive  )
+          ) AS cur_in_org,
+
+          at.max_per_city,
+          (
+            SELECT COUNT(DISTINCT( kdr.provider_id ))::SMALLINT
+              FROM spd.known_deals_ranked kdr, spd.providers p
+            WHERE
+              kdr.piece_id = ctx.piece_id
+                AND
+              kdr.end_epoch >= ctx.replica_expiration_cutoff_epoch
+                AND
+              kdr.provider_id = p.provider_id
+                AND
+              p.city_id = ctx.city_id
+                AND
+              ( kdr.is_filplus OR NOT at.filplus_exclusive )
+                AND
+              ( at.tenant_id = ANY ( kdr.claimant_ids ) OR NOT at.tenant_exclusive  )
+          ) AS cur_in_city,
+
+          at.max_per_country,
+          (
+            SELECT COUNT(DISTINCT( kdr.provider_id ))::SMALLINT
+              FROM spd.known_deals_ranked kdr, spd.providers p
+            WHERE
+              kdr.piece_id = ctx.piece_id
+                AND
+              kdr.end_epoch >= ctx.replica_expiration_cutoff_epoch
+                AND
+              kdr.provider_id = p.provider_id
+                AND
+              p.country_id = ctx.country_id
+                AND
+              ( kdr.is_filplus OR NOT at.filplus_exclusive )
+                AND
+              ( at.tenant_id = ANY ( kdr.claimant_ids ) OR NOT at.tenant_exclusive  )
+          ) AS cur_in_country,
+
+          at.max_per_continent,
+          (
+            SELECT COUNT(DISTINCT( kdr.provider_id ))::SMALLINT
+              FROM spd.known_deals_ranked kdr, spd.providers p
+            WHERE
+              kdr.piece_id = ctx.piece_id
+                AND
+              kdr.end_epoch >= ctx.replica_expiration_cutoff_epoch
+                AND
+              kdr.provider_id = p.provider_id
+                AND
+              p.continent_id = ctx.continent_id
+                AND
+              ( kdr.is_filplus OR NOT at.filplus_exclusive )
+                AND
+              ( at.tenant_id = ANY ( kdr.claimant_ids ) OR NOT at.tenant_exclusive  )
+          ) AS cur_in_continent,
+          -- END SQLGEN
+
+          at.scores_below_min,
+
+          at.tenant_meta
+
+        FROM ctx, available_tenants at
+
+    )
+  SELECT
+      piece_id,
+      proposal_label,
+      piece_size_bytes,
+      tenant_id,
+      client_id_to_use,
+      client_address_to_use,
+      tenant_exclusive,
+      deal_duration_days, start_within_hours,
+      deal_already_exists,
+      CASE WHEN previous_start_epoch > spd.proposal_deduplication_recent_cutoff_epoch()
+        THEN previous_start_epoch
+        ELSE NULL::INTEGER
+      END AS recently_used_start_epoch,
+      max_in_flight_bytes, cur_in_flight_bytes,
+      max_total, cur_total,
+      max_per_org, cur_in_org,
+      max_per_city, cur_in_city,
+      max_per_country, cur_in_country,
+      max_per_continent, cur_in_continent,
+      scores_below_min,
+      tenant_meta JSONB
+    FROM eligibility
+  ORDER BY
+    -- eligible 1st
+    (
+      NOT deal_already_exists
+        AND
+      client_id_to_use IS NOT NULL
+        AND
+      cur_in_flight_bytes < max_in_flight_bytes
+        AND
+      cur_total < max_total
+        AND
+      cur_in_org < max_per_org
+        AND
+      cur_in_city < max_per_city
+        AND
+      cur_in_country < max_per_country
+        AND
+      cur_in_continent < max_per_continent
+        AND
+      CARDINALITY( scores_below_min ) = 0
+    ) DESC,
+    tenant_exclusive DESC, -- exclusive 1st
+    tenant_datacap_available DESC
+$$;
@@ -0,0 +1,17 @@
+-- Outcomes of check-retrievals: a sample of every provider's active deals is periodically retrieved
+-- over the transports the provider advertises. retrieved is NULL when none of the advertised transports
+-- is one the checker speaks, such a check is recorded but does not count for or against the provider.
+-- The outcomes feed the retrievability component of spd.provider_scores.
+
+CREATE TABLE IF NOT EXISTS spd.retrieval_checks (
+  check_id BIGSERIAL NOT NULL UNIQUE,
+  provider_id INTEGER NOT NULL REFERENCES spd.providers ( provider_id ),
+  deal_id BIGINT NOT NULL REFERENCES spd.published_deals ( deal_id ),
+  transport TEXT NOT NULL,
+  entry_created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  retrieved BOOL,
+  took_msecs INTEGER,
+  bytes_received BIGINT,
+  check_meta JSONB NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS retrieval_checks_provider ON spd.retrieval_checks ( provider_id, entry_created );
@@ -0,0 +1,431 @@
+DROP FUNCTION IF EXISTS spd.pieces_eligible_head( INTEGER, INTEGER, SMALLINT, BOOL, BOOL, BOOL, BOOL, BOOL, INTEGER, TEXT );
+DROP FUNCTION IF EXISTS spd.pieces_eligible_full( INTEGER, INTEGER, SMALLINT, BOOL, BOOL, BOOL, BOOL, BOOL, INTEGER, TEXT );
+
+CREATE OR REPLACE
+  FUNCTION spd.pieces_eligible_head(
+    arg_calling_provider_id INTEGER,
+    arg_limit INTEGER,
+    arg_only_tenant_id SMALLINT, -- use 0 for ~any~
+    arg_include_sourceless BOOL,
+    arg_only_orglocal BOOL,
+    arg_after_display_sort BIGINT -- use 0 for ~from the start~
+  ) RETURNS TABLE (
+    piece_id BIGINT,
+    piece_log2_size SMALLINT,
+    has_sources_http BOOL,
+    has_sources_fil_active BOOL,
+    piece_cid TEXT,
+    tenant_ids SMALLINT[],
+    display_sort BIGINT
+  )
+LANGUAGE sql PARALLEL RESTRICTED STABLE STRICT AS $$
+
+  WITH
+    sp AS MATERIALIZED (
+      SELECT
+          sp.org_id,
+          sp.city_id,
+          sp.country_id,
+          sp.continent_id,
+          ( COALESCE( (spi.info->'sector_log2_size')::BIGINT, 0 ) >= 36 ) AS can_seal_64g_sectors
+        FROM spd.providers sp
+        LEFT JOIN spd.providers_info spi USING ( provider_id )
+      WHERE
+        sp.provider_id = arg_calling_provider_id
+    ),
+    enabled_tenants AS MATERIALIZED (
+      SELECT tp.tenant_id
+        FROM spd.tenants_providers tp
+      WHERE
+        tp.provider_id = arg_calling_provider_id
+          AND
+        NOT COALESCE( ( tp.tenant_provider_meta->'inactivated' )::BOOL, false )
+          AND
+        ( arg_only_tenant_id = 0 OR arg_only_tenant_id = tp.tenant_id )
+    )
+
+
+  SELECT
+      pa.piece_id,
+      pa.piece_log2_size,
+      pa.http_available AS has_sources_http,
+      ( pa.coarse_latest_active_end_epoch IS NOT NULL ) AS has_sources_fil_active,
+      pa.piece_cid,
+      claiming_tenants.tenant_ids,
+      pa.display_sort
+    FROM spd.mv_pieces_availability pa, sp , LATERAL (
+      SELECT
+          ARRAY_AGG( et.tenant_id ) AS tenant_ids
+        FROM enabled_tenants et
+
+      WHERE
+
+
+        et.tenant_id = ANY( pa.potential_tenant_ids )
+
+          AND
+
+        NOT EXISTS (
+          SELECT 42
+            FROM spd.mv_overreplicated_total o_total
+          WHERE
+            o_total.piece_id = pa.piece_id
+              AND
+            o_total.tenant_id = et.tenant_id
+        )
+
+          AND
+
+
+        NOT EXISTS (
+          SELECT 42
+            FROM spd.mv_overreplicated_org o_org
+          WHERE
+            o_org.piece_id = pa.piece_id
+              AND
+            o_org.tenant_id = et.tenant_id
+              AND
+            o_org.org_id = sp.org_id
+        )
+
+          AND
+
+        NOT EXISTS (
+          SELECT 42
+            FROM spd.mv_overreplicated_city o_city
+          WHERE
+            o_city.piece_id = pa.piece_id
+              AND
+            o_city.tenant_id = et.tenant_id
+              AND
+            o_city.city_id = sp.city_id
+        )
+
+          AND
+
+        NOT EXISTS (
+          SELECT 42
+            FROM spd.mv_overreplicated_country o_country
+          WHERE
+            o_country.piece_id = pa.piece_id
+              AND
+            o_country.tenant_id = et.tenant_id
+              AND
+            o_country.country_id = sp.country_id
+        )
+
+          AND
+
+        NOT EXISTS (
+          SELECT 42
+            FROM spd.mv_overreplicated_continent o_continent
+          WHERE
+            o_continent.piece_id = pa.piece_id
+              AND
+            o_continent.tenant_id = et.tenant_id
+              AND
+            o_continent.continent_id = sp.continent_id
+        )
+      ) claiming_tenants
+
+  WHERE
+    --
+    -- resume after the last entry of the previous page
+    pa.display_sort > arg_after_display_sort
+
+      AND
+
+    --
+    -- there are enabled tenants
+    -- ( we *MUST* check a COUNT(*), otherwise the lateral executes for *everything* and only then returns 0 )
+    ( SELECT COUNT(*) FROM enabled_tenants ) > 0
+
+      AND
+
+    -- there are claiming tenants
+    claiming_tenants.tenant_ids IS NOT NULL
+
+      AND
+
+    --
+    -- can we seal it ourselves?
+    (
+      sp.can_seal_64g_sectors
+        OR
+      NOT pa.requires_64g_sector
+    )
+
+      AND
+
+    --
+    -- sourcelessness
+    (
+      arg_include_sourceless
+        OR
+      pa.has_sources = true
+    )
+
+      AND
+
+    --
+    -- orglocal only
+    (
+      NOT arg_only_orglocal
+        OR
+      EXISTS (
+        SELECT 42
+          FROM spd.mv_orglocal_presence op
+        WHERE
+          op.piece_id = pa.piece_id
+            AND
+          op.org_id = sp.org_id
+      )
+    )
+
+      AND
+
+    --
+    -- exclude my own known/in-flight
+    NOT EXISTS (
+      SELECT 42
+        FROM spd.mv_deals_prefiltered_for_repcount dpfr
+      WHERE
+        dpfr.piece_id = pa.piece_id
+          AND
+        dpfr.provider_id = arg_calling_provider_id
+    )
+
+      AND
+
+    --
+    -- exclude my own pre-flight
+    NOT EXISTS (
+      SELECT 42
+        FROM spd.proposals pr
+      WHERE
+        pr.piece_id = pa.piece_id
+          AND
+        pr.provider_id = arg_calling_provider_id
+          AND
+        pr.proposal_failstamp = 0
+          AND
+        pr.activated_deal_id IS NULL
+    )
+
+  ORDER BY display_sort
+
+  LIMIT arg_limit
+$$;
+
+
+CREATE OR REPLACE
+  FUNCTION spd.pieces_eligible_full(
+    arg_calling_provider_id INTEGER,
+    arg_limit INTEGER,
+    arg_only_tenant_id SMALLINT, -- use 0 for ~any~
+    arg_include_sourceless BOOL,
+    arg_only_orglocal BOOL,
+    arg_after_display_sort BIGINT -- use 0 for ~from the start~
+  ) RETURNS TABLE (
+    piece_id BIGINT,
+    piece_log2_size SMALLINT,
+    has_sources_http BOOL,
+    has_sources_fil_active BOOL,
+    piece_cid TEXT,
+    tenant_ids SMALLINT[],
+    display_sort BIGINT
+  )
+LANGUAGE sql PARALLEL RESTRICTED STABLE STRICT AS $$
+
+  WITH
+    sp AS MATERIALIZED (
+      SELECT
+          sp.org_id,
+          sp.city_id,
+          sp.country_id,
+          sp.continent_id,
+          ( COALESCE( (spi.info->'sector_log2_size')::BIGINT, 0 ) >= 36 ) AS can_seal_64g_sectors
+        FROM spd.providers sp
+        LEFT JOIN spd.providers_info spi USING ( provider_id )
+      WHERE
+        sp.provider_id = arg_calling_provider_id
+    ),
+    enabled_tenants AS MATERIALIZED (
+      SELECT tp.tenant_id
+        FROM spd.tenants_providers tp
+      WHERE
+        tp.provider_id = arg_calling_provider_id
+          AND
+        NOT COALESCE( ( tp.tenant_provider_meta->'inactivated' )::BOOL, false )
+          AND
+        ( arg_only_tenant_id = 0 OR arg_only_tenant_id = tp.tenant_id )
+    )
+    ,
+    claiming_tenants AS (
+      SELECT
+          piece_id,
+          ARRAY_AGG( et.tenant_id ) AS tenant_ids
+        FROM spd.mv_pieces_availability pa, sp, enabled_tenants et
+
+      WHERE
+
+        et.tenant_id = ANY( pa.potential_tenant_ids )
+
+          AND
+
+        NOT EXISTS (
+          SELECT 42
+            FROM spd.mv_overreplicated_total o_total
+          WHERE
+            o_total.piece_id = pa.piece_id
+              AND
+            o_total.tenant_id = et.tenant_id
+        )
+
+          AND
+
+
+        NOT EXISTS (
+          SELECT 42
+            FROM spd.mv_overreplicated_org o_org
+          WHERE
+            o_org.piece_id = pa.piece_id
+              AND
+            o_org.tenant_id = et.tenant_id
+              AND
+            o_org.org_id = sp.org_id
+        )
+
+          AND
+
+        NOT EXISTS (
+          SELECT 42
+            FROM spd.mv_overreplicated_city o_city
+          WHERE
+            o_city.piece_id = pa.piece_id
+              AND
+            o_city.tenant_id = et.tenant_id
+              AND
+            o_city.city_id = sp.city_id
+        )
+
+          AND
+
+        NOT EXISTS (
+          SELECT 42
+            FROM spd.mv_overreplicated_country o_country
+          WHERE
+            o_country.piece_id = pa.piece_id
+              AND
+            o_country.tenant_id = et.tenant_id
+              AND
+            o_country.country_id = sp.country_id
+        )
+
+          AND
+
+        NOT EXISTS (
+          SELECT 42
+            FROM spd.mv_overreplicated_continent o_continent
+          WHERE
+            o_continent.piece_id = pa.piece_id
+              AND
+            o_continent.tenant_id = et.tenant_id
+              AND
+            o_continent.continent_id = sp.continent_id
+        )
+      GROUP BY piece_id
+    )
+
+  SELECT
+      pa.piece_id,
+      pa.piece_log2_size,
+      pa.http_available AS has_sources_http,
+      ( pa.coarse_latest_active_end_epoch IS NOT NULL ) AS has_sources_fil_active,
+      pa.piece_cid,
+      claiming_tenants.tenant_ids,
+      pa.display_sort
+    FROM spd.mv_pieces_availability pa, sp , claiming_tenants
+
+  WHERE
+    --
+    -- resume after the last entry of the previous page
+    pa.display_sort > arg_after_display_sort
+
+      AND
+
+    --
+    -- there is a list of interested+enabled tenants
+    claiming_tenants.piece_id = pa.piece_id
+
+      AND
+
+    --
+    -- can we seal it ourselves?
+    (
+      sp.can_seal_64g_sectors
+        OR
+      NOT pa.requires_64g_sector
+    )
+
+      AND
+
+    --
+    -- sourcelessness
+    (
+      arg_include_sourceless
+        OR
+      pa.has_sources = true
+    )
+
+      AND
+
+    --
+    -- orglocal only
+    (
+      NOT arg_only_orglocal
+        OR
+      EXISTS (
+        SELECT 42
+          FROM spd.mv_orglocal_presence op
+        WHERE
+          op.piece_id = pa.piece_id
+            AND
+          op.org_id = sp.org_id
+      )
+    )
+
+      AND
+
+    --
+    -- exclude my own known/in-flight
+    NOT EXISTS (
+      SELECT 42
+        FROM spd.mv_deals_prefiltered_for_repcount dpfr
+      WHERE
+        dpfr.piece_id = pa.piece_id
+          AND
+        dpfr.provider_id = arg_calling_provider_id
+    )
+
+      AND
+
+    --
+    -- exclude my own pre-flight
+    NOT EXISTS (
+      SELECT 42
+        FROM spd.proposals pr
+      WHERE
+        pr.piece_id = pa.piece_id
+          AND
+        pr.provider_id = arg_calling_provider_id
+          AND
+        pr.proposal_failstamp = 0
+          AND
+        pr.activated_deal_id IS NULL
+    )
+
+  ORDER BY display_sort
+
+  LIMIT arg_limit
+$$;
@@ -0,0 +1,234 @@
+// Package mocksp is an in-process stand-in for a Boost storage provider: a libp2p host answering
+// the storage proposal and retrieval transports protocols with scripted behavior, while recording
+// every proposal it receives. It makes no attempt to validate, let alone seal, anything.
+package mocksp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/fxamacker/cbor/v2"
+	libp2p "github.com/libp2p/go-libp2p"
+	lp2pnet "github.com/libp2p/go-libp2p/core/network"
+	lp2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
+	lp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	lp2ptcp "github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"github.com/ribasushi/go-toolbox-interplanetary/lp2p"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/filtypes"
+	"golang.org/x/xerrors"
+)
+
+// DefaultListenAddr binds to a random localhost port
+const DefaultListenAddr = "/ip4/127.0.0.1/tcp/0"
+
+// Behavior determines how a single proposal is answered
+type Behavior struct {
+	RejectMessage string        // when set the proposal is rejected with this message, otherwise accepted
+	Latency       time.Duration // wait this long before responding
+	Drop          bool          // reset the stream instead of responding at all
+}
+
+// Received is a proposal as seen by the mock, together with what it was answered with
+type Received struct {
+	Protocol string
+	From     lp2p.PeerID
+	At       time.Time
+	Params   filtypes.StorageProposalV12xParams
+	Behavior Behavior
+}
+
+// Config determines what a MockSP advertises
+type Config struct {
+	ListenAddr string   // defaults to DefaultListenAddr
+	Protocols  []string // defaults to filtypes.StorageProposalProtocols + filtypes.RetrievalTransports
+
+	// returned by filtypes.RetrievalTransports, keyed by transport name ( e.g. "http" )
+	RetrievalTransports map[string][]multiaddr.Multiaddr
+}
+
+// MockSP is a running mock provider. It must be Close()d.
+type MockSP struct {
+	Host lp2p.Host
+
+	mu         sync.Mutex
+	behaviorFn func(*filtypes.StorageProposalV12xParams) Behavior
+	received   []Received
+	onReceive  func(Received)
+	transports map[string][]multiaddr.Multiaddr
+}
+
+// New starts a MockSP accepting every proposal right away, until told otherwise via SetBehavior
+func New(cfg Config) (*MockSP, error) {
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = DefaultListenAddr
+	}
+	if cfg.Protocols == nil {
+		cfg.Protocols = append(append([]string{}, filtypes.StorageProposalProtocols...), filtypes.RetrievalTransports)
+	}
+
+	h, err := libp2p.New(
+		libp2p.RandomIdentity,
+		libp2p.ListenAddrStrings(cfg.ListenAddr),
+		libp2p.DisableRelay(),
+		libp2p.ResourceManager(&lp2pnet.NullResourceManager{}),
+		libp2p.NoTransports,
+		libp2p.Transport(lp2ptcp.NewTCPTransport),
+		libp2p.Security(lp2ptls.ID, lp2ptls.New),
+		libp2p.UserAgent("boost-mock"),
+	)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+
+	sp := &MockSP{
+		Host:       h,
+		behaviorFn: func(*filtypes.StorageProposalV12xParams) Behavior { return Behavior{} },
+		transports: cfg.RetrievalTransports,
+	}
+
+	for _, proto := range cfg.Protocols {
+		proto := proto
+		switch proto {
+		case filtypes.RetrievalTransports:
+			h.SetStreamHandler(lp2pprotocol.ID(proto), sp.handleRetrievalTransports)
+		case filtypes.StorageProposalV120, filtypes.StorageProposalV121:
+			h.SetStreamHandler(lp2pprotocol.ID(proto), func(st lp2pnet.Stream) { sp.handleProposal(proto, st) })
+		default:
+			// advertised but not spoken: any stream is immediately reset
+			h.SetStreamHandler(lp2pprotocol.ID(proto), func(st lp2pnet.Stream) { st.Reset() }) //nolint:errcheck
+		}
+	}
+
+	return sp, nil
+}
+
+// Close shuts the libp2p host down
+func (sp *MockSP) Close() error { return cmn.WrErr(sp.Host.Close()) }
+
+// AddrInfo is what a client needs to dial this MockSP
+func (sp *MockSP) AddrInfo() lp2p.AddrInfo {
+	return lp2p.AddrInfo{ID: sp.Host.ID(), Addrs: sp.Host.Addrs()}
+}
+
+// MinerInfo is a StateMinerInfo pointing at this MockSP, suitable for testharness.LotusMock
+func (sp *MockSP) MinerInfo(owner, worker fil.ActorID, sectorSize filabi.SectorSize) lotusapi.MinerInfo {
+	pid := sp.Host.ID()
+	addrs := sp.Host.Addrs()
+	maddrs := make([]filabi.Multiaddrs, len(addrs))
+	for i, a := range addrs {
+		maddrs[i] = a.Bytes()
+	}
+	return lotusapi.MinerInfo{
+		Owner:      owner.AsFilAddr(),
+		Worker:     worker.AsFilAddr(),
+		NewWorker:  worker.AsFilAddr(),
+		PeerId:     &pid,
+		Multiaddrs: maddrs,
+		SectorSize: sectorSize,
+	}
+}
+
+// SetBehavior answers every subsequent proposal the same way
+func (sp *MockSP) SetBehavior(b Behavior) {
+	sp.SetBehaviorFunc(func(*filtypes.StorageProposalV12xParams) Behavior { return b })
+}
+
+// SetBehaviorFunc decides how to answer each subsequent proposal based on its contents
+func (sp *MockSP) SetBehaviorFunc(f func(*filtypes.StorageProposalV12xParams) Behavior) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.behaviorFn = f
+}
+
+// OnReceive registers a callback invoked for every proposal, before it is answered
+func (sp *MockSP) OnReceive(f func(Received)) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.onReceive = f
+}
+
+// Received returns a copy of every proposal received so far, in order of arrival
+func (sp *MockSP) Received() []Received {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return append([]Received{}, sp.received...)
+}
+
+// WaitReceived blocks until at least n proposals have been received, or ctx is done
+func (sp *MockSP) WaitReceived(ctx context.Context, n int) ([]Received, error) {
+	for {
+		if r := sp.Received(); len(r) >= n {
+			return r, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, xerrors.Errorf("received only %d out of %d expected proposals: %w", len(sp.Received()), n, ctx.Err())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (sp *MockSP) handleProposal(proto string, st lp2pnet.Stream) {
+	defer st.Close() //nolint:errcheck
+
+	var params filtypes.StorageProposalV12xParams
+	if err := cborutil.ReadCborRPC(st, &params); err != nil {
+		st.Reset() //nolint:errcheck
+		return
+	}
+
+	sp.mu.Lock()
+	rcv := Received{
+		Protocol: proto,
+		From:     st.Conn().RemotePeer(),
+		At:       time.Now(),
+		Params:   params,
+		Behavior: sp.behaviorFn(&params),
+	}
+	sp.received = append(sp.received, rcv)
+	onReceive := sp.onReceive
+	sp.mu.Unlock()
+
+	if onReceive != nil {
+		onReceive(rcv)
+	}
+
+	if rcv.Behavior.Latency > 0 {
+		time.Sleep(rcv.Behavior.Latency)
+	}
+	if rcv.Behavior.Drop {
+		st.Reset() //nolint:errcheck
+		return
+	}
+
+	cborutil.WriteCborRPC(st, &filtypes.StorageProposalV12xResponse{ //nolint:errcheck
+		Accepted: rcv.Behavior.RejectMessage == "",
+		Message:  rcv.Behavior.RejectMessage,
+	})
+}
+
+func (sp *MockSP) handleRetrievalTransports(st lp2pnet.Stream) {
+	defer st.Close() //nolint:errcheck
+
+	var resp filtypes.RetrievalTransports100RawResponse
+	for name, maddrs := range sp.transports {
+		p := struct {
+			Name      string
+			Addresses [][]byte
+		}{Name: name}
+		for _, ma := range maddrs {
+			p.Addresses = append(p.Addresses, ma.Bytes())
+		}
+		resp.Protocols = append(resp.Protocols, p)
+	}
+
+	// the counterpart of RetrievalTransports100RawResponse.UnmarshalCBOR
+	cbor.NewEncoder(st).Encode(resp) //nolint:errcheck
+}
@@ -0,0 +1,663 @@
+package testharness
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	filaddr "github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	filmarket "github.com/filecoin-project/go-state-types/builtin/v9/market"
+	filprovider "github.com/filecoin-project/go-state-types/builtin/v9/miner"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	lotusmarket "github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/multiformats/go-multihash"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"github.com/ribasushi/spade/internal/app"
+	"github.com/ribasushi/spade/internal/mocksp"
+)
+
+// the actors participating in every flow below
+const (
+	e2eTenantID = 1
+	e2eSP       = fil.ActorID(17001)
+	e2eSPOwner  = fil.ActorID(17002)
+	e2eSPWorker = fil.ActorID(17003)
+	e2eClient   = fil.ActorID(17004)
+)
+
+var e2eBins struct {
+	once   sync.Once
+	dir    string
+	webapi string
+	cron   string
+	err    error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if e2eBins.dir != "" {
+		os.RemoveAll(e2eBins.dir) //nolint:errcheck
+	}
+	os.Exit(code)
+}
+
+// e2eBinaries builds spade-webapi and spade-cron exactly once per test run
+func e2eBinaries(t *testing.T) (webapi, cron string) {
+	t.Helper()
+	e2eBins.once.Do(func() {
+		if e2eBins.dir, e2eBins.err = os.MkdirTemp("", "spade-e2e-bin-"); e2eBins.err != nil {
+			return
+		}
+		for bin, pkg := range map[*string]string{
+			&e2eBins.webapi: "github.com/ribasushi/spade/webapi",
+			&e2eBins.cron:   "github.com/ribasushi/spade/cron",
+		} {
+			*bin = filepath.Join(e2eBins.dir, app.AppName+"-"+filepath.Base(pkg))
+			if out, err := exec.Command("go", "build", "-o", *bin, pkg).CombinedOutput(); err != nil {
+				e2eBins.err = fmt.Errorf("building %s failed: %w\n%s", pkg, err, out)
+				return
+			}
+		}
+	})
+	if e2eBins.err != nil {
+		t.Fatal(e2eBins.err)
+	}
+	return e2eBins.webapi, e2eBins.cron
+}
+
+// e2eFlow is an Env with a single tenant, client, dataset and piece, and a MockSP which the
+// LotusMock knows as e2eSP. The chain head is pinned a few epochs behind walltime, so that
+// advanceChain() can move it forward as the flow progresses.
+type e2eFlow struct {
+	t         *testing.T
+	env       *Env
+	db        *pgxpool.Pool
+	home      string
+	cronBin   string
+	webapiBin string
+	webapiURL string
+	sp        *mocksp.MockSP
+	pieceCid  cid.Cid
+	workerKey filaddr.Address
+	head      filabi.ChainEpoch
+}
+
+func newE2EFlow(t *testing.T) *e2eFlow {
+	t.Helper()
+
+	f := &e2eFlow{
+		t:    t,
+		env:  newTestEnv(t),
+		home: t.TempDir(),
+	}
+	f.db = app.GetGlobalCtx(f.env.Ctx).Db[app.DbMain]
+	f.webapiBin, f.cronBin = e2eBinaries(t)
+
+	// the webapi listen address is only known once a free port is found
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := l.Addr().String()
+	l.Close() //nolint:errcheck
+	f.webapiURL = "http://" + listenAddr
+
+	cfgPath := filepath.Join(f.home, app.AppName+".toml")
+	if err := f.env.WriteConfig(cfgPath); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := os.OpenFile(cfgPath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(cfg, "webapi-listen-address = %q\n", listenAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.sp, err = mocksp.New(mocksp.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.sp.Close() }) //nolint:errcheck
+
+	// chain side
+	clientKey := e2eKeyAddress(t, "client")
+	f.workerKey = e2eKeyAddress(t, "worker")
+	f.env.Lotus.SetMinerInfo(e2eSP, f.sp.MinerInfo(e2eSPOwner, e2eSPWorker, 32<<30))
+	f.env.Lotus.SetAccountKey(e2eSPWorker, f.workerKey)
+	f.env.Lotus.SetAccountKey(e2eClient, clientKey)
+	dcap := filabi.NewStoragePower(1 << 40)
+	f.env.Lotus.SetVerifiedClient(e2eClient.AsFilAddr(), &dcap)
+
+	// DB side
+	f.pieceCid = e2eCid(t, cid.FilCommitmentUnsealed, multihash.SHA2_256_TRUNC254_PADDED, "piece")
+	for _, stmt := range []struct {
+		sql  string
+		args []interface{}
+	}{
+		{
+			`INSERT INTO spd.tenants ( tenant_id, tenant_name, tenant_meta ) VALUES ( $1, 'e2e', $2 )`,
+			[]interface{}{e2eTenantID, map[string]interface{}{
+				"deal_params": map[string]int{"duration_days": 532, "start_within_hours": 72},
+				"max":         map[string]int{"total_replicas": 10, "per_org": 10, "per_city": 10, "per_country": 10, "per_continent": 10},
+			}},
+		},
+		{
+			`INSERT INTO spd.clients ( client_id, tenant_id, client_address ) VALUES ( $1, $2, $3 )`,
+			[]interface{}{e2eClient, e2eTenantID, clientKey.String()},
+		},
+		{
+			`INSERT INTO spd.datasets ( dataset_id, dataset_slug ) VALUES ( 1, 'e2e' )`,
+			nil,
+		},
+		{
+			`INSERT INTO spd.tenants_datasets ( tenant_id, dataset_id ) VALUES ( $1, 1 )`,
+			[]interface{}{e2eTenantID},
+		},
+		{
+			`INSERT INTO spd.pieces ( piece_id, piece_cid, piece_log2_size, proposal_label ) VALUES ( 1, $1, 30, $2 )`,
+			[]interface{}{f.pieceCid.String(), e2eCid(t, cid.Raw, multihash.SHA2_256, "payload").String()},
+		},
+		{
+			`INSERT INTO spd.datasets_pieces ( piece_id, dataset_id ) VALUES ( 1, 1 )`,
+			nil,
+		},
+		{
+			`INSERT INTO spd.providers ( provider_id ) VALUES ( $1 )`,
+			[]interface{}{e2eSP},
+		},
+		{
+			`INSERT INTO spd.tenants_providers ( tenant_id, provider_id ) VALUES ( $1, $2 )`,
+			[]interface{}{e2eTenantID, e2eSP},
+		},
+	} {
+		if _, err := f.db.Exec(f.env.Ctx, stmt.sql, stmt.args...); err != nil {
+			t.Fatalf("seeding via '%s' failed: %s", stmt.sql, err)
+		}
+	}
+
+	f.head = fil.WallTimeEpoch(time.Now()) - 3
+	f.env.Lotus.SetHeadEpoch(f.head)
+
+	return f
+}
+
+// advanceChain moves the chain head forward by at least one epoch, making market deals changed
+// since the last track-deals visible, while keeping the head as close to walltime as spade requires
+func (f *e2eFlow) advanceChain() {
+	f.head++
+	if minHead := fil.WallTimeEpoch(time.Now()) - 3; f.head < minHead {
+		f.head = minHead
+	}
+	f.env.Lotus.SetHeadEpoch(f.head)
+}
+
+// e2eKeyAddress is a deterministic secp256k1 address: the LotusMock never sees actual keys
+func e2eKeyAddress(t *testing.T, seed string) filaddr.Address {
+	t.Helper()
+	pub := sha256.Sum256([]byte(seed))
+	a, err := filaddr.NewSecp256k1Address(pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func e2eCid(t *testing.T, codec uint64, mhType uint64, seed string) cid.Cid {
+	t.Helper()
+	d := sha256.Sum256([]byte(seed))
+	if mhType == multihash.SHA2_256_TRUNC254_PADDED {
+		d[31] &= 0b00111111
+	}
+	mh, err := multihash.Encode(d[:], mhType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(codec, mh)
+}
+
+// procEnv points a spade binary at the config of this flow, and keeps its command
+// locks away from any spade deployment on the same host
+func (f *e2eFlow) procEnv() []string {
+	return append(os.Environ(), "HOME="+f.home, "TMPDIR="+f.home)
+}
+
+// cron runs a single spade-cron command to completion
+func (f *e2eFlow) cron(args ...string) {
+	f.t.Helper()
+	cmd := exec.CommandContext(f.env.Ctx, f.cronBin, args...)
+	cmd.Env = f.procEnv()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		f.t.Fatalf("spade-cron %v failed: %s\n%s", args, err, out)
+	}
+}
+
+// startWebapi runs spade-webapi until the end of the test
+func (f *e2eFlow) startWebapi() {
+	f.t.Helper()
+
+	var out bytes.Buffer
+	cmd := exec.Command(f.webapiBin)
+	cmd.Env = f.procEnv()
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt) //nolint:errcheck
+		cmd.Wait()                       //nolint:errcheck
+		if f.t.Failed() {
+			f.t.Logf("spade-webapi output:\n%s", out.String())
+		}
+	})
+
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		if resp, err := http.Get(f.webapiURL + "/openapi.json"); err == nil {
+			resp.Body.Close() //nolint:errcheck
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			f.t.Fatal("spade-webapi did not start listening within 30 seconds")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// spGet performs an /sp request authenticated by a FIL-SPID-V0 header signed by the worker
+func (f *e2eFlow) spGet(path string) (int, string) {
+	f.t.Helper()
+
+	epoch := fil.WallTimeEpoch(time.Now())
+	sig, err := f.env.Lotus.Sign(
+		f.workerKey,
+		append([]byte{0x20, 0x20, 0x20}, f.env.Lotus.BeaconEntry(epoch).Data...),
+	)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(f.env.Ctx, http.MethodGet, f.webapiURL+path, nil)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("FIL-SPID-V0 %d;%s;%s", epoch, e2eSP, base64.StdEncoding.EncodeToString(sig.Data)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+// requestPiece brings the flow up to a proposal for the piece being queued by spade-webapi
+func (f *e2eFlow) requestPiece() {
+	f.t.Helper()
+
+	// spInfo is what request_piece judges the SP by, the initial resync populates the datacap
+	// and the state epoch every response is annotated with
+	f.cron("poll-providers", "--requery-all")
+	f.cron("track-deals", "--full-resync")
+
+	f.startWebapi()
+	if code, body := f.spGet("/sp/request_piece/" + f.pieceCid.String()); code != http.StatusOK {
+		f.t.Fatalf("request_piece returned HTTP %d:\n%s", code, body)
+	}
+}
+
+// deliverProposal brings the flow up to the proposal being accepted by the MockSP, and returns it
+func (f *e2eFlow) deliverProposal() filmarket.DealProposal {
+	f.t.Helper()
+
+	f.requestPiece()
+	f.cron("sign-pending")
+	f.cron("propose-pending")
+
+	rcv := f.sp.Received()
+	if len(rcv) != 1 {
+		f.t.Fatalf("mock SP received %d proposals instead of 1", len(rcv))
+	}
+	return rcv[0].Params.ClientDealProposal.Proposal
+}
+
+// checkpointEpoch is the epoch of the tipset the last track-deals run examined
+func (f *e2eFlow) checkpointEpoch() filabi.ChainEpoch {
+	f.t.Helper()
+	var e filabi.ChainEpoch
+	if err := f.db.QueryRow(f.env.Ctx, `SELECT ( metadata->'market_state'->>'epoch' )::INTEGER FROM spd.global`).Scan(&e); err != nil {
+		f.t.Fatal(err)
+	}
+	return e
+}
+
+func (f *e2eFlow) dealStatus(dealID filabi.DealID) (status string, isFinal bool) {
+	f.t.Helper()
+	if err := f.db.QueryRow(
+		f.env.Ctx,
+		`SELECT status::TEXT, status_is_final FROM spd.published_deals WHERE deal_id = $1`,
+		dealID,
+	).Scan(&status, &isFinal); err != nil {
+		f.t.Fatal(err)
+	}
+	return status, isFinal
+}
+
+type e2eTransition struct {
+	NewStatus string
+	Finalized bool
+	Reverted  bool
+}
+
+func (f *e2eFlow) dealTransitions(dealID filabi.DealID) []e2eTransition {
+	f.t.Helper()
+	rows, err := f.db.Query(
+		f.env.Ctx,
+		`
+		SELECT new_status, finalized IS NOT NULL, reverted IS NOT NULL
+			FROM spd.published_deal_transitions
+		WHERE deal_id = $1
+		ORDER BY transition_id
+		`,
+		dealID,
+	)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	defer rows.Close()
+	trs := make([]e2eTransition, 0, 4)
+	for rows.Next() {
+		var tr e2eTransition
+		if err := rows.Scan(&tr.NewStatus, &tr.Finalized, &tr.Reverted); err != nil {
+			f.t.Fatal(err)
+		}
+		trs = append(trs, tr)
+	}
+	if err := rows.Err(); err != nil {
+		f.t.Fatal(err)
+	}
+	return trs
+}
+
+// ageTransitions pretends every provisional transition was observed the given amount of epochs
+// earlier, on the then-canonical tipset
+func (f *e2eFlow) ageTransitions(by filabi.ChainEpoch) {
+	f.t.Helper()
+
+	epochs := make([]filabi.ChainEpoch, 0, 4)
+	rows, err := f.db.Query(
+		f.env.Ctx,
+		`SELECT DISTINCT observed_epoch FROM spd.published_deal_transitions WHERE finalized IS NULL AND reverted IS NULL`,
+	)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	for rows.Next() {
+		var e filabi.ChainEpoch
+		if err := rows.Scan(&e); err != nil {
+			f.t.Fatal(err)
+		}
+		epochs = append(epochs, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		f.t.Fatal(err)
+	}
+
+	for _, e := range epochs {
+		ts, err := app.GetGlobalCtx(f.env.Ctx).LotusAPI[app.FilLite].ChainGetTipSetByHeight(f.env.Ctx, e-by, lotustypes.EmptyTSK)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		if _, err := f.db.Exec(
+			f.env.Ctx,
+			`
+			UPDATE spd.published_deal_transitions SET
+				observed_epoch = $2,
+				observed_tipset = $3
+			WHERE
+				observed_epoch = $1
+					AND
+				finalized IS NULL
+					AND
+				reverted IS NULL
+			`,
+			e,
+			ts.Height(),
+			ts.Key().String(),
+		); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+}
+
+type e2eProposalState struct {
+	Signed       bool
+	Delivered    bool
+	Failure      *string
+	ActivatedID  *int64
+	Attempts     int
+	RetryPending bool
+}
+
+func (f *e2eFlow) proposalState() e2eProposalState {
+	f.t.Helper()
+	var s e2eProposalState
+	if err := f.db.QueryRow(
+		f.env.Ctx,
+		`
+		SELECT
+				signature_obtained IS NOT NULL,
+				proposal_delivered IS NOT NULL,
+				proposal_meta->>'failure',
+				activated_deal_id,
+				delivery_attempts,
+				next_delivery_attempt IS NOT NULL
+			FROM spd.proposals
+		WHERE
+			piece_id = 1 AND provider_id = $1
+		ORDER BY entry_created DESC
+		LIMIT 1
+		`,
+		e2eSP,
+	).Scan(&s.Signed, &s.Delivered, &s.Failure, &s.ActivatedID, &s.Attempts, &s.RetryPending); err != nil {
+		f.t.Fatal(err)
+	}
+	return s
+}
+
+func TestDealFlow(t *testing.T) {
+	f := newE2EFlow(t)
+
+	f.requestPiece()
+	if s := f.proposalState(); s.Signed || s.Delivered {
+		t.Fatalf("unexpected state of a freshly requested proposal: %+v", s)
+	}
+
+	f.cron("sign-pending")
+	if s := f.proposalState(); !s.Signed {
+		t.Fatalf("proposal not signed by sign-pending: %+v", s)
+	}
+
+	f.cron("propose-pending")
+	if s := f.proposalState(); !s.Delivered || s.Failure != nil {
+		t.Fatalf("proposal not delivered by propose-pending: %+v", s)
+	}
+	rcv := f.sp.Received()
+	if len(rcv) != 1 {
+		t.Fatalf("mock SP received %d proposals instead of 1", len(rcv))
+	}
+	prop := rcv[0].Params.ClientDealProposal.Proposal
+	if prop.PieceCID != f.pieceCid || prop.Provider != e2eSP.AsFilAddr() || prop.Client != e2eClient.AsFilAddr() {
+		t.Fatalf("unexpected proposal received by the mock SP: %+v", prop)
+	}
+
+	// the SP publishes and seals the deal
+	const dealID = 4242
+	f.env.Lotus.SetMarketDeal(dealID, lotusapi.MarketDeal{
+		Proposal: prop,
+		State: filmarket.DealState{
+			SectorStartEpoch: fil.WallTimeEpoch(time.Now()) - app.FilDefaultLookback - 1,
+			LastUpdatedEpoch: -1,
+			SlashEpoch:       -1,
+		},
+	})
+	f.advanceChain()
+	f.cron("track-deals", "--full-resync")
+
+	if s := f.proposalState(); s.ActivatedID == nil || *s.ActivatedID != dealID {
+		t.Fatalf("proposal not marked activated by deal %d: %+v", dealID, s)
+	}
+	var status string
+	if err := f.db.QueryRow(f.env.Ctx, `SELECT status::TEXT FROM spd.published_deals WHERE deal_id = $1`, dealID).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != "active" {
+		t.Fatalf("deal %d recorded as '%s' instead of 'active'", dealID, status)
+	}
+}
+
+func TestProposalDeliveryRejections(t *testing.T) {
+	f := newE2EFlow(t)
+
+	f.requestPiece()
+	f.cron("sign-pending")
+
+	// a busy SP gets another chance later
+	f.sp.SetBehavior(mocksp.Behavior{RejectMessage: "deal rejected: too busy, try again later"})
+	f.cron("propose-pending")
+	if s := f.proposalState(); s.Delivered || s.Failure != nil || s.Attempts != 1 || !s.RetryPending {
+		t.Fatalf("transiently rejected proposal not scheduled for a retry: %+v", s)
+	}
+
+	// not waiting out the backoff
+	if _, err := f.db.Exec(
+		f.env.Ctx,
+		`UPDATE spd.proposals SET next_delivery_attempt = NOW() WHERE provider_id = $1`,
+		e2eSP,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// while a proposal the SP does not want is given up on right away
+	f.sp.SetBehavior(mocksp.Behavior{RejectMessage: "deal rejected: piece size not supported"})
+	f.cron("propose-pending")
+	if s := f.proposalState(); s.Delivered || s.Failure == nil || s.Attempts != 2 || s.RetryPending {
+		t.Fatalf("permanently rejected proposal not failed: %+v", s)
+	}
+
+	if n := len(f.sp.Received()); n != 2 {
+		t.Fatalf("mock SP received %d proposals instead of 2", n)
+	}
+}
+
+func TestTrackDealsIncremental(t *testing.T) {
+	f := newE2EFlow(t)
+	prop := f.deliverProposal()
+
+	// the SP publishes the deal
+	const dealID = 4243
+	published := lotusapi.MarketDeal{Proposal: prop, State: *lotusmarket.EmptyDealState()}
+	f.env.Lotus.SetMarketDeal(dealID, published)
+	f.advanceChain()
+	f.cron("track-deals")
+	if status, _ := f.dealStatus(dealID); status != "published" {
+		t.Fatalf("deal %d recorded as '%s' instead of 'published'", dealID, status)
+	}
+
+	// and seals it
+	activated := published
+	activated.State.SectorStartEpoch = f.head
+	f.env.Lotus.SetMarketDeal(dealID, activated)
+	f.advanceChain()
+	f.cron("track-deals")
+	if s := f.proposalState(); s.ActivatedID == nil || *s.ActivatedID != dealID {
+		t.Fatalf("proposal not marked activated by deal %d: %+v", dealID, s)
+	}
+	if status, isFinal := f.dealStatus(dealID); status != "active" || isFinal {
+		t.Fatalf("deal %d recorded as '%s' ( final: %t ) instead of a provisional 'active'", dealID, status, isFinal)
+	}
+
+	// nothing reorged: once ChainFinality behind, both transitions become final
+	f.ageTransitions(filprovider.ChainFinality)
+	f.cron("track-deals", "--full-resync")
+	if trs := f.dealTransitions(dealID); len(trs) != 2 ||
+		trs[0] != (e2eTransition{NewStatus: "published", Finalized: true}) ||
+		trs[1] != (e2eTransition{NewStatus: "active", Finalized: true}) {
+		t.Fatalf("unexpected transitions of deal %d: %+v", dealID, trs)
+	}
+	if status, isFinal := f.dealStatus(dealID); status != "active" || !isFinal {
+		t.Fatalf("deal %d recorded as '%s' ( final: %t ) instead of a final 'active'", dealID, status, isFinal)
+	}
+}
+
+func TestTrackDealsReorg(t *testing.T) {
+	f := newE2EFlow(t)
+	prop := f.deliverProposal()
+
+	const dealID = 4244
+	published := lotusapi.MarketDeal{Proposal: prop, State: *lotusmarket.EmptyDealState()}
+	f.env.Lotus.SetMarketDeal(dealID, published)
+	f.advanceChain()
+	f.cron("track-deals")
+
+	activated := published
+	activated.State.SectorStartEpoch = f.head
+	f.env.Lotus.SetMarketDeal(dealID, activated)
+	f.advanceChain()
+	f.cron("track-deals")
+	if s := f.proposalState(); s.ActivatedID == nil || *s.ActivatedID != dealID {
+		t.Fatalf("proposal not marked activated by deal %d: %+v", dealID, s)
+	}
+
+	// the tipset the activation was observed at gets orphaned: on the canonical chain the deal is not
+	// ( yet ) activated
+	f.env.Lotus.SetMarketDeal(dealID, published)
+	f.env.Lotus.Reorg(f.checkpointEpoch())
+	f.advanceChain()
+	f.cron("track-deals")
+
+	if s := f.proposalState(); s.ActivatedID != nil || s.Failure != nil {
+		t.Fatalf("proposal not pending again after its activation was reorged away: %+v", s)
+	}
+	var activationReverted bool
+	if err := f.db.QueryRow(
+		f.env.Ctx,
+		`SELECT proposal_meta ? 'activation_reverted' FROM spd.proposals WHERE piece_id = 1 AND provider_id = $1`,
+		e2eSP,
+	).Scan(&activationReverted); err != nil {
+		t.Fatal(err)
+	}
+	if !activationReverted {
+		t.Fatal("proposal does not record the reverted activation")
+	}
+	if status, isFinal := f.dealStatus(dealID); status != "published" || isFinal {
+		t.Fatalf("deal %d recorded as '%s' ( final: %t ) instead of a provisional 'published'", dealID, status, isFinal)
+	}
+	if trs := f.dealTransitions(dealID); len(trs) != 3 ||
+		trs[0] != (e2eTransition{NewStatus: "published"}) ||
+		trs[1] != (e2eTransition{NewStatus: "active", Reverted: true}) ||
+		trs[2] != (e2eTransition{NewStatus: "published"}) {
+		t.Fatalf("unexpected transitions of deal %d: %+v", dealID, trs)
+	}
+}
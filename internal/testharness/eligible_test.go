@@ -0,0 +1,66 @@
+package testharness
+
+import (
+	"testing"
+)
+
+func TestEligiblePiecesHonorMinScores(t *testing.T) {
+	f := newE2EFlow(t)
+
+	if _, err := f.db.Exec(f.env.Ctx, `REFRESH MATERIALIZED VIEW spd.mv_pieces_availability`); err != nil {
+		t.Fatal(err)
+	}
+
+	countEligible := func(fn string) (n int) {
+		t.Helper()
+		if err := f.db.QueryRow(
+			f.env.Ctx,
+			`SELECT COUNT(*) FROM spd.`+fn+`( $1, 100, 0, true, false, false, false, false, 0, '' )`,
+			e2eSP,
+		).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	for _, step := range []struct {
+		desc     string
+		sql      string
+		args     []interface{}
+		expected int
+	}{
+		{
+			"without a score",
+			`SELECT 42`,
+			nil,
+			1,
+		},
+		{
+			"with a score but no tenant minimum",
+			`INSERT INTO spd.provider_scores ( provider_id, provider_score ) VALUES ( $1, 10 )`,
+			[]interface{}{e2eSP},
+			1,
+		},
+		{
+			"with a score below the tenant minimum",
+			`UPDATE spd.tenants SET tenant_meta = JSONB_SET( tenant_meta, '{ min }', '{ "provider_score": 50 }' )`,
+			nil,
+			0,
+		},
+		{
+			"with a score at the tenant minimum",
+			`UPDATE spd.provider_scores SET provider_score = 50`,
+			nil,
+			1,
+		},
+	} {
+		if _, err := f.db.Exec(f.env.Ctx, step.sql, step.args...); err != nil {
+			t.Fatal(err)
+		}
+		for _, fn := range []string{"pieces_eligible_head", "pieces_eligible_full"} {
+			if n := countEligible(fn); n != step.expected {
+				t.Errorf("%s returned %d pieces %s, expected %d", fn, n, step.desc, step.expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package testharness
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/app"
+	"github.com/ribasushi/spade/internal/migrations"
+)
+
+// Env is a complete environment: a database with the current schema, a LotusMock, and a context
+// carrying the same app.GlobalContext app.GlobalInit would have produced when pointed at them.
+// Anything accepting a context in spade can be invoked with Ctx directly.
+type Env struct {
+	Ctx   context.Context
+	PG    *Postgres
+	Lotus *LotusMock
+
+	closers []func()
+}
+
+// NewEnv brings up a fresh Env. It must be Close()d, including when an error is returned.
+func NewEnv(ctx context.Context, logger ufcli.Logger) (*Env, error) {
+	e := new(Env)
+
+	pg, err := StartPostgres(ctx)
+	if err != nil {
+		return e, err
+	}
+	e.PG = pg
+	e.closers = append(e.closers, pg.Stop)
+
+	e.Lotus = NewLotusMock()
+	e.closers = append(e.closers, e.Lotus.Close)
+
+	gctx := app.GlobalContext{
+		Logger:   logger,
+		LotusAPI: make(app.FilAPIs, 2),
+		Db:       make(app.DbConns, 2),
+	}
+
+	// through the same failover/caching layer app.GlobalInit uses
+	connectLotus := func(timeoutSecs int) (app.FilAPI, error) {
+		api, apiCloser, err := fil.LotusAPIClientV0(ctx, e.Lotus.URL(), timeoutSecs, "")
+		if err != nil {
+			return nil, cmn.WrErr(err)
+		}
+		e.closers = append(e.closers, apiCloser)
+		return app.NewFilFailover(logger, &app.FilEndpoint{Name: "lotusmock", API: api}), nil
+	}
+	if gctx.LotusAPI[app.FilLite], err = connectLotus(30); err != nil {
+		return e, err
+	}
+	if gctx.LotusAPI[app.FilHeavy], err = connectLotus(300); err != nil {
+		return e, err
+	}
+
+	db, err := pgxpool.Connect(ctx, pg.ConnString)
+	if err != nil {
+		return e, cmn.WrErr(err)
+	}
+	e.closers = append(e.closers, db.Close)
+	gctx.Db[app.DbMain] = db
+	gctx.Db[app.DbMetrics] = db
+
+	if err := migrations.CheckSchemaVersion(ctx, db); err != nil {
+		return e, err
+	}
+
+	e.Ctx = app.WithGlobalCtx(ctx, gctx)
+	return e, nil
+}
+
+// WriteConfig writes a TOML file pointing the spade binaries at this Env: place it at
+// $HOME/spade.toml of the process being exec()ed
+func (e *Env) WriteConfig(path string) error {
+	return cmn.WrErr(os.WriteFile(path, []byte(fmt.Sprintf(
+		"pg-connstring = %q\nlotus-api-lite = %q\nlotus-api-heavy = %q\n",
+		e.PG.ConnString,
+		e.Lotus.URL(),
+		e.Lotus.URL(),
+	)), 0o600))
+}
+
+// Close tears everything down, in reverse order of creation
+func (e *Env) Close() {
+	for i := len(e.closers) - 1; i >= 0; i-- {
+		e.closers[i]()
+	}
+	e.closers = nil
+}
@@ -0,0 +1,505 @@
+package testharness
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	filaddr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	actorstypes "github.com/filecoin-project/go-state-types/actors"
+	filbig "github.com/filecoin-project/go-state-types/big"
+	filmarket "github.com/filecoin-project/go-state-types/builtin/v9/market"
+	filadt "github.com/filecoin-project/go-state-types/builtin/v9/util/adt"
+	filcrypto "github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/manifest"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	lotusbs "github.com/filecoin-project/lotus/blockstore"
+	lotusactors "github.com/filecoin-project/lotus/chain/actors"
+	lotusmarket "github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"golang.org/x/xerrors"
+)
+
+// LotusMock is an in-process stand-in for the subset of the Lotus v0 API spade uses. It is served
+// over real JSON-RPC, so that clients obtained via fil.LotusAPIClientV0( URL() ) behave exactly
+// like they would against a Lotus node.
+//
+// The chain is synthesized: there is one tipset per epoch up to the walltime epoch, with keys
+// that are stable until Reorg() is called. All state is whatever was Set*() last, regardless of
+// the tipset it is requested at, with the exception of the market deals: these are frozen at a
+// tipset the first time they are requested there, as a v9 market actor state readable via
+// StateGetActor + ChainReadObj. Thus a test changing deals between `track-deals` runs must also
+// move the head forward via SetHeadEpoch(), for the change to become visible. Signatures are
+// deterministic digests rather than real BLS or secp256k1 ones, only WalletVerify of this same
+// mock accepts them.
+type LotusMock struct {
+	srv *httptest.Server
+
+	mu                 sync.Mutex
+	marketDeals        map[filabi.DealID]lotusapi.MarketDeal
+	minerInfos         map[filaddr.Address]lotusapi.MinerInfo
+	minerIneligible    map[filaddr.Address]bool
+	accountKeys        map[filaddr.Address]filaddr.Address
+	verifiedClients    map[filaddr.Address]filabi.StoragePower
+	collateralBounds   lotusapi.DealCollateralBounds
+	reorgEpochs        []filabi.ChainEpoch
+	tipsets            map[lotustypes.TipSetKey]*lotustypes.TipSet
+	marketStates       map[lotustypes.TipSetKey]*frozenMarketState
+	blocks             lotusbs.MemBlockstore
+	dummyMinerAddr     filaddr.Address
+	headEpochOverwrite filabi.ChainEpoch
+}
+
+// NewLotusMock starts serving a new mock on a random localhost port. It must be Close()d.
+func NewLotusMock() *LotusMock {
+	m := &LotusMock{
+		marketDeals:     make(map[filabi.DealID]lotusapi.MarketDeal),
+		minerInfos:      make(map[filaddr.Address]lotusapi.MinerInfo),
+		minerIneligible: make(map[filaddr.Address]bool),
+		accountKeys:     make(map[filaddr.Address]filaddr.Address),
+		verifiedClients: make(map[filaddr.Address]filabi.StoragePower),
+		collateralBounds: lotusapi.DealCollateralBounds{
+			Min: filbig.Zero(),
+			Max: filbig.Zero(),
+		},
+		tipsets:        make(map[lotustypes.TipSetKey]*lotustypes.TipSet),
+		marketStates:   make(map[lotustypes.TipSetKey]*frozenMarketState),
+		blocks:         lotusbs.NewMemory(),
+		dummyMinerAddr: fil.ActorID(1000).AsFilAddr(),
+	}
+
+	rpc := jsonrpc.NewServer()
+	rpc.Register("Filecoin", &lotusRPC{m: m})
+	mux := http.NewServeMux()
+	mux.Handle("/rpc/v0", rpc)
+	m.srv = httptest.NewServer(mux)
+
+	return m
+}
+
+// URL is the endpoint to hand to fil.LotusAPIClientV0, or to --lotus-api-lite / --lotus-api-heavy
+func (m *LotusMock) URL() string { return m.srv.URL }
+
+// Close stops serving
+func (m *LotusMock) Close() { m.srv.Close() }
+
+// SetMarketDeal adds or replaces a deal returned by StateMarketDeals at tipsets not yet examined
+func (m *LotusMock) SetMarketDeal(dealID filabi.DealID, md lotusapi.MarketDeal) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.marketDeals[dealID] = md
+}
+
+// RemoveMarketDeal makes a deal disappear from the market state at tipsets not yet examined,
+// as if it expired or was slashed
+func (m *LotusMock) RemoveMarketDeal(dealID filabi.DealID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.marketDeals, dealID)
+}
+
+// SetMinerInfo adds or replaces the StateMinerInfo of a storage provider. Providers are eligible to
+// mine unless marked otherwise via SetMinerEligible.
+func (m *LotusMock) SetMinerInfo(sp fil.ActorID, mi lotusapi.MinerInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.minerInfos[sp.AsFilAddr()] = mi
+}
+
+// SetMinerEligible controls the EligibleForMining reported by MinerGetBaseInfo
+func (m *LotusMock) SetMinerEligible(sp fil.ActorID, eligible bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.minerIneligible[sp.AsFilAddr()] = !eligible
+}
+
+// SetAccountKey registers the key address StateAccountKey resolves an ID address to
+func (m *LotusMock) SetAccountKey(id fil.ActorID, key filaddr.Address) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accountKeys[id.AsFilAddr()] = key
+}
+
+// SetVerifiedClient sets the remaining datacap of a client, a nil datacap makes it unverified
+func (m *LotusMock) SetVerifiedClient(client filaddr.Address, datacap *filabi.StoragePower) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if datacap == nil {
+		delete(m.verifiedClients, client)
+	} else {
+		m.verifiedClients[client] = *datacap
+	}
+}
+
+// SetCollateralBounds sets the StateDealProviderCollateralBounds returned for any piece size
+func (m *LotusMock) SetCollateralBounds(b lotusapi.DealCollateralBounds) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collateralBounds = b
+}
+
+// SetHeadEpoch pins the chain head instead of following walltime, 0 reverts to walltime. Note that
+// fil.GetTipset refuses a head lagging walltime by more than a few epochs.
+func (m *LotusMock) SetHeadEpoch(e filabi.ChainEpoch) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.headEpochOverwrite = e
+}
+
+// Reorg replaces every tipset at or above fromEpoch with a different one of the same height
+func (m *LotusMock) Reorg(fromEpoch filabi.ChainEpoch) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reorgEpochs = append(m.reorgEpochs, fromEpoch)
+}
+
+// Sign produces the signature WalletSign would, for use by callers playing the part of an SP.
+// The key must be a BLS or secp256k1 address.
+func (m *LotusMock) Sign(key filaddr.Address, msg []byte) (*filcrypto.Signature, error) {
+	var sig filcrypto.Signature
+	var sigLen int
+	switch key.Protocol() {
+	case filaddr.BLS:
+		sig.Type, sigLen = filcrypto.SigTypeBLS, 96
+	case filaddr.SECP256K1:
+		sig.Type, sigLen = filcrypto.SigTypeSecp256k1, 65
+	default:
+		return nil, xerrors.Errorf("address %s is not a key address", key)
+	}
+
+	h := sha256.New()
+	h.Write(key.Bytes())
+	h.Write(msg)
+	digest := h.Sum(nil)
+	for len(sig.Data) < sigLen {
+		sig.Data = append(sig.Data, digest...)
+	}
+	sig.Data = sig.Data[:sigLen]
+
+	return &sig, nil
+}
+
+// BeaconEntry is the deterministic beacon of the given epoch
+func (m *LotusMock) BeaconEntry(e filabi.ChainEpoch) *lotustypes.BeaconEntry {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(e))
+	d := sha256.Sum256(b[:])
+	return &lotustypes.BeaconEntry{Round: uint64(e), Data: d[:]}
+}
+
+func (m *LotusMock) headEpoch() filabi.ChainEpoch {
+	if m.headEpochOverwrite != 0 {
+		return m.headEpochOverwrite
+	}
+	return fil.WallTimeEpoch(time.Now())
+}
+
+// tipsetAt must be called with mu held
+func (m *LotusMock) tipsetAt(e filabi.ChainEpoch) (*lotustypes.TipSet, error) {
+	var generation int
+	for _, re := range m.reorgEpochs {
+		if e >= re {
+			generation++
+		}
+	}
+
+	dummyCid := func(kind string) (cid.Cid, error) {
+		return filabi.CidBuilder.Sum([]byte(fmt.Sprintf("%s-%d-%d", kind, e, generation)))
+	}
+	var cids [4]cid.Cid
+	for i, kind := range []string{"parent", "stateroot", "receipts", "messages"} {
+		var err error
+		if cids[i], err = dummyCid(kind); err != nil {
+			return nil, cmn.WrErr(err)
+		}
+	}
+
+	ts, err := lotustypes.NewTipSet([]*lotustypes.BlockHeader{{
+		Miner:                 m.dummyMinerAddr,
+		Ticket:                &lotustypes.Ticket{VRFProof: []byte(fmt.Sprintf("ticket-%d", generation))},
+		Parents:               []cid.Cid{cids[0]},
+		ParentWeight:          filbig.NewInt(int64(e)),
+		Height:                e,
+		ParentStateRoot:       cids[1],
+		ParentMessageReceipts: cids[2],
+		Messages:              cids[3],
+		Timestamp:             uint64(fil.MainnetTime(e).Unix()),
+		ParentBaseFee:         filbig.Zero(),
+	}})
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	m.tipsets[ts.Key()] = ts
+	return ts, nil
+}
+
+type frozenMarketState struct {
+	deals map[filabi.DealID]lotusapi.MarketDeal
+	head  cid.Cid
+}
+
+// marketStateAt must be called with mu held
+func (m *LotusMock) marketStateAt(tsk lotustypes.TipSetKey) (*frozenMarketState, error) {
+	if tsk == lotustypes.EmptyTSK {
+		ts, err := m.tipsetAt(m.headEpoch())
+		if err != nil {
+			return nil, err
+		}
+		tsk = ts.Key()
+	} else if _, known := m.tipsets[tsk]; !known {
+		return nil, xerrors.Errorf("tipset %s not found", tsk)
+	}
+	if fs, known := m.marketStates[tsk]; known {
+		return fs, nil
+	}
+
+	ctx := context.Background()
+	store := filadt.WrapStore(ctx, ipldcbor.NewCborStore(m.blocks))
+	st, err := filmarket.ConstructState(store)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	props, err := filadt.AsArray(store, st.Proposals, filmarket.ProposalsAmtBitwidth)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	states, err := filadt.AsArray(store, st.States, filmarket.StatesAmtBitwidth)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+
+	fs := &frozenMarketState{deals: make(map[filabi.DealID]lotusapi.MarketDeal, len(m.marketDeals))}
+	for id, md := range m.marketDeals {
+		md := md
+		fs.deals[id] = md
+		if err := props.Set(uint64(id), &md.Proposal); err != nil {
+			return nil, cmn.WrErr(err)
+		}
+		// like on chain: a deal has no state entry until something happens to it
+		if md.State != *lotusmarket.EmptyDealState() {
+			if err := states.Set(uint64(id), &md.State); err != nil {
+				return nil, cmn.WrErr(err)
+			}
+		}
+	}
+	if st.Proposals, err = props.Root(); err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	if st.States, err = states.Root(); err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	if fs.head, err = store.Put(ctx, st); err != nil {
+		return nil, cmn.WrErr(err)
+	}
+
+	m.marketStates[tsk] = fs
+	return fs, nil
+}
+
+// lotusRPC is what is actually served: keeps the Set*() methods of LotusMock out of the RPC namespace
+type lotusRPC struct{ m *LotusMock }
+
+func (r *lotusRPC) ChainHead(ctx context.Context) (*lotustypes.TipSet, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return r.m.tipsetAt(r.m.headEpoch())
+}
+
+func (r *lotusRPC) ChainGetTipSet(ctx context.Context, tsk lotustypes.TipSetKey) (*lotustypes.TipSet, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	if tsk == lotustypes.EmptyTSK {
+		return r.m.tipsetAt(r.m.headEpoch())
+	}
+	ts, known := r.m.tipsets[tsk]
+	if !known {
+		return nil, xerrors.Errorf("tipset %s not found", tsk)
+	}
+	return ts, nil
+}
+
+func (r *lotusRPC) ChainGetTipSetByHeight(ctx context.Context, e filabi.ChainEpoch, tsk lotustypes.TipSetKey) (*lotustypes.TipSet, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	top := r.m.headEpoch()
+	if tsk != lotustypes.EmptyTSK {
+		ts, known := r.m.tipsets[tsk]
+		if !known {
+			return nil, xerrors.Errorf("tipset %s not found", tsk)
+		}
+		top = ts.Height()
+	}
+	if e > top {
+		return nil, xerrors.Errorf("looking for tipset with height greater than start point")
+	}
+	if e < 0 {
+		return nil, xerrors.Errorf("negative epoch %d", e)
+	}
+	return r.m.tipsetAt(e)
+}
+
+func (r *lotusRPC) BeaconGetEntry(ctx context.Context, e filabi.ChainEpoch) (*lotustypes.BeaconEntry, error) {
+	return r.m.BeaconEntry(e), nil
+}
+
+func (r *lotusRPC) MinerGetBaseInfo(ctx context.Context, sp filaddr.Address, e filabi.ChainEpoch, tsk lotustypes.TipSetKey) (*lotusapi.MiningBaseInfo, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	mi, known := r.m.minerInfos[sp]
+	if !known {
+		return nil, xerrors.Errorf("actor %s not found", sp)
+	}
+	// lotus returns no info at all for miners without power
+	if r.m.minerIneligible[sp] {
+		return nil, nil
+	}
+	return &lotusapi.MiningBaseInfo{
+		MinerPower:        filbig.NewInt(1 << 40),
+		NetworkPower:      filbig.NewInt(1 << 60),
+		WorkerKey:         r.m.accountKeys[mi.Worker],
+		SectorSize:        mi.SectorSize,
+		PrevBeaconEntry:   *r.m.BeaconEntry(e - 1),
+		BeaconEntries:     []lotustypes.BeaconEntry{*r.m.BeaconEntry(e)},
+		EligibleForMining: true,
+	}, nil
+}
+
+func (r *lotusRPC) resolveKey(a filaddr.Address) (filaddr.Address, error) {
+	if a.Protocol() != filaddr.ID {
+		return a, nil
+	}
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	k, known := r.m.accountKeys[a]
+	if !known {
+		return filaddr.Undef, xerrors.Errorf("actor %s not found or not an account", a)
+	}
+	return k, nil
+}
+
+func (r *lotusRPC) WalletSign(ctx context.Context, a filaddr.Address, msg []byte) (*filcrypto.Signature, error) {
+	k, err := r.resolveKey(a)
+	if err != nil {
+		return nil, err
+	}
+	return r.m.Sign(k, msg)
+}
+
+func (r *lotusRPC) WalletVerify(ctx context.Context, k filaddr.Address, msg []byte, sig *filcrypto.Signature) (bool, error) {
+	if sig == nil {
+		return false, xerrors.New("no signature supplied")
+	}
+	expected, err := r.m.Sign(k, msg)
+	if err != nil {
+		return false, err
+	}
+	return sig.Type == expected.Type && string(sig.Data) == string(expected.Data), nil
+}
+
+func (r *lotusRPC) StateAccountKey(ctx context.Context, a filaddr.Address, tsk lotustypes.TipSetKey) (filaddr.Address, error) {
+	return r.resolveKey(a)
+}
+
+func (r *lotusRPC) StateMinerInfo(ctx context.Context, sp filaddr.Address, tsk lotustypes.TipSetKey) (lotusapi.MinerInfo, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	mi, known := r.m.minerInfos[sp]
+	if !known {
+		return lotusapi.MinerInfo{}, xerrors.Errorf("actor %s not found", sp)
+	}
+	return mi, nil
+}
+
+func (r *lotusRPC) StateMarketDeals(ctx context.Context, tsk lotustypes.TipSetKey) (map[string]*lotusapi.MarketDeal, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+
+	fs, err := r.m.marketStateAt(tsk)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]filabi.DealID, 0, len(fs.deals))
+	for id := range fs.deals {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	ret := make(map[string]*lotusapi.MarketDeal, len(ids))
+	for _, id := range ids {
+		md := fs.deals[id]
+		ret[strconv.FormatUint(uint64(id), 10)] = &md
+	}
+	return ret, nil
+}
+
+// only the market actor is modelled
+func (r *lotusRPC) StateGetActor(ctx context.Context, a filaddr.Address, tsk lotustypes.TipSetKey) (*lotustypes.Actor, error) {
+	if a != lotusmarket.Address {
+		return nil, xerrors.Errorf("actor %s not found", a)
+	}
+	code, known := lotusactors.GetActorCodeID(actorstypes.Version9, manifest.MarketKey)
+	if !known {
+		return nil, xerrors.New("no code CID registered for the v9 market actor")
+	}
+
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	fs, err := r.m.marketStateAt(tsk)
+	if err != nil {
+		return nil, err
+	}
+	return &lotustypes.Actor{
+		Code:    code,
+		Head:    fs.head,
+		Balance: filbig.Zero(),
+	}, nil
+}
+
+func (r *lotusRPC) ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	blk, err := r.m.blocks.Get(ctx, c)
+	if err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	return blk.RawData(), nil
+}
+
+func (r *lotusRPC) ChainHasObj(ctx context.Context, c cid.Cid) (bool, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	has, err := r.m.blocks.Has(ctx, c)
+	return has, cmn.WrErr(err)
+}
+
+func (r *lotusRPC) StateVerifiedClientStatus(ctx context.Context, a filaddr.Address, tsk lotustypes.TipSetKey) (*filabi.StoragePower, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	dc, known := r.m.verifiedClients[a]
+	if !known {
+		return nil, nil
+	}
+	return &dc, nil
+}
+
+func (r *lotusRPC) StateDealProviderCollateralBounds(ctx context.Context, size filabi.PaddedPieceSize, verified bool, tsk lotustypes.TipSetKey) (lotusapi.DealCollateralBounds, error) {
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return r.m.collateralBounds, nil
+}
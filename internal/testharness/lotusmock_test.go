@@ -0,0 +1,174 @@
+package testharness
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	filaddr "github.com/filecoin-project/go-address"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	filbig "github.com/filecoin-project/go-state-types/big"
+	filmarket "github.com/filecoin-project/go-state-types/builtin/v9/market"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	lotusbs "github.com/filecoin-project/lotus/blockstore"
+	lotusadt "github.com/filecoin-project/lotus/chain/actors/adt"
+	lotusmarket "github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	lotustypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/multiformats/go-multihash"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+)
+
+// e2eMarketDeal is a deal between e2eClient and e2eSP, not yet activated
+func e2eMarketDeal(t *testing.T, pieceCid cid.Cid, startEpoch filabi.ChainEpoch) lotusapi.MarketDeal {
+	t.Helper()
+	label, err := filmarket.NewLabelFromString("e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lotusapi.MarketDeal{
+		Proposal: filmarket.DealProposal{
+			PieceCID:             pieceCid,
+			PieceSize:            1 << 30,
+			VerifiedDeal:         true,
+			Client:               e2eClient.AsFilAddr(),
+			Provider:             e2eSP.AsFilAddr(),
+			Label:                label,
+			StartEpoch:           startEpoch,
+			EndEpoch:             startEpoch + 532*2880,
+			StoragePricePerEpoch: filbig.Zero(),
+			ProviderCollateral:   filbig.Zero(),
+			ClientCollateral:     filbig.Zero(),
+		},
+		State: *lotusmarket.EmptyDealState(),
+	}
+}
+
+func TestLotusMockMarketState(t *testing.T) {
+	ctx := context.Background()
+
+	m := NewLotusMock()
+	defer m.Close()
+	api, apiCloser, err := fil.LotusAPIClientV0(ctx, m.URL(), 30, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apiCloser()
+
+	// the same way track-deals reads the market actor
+	store := lotusadt.WrapStore(ctx, ipldcbor.NewCborStore(lotusbs.NewAPIBlockstore(api)))
+	marketAt := func(e filabi.ChainEpoch) (lotusmarket.State, lotustypes.TipSetKey) {
+		t.Helper()
+		ts, err := api.ChainGetTipSetByHeight(ctx, e, lotustypes.EmptyTSK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		act, err := api.StateGetActor(ctx, lotusmarket.Address, ts.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := lotusmarket.Load(store, act)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st, ts.Key()
+	}
+	diff := func(from, to lotusmarket.State) (*lotusmarket.DealProposalChanges, *lotusmarket.DealStateChanges) {
+		t.Helper()
+		fromProps, err := from.Proposals()
+		if err != nil {
+			t.Fatal(err)
+		}
+		toProps, err := to.Proposals()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromStates, err := from.States()
+		if err != nil {
+			t.Fatal(err)
+		}
+		toStates, err := to.States()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc, err := lotusmarket.DiffDealProposals(fromProps, toProps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc, err := lotusmarket.DiffDealStates(fromStates, toStates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pc, sc
+	}
+
+	epoch := fil.WallTimeEpoch(time.Now()) - 3
+	m.SetHeadEpoch(epoch)
+
+	pieceCid := e2eCid(t, cid.FilCommitmentUnsealed, multihash.SHA2_256_TRUNC254_PADDED, "piece")
+	m.SetMarketDeal(1, e2eMarketDeal(t, pieceCid, epoch+100))
+	st0, tsk0 := marketAt(epoch)
+
+	// changes after the state at a tipset was read do not affect it
+	active := e2eMarketDeal(t, pieceCid, epoch+100)
+	active.State.SectorStartEpoch = epoch
+	m.SetMarketDeal(1, active)
+	m.SetMarketDeal(2, e2eMarketDeal(t, pieceCid, epoch+100))
+	if again, _ := marketAt(epoch); mustDealState(t, again, 1) != *lotusmarket.EmptyDealState() {
+		t.Fatal("market state of an already examined tipset changed")
+	}
+
+	m.SetHeadEpoch(epoch + 1)
+	st1, tsk1 := marketAt(epoch + 1)
+	pc, sc := diff(st0, st1)
+	if len(pc.Added) != 1 || pc.Added[0].ID != 2 || len(pc.Removed) != 0 {
+		t.Fatalf("unexpected proposal changes: %+v", pc)
+	}
+	if len(sc.Added) != 1 || sc.Added[0].ID != 1 || sc.Added[0].Deal.SectorStartEpoch != epoch {
+		t.Fatalf("unexpected state changes: %+v", sc)
+	}
+
+	// a reorg yields a new tipset with its own state, the orphaned one remains readable
+	m.RemoveMarketDeal(2)
+	m.Reorg(epoch + 1)
+	st1r, tsk1r := marketAt(epoch + 1)
+	if tsk1r == tsk1 {
+		t.Fatal("tipset key did not change after a reorg")
+	}
+	if _, err := api.StateGetActor(ctx, lotusmarket.Address, tsk1); err != nil {
+		t.Fatalf("market state of an orphaned tipset no longer readable: %s", err)
+	}
+	if pc, _ := diff(st1, st1r); len(pc.Removed) != 1 || pc.Removed[0].ID != 2 {
+		t.Fatalf("unexpected proposal changes across the reorg: %+v", pc)
+	}
+
+	// and the full StateMarketDeals agrees
+	deals, err := api.StateMarketDeals(ctx, tsk0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deals) != 1 || deals["1"] == nil || deals["1"].State.SectorStartEpoch != -1 {
+		t.Fatalf("unexpected StateMarketDeals at the initial tipset: %+v", deals)
+	}
+
+	if _, err := api.StateGetActor(ctx, filaddr.Undef, tsk0); err == nil {
+		t.Fatal("StateGetActor of a non-market actor succeeded")
+	}
+}
+
+func mustDealState(t *testing.T, st lotusmarket.State, id filabi.DealID) lotusmarket.DealState {
+	t.Helper()
+	states, err := st.States()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, found, err := states.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		return *lotusmarket.EmptyDealState()
+	}
+	return *ds
+}
@@ -0,0 +1,95 @@
+package testharness
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/jackc/pgx/v4"
+	"github.com/ribasushi/spade/internal/app"
+	"github.com/ribasushi/spade/internal/migrations"
+)
+
+// newTestEnv is NewEnv, skipping the calling test when PostgreSQL is not available
+func newTestEnv(t *testing.T) *Env {
+	t.Helper()
+	e, err := NewEnv(context.Background(), logging.Logger("testharness"))
+	t.Cleanup(e.Close)
+	if errors.Is(err, ErrNoPostgres) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	all, err := migrations.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range all {
+		if m.Version != i+1 {
+			t.Fatalf("migration %04d_%s is out of sequence: expected version %d", m.Version, m.Name, i+1)
+		}
+		// only the initial schema is irreversible
+		if m.Version > 1 && m.Down == "" {
+			t.Errorf("migration %04d_%s lacks a .down.sql file", m.Version, m.Name)
+		}
+	}
+	if migrations.Latest() != all[len(all)-1].Version {
+		t.Fatalf("Latest() returned %d instead of %d", migrations.Latest(), all[len(all)-1].Version)
+	}
+}
+
+func TestSchemaLoads(t *testing.T) {
+	e := newTestEnv(t)
+
+	// NewEnv already ran CheckSchemaVersion: make sure it is not trivially satisfied
+	db := app.GetGlobalCtx(e.Ctx).Db[app.DbMain]
+	if _, err := db.Exec(
+		e.Ctx,
+		`UPDATE spd.global SET metadata = JSONB_SET( metadata, '{ schema_version, minor }', TO_JSONB( $1::INTEGER ) )`,
+		migrations.Latest()+1,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrations.CheckSchemaVersion(e.Ctx, db); err == nil {
+		t.Fatal("a database migrated past the latest embedded migration was accepted")
+	}
+}
+
+func TestMigrationsRoundtrip(t *testing.T) {
+	e := newTestEnv(t)
+
+	all, err := migrations.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := pgx.Connect(e.Ctx, e.PG.ConnString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background()) //nolint:errcheck
+
+	// everything down to the initial schema and back up, each step in its own transaction
+	// the same way spade-migrate applies them
+	apply := func(m migrations.Migration, script, direction string) {
+		t.Helper()
+		if err := conn.BeginFunc(e.Ctx, func(tx pgx.Tx) error {
+			_, err := tx.Exec(e.Ctx, script)
+			return err
+		}); err != nil {
+			t.Fatalf("applying %s of migration %04d_%s failed: %s", direction, m.Version, m.Name, err)
+		}
+	}
+	for i := len(all) - 1; i > 0; i-- {
+		apply(all[i], all[i].Down, "down")
+	}
+	for _, m := range all[1:] {
+		apply(m, m.Up, "up")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v4"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/app"
+	"github.com/ribasushi/spade/internal/migrations"
+	"golang.org/x/xerrors"
+)
+
+var downTo int
+var migrateDown = &ufcli.Command{
+	Usage: "Revert applied migrations down to a specific version, atomically",
+	Name:  "down",
+	Flags: []ufcli.Flag{
+		&ufcli.IntFlag{
+			Name:        "to",
+			Usage:       "Revert every migration above this version",
+			Required:    true,
+			Destination: &downTo,
+		},
+	},
+	Action: func(cctx *ufcli.Context) error {
+		ctx, log, _, _ := app.UnpackCtx(cctx.Context)
+
+		if downTo < 1 {
+			return xerrors.New("the initial schema can not be reverted: --to must be at least 1")
+		}
+
+		return withLedgerLock(ctx, func(tx pgx.Tx, all []migrations.Migration, applied []appliedMigration) error {
+			known := make(map[int]migrations.Migration, len(all))
+			for _, m := range all {
+				known[m.Version] = m
+			}
+
+			var count int
+			for i := len(applied) - 1; i >= 0 && applied[i].Version > downTo; i-- {
+				m, isKnown := known[applied[i].Version]
+				if !isKnown {
+					return xerrors.Errorf("applied migration %04d_%s is not known to this build: revert it with the build that applied it", applied[i].Version, applied[i].Name)
+				}
+				if m.Down == "" {
+					return xerrors.Errorf("migration %04d_%s is irreversible", m.Version, m.Name)
+				}
+				if err := applyMigration(ctx, tx, m, false); err != nil {
+					return err
+				}
+				count++
+			}
+
+			if count == 0 {
+				log.Infof("no applied migrations above version %d, nothing to revert", downTo)
+			} else {
+				log.Infof("reverted %d migrations", count)
+			}
+			return nil
+		})
+	},
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/app"
+	"github.com/ribasushi/spade/internal/migrations"
+)
+
+var migrateStatus = &ufcli.Command{
+	Usage: "List embedded migrations and whether they are applied",
+	Name:  "status",
+	Action: func(cctx *ufcli.Context) error {
+		ctx, _, _, _ := app.UnpackCtx(cctx.Context)
+
+		return withLedgerLock(ctx, func(_ pgx.Tx, all []migrations.Migration, applied []appliedMigration) error {
+			isApplied := make(map[int]appliedMigration, len(applied))
+			for _, a := range applied {
+				isApplied[a.Version] = a
+			}
+
+			for _, m := range all {
+				state := "pending"
+				if a, done := isApplied[m.Version]; done {
+					state = "applied " + a.AppliedAt.Format("2006-01-02 15:04:05Z07:00")
+					delete(isApplied, m.Version)
+				}
+				rev := ""
+				if m.Down == "" {
+					rev = " ( irreversible )"
+				}
+				fmt.Printf("%04d_%-40s %s%s\n", m.Version, m.Name, state, rev)
+			}
+			for _, a := range applied {
+				if _, unknown := isApplied[a.Version]; unknown {
+					fmt.Printf("%04d_%-40s applied %s ( NOT KNOWN TO THIS BUILD )\n", a.Version, a.Name, a.AppliedAt.Format("2006-01-02 15:04:05Z07:00"))
+				}
+			}
+
+			if err := migrations.CheckSchemaVersion(ctx, app.GetGlobalCtx(ctx).Db[app.DbMain]); err != nil {
+				fmt.Printf("\nThis build will refuse to run: %s\n", err)
+			}
+			return nil
+		})
+	},
+}
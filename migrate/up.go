@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v4"
+	"github.com/ribasushi/go-toolbox/ufcli"
+	"github.com/ribasushi/spade/internal/app"
+	"github.com/ribasushi/spade/internal/migrations"
+	"golang.org/x/xerrors"
+)
+
+var upTo int
+var migrateUp = &ufcli.Command{
+	Usage: "Apply all pending migrations, atomically",
+	Name:  "up",
+	Flags: []ufcli.Flag{
+		&ufcli.IntFlag{
+			Name:        "to",
+			Usage:       "Stop after applying this version ( 0 means latest )",
+			Destination: &upTo,
+		},
+	},
+	Action: func(cctx *ufcli.Context) error {
+		ctx, log, _, _ := app.UnpackCtx(cctx.Context)
+
+		return withLedgerLock(ctx, func(tx pgx.Tx, all []migrations.Migration, applied []appliedMigration) error {
+			isApplied := make(map[int]struct{}, len(applied))
+			for _, a := range applied {
+				isApplied[a.Version] = struct{}{}
+			}
+			if upTo != 0 && len(applied) > 0 && upTo < applied[len(applied)-1].Version {
+				return xerrors.Errorf("version %d is below the current %d: use `down` instead", upTo, applied[len(applied)-1].Version)
+			}
+
+			var count int
+			for _, m := range all {
+				if upTo != 0 && m.Version > upTo {
+					break
+				}
+				if _, done := isApplied[m.Version]; done {
+					continue
+				}
+				if err := applyMigration(ctx, tx, m, true); err != nil {
+					return err
+				}
+				count++
+			}
+
+			if count == 0 {
+				log.Info("schema is up to date, nothing to apply")
+			} else {
+				log.Infof("applied %d migrations", count)
+			}
+			return nil
+		})
+	},
+}
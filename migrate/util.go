@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/app"
+	"github.com/ribasushi/spade/internal/migrations"
+	"golang.org/x/xerrors"
+)
+
+// arbitrary, but must never change: serializes concurrent spade-migrate invocations
+const migrateAdvisoryLockID = 0x5ade_d1b
+
+type appliedMigration struct {
+	Version   int
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+func ensureLedger(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(
+		ctx,
+		`
+		CREATE SCHEMA IF NOT EXISTS spd;
+		CREATE TABLE IF NOT EXISTS spd.schema_migrations (
+			version INTEGER NOT NULL UNIQUE CONSTRAINT migration_valid_version CHECK ( version > 0 ),
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		`,
+	)
+	return cmn.WrErr(err)
+}
+
+func appliedMigrations(ctx context.Context, tx pgx.Tx) ([]appliedMigration, error) {
+	applied := make([]appliedMigration, 0, 64)
+	return applied, cmn.WrErr(pgxscan.Select(
+		ctx,
+		tx,
+		&applied,
+		`SELECT version, name, checksum, applied_at FROM spd.schema_migrations ORDER BY version`,
+	))
+}
+
+// withLedgerLock runs fn within a transaction holding the migration lock, after
+// verifying that every applied migration is still embedded unmodified
+func withLedgerLock(ctx context.Context, fn func(pgx.Tx, []migrations.Migration, []appliedMigration) error) error {
+	all, err := migrations.All()
+	if err != nil {
+		return err
+	}
+
+	return app.GetGlobalCtx(ctx).Db[app.DbMain].BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT PG_ADVISORY_XACT_LOCK( $1 )`, migrateAdvisoryLockID); err != nil {
+			return cmn.WrErr(err)
+		}
+		if err := ensureLedger(ctx, tx); err != nil {
+			return err
+		}
+		applied, err := appliedMigrations(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		known := make(map[int]migrations.Migration, len(all))
+		for _, m := range all {
+			known[m.Version] = m
+		}
+		for _, a := range applied {
+			if m, isKnown := known[a.Version]; isKnown && m.Checksum != a.Checksum {
+				return xerrors.Errorf("migration %04d_%s was modified after it was applied: add a new migration instead", m.Version, m.Name)
+			}
+		}
+
+		return fn(tx, all, applied)
+	})
+}
+
+// all migrations of a single run share the same transaction: a failure leaves no trace of any of them
+func applyMigration(ctx context.Context, tx pgx.Tx, m migrations.Migration, up bool) error {
+	log := app.GetGlobalCtx(ctx).Logger
+
+	script, direction := m.Up, "up"
+	if !up {
+		script, direction = m.Down, "down"
+	}
+
+	t0 := time.Now()
+	log.Infof("applying %04d_%s.%s.sql", m.Version, m.Name, direction)
+
+	if _, err := tx.Exec(ctx, script); err != nil {
+		return xerrors.Errorf("migration %04d_%s.%s.sql failed: %w", m.Version, m.Name, direction, err)
+	}
+
+	var err error
+	if up {
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO spd.schema_migrations ( version, name, checksum ) VALUES ( $1, $2, $3 )`,
+			m.Version, m.Name, m.Checksum,
+		)
+	} else {
+		_, err = tx.Exec(ctx, `DELETE FROM spd.schema_migrations WHERE version = $1`, m.Version)
+	}
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	// mirror the result into the schema_version checked by every other binary on startup
+	if _, err := tx.Exec(
+		ctx,
+		`
+		UPDATE spd.global SET
+			metadata = JSONB_SET(
+				metadata,
+				'{ schema_version }',
+				JSONB_BUILD_OBJECT(
+					'major', $1::INTEGER,
+					'minor', ( SELECT COALESCE( MAX( version ), 0 ) FROM spd.schema_migrations )
+				)
+			)
+		`,
+		migrations.SchemaMajor,
+	); err != nil {
+		return cmn.WrErr(err)
+	}
+
+	log.Infow("applied", "migration", m.Version, "direction", direction, "took_seconds", time.Since(t0).Truncate(time.Millisecond).Seconds())
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/app"
+)
+
+// (!) must match the dataset_slug_lc constraint in the schema
+var datasetSlugRe = regexp.MustCompile(`^[a-z0-9\-]+$`)
+
+type adminDataset struct {
+	DatasetID   int16           `json:"dataset_id"`
+	DatasetSlug string          `json:"dataset_slug"`
+	DatasetMeta json.RawMessage `json:"dataset_meta"`
+	TenantIDs   []int16         `json:"tenant_ids"`
+	PieceCount  int64           `json:"piece_count"`
+}
+type responseAdminDatasets struct {
+	localResponsePayload
+	Datasets []adminDataset `json:"datasets"`
+}
+
+// datasetIDParam returns the adminDatasetIDParam, already validated by the route registry
+func datasetIDParam(c echo.Context) int16 {
+	did, _ := uintParam(c, adminDatasetIDParam.Name)
+	return int16(did)
+}
+
+func selectAdminDatasets(c echo.Context, datasetID int16) ([]adminDataset, error) {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	ds := make([]adminDataset, 0, 32)
+	return ds, pgxscan.Select(
+		ctx,
+		ctxMeta.Db[app.DbMain],
+		&ds,
+		`
+		SELECT
+				d.dataset_id,
+				d.dataset_slug,
+				d.dataset_meta,
+				COALESCE(
+					( SELECT ARRAY_AGG( tenant_id ORDER BY tenant_id ) FROM spd.tenants_datasets td WHERE td.dataset_id = d.dataset_id ),
+					'{}'
+				) AS tenant_ids,
+				( SELECT COUNT(*) FROM spd.datasets_pieces dp WHERE dp.dataset_id = d.dataset_id ) AS piece_count
+			FROM spd.datasets d
+		WHERE
+			( 0 = $1 OR d.dataset_id = $1 )
+		ORDER BY d.dataset_id
+		`,
+		datasetID,
+	)
+}
+
+func retAdminDataset(c echo.Context, datasetID int16, fmsg string, args ...interface{}) error {
+	ds, err := selectAdminDatasets(c, datasetID)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	if len(ds) == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "dataset %d does not exist", datasetID)
+	}
+	return retPayloadAnnotated(c, http.StatusOK, 0, responseAdminDatasets{Datasets: ds}, fmsg, args...)
+}
+
+func apiAdminListDatasets(c echo.Context) error {
+	ds, err := selectAdminDatasets(c, 0)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	return retPayloadAnnotated(c, http.StatusOK, 0, responseAdminDatasets{Datasets: ds}, "")
+}
+
+func apiAdminGetDataset(c echo.Context) error {
+	datasetID := datasetIDParam(c)
+	return retAdminDataset(c, datasetID, "")
+}
+
+// apiAdminUpsertDataset handles both creation ( POST without a datasetID ) and replacement
+func apiAdminUpsertDataset(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	var datasetID int16
+	if id, present := uintParam(c, "datasetID"); present {
+		datasetID = int16(id)
+	}
+
+	var req struct {
+		DatasetSlug string          `json:"dataset_slug"`
+		DatasetMeta json.RawMessage `json:"dataset_meta"`
+	}
+	if err := parseJSONBody(c, &req); err != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+	}
+	if !datasetSlugRe.MatchString(req.DatasetSlug) {
+		return retFail(c, apitypes.ErrInvalidRequest, "provided dataset_slug '%s' is not valid: must match %s", req.DatasetSlug, datasetSlugRe.String())
+	}
+	if len(req.DatasetMeta) == 0 {
+		req.DatasetMeta = json.RawMessage(`{}`)
+	}
+	var dm map[string]json.RawMessage
+	if err := json.Unmarshal(req.DatasetMeta, &dm); err != nil || dm == nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "dataset_meta must be a JSON object")
+	}
+
+	var err error
+	if datasetID == 0 {
+		err = ctxMeta.Db[app.DbMain].QueryRow(
+			ctx,
+			`
+			INSERT INTO spd.datasets ( dataset_slug, dataset_meta )
+				VALUES ( $1, $2 )
+			RETURNING dataset_id
+			`,
+			req.DatasetSlug,
+			req.DatasetMeta,
+		).Scan(&datasetID)
+	} else {
+		err = ctxMeta.Db[app.DbMain].QueryRow(
+			ctx,
+			`
+			UPDATE spd.datasets SET
+				dataset_slug = $1,
+				dataset_meta = $2
+			WHERE
+				dataset_id = $3
+			RETURNING dataset_id
+			`,
+			req.DatasetSlug,
+			req.DatasetMeta,
+			datasetID,
+		).Scan(&datasetID)
+	}
+	if err == pgx.ErrNoRows {
+		return retFail(c, apitypes.ErrInvalidRequest, "dataset %d does not exist", datasetID)
+	} else if pgErr := pgConstraintViolation(err); pgErr != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "dataset could not be stored: %s", pgErr.Message)
+	} else if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	return retAdminDataset(c, datasetID, "dataset %d stored", datasetID)
+}
+
+func apiAdminDeleteDataset(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	datasetID := datasetIDParam(c)
+
+	res, err := ctxMeta.Db[app.DbMain].Exec(
+		ctx,
+		`DELETE FROM spd.datasets WHERE dataset_id = $1`,
+		datasetID,
+	)
+	if pgErr := pgConstraintViolation(err); pgErr != nil {
+		return retFail(
+			c,
+			apitypes.ErrInvalidRequest,
+			"dataset %d is still referenced and can not be deleted ( %s ): consider unlinking it from its tenants instead",
+			datasetID,
+			pgErr.Message,
+		)
+	} else if err != nil {
+		return cmn.WrErr(err)
+	}
+	if res.RowsAffected() == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "dataset %d does not exist", datasetID)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, nil, "dataset %d deleted", datasetID)
+}
+
+func apiAdminLinkTenantDataset(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	tenantID := tenantIDParam(c)
+	datasetID := datasetIDParam(c)
+
+	var req struct {
+		TenantDatasetMeta json.RawMessage `json:"tenant_dataset_meta"`
+	}
+	if err := parseJSONBody(c, &req); err != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+	}
+	if len(req.TenantDatasetMeta) == 0 {
+		req.TenantDatasetMeta = json.RawMessage(`{}`)
+	}
+	var tdm map[string]json.RawMessage
+	if err := json.Unmarshal(req.TenantDatasetMeta, &tdm); err != nil || tdm == nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "tenant_dataset_meta must be a JSON object")
+	}
+
+	if _, err := ctxMeta.Db[app.DbMain].Exec(
+		ctx,
+		`
+		INSERT INTO spd.tenants_datasets ( tenant_id, dataset_id, tenant_dataset_meta )
+			VALUES ( $1, $2, $3 )
+		ON CONFLICT ( tenant_id, dataset_id ) DO UPDATE SET
+			tenant_dataset_meta = EXCLUDED.tenant_dataset_meta
+		`,
+		tenantID,
+		datasetID,
+		req.TenantDatasetMeta,
+	); err != nil {
+		if pgErr := pgConstraintViolation(err); pgErr != nil {
+			return retFail(c, apitypes.ErrInvalidRequest, "dataset %d could not be linked to tenant %d: %s", datasetID, tenantID, pgErr.Message)
+		}
+		return cmn.WrErr(err)
+	}
+
+	return retAdminDataset(c, datasetID, "dataset %d linked to tenant %d", datasetID, tenantID)
+}
+
+func apiAdminUnlinkTenantDataset(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	tenantID := tenantIDParam(c)
+	datasetID := datasetIDParam(c)
+
+	res, err := ctxMeta.Db[app.DbMain].Exec(
+		ctx,
+		`DELETE FROM spd.tenants_datasets WHERE tenant_id = $1 AND dataset_id = $2`,
+		tenantID,
+		datasetID,
+	)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	if res.RowsAffected() == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "dataset %d is not linked to tenant %d", datasetID, tenantID)
+	}
+
+	return retAdminDataset(c, datasetID, "dataset %d unlinked from tenant %d", datasetID, tenantID)
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
+	filbuiltin "github.com/filecoin-project/go-state-types/builtin"
+	filmarket "github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/xerrors"
+)
+
+// (!) the shapes below must match what spd.piece_realtime_eligibility() and
+// the mv_overreplicated_* matviews read out of the tenant_meta column
+type tenantMetaDealParams struct {
+	DurationDays     *int16 `json:"duration_days"`
+	StartWithinHours *int16 `json:"start_within_hours"`
+}
+type tenantMetaMax struct {
+	TotalReplicas      *int16 `json:"total_replicas"`
+	PerOrg             *int16 `json:"per_org"`
+	PerCity            *int16 `json:"per_city"`
+	PerCountry         *int16 `json:"per_country"`
+	PerContinent       *int16 `json:"per_continent"`
+	DefaultInFlightGiB *int64 `json:"default_in_flight_GiB,omitempty"`
+	FilplusExclusive   *bool  `json:"filplus_exclusive,omitempty"`
+	TenantExclusive    *bool  `json:"tenant_exclusive,omitempty"`
+}
+
+// minimums are compared against spd.provider_scores, names must match cron/scoreproviders.go
+type tenantMetaMin struct {
+	ProviderScore      *int16 `json:"provider_score,omitempty"`
+	ProposalAcceptance *int16 `json:"proposal_acceptance,omitempty"`
+	ProposalLatency    *int16 `json:"proposal_latency,omitempty"`
+	Activation         *int16 `json:"activation,omitempty"`
+	Retention          *int16 `json:"retention,omitempty"`
+	Dialability        *int16 `json:"dialability,omitempty"`
+	Retrievability     *int16 `json:"retrievability,omitempty"`
+}
+type tenantProviderMeta struct {
+	MaxInFlightGiB *int64 `json:"max_in_flight_GiB,omitempty"`
+	Inactivated    *bool  `json:"inactivated,omitempty"`
+}
+
+type adminTenant struct {
+	TenantID   int16           `json:"tenant_id"`
+	TenantName string          `json:"tenant_name"`
+	TenantMeta json.RawMessage `json:"tenant_meta"`
+	DatasetIDs []int16         `json:"dataset_ids"`
+	ClientIDs  []string        `json:"client_ids"`
+}
+type responseAdminTenants struct {
+	localResponsePayload
+	Tenants []adminTenant `json:"tenants"`
+}
+
+type adminTenantProvider struct {
+	TenantID           int16           `json:"tenant_id"`
+	ProviderID         string          `json:"provider_id"`
+	TenantProviderMeta json.RawMessage `json:"tenant_provider_meta"`
+}
+type responseAdminTenantProviders struct {
+	localResponsePayload
+	Registrations []adminTenantProvider `json:"registrations"`
+}
+
+func strictUnmarshal(raw []byte, dst interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(dst)
+}
+
+func validateTenantMetaMax(raw json.RawMessage) error {
+	var m tenantMetaMax
+	if err := strictUnmarshal(raw, &m); err != nil {
+		return xerrors.Errorf("invalid 'max' object: %w", err)
+	}
+	for _, l := range []struct {
+		name string
+		val  *int16
+	}{
+		{"total_replicas", m.TotalReplicas},
+		{"per_org", m.PerOrg},
+		{"per_city", m.PerCity},
+		{"per_country", m.PerCountry},
+		{"per_continent", m.PerContinent},
+	} {
+		if l.val == nil {
+			return xerrors.Errorf("required value 'max.%s' is missing", l.name)
+		}
+		if *l.val < 1 {
+			return xerrors.Errorf("value 'max.%s' must be a positive integer", l.name)
+		}
+	}
+	if m.DefaultInFlightGiB != nil && *m.DefaultInFlightGiB < 1 {
+		return xerrors.New("value 'max.default_in_flight_GiB' must be a positive integer")
+	}
+	return nil
+}
+
+func validateTenantMetaMin(raw json.RawMessage) error {
+	var m tenantMetaMin
+	if err := strictUnmarshal(raw, &m); err != nil {
+		return xerrors.Errorf("invalid 'min' object: %w", err)
+	}
+	for _, l := range []struct {
+		name string
+		val  *int16
+	}{
+		{"provider_score", m.ProviderScore},
+		{"proposal_acceptance", m.ProposalAcceptance},
+		{"proposal_latency", m.ProposalLatency},
+		{"activation", m.Activation},
+		{"retention", m.Retention},
+		{"dialability", m.Dialability},
+		{"retrievability", m.Retrievability},
+	} {
+		if l.val != nil && (*l.val < 0 || *l.val > 100) {
+			return xerrors.Errorf("value 'min.%s' is out of bounds ( 0 ~ 100 )", l.name)
+		}
+	}
+	return nil
+}
+
+// validates the portions of tenant_meta the app relies on, leaves everything else as-is
+func validateTenantMeta(raw json.RawMessage) error {
+	var parts map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &parts); err != nil || parts == nil {
+		return xerrors.New("tenant_meta must be a JSON object")
+	}
+
+	if _, has := parts["deal_params"]; !has {
+		return xerrors.New("required object 'deal_params' is missing")
+	}
+	var dp tenantMetaDealParams
+	if err := strictUnmarshal(parts["deal_params"], &dp); err != nil {
+		return xerrors.Errorf("invalid 'deal_params' object: %w", err)
+	}
+	if dp.DurationDays == nil {
+		return xerrors.New("required value 'deal_params.duration_days' is missing")
+	}
+	minDays, maxDays := int16(filmarket.DealMinDuration/filbuiltin.EpochsInDay), int16(filmarket.DealMaxDuration/filbuiltin.EpochsInDay)
+	if *dp.DurationDays < minDays || *dp.DurationDays > maxDays {
+		return xerrors.Errorf("value 'deal_params.duration_days' is out of bounds ( %d ~ %d )", minDays, maxDays)
+	}
+	if dp.StartWithinHours == nil {
+		return xerrors.New("required value 'deal_params.start_within_hours' is missing")
+	}
+	if *dp.StartWithinHours < 1 {
+		return xerrors.New("value 'deal_params.start_within_hours' must be a positive integer")
+	}
+
+	if _, has := parts["max"]; !has {
+		return xerrors.New("required object 'max' is missing")
+	}
+	if err := validateTenantMetaMax(parts["max"]); err != nil {
+		return err
+	}
+
+	if mins, has := parts["min"]; has && string(mins) != "null" {
+		if err := validateTenantMetaMin(mins); err != nil {
+			return err
+		}
+	}
+
+	if hook, has := parts["reservation_hook"]; has && string(hook) != "null" {
+		return validateReservationHook(hook)
+	}
+	return nil
+}
+
+func validateTenantProviderMeta(raw json.RawMessage) error {
+	var m tenantProviderMeta
+	if err := strictUnmarshal(raw, &m); err != nil {
+		return xerrors.Errorf("invalid tenant_provider_meta: %w", err)
+	}
+	if m.MaxInFlightGiB != nil && *m.MaxInFlightGiB < 1 {
+		return xerrors.New("value 'max_in_flight_GiB' must be a positive integer")
+	}
+	return nil
+}
+
+// tenantIDParam returns the adminTenantIDParam, already validated by the route registry
+func tenantIDParam(c echo.Context) int16 {
+	tid, _ := uintParam(c, adminTenantIDParam.Name)
+	return int16(tid)
+}
+
+func selectAdminTenants(c echo.Context, tenantID int16) ([]adminTenant, error) {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	ts := make([]adminTenant, 0, 32)
+	return ts, pgxscan.Select(
+		ctx,
+		ctxMeta.Db[app.DbMain],
+		&ts,
+		`
+		SELECT
+				t.tenant_id,
+				t.tenant_name,
+				t.tenant_meta,
+				COALESCE(
+					( SELECT ARRAY_AGG( dataset_id ORDER BY dataset_id ) FROM spd.tenants_datasets td WHERE td.tenant_id = t.tenant_id ),
+					'{}'
+				) AS dataset_ids,
+				COALESCE(
+					( SELECT ARRAY_AGG( 'f0' || client_id::TEXT ORDER BY client_id ) FROM spd.clients c WHERE c.tenant_id = t.tenant_id ),
+					'{}'
+				) AS client_ids
+			FROM spd.tenants t
+		WHERE
+			( 0 = $1 OR t.tenant_id = $1 )
+		ORDER BY t.tenant_id
+		`,
+		tenantID,
+	)
+}
+
+func retAdminTenant(c echo.Context, tenantID int16, fmsg string, args ...interface{}) error {
+	ts, err := selectAdminTenants(c, tenantID)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	if len(ts) == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "tenant %d does not exist", tenantID)
+	}
+	return retPayloadAnnotated(c, http.StatusOK, 0, responseAdminTenants{Tenants: ts}, fmsg, args...)
+}
+
+func apiAdminListTenants(c echo.Context) error {
+	ts, err := selectAdminTenants(c, 0)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	return retPayloadAnnotated(c, http.StatusOK, 0, responseAdminTenants{Tenants: ts}, "")
+}
+
+func apiAdminGetTenant(c echo.Context) error {
+	tenantID := tenantIDParam(c)
+	return retAdminTenant(c, tenantID, "")
+}
+
+// apiAdminUpsertTenant handles both creation ( POST without a tenantID ) and replacement
+func apiAdminUpsertTenant(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	var tenantID int16
+	if id, present := uintParam(c, "tenantID"); present {
+		tenantID = int16(id)
+	}
+
+	var req struct {
+		TenantName string          `json:"tenant_name"`
+		TenantMeta json.RawMessage `json:"tenant_meta"`
+	}
+	if err := parseJSONBody(c, &req); err != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+	}
+	if req.TenantName == "" {
+		return retFail(c, apitypes.ErrInvalidRequest, "required value 'tenant_name' is missing")
+	}
+	if err := validateTenantMeta(req.TenantMeta); err != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+	}
+
+	var err error
+	if tenantID == 0 {
+		err = ctxMeta.Db[app.DbMain].QueryRow(
+			ctx,
+			`
+			INSERT INTO spd.tenants ( tenant_name, tenant_meta )
+				VALUES ( $1, $2 )
+			RETURNING tenant_id
+			`,
+			req.TenantName,
+			req.TenantMeta,
+		).Scan(&tenantID)
+	} else {
+		err = ctxMeta.Db[app.DbMain].QueryRow(
+			ctx,
+			`
+			UPDATE spd.tenants SET
+				tenant_name = $1,
+				tenant_meta = $2
+			WHERE
+				tenant_id = $3
+			RETURNING tenant_id
+			`,
+			req.TenantName,
+			req.TenantMeta,
+			tenantID,
+		).Scan(&tenantID)
+	}
+	if err == pgx.ErrNoRows {
+		return retFail(c, apitypes.ErrInvalidRequest, "tenant %d does not exist", tenantID)
+	} else if pgErr := pgConstraintViolation(err); pgErr != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "tenant could not be stored: %s", pgErr.Message)
+	} else if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	return retAdminTenant(c, tenantID, "tenant %d stored", tenantID)
+}
+
+func apiAdminSetTenantReplicationLimits(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	tenantID := tenantIDParam(c)
+
+	var maxLimits json.RawMessage
+	if err := parseJSONBody(c, &maxLimits); err != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+	}
+	if err := validateTenantMetaMax(maxLimits); err != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+	}
+
+	res, err := ctxMeta.Db[app.DbMain].Exec(
+		ctx,
+		`
+		UPDATE spd.tenants SET
+			tenant_meta = JSONB_SET( tenant_meta, '{ max }', $1 )
+		WHERE
+			tenant_id = $2
+		`,
+		maxLimits,
+		tenantID,
+	)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	if res.RowsAffected() == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "tenant %d does not exist", tenantID)
+	}
+
+	return retAdminTenant(c, tenantID, "replication limits of tenant %d updated", tenantID)
+}
+
+func apiAdminDeleteTenant(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	tenantID := tenantIDParam(c)
+
+	res, err := ctxMeta.Db[app.DbMain].Exec(
+		ctx,
+		`DELETE FROM spd.tenants WHERE tenant_id = $1`,
+		tenantID,
+	)
+	if pgErr := pgConstraintViolation(err); pgErr != nil {
+		return retFail(
+			c,
+			apitypes.ErrInvalidRequest,
+			"tenant %d is still referenced and can not be deleted ( %s ): consider inactivating its provider registrations instead",
+			tenantID,
+			pgErr.Message,
+		)
+	} else if err != nil {
+		return cmn.WrErr(err)
+	}
+	if res.RowsAffected() == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "tenant %d does not exist", tenantID)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, nil, "tenant %d deleted", tenantID)
+}
+
+func apiAdminListTenantProviders(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	tenantID := tenantIDParam(c)
+
+	ret := responseAdminTenantProviders{
+		Registrations: make([]adminTenantProvider, 0, 1024),
+	}
+	if err := pgxscan.Select(
+		ctx,
+		ctxMeta.Db[app.DbMain],
+		&ret.Registrations,
+		`
+		SELECT tenant_id, 'f0' || provider_id::TEXT AS provider_id, tenant_provider_meta
+			FROM spd.tenants_providers
+		WHERE tenant_id = $1
+		ORDER BY provider_id
+		`,
+		tenantID,
+	); err != nil {
+		return cmn.WrErr(err)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, ret, "")
+}
+
+func apiAdminUpsertTenantProvider(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	tenantID := tenantIDParam(c)
+	spID, _ := actorParam(c, "spID")
+
+	var req struct {
+		TenantProviderMeta json.RawMessage `json:"tenant_provider_meta"`
+	}
+	if err := parseJSONBody(c, &req); err != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+	}
+	if len(req.TenantProviderMeta) == 0 {
+		req.TenantProviderMeta = json.RawMessage(`{}`)
+	}
+	if err := validateTenantProviderMeta(req.TenantProviderMeta); err != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+	}
+
+	if err := ctxMeta.Db[app.DbMain].BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(
+			ctx,
+			`INSERT INTO spd.providers ( provider_id ) VALUES ( $1 ) ON CONFLICT DO NOTHING`,
+			spID,
+		); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			ctx,
+			`
+			INSERT INTO spd.tenants_providers ( tenant_id, provider_id, tenant_provider_meta )
+				VALUES ( $1, $2, $3 )
+			ON CONFLICT ( tenant_id, provider_id ) DO UPDATE SET
+				tenant_provider_meta = EXCLUDED.tenant_provider_meta
+			`,
+			tenantID,
+			spID,
+			req.TenantProviderMeta,
+		)
+		return err
+	}); err != nil {
+		if pgErr := pgConstraintViolation(err); pgErr != nil {
+			return retFail(c, apitypes.ErrInvalidRequest, "registration could not be stored: %s", pgErr.Message)
+		}
+		return cmn.WrErr(err)
+	}
+
+	return retPayloadAnnotated(
+		c,
+		http.StatusOK,
+		0,
+		responseAdminTenantProviders{
+			Registrations: []adminTenantProvider{{
+				TenantID:           tenantID,
+				ProviderID:         spID.String(),
+				TenantProviderMeta: req.TenantProviderMeta,
+			}},
+		},
+		"provider %s registration with tenant %d stored", spID, tenantID,
+	)
+}
+
+func apiAdminDeleteTenantProvider(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	tenantID := tenantIDParam(c)
+	spID, _ := actorParam(c, "spID")
+
+	res, err := ctxMeta.Db[app.DbMain].Exec(
+		ctx,
+		`DELETE FROM spd.tenants_providers WHERE tenant_id = $1 AND provider_id = $2`,
+		tenantID,
+		spID,
+	)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	if res.RowsAffected() == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "provider %s is not registered with tenant %d", spID, tenantID)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, nil, "provider %s registration with tenant %d removed", spID, tenantID)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+
+	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
+	"github.com/labstack/echo/v4"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/app"
+)
+
+func apiAdminGetTenantWebhook(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	tenantID := tenantIDParam(c)
+
+	wh, err := selectWebhook(ctx, ctxMeta.GlobalContext, 0, tenantID)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	if wh == nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "no webhook is registered for tenant %d", tenantID)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, responseWebhook{Webhook: wh}, webhookEventsDesc)
+}
+
+// (re)registration always rotates the secret and reactivates the hook
+func apiAdminSetTenantWebhook(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	tenantID := tenantIDParam(c)
+
+	var req struct {
+		WebhookURL string `json:"webhook_url"`
+	}
+	if err := parseJSONBody(c, &req); err != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+	}
+	if err := validateWebhookURL(req.WebhookURL); err != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	if _, err := ctxMeta.Db[app.DbMain].Exec(
+		ctx,
+		`
+		INSERT INTO spd.webhooks ( tenant_id, webhook_url, webhook_secret )
+			VALUES ( $1, $2, $3 )
+		ON CONFLICT ( tenant_id ) WHERE ( tenant_id IS NOT NULL ) DO UPDATE SET
+			webhook_url = EXCLUDED.webhook_url,
+			webhook_secret = EXCLUDED.webhook_secret,
+			webhook_meta = spd.webhooks.webhook_meta - 'inactivated'
+		`,
+		tenantID,
+		req.WebhookURL,
+		secret,
+	); err != nil {
+		if pgErr := pgConstraintViolation(err); pgErr != nil {
+			return retFail(c, apitypes.ErrInvalidRequest, "webhook could not be registered for tenant %d: %s", tenantID, pgErr.Message)
+		}
+		return cmn.WrErr(err)
+	}
+
+	wh, err := selectWebhook(ctx, ctxMeta.GlobalContext, 0, tenantID)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, responseWebhook{Webhook: wh}, "webhook registered for tenant %d", tenantID)
+}
+
+func apiAdminDeleteTenantWebhook(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	tenantID := tenantIDParam(c)
+
+	res, err := ctxMeta.Db[app.DbMain].Exec(
+		ctx,
+		`DELETE FROM spd.webhooks WHERE tenant_id = $1`,
+		tenantID,
+	)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	if res.RowsAffected() == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "no webhook is registered for tenant %d", tenantID)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, responseWebhook{}, "webhook of tenant %d removed", tenantID)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
+	"github.com/labstack/echo/v4"
+	"github.com/ribasushi/spade/internal/app"
+)
+
+type oaObj = map[string]interface{}
+
+var (
+	openapiOnce sync.Once
+	openapiDoc  []byte
+	openapiErr  error
+)
+
+func apiOpenAPI(c echo.Context) error {
+	openapiOnce.Do(func() {
+		openapiDoc, openapiErr = json.Marshal(buildOpenAPI(routeRegistry()))
+	})
+	if openapiErr != nil {
+		return openapiErr
+	}
+	return c.JSONBlob(http.StatusOK, openapiDoc)
+}
+
+// interface-typed fields are described as any of their known implementations
+var openapiInterfaceImpls = map[reflect.Type][]reflect.Type{
+	reflect.TypeOf((*apitypes.DataSource)(nil)).Elem(): {
+		reflect.TypeOf(apitypes.FilSourceDAG{}),
+		reflect.TypeOf(dataSourceHTTP{}),
+	},
+}
+
+var (
+	typeTime          = reflect.TypeOf(time.Time{})
+	typeRawMessage    = reflect.TypeOf(json.RawMessage{})
+	typeJSONMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	typeTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+type openapiSchemas struct {
+	components  oaObj
+	envelopeRef oaObj
+}
+
+func buildOpenAPI(groups []apiRouteGroup) oaObj {
+	s := &openapiSchemas{components: oaObj{}}
+	s.envelopeRef = s.schemaOf(reflect.TypeOf(apitypes.ResponseEnvelope{}))
+
+	paths := oaObj{}
+	for _, g := range groups {
+		for _, r := range g.Routes {
+			p := openapiPath(g.Prefix + r.Path)
+			if paths[p] == nil {
+				paths[p] = oaObj{}
+			}
+			paths[p].(oaObj)[strings.ToLower(r.Method)] = s.operation(g, r)
+		}
+	}
+
+	return oaObj{
+		"openapi": "3.0.3",
+		"info": oaObj{
+			"title":   app.AppName + " webapi",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": oaObj{
+			"schemas": s.components,
+			"securitySchemes": oaObj{
+				"spid": oaObj{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        echo.HeaderAuthorization,
+					"description": "`" + authScheme + " {epoch};{spID};{signature}[;{signedArg}]` as produced by fil-spid.bash",
+				},
+				"sptoken": oaObj{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "`" + spTokenPrefix + "...` token minted via /sp/mint_token, valid only for routes matching one of its scopes",
+				},
+				"admin": oaObj{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+	}
+}
+
+func (s *openapiSchemas) operation(g apiRouteGroup, r apiRoute) oaObj {
+	op := oaObj{
+		"operationId": operationID(r.Method, g.Prefix+r.Path),
+		"summary":     r.Summary,
+	}
+	if r.Description != "" {
+		op["description"] = r.Description
+	}
+	if g.Prefix != "" {
+		op["tags"] = []string{strings.TrimPrefix(g.Prefix, "/")}
+	}
+	if g.Security != "" {
+		op["security"] = []oaObj{{g.Security: []string{}}}
+		if r.Scope != "" {
+			op["security"] = append(op["security"].([]oaObj), oaObj{"sptoken": []string{r.Scope}})
+		}
+	}
+
+	params := make([]oaObj, 0, len(r.Params))
+	for _, p := range r.Params {
+		if p.Internal {
+			continue
+		}
+		schema := oaObj{"type": string(p.Type)}
+		if p.Format != "" {
+			schema["format"] = p.Format
+		}
+		if p.Type == paramInteger {
+			schema["minimum"] = p.Min
+			schema["maximum"] = p.Max
+		}
+		if p.Default != nil {
+			schema["default"] = p.Default
+		}
+		param := oaObj{
+			"name":     p.Name,
+			"in":       p.In,
+			"required": p.In == paramInPath,
+			"schema":   schema,
+		}
+		if p.Description != "" {
+			param["description"] = p.Description
+		}
+		params = append(params, param)
+	}
+	if r.Produces == "" {
+		params = append(params, oaObj{
+			"name":        "pretty",
+			"in":          paramInQuery,
+			"description": "Force JSON indentation on or off, regardless of User-Agent",
+			"schema":      oaObj{"type": string(paramBoolean)},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if r.Body != "" {
+		op["requestBody"] = oaObj{
+			"required":    true,
+			"description": r.Body,
+			"content": oaObj{
+				echo.MIMEApplicationJSON: oaObj{"schema": oaObj{"type": "object"}},
+			},
+		}
+	}
+
+	if r.Produces != "" {
+		op["responses"] = oaObj{
+			"200": oaObj{
+				"description": "OK",
+				"content":     oaObj{r.Produces: oaObj{"schema": oaObj{"type": "string"}}},
+			},
+		}
+		return op
+	}
+
+	okSchema := s.envelopeRef
+	if r.Response != nil {
+		okSchema = oaObj{
+			"allOf": []oaObj{
+				s.envelopeRef,
+				{
+					"type":       "object",
+					"properties": oaObj{"response": s.schemaOf(reflect.TypeOf(r.Response))},
+				},
+			},
+		}
+	}
+	errContent := envelopeContent(s.envelopeRef)
+	responses := oaObj{
+		"200": oaObj{"description": "OK", "content": envelopeContent(okSchema)},
+		"403": oaObj{"description": "The request is invalid or can not be satisfied, see error_code / error_slug", "content": errContent},
+	}
+	if g.Auth != nil {
+		responses["401"] = oaObj{"description": "Missing or invalid Authorization", "content": errContent}
+	}
+	op["responses"] = responses
+
+	return op
+}
+
+func envelopeContent(schema oaObj) oaObj {
+	return oaObj{
+		echo.MIMEApplicationJSON: oaObj{"schema": schema},
+		mimeCBOR:                 oaObj{"schema": schema},
+	}
+}
+
+// GET /sp/request_piece/:pieceCID => getSpRequestPiece
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, seg := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '_' || r == '-' }) {
+		if strings.HasPrefix(seg, ":") {
+			seg = "by" + strings.ToUpper(seg[1:2]) + seg[2:]
+		}
+		b.WriteString(strings.ToUpper(seg[:1]) + seg[1:])
+	}
+	return b.String()
+}
+
+func (s *openapiSchemas) schemaOf(t reflect.Type) oaObj {
+	switch {
+	case t == typeTime:
+		return oaObj{"type": "string", "format": "date-time"}
+	case t == typeRawMessage:
+		return oaObj{}
+	}
+
+	if t.Kind() == reflect.Pointer {
+		sch := s.schemaOf(t.Elem())
+		if _, isRef := sch["$ref"]; isRef {
+			return oaObj{"allOf": []oaObj{sch}, "nullable": true}
+		}
+		sch["nullable"] = true
+		return sch
+	}
+
+	if impls, known := openapiInterfaceImpls[t]; known {
+		oneOf := make([]oaObj, len(impls))
+		for i, it := range impls {
+			oneOf[i] = s.schemaOf(it)
+		}
+		return oaObj{"oneOf": oneOf}
+	}
+
+	// types with custom encoders: the best we can say without calling them
+	if t.Kind() != reflect.Struct || t.Name() != "" {
+		if t.Implements(typeTextMarshaler) || reflect.PointerTo(t).Implements(typeTextMarshaler) {
+			return oaObj{"type": "string"}
+		}
+		if t.Implements(typeJSONMarshaler) || reflect.PointerTo(t).Implements(typeJSONMarshaler) {
+			return oaObj{}
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return oaObj{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return oaObj{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return oaObj{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return oaObj{"type": "number"}
+	case reflect.String:
+		return oaObj{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return oaObj{"type": "string", "format": "byte"}
+		}
+		return oaObj{"type": "array", "items": s.schemaOf(t.Elem())}
+	case reflect.Map:
+		return oaObj{"type": "object", "additionalProperties": s.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, seen := s.components[name]; !seen {
+			s.components[name] = oaObj{} // placeholder, in case of recursion
+			s.components[name] = s.structSchema(t)
+		}
+		return oaObj{"$ref": "#/components/schemas/" + name}
+	default:
+		return oaObj{}
+	}
+}
+
+func (s *openapiSchemas) structSchema(t reflect.Type) oaObj {
+	props := oaObj{}
+	var required []string
+	s.collectFields(t, props, &required)
+
+	sch := oaObj{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		sch["required"] = required
+	}
+	return sch
+}
+
+func (s *openapiSchemas) collectFields(t reflect.Type, props oaObj, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		// embedded structs without an explicit name are flattened, just like encoding/json does
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				s.collectFields(ft, props, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = s.schemaOf(f.Type)
+		if !strings.Contains(","+opts+",", ",omitempty,") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// apitypes.Piece => "apitypes.Piece", local types keep their bare name
+func schemaName(t reflect.Type) string {
+	return strings.TrimPrefix(t.String(), "main.")
+}
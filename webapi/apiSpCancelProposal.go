@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/app"
+)
+
+const (
+	cancelProposalsMaxBulk = 1024
+	cancelledByProvider    = "cancelled by provider"
+)
+
+type proposalNotCancelled struct {
+	ProposalID string `json:"proposal_id"`
+	Reason     string `json:"reason"`
+}
+
+type responseCancelledProposals struct {
+	localResponsePayload
+	Cancelled    []string               `json:"cancelled"`
+	NotCancelled []proposalNotCancelled `json:"not_cancelled,omitempty"`
+}
+
+func apiSpCancelProposal(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	pUUID, _ := uuidParam(c, "proposalUUID")
+
+	res, err := cancelProposals(ctx, ctxMeta.authedActorID, []uuid.UUID{pUUID})
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	if len(res.Cancelled) == 0 {
+		return retPayloadAnnotated(c, http.StatusForbidden,
+			apitypes.ErrInvalidRequest,
+			res,
+			"Proposal %s can not be cancelled: %s", pUUID, res.NotCancelled[0].Reason,
+		)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, res, "%s", cancelledMsg(c, ctxMeta.authedActorID, res))
+}
+
+func apiSpCancelProposals(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	idsArg, _ := stringParam(c, "ids")
+	ids := strings.FieldsFunc(idsArg, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(ids) == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "A comma-separated list of proposal IDs must be supplied via the 'ids' parameter")
+	}
+	if len(ids) > cancelProposalsMaxBulk {
+		return retFail(c, apitypes.ErrInvalidRequest, "At most %d proposals can be cancelled at once, %d requested", cancelProposalsMaxBulk, len(ids))
+	}
+
+	seen := make(map[uuid.UUID]struct{}, len(ids))
+	pUUIDs := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		pUUID, err := uuid.Parse(id)
+		if err != nil {
+			return retFail(c, apitypes.ErrInvalidRequest, "Proposal ID '%s' is not valid: %s", id, err)
+		}
+		if _, dup := seen[pUUID]; !dup {
+			seen[pUUID] = struct{}{}
+			pUUIDs = append(pUUIDs, pUUID)
+		}
+	}
+
+	res, err := cancelProposals(ctx, ctxMeta.authedActorID, pUUIDs)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, res, "%s", cancelledMsg(c, ctxMeta.authedActorID, res))
+}
+
+func cancelledMsg(c echo.Context, spID fil.ActorID, res responseCancelledProposals) string {
+	msg := []string{
+		fmt.Sprintf("Cancelled %d proposals, the corresponding in-flight quota is available again", len(res.Cancelled)),
+	}
+	if len(res.NotCancelled) > 0 {
+		msg = append(msg, fmt.Sprintf("%d proposals could not be cancelled, see not_cancelled below", len(res.NotCancelled)))
+	}
+	return strings.Join(append(msg,
+		``,
+		`Cancelled proposals are listed among the recent_failures of:`,
+		" "+curlAuthedForSP(c, spID, "/sp/pending_proposals"),
+	), "\n")
+}
+
+// Only proposals which have not (yet) resulted in a published deal can be cancelled:
+// beyond that point the SP is committed on-chain, and the regular deal lifecycle applies
+func cancelProposals(ctx context.Context, spID fil.ActorID, pUUIDs []uuid.UUID) (responseCancelledProposals, error) {
+	res := responseCancelledProposals{
+		Cancelled: make([]string, 0, len(pUUIDs)),
+	}
+	ids := make([]string, len(pUUIDs))
+	for i := range pUUIDs {
+		ids[i] = pUUIDs[i].String()
+	}
+
+	err := app.GetGlobalCtx(ctx).Db[app.DbMain].BeginFunc(ctx, func(tx pgx.Tx) error {
+
+		if err := pgxscan.Select(
+			ctx,
+			tx,
+			&res.Cancelled,
+			`
+			UPDATE spd.proposals SET
+				proposal_failstamp = spd.big_now(),
+				proposal_meta = proposal_meta || JSONB_BUILD_OBJECT(
+					'failure', $3::TEXT,
+					'cancelled_by_provider', true
+				)
+			WHERE
+				proposal_uuid = ANY( $2::UUID[] )
+					AND
+				provider_id = $1
+					AND
+				proposal_failstamp = 0
+					AND
+				activated_deal_id IS NULL
+					AND
+				NOT EXISTS (
+					SELECT 42
+						FROM spd.published_deals pd
+					WHERE
+						pd.piece_id = proposals.piece_id
+							AND
+						pd.provider_id = proposals.provider_id
+							AND
+						pd.client_id = proposals.client_id
+							AND
+						pd.status = 'published'
+				)
+			RETURNING proposal_uuid::TEXT
+			`,
+			spID,
+			ids,
+			cancelledByProvider,
+		); err != nil {
+			return cmn.WrErr(err)
+		}
+
+		if len(res.Cancelled) == len(pUUIDs) {
+			return nil
+		}
+
+		// explain what happened to the rest
+		if err := pgxscan.Select(
+			ctx,
+			tx,
+			&res.NotCancelled,
+			`
+			SELECT
+					req.proposal_uuid::TEXT AS proposal_id,
+					( CASE
+						WHEN pr.proposal_uuid IS NULL THEN 'unknown proposal'
+						WHEN pr.proposal_meta->'cancelled_by_provider' IS NOT NULL THEN 'already cancelled'
+						WHEN pr.proposal_failstamp > 0 THEN 'proposal already failed: ' || ( pr.proposal_meta->>'failure' )
+						WHEN pr.activated_deal_id IS NOT NULL THEN 'deal already activated'
+						ELSE 'deal already published'
+					END ) AS reason
+				FROM UNNEST( $2::UUID[] ) req( proposal_uuid )
+				LEFT JOIN spd.proposals pr
+					ON pr.proposal_uuid = req.proposal_uuid AND pr.provider_id = $1
+			WHERE
+				req.proposal_uuid::TEXT != ALL( $3::TEXT[] )
+			`,
+			spID,
+			ids,
+			res.Cancelled,
+		); err != nil {
+			return cmn.WrErr(err)
+		}
+
+		return nil
+	})
+	return res, err
+}
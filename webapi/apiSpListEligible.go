@@ -1,6 +1,8 @@
 package main //nolint:revive
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -10,63 +12,157 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/ribasushi/go-toolbox/cmn"
 	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/xerrors"
 )
 
+const (
+	mimeNDJSON             = "application/x-ndjson"
+	listEligibleCursorHdr  = "X-SPADE-NEXT-CURSOR"
+	listEligibleCursorVers = 2
+)
+
+type eligiblePieceRow struct {
+	PieceID                    int64
+	PieceLog2Size              uint8
+	CoarseLatestActiveEndEpoch *int32
+	pieceSources
+	*apitypes.Piece
+}
+
+// eligibleSortKey is the position of a piece within the MASTER SORT of mv_pieces_availability,
+// with every term flipped to ascending. Unlike display_sort it does not change across matview
+// refreshes, and as it ends with the unique piece_cid no two pieces share it.
+type eligibleSortKey struct {
+	Small       bool   `json:"sm,omitempty"`
+	NoHTTP      bool   `json:"nh,omitempty"`
+	NoFilActive bool   `json:"nf,omitempty"`
+	EndEpoch    int32  `json:"ee,omitempty"`
+	PieceCid    string `json:"p"`
+}
+
+func (p *eligiblePieceRow) sortKey() eligibleSortKey {
+	k := eligibleSortKey{
+		Small:       p.PieceLog2Size < 18,
+		NoHTTP:      !p.HasSourcesHTTP,
+		NoFilActive: p.CoarseLatestActiveEndEpoch == nil,
+		PieceCid:    p.PieceCid,
+	}
+	if p.CoarseLatestActiveEndEpoch != nil {
+		k.EndEpoch = *p.CoarseLatestActiveEndEpoch
+	}
+	return k
+}
+
+// eligibleCursor is handed out base64-encoded, and is only valid with the same filters it was issued for
+type eligibleCursor struct {
+	Version           int             `json:"v"`
+	After             eligibleSortKey `json:"a"`
+	TenantID          int16           `json:"t,omitempty"`
+	IncludeSourceless bool            `json:"s,omitempty"`
+	OrglocalOnly      bool            `json:"o,omitempty"`
+}
+
+func (ec eligibleCursor) String() string {
+	j, _ := json.Marshal(ec)
+	return base64.RawURLEncoding.EncodeToString(j)
+}
+
+func parseEligibleCursor(s string, expect eligibleCursor) (eligibleSortKey, error) {
+	j, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return eligibleSortKey{}, xerrors.New("the supplied 'cursor' is not valid")
+	}
+	var ec eligibleCursor
+	if err := strictUnmarshal(j, &ec); err != nil || ec.Version != listEligibleCursorVers || ec.After.PieceCid == "" || (ec.After.NoFilActive && ec.After.EndEpoch != 0) {
+		return eligibleSortKey{}, xerrors.New("the supplied 'cursor' is not valid")
+	}
+	expect.After = ec.After
+	if ec != expect {
+		return eligibleSortKey{}, xerrors.New("the supplied 'cursor' was issued for a different combination of 'tenant', 'include-sourceless' and 'orglocal-only'")
+	}
+	return ec.After, nil
+}
+
+type ndjsonTrailer struct {
+	StreamEnd  bool   `json:"stream_end"`
+	RequestID  string `json:"request_id,omitempty"`
+	Entries    int    `json:"entries"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
 func apiSpListEligible(c echo.Context) error {
 	ctx, ctxMeta := unpackAuthedEchoContext(c)
 
+	streaming := strings.Contains(c.Request().Header.Get(echo.HeaderAccept), mimeNDJSON)
+
 	lim := uint64(listEligibleDefaultSize)
-	if c.QueryParams().Has("limit") {
-		var err error
-		lim, err = parseUIntQueryParam(c, "limit", 1, listEligibleMaxSize)
-		if err != nil {
-			return retFail(c, apitypes.ErrInvalidRequest, err.Error())
-		}
+	if streaming {
+		lim = listEligibleMaxSize
 	}
-
-	tenantID := int16(0) // 0 == any
-	if c.QueryParams().Has("tenant") {
-		tid, err := parseUIntQueryParam(c, "tenant", 1, 1<<15)
-		if err != nil {
-			return retFail(c, apitypes.ErrInvalidRequest, err.Error())
-		}
-		tenantID = int16(tid)
+	if l, present := uintParam(c, "limit"); present {
+		lim = l
 	}
 
+	tid, _ := uintParam(c, "tenant")
+	tenantID := int16(tid) // 0 == any
+
 	var restrictToOrgID int16
-	orglocalOnly := truthyBoolQueryParam(c, "orglocal-only")
+	orglocalOnly := boolParam(c, "orglocal-only")
 	if orglocalOnly {
 		restrictToOrgID = ctxMeta.spOrgID
 	}
 
+	cursorTpl := eligibleCursor{
+		Version:           listEligibleCursorVers,
+		TenantID:          tenantID,
+		IncludeSourceless: boolParam(c, "include-sourceless"),
+		OrglocalOnly:      orglocalOnly,
+	}
+	var after eligibleSortKey // zero value == from the start
+	if cursor, present := stringParam(c, "cursor"); present {
+		var err error
+		after, err = parseEligibleCursor(cursor, cursorTpl)
+		if err != nil {
+			return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+		}
+	}
+
 	// how to list: start small, find setting below
 	useQueryFunc := "pieces_eligible_head"
 
-	if c.QueryParams().Has("internal-nolateral") { // secret flag to tune this in flight / figure out optimal values
-		if truthyBoolQueryParam(c, "internal-nolateral") {
+	if _, present := validatedParam(c, "internal-nolateral"); present {
+		if boolParam(c, "internal-nolateral") {
 			useQueryFunc = "pieces_eligible_full"
 		}
-	} else if lim > listEligibleDefaultSize { // deduce from requested lim
+	} else if lim > listEligibleDefaultSize || streaming { // deduce from requested lim
 		useQueryFunc = "pieces_eligible_full"
 	}
 
-	orderedPieces := make([]*struct {
-		PieceID       int64
-		PieceLog2Size uint8
-		pieceSources
-		*apitypes.Piece
-	}, 0, lim+1)
+	query := fmt.Sprintf("SELECT * FROM spd.%s( $1, $2, $3, $4, $5, $6, $7, $8, $9, $10 )", useQueryFunc)
+	queryArgs := []interface{}{
+		ctxMeta.authedActorID,
+		lim + 1, // ask for one extra, to disambiguate "there is more"
+		tenantID,
+		cursorTpl.IncludeSourceless,
+		orglocalOnly,
+		after.Small,
+		after.NoHTTP,
+		after.NoFilActive,
+		after.EndEpoch,
+		after.PieceCid,
+	}
+
+	if streaming {
+		return streamEligible(c, lim, cursorTpl, restrictToOrgID, query, queryArgs...)
+	}
 
+	orderedPieces := make([]*eligiblePieceRow, 0, lim+1)
 	if err := pgxscan.Select(
 		ctx,
 		ctxMeta.Db[app.DbMain],
 		&orderedPieces,
-		fmt.Sprintf("SELECT * FROM spd.%s( $1, $2, $3, $4, $5 )", useQueryFunc),
-		ctxMeta.authedActorID,
-		lim+1, // ask for one extra, to disambiguate "there is more"
-		tenantID,
-		truthyBoolQueryParam(c, "include-sourceless"),
-		orglocalOnly,
+		query,
+		queryArgs...,
 	); err != nil {
 		return cmn.WrErr(err)
 	}
@@ -110,20 +206,111 @@ func apiSpListEligible(c echo.Context) error {
 			exLim = listEligibleDefaultSize
 		}
 
+		cursorTpl.After = orderedPieces[lim-1].sortKey()
+		nextCursor := cursorTpl.String()
+		c.Response().Header().Set(listEligibleCursorHdr, nextCursor)
+
 		info = append(
 			[]string{
 				fmt.Sprintf(`NOTE: The complete list of entries has been TRUNCATED to the top %d.`, lim),
 				"Use the 'limit' param in your API call to request more of the (possibly very large) list:",
 				" " + curlAuthedForSP(c, ctxMeta.authedActorID, fmt.Sprintf("%s?limit=%d", c.Request().URL.Path, (2*exLim)/100*100)),
+				"or fetch the next page, using the cursor also returned in the " + listEligibleCursorHdr + " header:",
+				" " + curlAuthedForSP(c, ctxMeta.authedActorID, fmt.Sprintf("%s?%s", c.Request().URL.Path, nextPageParams(c, nextCursor))),
 				"",
 			},
 			info...,
 		)
 	}
 
-	srcPtrs := make(piecePointers, len(orderedPieces))
 	ret := make(apitypes.ResponsePiecesEligible, len(orderedPieces))
-	for i, p := range orderedPieces {
+	if err := finalizeEligible(c, orderedPieces, ret, restrictToOrgID); err != nil {
+		return cmn.WrErr(err)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, ret, "%s", strings.Join(info, "\n"))
+}
+
+// streamEligible writes one apitypes.Piece per line as rows arrive, followed by a single ndjsonTrailer.
+// Sources are injected in chunks, so memory use is bounded regardless of limit.
+func streamEligible(c echo.Context, lim uint64, cursorTpl eligibleCursor, restrictToOrgID int16, query string, args ...interface{}) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	rows, err := ctxMeta.Db[app.DbMain].Query(ctx, query, args...)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	defer rows.Close()
+	rs := pgxscan.NewRowScanner(rows)
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, mimeNDJSON)
+	resp.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(resp)
+
+	trailer := ndjsonTrailer{
+		StreamEnd: true,
+		RequestID: c.Request().Header.Get("X-SPADE-REQUEST-UUID"),
+	}
+
+	chunk := make([]*eligiblePieceRow, 0, listEligibleStreamChunk)
+	flushChunk := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		ret := make(apitypes.ResponsePiecesEligible, len(chunk))
+		if err := finalizeEligible(c, chunk, ret, restrictToOrgID); err != nil {
+			return err
+		}
+		for _, p := range ret {
+			if err := enc.Encode(p); err != nil {
+				return cmn.WrErr(err)
+			}
+		}
+		resp.Flush()
+		trailer.Entries += len(chunk)
+		chunk = chunk[:0]
+		return nil
+	}
+
+	var seen uint64
+	var lastSortKey eligibleSortKey
+	for rows.Next() {
+		seen++
+		if seen > lim {
+			cursorTpl.After = lastSortKey
+			trailer.NextCursor = cursorTpl.String()
+			break
+		}
+
+		p := new(eligiblePieceRow)
+		if err := rs.Scan(p); err != nil {
+			return cmn.WrErr(err)
+		}
+		lastSortKey = p.sortKey()
+		chunk = append(chunk, p)
+
+		if len(chunk) == listEligibleStreamChunk {
+			if err := flushChunk(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return cmn.WrErr(err)
+	}
+	if err := flushChunk(); err != nil {
+		return err
+	}
+
+	return cmn.WrErr(enc.Encode(trailer))
+}
+
+func finalizeEligible(c echo.Context, rows []*eligiblePieceRow, ret apitypes.ResponsePiecesEligible, restrictToOrgID int16) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	srcPtrs := make(piecePointers, len(rows))
+	for i, p := range rows {
 		p.PaddedPieceSize = 1 << p.PieceLog2Size
 		p.SampleRequestCmd = curlAuthedForSP(c, ctxMeta.authedActorID, "/sp/request_piece/"+p.PieceCid)
 		ret[i] = p.Piece
@@ -133,9 +320,12 @@ func apiSpListEligible(c echo.Context) error {
 		srcPtrs[p.PieceID] = p.pieceSources
 	}
 
-	if err := injectSources(ctx, srcPtrs, restrictToOrgID); err != nil {
-		return cmn.WrErr(err)
-	}
+	return injectSources(ctx, srcPtrs, restrictToOrgID)
+}
 
-	return retPayloadAnnotated(c, http.StatusOK, 0, ret, strings.Join(info, "\n"))
+// the current query with cursor swapped in
+func nextPageParams(c echo.Context, cursor string) string {
+	qp := c.Request().URL.Query()
+	qp.Set("cursor", cursor)
+	return qp.Encode()
 }
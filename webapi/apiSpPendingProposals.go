@@ -62,7 +62,7 @@ func apiSpListPendingProposals(c echo.Context) error {
 						pd.status = 'published'
 				) ) AS is_published,
 				COALESCE( ( pa.coarse_latest_active_end_epoch IS NOT NULL ), false ) AS has_sources_fil_active,
-				false AS has_sources_http
+				COALESCE( pa.http_available, false ) AS has_sources_http
 			FROM spd.proposals pr
 			JOIN spd.pieces p USING ( piece_id )
 			JOIN spd.clients c USING ( client_id )
@@ -31,7 +31,7 @@ var v1UrlEnc = multibase.MustNewEncoder(multibase.Base64url)
 func apiSpRequestPiece(c echo.Context) error {
 	ctx, ctxMeta := unpackAuthedEchoContext(c)
 
-	pCidArg := c.Param("pieceCID")
+	pCidArg, _ := stringParam(c, "pieceCID")
 	pCid, err := cid.Parse(pCidArg)
 	if err != nil {
 		return retFail(c, apitypes.ErrInvalidRequest, "Requested PieceCid '%s' is not valid: %s", pCidArg, err)
@@ -47,14 +47,8 @@ func apiSpRequestPiece(c echo.Context) error {
 		)
 	}
 
-	tenantID := int16(0) // 0 == any
-	if c.QueryParams().Has("tenant") {
-		tid, err := parseUIntQueryParam(c, "tenant", 1, 1<<15)
-		if err != nil {
-			return retFail(c, apitypes.ErrInvalidRequest, err.Error())
-		}
-		tenantID = int16(tid)
-	}
+	tid, _ := uintParam(c, "tenant")
+	tenantID := int16(tid) // 0 == any
 
 	// check whether the provider has been polled
 	if ctxMeta.spInfoLastPolled == nil ||
@@ -71,24 +65,21 @@ func apiSpRequestPiece(c echo.Context) error {
 		return retFail(
 			c,
 			apitypes.ErrStorageProviderUndialable,
-			strings.Join([]string{
-				"It appears your provider can not be libp2p-dialed over the TCP transport.",
-				"Please invoke the status endpoint for further details:",
-				curlAuthedForSP(c, ctxMeta.authedActorID, "/sp/status"),
-			}, "\n"),
+			"It appears your provider can not be libp2p-dialed over the TCP transport.\nPlease invoke the status endpoint for further details:\n%s",
+			curlAuthedForSP(c, ctxMeta.authedActorID, "/sp/status"),
 		)
 	}
 
 	// only boost
-	if _, canV120 := ctxMeta.spInfo.PeerInfo.Protos[filtypes.StorageProposalV120]; !canV120 {
+	if filtypes.NegotiateStorageProposalProtocol(ctxMeta.spInfo.PeerInfo.Protos) == "" {
 		return retFail(
 			c,
 			apitypes.ErrStorageProviderUnsupported,
 			strings.Join([]string{
-				"It appears your provider does not support %s.",
+				"It appears your provider does not support any of: %s.",
 				"You must upgrade to Boost v1.5.1 or equivalent to use ♠️",
 			}, "\n"),
-			filtypes.StorageProposalV120,
+			strings.Join(filtypes.StorageProposalProtocols, ", "),
 		)
 	}
 
@@ -99,6 +90,29 @@ func apiSpRequestPiece(c echo.Context) error {
 		return retFail(c, errCode, ineligibleSpMsg(ctxMeta.authedActorID))
 	}
 
+	// Outcomes of the reservation hooks are recorded only after the transaction is over: the
+	// refusal path writes the same spd.requests row via retPayloadAnnotated on a separate
+	// connection, which would block forever behind a row lock held by our transaction.
+	var hookOutcomes []reservationHookOutcome
+	defer func() {
+		if len(hookOutcomes) == 0 {
+			return
+		}
+		if _, err := ctxMeta.Db[app.DbMain].Exec(
+			ctx,
+			`
+			UPDATE spd.requests SET
+				request_meta = JSONB_SET( request_meta, '{ reservation_hooks }', $1 )
+			WHERE
+				request_uuid = $2
+			`,
+			hookOutcomes,
+			c.Request().Header.Get("X-SPADE-REQUEST-UUID"),
+		); err != nil {
+			app.GetGlobalCtx(ctx).Logger.Errorw("unable to record reservation hook outcomes", "error", err)
+		}
+	}()
+
 	return ctxMeta.Db[app.DbMain].BeginFunc(ctx, func(tx pgx.Tx) error {
 
 		_, err = tx.Exec(
@@ -124,6 +138,8 @@ func apiSpRequestPiece(c echo.Context) error {
 			StartWithinHours       int16
 			RecentlyUsedStartEpoch *int64
 
+			ScoresBelowMin []string
+
 			TenantMeta []byte
 		}
 
@@ -163,12 +179,13 @@ func apiSpRequestPiece(c echo.Context) error {
 		}
 
 		// count ineligibles, assemble actual return
-		var countNoDataCap, countAlreadyDealt, countOverReplicated, countOverPending int
-		var chosenTenant *tenantEligible
+		var countNoDataCap, countAlreadyDealt, countOverReplicated, countOverPending, countBelowMinScore int
+		candidates := make([]*tenantEligible, 0, len(tenantsEligible))
 		resp := apitypes.ResponseDealRequest{
 			ReplicationStates: make([]apitypes.TenantReplicationState, len(tenantsEligible)),
 		}
-		for i, te := range tenantsEligible {
+		for i := range tenantsEligible {
+			te := &tenantsEligible[i]
 			if te.TenantClientID != nil {
 				s := te.TenantClientID.String()
 				te.TenantReplicationState.TenantClient = &s
@@ -197,15 +214,19 @@ func apiSpRequestPiece(c echo.Context) error {
 				countOverPending++
 				invalidated = true
 			}
+			if len(te.ScoresBelowMin) > 0 {
+				countBelowMinScore++
+				invalidated = true
+			}
 
-			if !invalidated && chosenTenant == nil {
-				chosenTenant = &te
+			if !invalidated {
+				candidates = append(candidates, te)
 			}
 		}
 
 		// handle "no takers" here, for ease of reading further down
 		// this is slightly convoluted since we can have a "mixed error condition" - handled in the default:
-		if chosenTenant == nil {
+		if len(candidates) == 0 {
 
 			switch len(tenantsEligible) {
 
@@ -236,6 +257,19 @@ func apiSpRequestPiece(c echo.Context) error {
 					"Provider has more proposals in-flight than permitted by selected tenant rules",
 				)
 
+			case countBelowMinScore:
+				belowMin := make([]string, 0, len(tenantsEligible))
+				for _, te := range tenantsEligible {
+					belowMin = append(belowMin, fmt.Sprintf(" - tenant %d: %s", te.TenantID, strings.Join(te.ScoresBelowMin, ", ")))
+				}
+				return retPayloadAnnotated(c, http.StatusForbidden,
+					apitypes.ErrReplicationRulesViolation,
+					resp,
+					"Provider reliability scores are below the minimum required by all selected tenants:\n%s\nPlease invoke the status endpoint for further details:\n%s",
+					strings.Join(belowMin, "\n"),
+					curlAuthedForSP(c, ctxMeta.authedActorID, "/sp/status"),
+				)
+
 			default:
 				return retPayloadAnnotated(c, http.StatusForbidden,
 					apitypes.ErrReplicationRulesViolation,
@@ -246,13 +280,75 @@ func apiSpRequestPiece(c echo.Context) error {
 		}
 
 		//
-		// Here, at the very end, is where we would make a tightly-timeboxed outbound call
-		// to check for potential external eligibility criteria
-		// Then either return ErrExternalReservationRefused or proceed below.
+		// Here, at the very end, is where we make a tightly-timeboxed outbound call for every
+		// tenant with a configured reservation_hook, checking potential external eligibility criteria.
+		// The first tenant ( in order of preference ) without a hook, or whose hook agrees, is chosen.
+		// If every candidate refuses we return ErrExternalReservationRefused.
 		//
 		// We *DO* always check using our own replication rules first, and keep a lock for the duration
 		// ( in order to maintain a uniform "decency floor" among our esteemed SPs ;)
+		// Because of that lock all hooks combined must fit in reservationHookBudgetMsecs: candidates
+		// whose turn comes after the budget is spent are refused without being called.
 		//
+		var chosenTenant *tenantEligible
+		var chosenHookOutcome *reservationHookOutcome
+		hooksCtx, hooksCancel := context.WithTimeout(ctx, reservationHookBudgetMsecs*time.Millisecond)
+		defer hooksCancel()
+		hookOutcomes = make([]reservationHookOutcome, 0, len(candidates))
+		for _, cand := range candidates {
+			hook, err := tenantReservationHookFromMeta(cand.TenantMeta)
+			if err != nil {
+				// invalid configuration can only be fixed by the tenant: refuse, same as an unreachable hook
+				hookOutcomes = append(hookOutcomes, reservationHookOutcome{TenantID: cand.TenantID, Error: err.Error()})
+				continue
+			}
+			if hook == nil {
+				chosenTenant = cand
+				break
+			}
+			if hooksCtx.Err() != nil {
+				hookOutcomes = append(hookOutcomes, reservationHookOutcome{TenantID: cand.TenantID, URL: hook.URL, Error: "not called: overall reservation hook time budget exhausted"})
+				continue
+			}
+
+			o := callReservationHook(hooksCtx, hook, reservationHookRequest{
+				RequestID:           c.Request().Header.Get("X-SPADE-REQUEST-UUID"),
+				TenantID:            cand.TenantID,
+				ProviderID:          ctxMeta.authedActorID.String(),
+				ProviderOrgID:       ctxMeta.spOrgID,
+				ProviderCityID:      ctxMeta.spCityID,
+				ProviderCountryID:   ctxMeta.spCountryID,
+				ProviderContinentID: ctxMeta.spContinentID,
+				PieceCid:            pCid.String(),
+				PaddedPieceSize:     cand.PieceSizeBytes,
+				ProposalLabel:       cand.ProposalLabel,
+				ReplicationState:    cand.TenantReplicationState,
+			})
+			hookOutcomes = append(hookOutcomes, o)
+			if o.Allowed {
+				chosenTenant = cand
+				chosenHookOutcome = &hookOutcomes[len(hookOutcomes)-1]
+				break
+			}
+		}
+
+		if chosenTenant == nil {
+			refusals := make([]string, 0, len(hookOutcomes))
+			for _, o := range hookOutcomes {
+				reason := o.Message
+				if o.Error != "" {
+					reason = "reservation check unavailable"
+				} else if reason == "" {
+					reason = "no reason given"
+				}
+				refusals = append(refusals, fmt.Sprintf(" - tenant %d: %s", o.TenantID, reason))
+			}
+			return retPayloadAnnotated(c, http.StatusForbidden,
+				apitypes.ErrExternalReservationRefused,
+				resp,
+				"All tenants otherwise willing to grant a deal for %s refused the reservation:\n%s", pCid, strings.Join(refusals, "\n"),
+			)
+		}
 
 		// We got that far - let's do it!
 		startEpoch := fil.WallTimeEpoch(time.Now().Add(
@@ -295,8 +391,10 @@ func apiSpRequestPiece(c echo.Context) error {
 		}
 
 		prop := struct {
-			ProposalV0 filmarket.DealProposal `json:"filmarket_proposal"`
+			ProposalV0      filmarket.DealProposal  `json:"filmarket_proposal"`
+			ReservationHook *reservationHookOutcome `json:"reservation_hook,omitempty"`
 		}{
+			ReservationHook: chosenHookOutcome,
 			ProposalV0: filmarket.DealProposal{
 
 				// Label is a *completely* arbitrary, client-chosen nonce to apply to the deal, can be a UTF8-string or []bytes
@@ -364,7 +462,7 @@ func apiSpRequestPiece(c echo.Context) error {
 			http.StatusOK,
 			0,
 			resp,
-			strings.Join([]string{
+			"%s", strings.Join([]string{
 				fmt.Sprintf("Deal queued for PieceCID %s", pCid),
 				``,
 				`In about 5 minutes check the pending list:`,
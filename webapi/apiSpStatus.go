@@ -1,21 +1,287 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
 	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
+	filabi "github.com/filecoin-project/go-state-types/abi"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
 	"github.com/labstack/echo/v4"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/app"
+	"github.com/ribasushi/spade/internal/filtypes"
 )
 
+type spStatusTenant struct {
+	TenantID         int16  `json:"tenant_id"`
+	TenantName       string `json:"tenant_name"`
+	IsActive         bool   `json:"registration_active"`
+	MaxInFlightBytes int64  `json:"tenant_max_in_flight_bytes"`
+	SpInFlightBytes  int64  `json:"actual_in_flight_bytes" db:"cur_in_flight_bytes"`
+
+	MinScores      map[string]int16 `json:"tenant_min_scores,omitempty"`
+	ScoresBelowMin []string         `json:"scores_below_min,omitempty"`
+}
+
+type responseSpStatus struct {
+	localResponsePayload
+
+	ProviderID string `json:"provider_id"`
+
+	Eligibility struct {
+		IsEligible bool   `json:"is_eligible"`
+		ErrCode    int    `json:"error_code,omitempty"`
+		ErrSlug    string `json:"error_slug,omitempty"`
+	} `json:"eligibility"`
+
+	Location struct {
+		OrgID       int16 `json:"org_id"`
+		CityID      int16 `json:"city_id"`
+		CountryID   int16 `json:"country_id"`
+		ContinentID int16 `json:"continent_id"`
+	} `json:"location"`
+
+	PolledInfo struct {
+		LastPolled       *time.Time       `json:"last_polled"`
+		DialingTookMsecs *int64           `json:"dialing_took_msecs,omitempty"`
+		DialingPeerID    *string          `json:"dialing_peerid,omitempty"`
+		Info             *apitypes.SPInfo `json:"info,omitempty"`
+	} `json:"polled_info"`
+
+	Reliability struct {
+		LastComputed *time.Time       `json:"last_computed"`
+		Score        *int16           `json:"provider_score"`
+		Components   map[string]int16 `json:"components"`
+	} `json:"reliability"`
+
+	Retrievals struct {
+		WindowDays   int        `json:"window_days"`
+		LastChecked  *time.Time `json:"last_checked"`
+		Checked      int64      `json:"checked"`
+		Retrieved    int64      `json:"retrieved"`
+		NotAttempted int64      `json:"not_attempted"`
+		LastFailure  *string    `json:"last_failure,omitempty"`
+	} `json:"retrieval_checks"`
+
+	Tenants []spStatusTenant `json:"tenant_registrations"`
+
+	System struct {
+		MarketStateEpoch int64     `json:"market_state_epoch"`
+		MarketStateTime  time.Time `json:"market_state_timestamp"`
+		SchemaVersion    *struct {
+			Major int `json:"major"`
+			Minor int `json:"minor"`
+		} `json:"schema_version,omitempty"`
+	} `json:"system"`
+}
+
+const spStatusRetrievalWindowDays = 7
+
 func apiSpStatus(c echo.Context) error {
-	_, ctxMeta := unpackAuthedEchoContext(c)
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+	db := ctxMeta.Db[app.DbMain]
 
-	return retFail(
-		c,
-		apitypes.ErrSystemTemporarilyDisabled,
+	ret := responseSpStatus{
+		ProviderID: ctxMeta.authedActorID.String(),
+		Tenants:    make([]spStatusTenant, 0, 8),
+	}
+
+	ret.Location.OrgID = ctxMeta.spOrgID
+	ret.Location.CityID = ctxMeta.spCityID
+	ret.Location.CountryID = ctxMeta.spCountryID
+	ret.Location.ContinentID = ctxMeta.spContinentID
+
+	ret.System.MarketStateEpoch = ctxMeta.stateEpoch
+	ret.System.MarketStateTime = fil.MainnetTime(filabi.ChainEpoch(ctxMeta.stateEpoch))
+	if err := db.QueryRow(
+		ctx,
+		`SELECT metadata->'schema_version' FROM spd.global`,
+	).Scan(&ret.System.SchemaVersion); err != nil {
+		return cmn.WrErr(err)
+	}
+
+	ret.PolledInfo.LastPolled = ctxMeta.spInfoLastPolled
+	if ctxMeta.spInfoLastPolled != nil {
+		spi := ctxMeta.spInfo
+		ret.PolledInfo.Info = &spi
+		if err := db.QueryRow(
+			ctx,
+			`
+			SELECT info_dialing_took_msecs, info_dialing_peerid
+				FROM spd.providers_info
+			WHERE provider_id = $1
+			`,
+			ctxMeta.authedActorID,
+		).Scan(&ret.PolledInfo.DialingTookMsecs, &ret.PolledInfo.DialingPeerID); err != nil {
+			return cmn.WrErr(err)
+		}
+	}
+
+	if err := pgxscan.Select(
+		ctx,
+		db,
+		&ret.Tenants,
+		`
+		SELECT
+				t.tenant_id,
+				t.tenant_name,
+				NOT COALESCE( ( tp.tenant_provider_meta->'inactivated' )::BOOL, false ) AS is_active,
+				COALESCE( (tp.tenant_provider_meta->'max_in_flight_GiB')::BIGINT,  (t.tenant_meta->'max'->'default_in_flight_GiB')::BIGINT, 1024 )::BIGINT << 30 AS max_in_flight_bytes,
+				COALESCE(
+					(
+						SELECT SUM( 1::BIGINT << pr.proxied_log2_size )
+							FROM spd.proposals pr
+							JOIN spd.clients c USING ( client_id )
+						WHERE
+							pr.provider_id = tp.provider_id
+								AND
+							pr.proposal_failstamp = 0
+								AND
+							pr.activated_deal_id IS NULL
+								AND
+							c.tenant_id = t.tenant_id
+					)::BIGINT,
+					0::BIGINT
+				) AS cur_in_flight_bytes,
+				t.tenant_meta->'min' AS min_scores,
+				spd.provider_scores_below_min( tp.provider_id, t.tenant_meta ) AS scores_below_min
+			FROM spd.tenants_providers tp
+			JOIN spd.tenants t USING ( tenant_id )
+		WHERE
+			tp.provider_id = $1
+		ORDER BY t.tenant_id
+		`,
+		ctxMeta.authedActorID,
+	); err != nil {
+		return cmn.WrErr(err)
+	}
+
+	if err := db.QueryRow(
+		ctx,
+		`
+		SELECT score_computed, provider_score, score_components
+			FROM spd.provider_scores
+		WHERE provider_id = $1
+		`,
+		ctxMeta.authedActorID,
+	).Scan(&ret.Reliability.LastComputed, &ret.Reliability.Score, &ret.Reliability.Components); err != nil && err != pgx.ErrNoRows {
+		return cmn.WrErr(err)
+	}
+
+	ret.Retrievals.WindowDays = spStatusRetrievalWindowDays
+	if err := db.QueryRow(
+		ctx,
 		`
-                                            !!! COMING SOON !!!
+		SELECT
+				MAX( entry_created ),
+				COUNT(*),
+				COUNT(*) FILTER ( WHERE retrieved ),
+				COUNT(*) FILTER ( WHERE retrieved IS NULL ),
+				(
+					SELECT check_meta->>'error'
+						FROM spd.retrieval_checks
+					WHERE
+						provider_id = $1
+							AND
+						NOT retrieved
+					ORDER BY entry_created DESC
+					LIMIT 1
+				)
+			FROM spd.retrieval_checks
+		WHERE
+			provider_id = $1
+				AND
+			entry_created > NOW() - MAKE_INTERVAL( days => $2 )
+		`,
+		ctxMeta.authedActorID,
+		spStatusRetrievalWindowDays,
+	).Scan(
+		&ret.Retrievals.LastChecked,
+		&ret.Retrievals.Checked,
+		&ret.Retrievals.Retrieved,
+		&ret.Retrievals.NotAttempted,
+		&ret.Retrievals.LastFailure,
+	); err != nil {
+		return cmn.WrErr(err)
+	}
 
-This area will contain various information regarding the system and the current state of Storage Provider %s
-    `,
-		ctxMeta.authedActorID.String(),
+	errCode, err := spIneligibleErr(ctx, ctxMeta.authedActorID)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	ret.Eligibility.IsEligible = (errCode == 0)
+	if errCode != 0 {
+		ret.Eligibility.ErrCode = int(errCode)
+		ret.Eligibility.ErrSlug = errCode.String()
+	}
+
+	//
+	// Assemble a list of everything that would prevent the SP from obtaining deals
+	//
+	problems := make([]string, 0, 8)
+
+	if errCode != 0 {
+		problems = append(problems, fmt.Sprintf("The SP is currently not eligible to use this API ( %s )", errCode))
+	}
+
+	if ctxMeta.spOrgID == 0 {
+		problems = append(problems, "The SP has not yet been assigned an Org/Location by the API administrators")
+	}
+
+	var activeTenants int
+	for _, t := range ret.Tenants {
+		if t.IsActive {
+			activeTenants++
+			if len(t.ScoresBelowMin) > 0 {
+				problems = append(problems, fmt.Sprintf("The SP reliability scores ( %s ) are below the minimum required by tenant %d", strings.Join(t.ScoresBelowMin, ", "), t.TenantID))
+			}
+		}
+	}
+	if activeTenants == 0 {
+		problems = append(problems, "The SP does not have an active registration with any tenant")
+	}
+
+	switch {
+	case ctxMeta.spInfoLastPolled == nil:
+		problems = append(problems, "The SP has never been dialed by the polling system")
+	case ctxMeta.spInfoLastPolled.Before(time.Now().Add(-1 * app.PolledSPInfoStaleAfterMinutes * time.Minute)):
+		problems = append(problems, "The SP has not been dialed by the polling system recently")
+	case ctxMeta.spInfo.PeerInfo == nil || len(ctxMeta.spInfo.PeerInfo.Protos) == 0:
+		problems = append(problems, "The SP can not be libp2p-dialed over the TCP transport ( see polled_info.info.errors )")
+	default:
+		if filtypes.NegotiateStorageProposalProtocol(ctxMeta.spInfo.PeerInfo.Protos) == "" {
+			problems = append(problems, fmt.Sprintf("The SP does not advertise support for any of: %s", strings.Join(filtypes.StorageProposalProtocols, ", ")))
+		}
+	}
+
+	msg := []string{
+		fmt.Sprintf("This is an overview of the state of SP %s as seen by the system", ctxMeta.authedActorID),
+		``,
+	}
+	if len(problems) == 0 {
+		msg = append(msg,
+			`No problems detected: the SP is able to request deal proposals`,
+			``,
+			`You can see a list of pieces you are eligible for via:`,
+			" "+curlAuthedForSP(c, ctxMeta.authedActorID, "/sp/eligible_pieces"),
+		)
+	} else {
+		msg = append(msg, `The following problems currently prevent the SP from obtaining deal proposals:`)
+		for _, p := range problems {
+			msg = append(msg, " - "+p)
+		}
+	}
+
+	return retPayloadAnnotated(
+		c,
+		http.StatusOK,
+		0,
+		ret,
+		"%s", strings.Join(msg, "\n"),
 	)
 }
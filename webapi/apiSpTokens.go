@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/app"
+)
+
+// a token carrying a scope can access every route declaring the same apiRoute.Scope
+const (
+	tokenScopeRead    = "read"    // status and listings
+	tokenScopeReserve = "reserve" // requesting and cancelling proposals
+)
+
+var tokenScopes = map[string]struct{}{
+	tokenScopeRead:    {},
+	tokenScopeReserve: {},
+}
+
+type spToken struct {
+	TokenID  string     `json:"token_id"`
+	Scopes   []string   `json:"scopes" db:"token_scopes"`
+	Label    *string    `json:"label,omitempty" db:"token_label"`
+	Created  time.Time  `json:"created" db:"entry_created"`
+	Expires  time.Time  `json:"expires" db:"token_expires"`
+	LastUsed *time.Time `json:"last_used,omitempty" db:"token_last_used"`
+}
+
+type responseSpTokens struct {
+	localResponsePayload
+	Token  string    `json:"token,omitempty"` // returned only once, by /sp/mint_token
+	Tokens []spToken `json:"tokens"`
+}
+
+func apiSpMintToken(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	// the query is part of the signed auth header: a header signed for any other call can not be
+	// replayed to mint a token, and an intermediary can not alter its scope, ttl or label
+	if q := c.Request().URL.RawQuery; len(ctxMeta.authArg) == 0 || string(ctxMeta.authArg) != q {
+		return retFail(
+			c,
+			apitypes.ErrInvalidRequest,
+			"The query string '%s' must be supplied verbatim as the signed (base64-encoded) argument of your %s Authorization header:\n %s",
+			q, authScheme,
+			curlAuthedForSPWithArg(c, ctxMeta.authedActorID, "/sp/mint_token", q),
+		)
+	}
+
+	scopeArg, present := stringParam(c, "scope")
+	if !present {
+		return retFail(c, apitypes.ErrInvalidRequest, "The 'scope' of the token must be supplied, valid scopes are: %s", strings.Join(knownTokenScopes(), ", "))
+	}
+	scopeSet := make(map[string]struct{})
+	for _, s := range strings.FieldsFunc(scopeArg, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if _, known := tokenScopes[s]; !known {
+			return retFail(c, apitypes.ErrInvalidRequest, "Unknown token scope '%s', valid scopes are: %s", s, strings.Join(knownTokenScopes(), ", "))
+		}
+		scopeSet[s] = struct{}{}
+	}
+	if len(scopeSet) == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "At least one token scope must be supplied, valid scopes are: %s", strings.Join(knownTokenScopes(), ", "))
+	}
+	scopes := make([]string, 0, len(scopeSet))
+	for s := range scopeSet {
+		scopes = append(scopes, s)
+	}
+	sort.Strings(scopes)
+
+	ttlHours := uint64(spTokenDefaultTTLHours)
+	if h, present := uintParam(c, "ttl-hours"); present {
+		ttlHours = h
+	}
+
+	var label *string
+	if l, present := stringParam(c, "label"); present && l != "" {
+		label = &l
+	}
+
+	rb := make([]byte, 32)
+	if _, err := rand.Read(rb); err != nil {
+		return cmn.WrErr(err)
+	}
+	token := spTokenPrefix + base64.RawURLEncoding.EncodeToString(rb)
+	tokenHash := sha256.Sum256([]byte(token))
+
+	var tokenID string
+	if err := ctxMeta.Db[app.DbMain].QueryRow(
+		ctx,
+		`
+		INSERT INTO spd.provider_tokens ( provider_id, token_hash, token_scopes, token_label, token_expires, token_meta )
+			SELECT $1, $2, $3, $4, NOW() + MAKE_INTERVAL( hours => $5 ), JSONB_BUILD_OBJECT( 'minted_by', $6::TEXT, 'minted_request_uuid', $7::UUID )
+		WHERE
+			$8 > (
+				SELECT COUNT(*)
+					FROM spd.provider_tokens
+				WHERE
+					provider_id = $1
+						AND
+					token_revoked IS NULL
+						AND
+					token_expires > NOW()
+			)
+		RETURNING token_id
+		`,
+		ctxMeta.authedActorID,
+		tokenHash[:],
+		scopes,
+		label,
+		ttlHours,
+		ctxMeta.authRole,
+		c.Request().Header.Get("X-SPADE-REQUEST-UUID"),
+		spTokensMaxActive,
+	).Scan(&tokenID); err != nil {
+		if err == pgx.ErrNoRows {
+			return retFail(c, apitypes.ErrInvalidRequest, "SP %s already holds the maximum of %d active tokens, revoke some of them first", ctxMeta.authedActorID, spTokensMaxActive)
+		}
+		return cmn.WrErr(err)
+	}
+
+	toks, err := selectSpTokens(c, ctxMeta.authedActorID, tokenID)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	return retPayloadAnnotated(
+		c,
+		http.StatusOK,
+		0,
+		responseSpTokens{Token: token, Tokens: toks},
+		strings.Join([]string{
+			"Minted token %s for SP %s with scope(s) '%s', valid until %s",
+			"",
+			"The token is displayed only this once: store it now. Use it as:",
+			`  curl -sLH "Authorization: %s %s" ...`,
+			"",
+			"It can be revoked at any time by invoking:",
+			" %s",
+		}, "\n"),
+		tokenID, ctxMeta.authedActorID, strings.Join(scopes, ","), toks[0].Expires.Format(time.RFC3339),
+		spTokenAuthScheme, token,
+		curlAuthedForSP(c, ctxMeta.authedActorID, "/sp/revoke_token/"+tokenID),
+	)
+}
+
+func apiSpListTokens(c echo.Context) error {
+	_, ctxMeta := unpackAuthedEchoContext(c)
+
+	toks, err := selectSpTokens(c, ctxMeta.authedActorID, "")
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	return retPayloadAnnotated(
+		c,
+		http.StatusOK,
+		0,
+		responseSpTokens{Tokens: toks},
+		"Active tokens of SP %s. Mint a new one by invoking:\n %s",
+		ctxMeta.authedActorID,
+		curlAuthedForSPWithArg(c, ctxMeta.authedActorID, "/sp/mint_token", "scope="+tokenScopeRead+"&label=my-automation-host"),
+	)
+}
+
+func apiSpRevokeToken(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	tUUID, _ := uuidParam(c, "tokenID")
+
+	res, err := ctxMeta.Db[app.DbMain].Exec(
+		ctx,
+		`
+		UPDATE spd.provider_tokens SET
+			token_revoked = NOW()
+		WHERE
+			token_id = $1
+				AND
+			provider_id = $2
+				AND
+			token_revoked IS NULL
+				AND
+			token_expires > NOW()
+		`,
+		tUUID,
+		ctxMeta.authedActorID,
+	)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	if res.RowsAffected() == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "No active token %s exists for SP %s", tUUID, ctxMeta.authedActorID)
+	}
+
+	toks, err := selectSpTokens(c, ctxMeta.authedActorID, "")
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, responseSpTokens{Tokens: toks}, "Revoked token %s of SP %s", tUUID, ctxMeta.authedActorID)
+}
+
+// active tokens only, optionally restricted to a single tokenID
+func selectSpTokens(c echo.Context, spID fil.ActorID, tokenID string) ([]spToken, error) {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	toks := make([]spToken, 0, spTokensMaxActive)
+	if err := pgxscan.Select(
+		ctx,
+		ctxMeta.Db[app.DbMain],
+		&toks,
+		`
+		SELECT
+				token_id,
+				token_scopes,
+				token_label,
+				entry_created,
+				token_expires,
+				token_last_used
+			FROM spd.provider_tokens
+		WHERE
+			provider_id = $1
+				AND
+			( $2 = '' OR token_id::TEXT = $2 )
+				AND
+			token_revoked IS NULL
+				AND
+			token_expires > NOW()
+		ORDER BY entry_created
+		`,
+		spID,
+		tokenID,
+	); err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	return toks, nil
+}
+
+func knownTokenScopes() []string {
+	ks := make([]string, 0, len(tokenScopes))
+	for s := range tokenScopes {
+		ks = append(ks, s)
+	}
+	sort.Strings(ks)
+	return ks
+}
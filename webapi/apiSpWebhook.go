@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
+	"github.com/labstack/echo/v4"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/app"
+)
+
+const webhookEventsDesc = `Events are POSTed as JSON objects, one per request, for the following proposal transitions:
+  proposal_signed, proposal_delivered, deal_activated, proposal_failed
+
+A deal_activated event is provisional until ChainFinality epochs later. Should the activation not survive
+a chain reorg, a deal_activation_reverted event follows and the proposal is considered pending again.
+
+Each request carries the headers:
+  X-Spade-Event:       the event type
+  X-Spade-Delivery-Id: a unique delivery ID, retries of the same event reuse it
+  X-Spade-Signature:   t={unixtime},v1={hex( HMAC-SHA256( webhook_secret, "{unixtime}.{body}" ) )}
+
+Any non-2xx response is retried with an exponential backoff, before being eventually abandoned.`
+
+func apiSpShowWebhook(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	wh, err := selectWebhook(ctx, ctxMeta.GlobalContext, int64(ctxMeta.authedActorID), 0)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	if wh == nil {
+		return retPayloadAnnotated(c, http.StatusOK, 0, responseWebhook{}, "%s", strings.Join([]string{
+			"No webhook is currently registered for SP " + ctxMeta.authedActorID.String(),
+			"",
+			"You can register one by supplying its URL as the signed argument of your Authorization header:",
+			strings.Replace(
+				curlAuthedForSP(c, ctxMeta.authedActorID, "/sp/register_webhook"),
+				ctxMeta.authedActorID.String()+" )",
+				ctxMeta.authedActorID.String()+" https://your.endpoint/path )",
+				1,
+			),
+		}, "\n"))
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, responseWebhook{Webhook: wh}, webhookEventsDesc)
+}
+
+func apiSpRegisterWebhook(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	// the URL is part of the signed auth header: an intermediary can not redirect our notifications
+	whURL := string(ctxMeta.authArg)
+	if whURL == "" {
+		return retFail(
+			c,
+			apitypes.ErrInvalidRequest,
+			"The webhook URL must be supplied as the signed (base64-encoded) argument of your %s Authorization header",
+			authScheme,
+		)
+	}
+	if err := validateWebhookURL(whURL); err != nil {
+		return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	// (re)registration always rotates the secret and reactivates the hook
+	if _, err := ctxMeta.Db[app.DbMain].Exec(
+		ctx,
+		`
+		INSERT INTO spd.webhooks ( provider_id, webhook_url, webhook_secret )
+			VALUES ( $1, $2, $3 )
+		ON CONFLICT ( provider_id ) WHERE ( provider_id IS NOT NULL ) DO UPDATE SET
+			webhook_url = EXCLUDED.webhook_url,
+			webhook_secret = EXCLUDED.webhook_secret,
+			webhook_meta = spd.webhooks.webhook_meta - 'inactivated'
+		`,
+		ctxMeta.authedActorID,
+		whURL,
+		secret,
+	); err != nil {
+		if pgErr := pgConstraintViolation(err); pgErr != nil {
+			return retFail(c, apitypes.ErrInvalidRequest, "webhook could not be registered: %s", pgErr.Message)
+		}
+		return cmn.WrErr(err)
+	}
+
+	wh, err := selectWebhook(ctx, ctxMeta.GlobalContext, int64(ctxMeta.authedActorID), 0)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	return retPayloadAnnotated(
+		c,
+		http.StatusOK,
+		0,
+		responseWebhook{Webhook: wh},
+		"Webhook registered for SP %s, use the webhook_secret below to verify deliveries\n\n%s",
+		ctxMeta.authedActorID,
+		webhookEventsDesc,
+	)
+}
+
+func apiSpRemoveWebhook(c echo.Context) error {
+	ctx, ctxMeta := unpackAuthedEchoContext(c)
+
+	res, err := ctxMeta.Db[app.DbMain].Exec(
+		ctx,
+		`DELETE FROM spd.webhooks WHERE provider_id = $1`,
+		ctxMeta.authedActorID,
+	)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	if res.RowsAffected() == 0 {
+		return retFail(c, apitypes.ErrInvalidRequest, "No webhook is registered for SP %s", ctxMeta.authedActorID)
+	}
+
+	return retPayloadAnnotated(c, http.StatusOK, 0, responseWebhook{}, "Webhook of SP %s removed", ctxMeta.authedActorID)
+}
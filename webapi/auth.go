@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,6 +11,7 @@ import (
 	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
@@ -17,6 +20,7 @@ import (
 	filprovider "github.com/filecoin-project/go-state-types/builtin/v9/miner"
 	filcrypto "github.com/filecoin-project/go-state-types/crypto"
 	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/jackc/pgx/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/ribasushi/go-toolbox-interplanetary/fil"
 	"github.com/ribasushi/go-toolbox/cmn"
@@ -24,10 +28,30 @@ import (
 )
 
 const (
-	sigGraceEpochs = 3
-	authScheme     = `FIL-SPID-V0`
+	sigGraceEpochs    = 3
+	authScheme        = `FIL-SPID-V0`
+	adminAuthScheme   = `Bearer`
+	spTokenAuthScheme = `Bearer`
+	spTokenPrefix     = `spd_`
 )
 
+// lengths of the only two signature types an account key can produce
+const (
+	sigLenBLS       = 96
+	sigLenSecp256k1 = 65
+)
+
+// who authenticated the request: one of the MinerInfo keys, or a previously minted bearer token
+const (
+	authRoleWorker  = "worker"
+	authRoleOwner   = "owner"
+	authRoleControl = "control"
+	authRoleToken   = "token"
+)
+
+// set from the webapi-admin-token config, when empty all /admin routes are disabled
+var adminAuthToken string
+
 type rawHdr struct {
 	epoch  string
 	addr   string
@@ -44,6 +68,15 @@ type sigChallenge struct {
 
 type verifySigResult struct {
 	invalidSigErrstr string
+	signerRole       string
+}
+
+type spAuthResult struct {
+	spID        fil.ActorID
+	arg         []byte
+	role        string
+	tokenID     string
+	tokenScopes []string
 }
 
 var (
@@ -62,9 +95,11 @@ var (
 			`\s*$`,
 	)
 	challengeCache, _ = lru.New[rawHdr, verifySigResult](sigGraceEpochs * 128)
-	beaconCache, _    = lru.New[int64, *fil.LotusBeaconEntry](sigGraceEpochs * 4)
 )
 
+// spidAuth accepts either a FIL-SPID-V0 header signed by the worker, owner or any control
+// address of the SP, or a bearer token previously minted via /sp/mint_token. Which routes a
+// token is good for is decided by requireTokenScope() further down the chain.
 func spidAuth(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 
@@ -72,6 +107,18 @@ func spidAuth(next echo.HandlerFunc) echo.HandlerFunc {
 
 		var challenge sigChallenge
 		challenge.authHdr = c.Request().Header.Get(echo.HeaderAuthorization)
+
+		if strings.HasPrefix(challenge.authHdr, spTokenAuthScheme+" ") {
+			ar, invalidErrstr, err := verifySpToken(ctx, strings.TrimSpace(challenge.authHdr[len(spTokenAuthScheme)+1:]))
+			if err != nil {
+				return cmn.WrErr(err)
+			}
+			if invalidErrstr != "" {
+				return retAuthFail(c, "%s", invalidErrstr)
+			}
+			return establishSpSession(c, next, ar)
+		}
+
 		res := spAuthRe.FindStringSubmatch(challenge.authHdr)
 
 		if len(res) == 5 {
@@ -116,50 +163,68 @@ func spidAuth(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 
 		if vsr.invalidSigErrstr != "" {
-			return retAuthFail(c, vsr.invalidSigErrstr)
+			return retAuthFail(c, "%s", vsr.invalidSigErrstr)
 		}
 
-		// set only on request object for logging, not part of response
-		c.Request().Header.Set("X-SPADE-LOGGED-SP", challenge.addr.String())
-
 		// if challenge.addr.String() == "f01" {
 		// 	challenge.addr, _ = filaddr.NewFromString("f02")
 		// }
 
-		spID := fil.MustParseActorString(challenge.addr.String())
+		return establishSpSession(c, next, spAuthResult{
+			spID: fil.MustParseActorString(challenge.addr.String()),
+			arg:  challenge.arg,
+			role: vsr.signerRole,
+		})
+	}
+}
 
-		reqCopy := c.Request().Clone(ctx)
-		// do not need to store any IPs anywhere in the DB
-		for _, strip := range []string{
-			"X-Real-Ip", "X-Forwarded-For", "Cf-Connecting-Ip",
-		} {
-			delete(reqCopy.Header, strip)
-		}
-		reqJ, err := json.Marshal(
-			struct {
-				Method  string
-				Host    string
-				URL     *url.URL
-				Headers http.Header
-			}{
-				Method:  reqCopy.Method,
-				Host:    reqCopy.Host,
-				URL:     reqCopy.URL,
-				Headers: reqCopy.Header,
-			},
-		)
-		if err != nil {
-			return cmn.WrErr(err)
-		}
+// establishSpSession records the request and populates the context of an authenticated SP
+func establishSpSession(c echo.Context, next echo.HandlerFunc, ar spAuthResult) error {
+	ctx := c.Request().Context()
 
-		var requestUUID string
-		var stateEpoch int64
-		var spDetails []int16
-		var spInfo apitypes.SPInfo
-		var spInfoLastPoll *time.Time
-		if err := app.GetGlobalCtx(ctx).Db[app.DbMain].QueryRow(
-			ctx,
-			`
+	// set only on request object for logging, not part of response
+	c.Request().Header.Set("X-SPADE-LOGGED-SP", ar.spID.String())
+
+	reqCopy := c.Request().Clone(ctx)
+	// do not need to store any IPs anywhere in the DB
+	for _, strip := range []string{
+		"X-Real-Ip", "X-Forwarded-For", "Cf-Connecting-Ip",
+	} {
+		delete(reqCopy.Header, strip)
+	}
+	// unlike a signed header, a token remains valid long after the request: never store it
+	if ar.role == authRoleToken {
+		delete(reqCopy.Header, echo.HeaderAuthorization)
+	}
+	reqJ, err := json.Marshal(
+		struct {
+			Method   string
+			Host     string
+			URL      *url.URL
+			Headers  http.Header
+			AuthRole string
+			TokenID  string `json:",omitempty"`
+		}{
+			Method:   reqCopy.Method,
+			Host:     reqCopy.Host,
+			URL:      reqCopy.URL,
+			Headers:  reqCopy.Header,
+			AuthRole: ar.role,
+			TokenID:  ar.tokenID,
+		},
+	)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+
+	var requestUUID string
+	var stateEpoch int64
+	var spDetails []int16
+	var spInfo apitypes.SPInfo
+	var spInfoLastPoll *time.Time
+	if err := app.GetGlobalCtx(ctx).Db[app.DbMain].QueryRow(
+		ctx,
+		`
 			INSERT INTO spd.requests ( provider_id, request_dump )
 				VALUES ( $1, $2 )
 			RETURNING
@@ -187,31 +252,64 @@ func spidAuth(next echo.HandlerFunc) echo.HandlerFunc {
 					WHERE provider_id = $1
 				)
 			`,
-			spID,
-			reqJ,
-		).Scan(&requestUUID, &stateEpoch, &spDetails, &spInfo, &spInfoLastPoll); err != nil {
-			return cmn.WrErr(err)
-		}
+		ar.spID,
+		reqJ,
+	).Scan(&requestUUID, &stateEpoch, &spDetails, &spInfo, &spInfoLastPoll); err != nil {
+		return cmn.WrErr(err)
+	}
 
-		c.Response().Header().Set("X-SPADE-FIL-SPID", challenge.addr.String())
+	c.Response().Header().Set("X-SPADE-FIL-SPID", ar.spID.String())
+
+	// set on both request (for logging ) and response object
+	c.Request().Header.Set("X-SPADE-REQUEST-UUID", requestUUID)
+	c.Response().Header().Set("X-SPADE-REQUEST-UUID", requestUUID)
+
+	c.Set("♠️", metaContext{
+		GlobalContext:    app.GetGlobalCtx(ctx),
+		stateEpoch:       stateEpoch,
+		authedActorID:    ar.spID,
+		authArg:          ar.arg,
+		authRole:         ar.role,
+		authTokenID:      ar.tokenID,
+		authTokenScopes:  ar.tokenScopes,
+		spOrgID:          spDetails[0],
+		spCityID:         spDetails[1],
+		spCountryID:      spDetails[2],
+		spContinentID:    spDetails[3],
+		spInfo:           spInfo,
+		spInfoLastPolled: spInfoLastPoll,
+	})
+
+	return next(c)
+}
 
-		// set on both request (for logging ) and response object
-		c.Request().Header.Set("X-SPADE-REQUEST-UUID", requestUUID)
-		c.Response().Header().Set("X-SPADE-REQUEST-UUID", requestUUID)
+func adminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
 
+		// populate the common context early, so that the failures below render correctly
 		c.Set("♠️", metaContext{
-			GlobalContext:    app.GetGlobalCtx(ctx),
-			stateEpoch:       stateEpoch,
-			authedActorID:    spID,
-			authArg:          challenge.arg,
-			spOrgID:          spDetails[0],
-			spCityID:         spDetails[1],
-			spCountryID:      spDetails[2],
-			spContinentID:    spDetails[3],
-			spInfo:           spInfo,
-			spInfoLastPolled: spInfoLastPoll,
+			GlobalContext: app.GetGlobalCtx(ctx),
 		})
 
+		if adminAuthToken == "" {
+			return retFail(c, apitypes.ErrSystemTemporarilyDisabled, "administrative API is not enabled on this instance")
+		}
+
+		hdr := c.Request().Header.Get(echo.HeaderAuthorization)
+		if len(hdr) <= len(adminAuthScheme)+1 ||
+			hdr[:len(adminAuthScheme)+1] != adminAuthScheme+" " ||
+			subtle.ConstantTimeCompare([]byte(hdr[len(adminAuthScheme)+1:]), []byte(adminAuthToken)) != 1 {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, adminAuthScheme)
+			return retPayloadAnnotated(
+				c,
+				http.StatusUnauthorized,
+				apitypes.ErrUnauthorizedAccess,
+				nil,
+				echo.ErrUnauthorized.Error(),
+			)
+		}
+
 		return next(c)
 	}
 }
@@ -227,6 +325,9 @@ type metaContext struct {
 	spCountryID      int16
 	spContinentID    int16
 	authArg          []byte
+	authRole         string
+	authTokenID      string
+	authTokenScopes  []string // empty unless authRole == authRoleToken
 }
 
 func unpackAuthedEchoContext(c echo.Context) (context.Context, metaContext) {
@@ -247,13 +348,10 @@ func verifySig(ctx context.Context, challenge sigChallenge) (verifySigResult, er
 	hAPI := apis[app.FilHeavy]
 	lAPI := apis[app.FilLite]
 
-	be, didFind := beaconCache.Get(challenge.epoch)
-	if !didFind {
-		be, err = hAPI.BeaconGetEntry(ctx, filabi.ChainEpoch(challenge.epoch))
-		if err != nil {
-			return verifySigResult{}, cmn.WrErr(err)
-		}
-		beaconCache.Add(challenge.epoch, be)
+	// beacon entries are cached by the API itself
+	be, err := hAPI.BeaconGetEntry(ctx, filabi.ChainEpoch(challenge.epoch))
+	if err != nil {
+		return verifySigResult{}, cmn.WrErr(err)
 	}
 
 	miFinTs, err := lAPI.ChainGetTipSetByHeight(ctx, filabi.ChainEpoch(challenge.epoch)-filprovider.ChainFinality, fil.LotusTSK{})
@@ -264,28 +362,125 @@ func verifySig(ctx context.Context, challenge sigChallenge) (verifySigResult, er
 	if err != nil {
 		return verifySigResult{}, cmn.WrErr(err)
 	}
-	workerAddr, err := lAPI.StateAccountKey(ctx, mi.Worker, miFinTs.Key())
-	if err != nil {
-		return verifySigResult{}, cmn.WrErr(err)
+	// the signature length determines which keys could have possibly produced it
+	var sigType filcrypto.SigType
+	var keyProto filaddr.Protocol
+	switch len(sig) {
+	case sigLenBLS:
+		sigType, keyProto = filcrypto.SigTypeBLS, filaddr.BLS
+	case sigLenSecp256k1:
+		sigType, keyProto = filcrypto.SigTypeSecp256k1, filaddr.SECP256K1
+	default:
+		return verifySigResult{
+			invalidSigErrstr: fmt.Sprintf("unexpected %s auth signature length of %d bytes", authScheme, len(sig)),
+		}, nil
+	}
+
+	type candidate struct {
+		role string
+		addr filaddr.Address
+	}
+	candidates := make([]candidate, 0, 2+len(mi.ControlAddresses))
+	candidates = append(candidates, candidate{authRoleWorker, mi.Worker}, candidate{authRoleOwner, mi.Owner})
+	for _, a := range mi.ControlAddresses {
+		candidates = append(candidates, candidate{authRoleControl, a})
+	}
+
+	signedPayload := append(append([]byte{0x20, 0x20, 0x20}, be.Data...), challenge.arg...)
+	seen := make(map[filaddr.Address]struct{}, len(candidates))
+	for _, cand := range candidates {
+		if _, dup := seen[cand.addr]; dup {
+			continue
+		}
+		seen[cand.addr] = struct{}{}
+
+		keyAddr, err := lAPI.StateAccountKey(ctx, cand.addr, miFinTs.Key())
+		if err != nil {
+			// the worker is always an account, an owner can be a multisig which can not sign anything
+			if cand.role == authRoleWorker {
+				return verifySigResult{}, cmn.WrErr(err)
+			}
+			continue
+		}
+		if keyAddr.Protocol() != keyProto {
+			continue
+		}
+
+		sigMatch, err := hAPI.WalletVerify(
+			ctx,
+			keyAddr,
+			signedPayload,
+			&filcrypto.Signature{
+				Type: sigType,
+				Data: sig,
+			},
+		)
+		if err != nil {
+			return verifySigResult{}, cmn.WrErr(err)
+		}
+		if sigMatch {
+			return verifySigResult{signerRole: cand.role}, nil
+		}
 	}
 
-	sigMatch, err := hAPI.WalletVerify(
+	return verifySigResult{
+		invalidSigErrstr: fmt.Sprintf("%s signature validation failed for auth header '%s': not signed by the worker, owner or any control address of %s", authScheme, challenge.authHdr, challenge.addr),
+	}, nil
+}
+
+// verifySpToken resolves a bearer token minted via /sp/mint_token, marking it as used
+func verifySpToken(ctx context.Context, token string) (spAuthResult, string, error) {
+	if !strings.HasPrefix(token, spTokenPrefix) {
+		return spAuthResult{}, fmt.Sprintf("unexpected %s token format, expected %s...", spTokenAuthScheme, spTokenPrefix), nil
+	}
+
+	ar := spAuthResult{role: authRoleToken}
+	var spID int64
+	tokenHash := sha256.Sum256([]byte(token))
+	err := app.GetGlobalCtx(ctx).Db[app.DbMain].QueryRow(
 		ctx,
-		workerAddr,
-		append(append([]byte{0x20, 0x20, 0x20}, be.Data...), challenge.arg...),
-		&filcrypto.Signature{
-			Type: filcrypto.SigTypeBLS, // worker keys are always BLS
-			Data: []byte(sig),
-		},
-	)
+		`
+		UPDATE spd.provider_tokens SET
+			token_last_used = NOW()
+		WHERE
+			token_hash = $1
+				AND
+			token_revoked IS NULL
+				AND
+			token_expires > NOW()
+		RETURNING provider_id, token_id, token_scopes
+		`,
+		tokenHash[:],
+	).Scan(&spID, &ar.tokenID, &ar.tokenScopes)
+	if err == pgx.ErrNoRows {
+		return spAuthResult{}, "the supplied token is not valid: it is unknown, expired or revoked", nil
+	}
 	if err != nil {
-		return verifySigResult{}, cmn.WrErr(err)
+		return spAuthResult{}, "", cmn.WrErr(err)
 	}
 
-	if !sigMatch {
-		return verifySigResult{
-			invalidSigErrstr: fmt.Sprintf("%s signature validation failed for auth header '%s'", authScheme, challenge.authHdr),
-		}, nil
+	ar.spID = fil.ActorID(spID)
+	return ar, "", nil
+}
+
+// requireTokenScope restricts token-authenticated requests to routes matching one of the token
+// scopes. Routes without a scope can only be accessed with a signed header.
+func requireTokenScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			_, ctxMeta := unpackAuthedEchoContext(c)
+			if ctxMeta.authRole != authRoleToken {
+				return next(c)
+			}
+			if scope == "" {
+				return retFail(c, apitypes.ErrUnauthorizedAccess, "this call requires a %s Authorization header signed by a key of %s, tokens are not accepted", authScheme, ctxMeta.authedActorID)
+			}
+			for _, s := range ctxMeta.authTokenScopes {
+				if s == scope {
+					return next(c)
+				}
+			}
+			return retFail(c, apitypes.ErrUnauthorizedAccess, "the supplied token lacks the '%s' scope required for this call", scope)
+		}
 	}
-	return verifySigResult{}, nil
 }
@@ -3,8 +3,13 @@ package main
 const (
 	listEligibleDefaultSize = 500
 	listEligibleMaxSize     = 2 << 20
+	listEligibleStreamChunk = 512
 
 	showRecentFailuresHours = 24
 
+	spTokenDefaultTTLHours = 24 * 30
+	spTokenMaxTTLHours     = 24 * 365
+	spTokensMaxActive      = 32
+
 	requestPieceLockStatement = `SELECT PG_ADVISORY_XACT_LOCK( 1234567890111 )`
 )
@@ -32,6 +32,9 @@ func setup() *echo.Echo {
 		},
 	))
 
+	// before routing, so that auth failures are accounted for as well
+	e.Use(metricsMiddleware)
+
 	// routes
 	registerRoutes(e)
 
@@ -70,6 +73,7 @@ func main() {
 	}
 
 	var e *echo.Echo
+	var metricsCtx context.Context
 	(&ufcli.UFcli{
 		Logger:   log,
 		TOMLPath: fmt.Sprintf("%s/%s.toml", home, app.AppName),
@@ -78,6 +82,8 @@ func main() {
 			Action: func(cctx *ufcli.Context) error {
 				e = setup()
 				e.Server.BaseContext = func(net.Listener) context.Context { return cctx.Context }
+				metricsCtx = cctx.Context
+				go flushMetricsPeriodically(cctx.Context)
 				return e.Start(cctx.String("webapi-listen-address"))
 			},
 			Flags: append(
@@ -86,6 +92,12 @@ func main() {
 						Name:  "webapi-listen-address",
 						Value: "localhost:8080",
 					}),
+					ufcli.ConfStringFlag(&ufcli.StringFlag{
+						Name:        "webapi-admin-token",
+						Usage:       "Bearer token granting access to the /admin API, which is disabled when unset",
+						DefaultText: "  {{ private, read from config file }}  ",
+						Destination: &adminAuthToken,
+					}),
 				},
 				app.CommonFlags...,
 			),
@@ -93,7 +105,12 @@ func main() {
 		GlobalInit: app.GlobalInit,
 		BeforeShutdown: func() error {
 			if e != nil {
-				return e.Close()
+				if err := e.Close(); err != nil {
+					return err
+				}
+			}
+			if metricsCtx != nil {
+				return flushPendingMetrics(metricsCtx)
 			}
 			return nil
 		},
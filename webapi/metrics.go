@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/app"
+)
+
+const (
+	metricsFlushInterval = 30 * time.Second
+	metricsErrSlugKey    = "metricsErrSlug"
+)
+
+var requestDurationBucketsMsecs = []int64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// request counters accumulate in memory, and are periodically added to spd.metrics
+var pendingMetrics = struct {
+	sync.Mutex
+	since   time.Time
+	entries map[string]*app.Metric
+}{
+	since:   time.Now(),
+	entries: make(map[string]*app.Metric, 256),
+}
+
+// dims are supplied as key, value, key, value...
+func addPendingMetric(name, desc, mType string, val int64, dims ...string) {
+	m := app.Metric{
+		Name:        name,
+		Description: desc,
+		Type:        mType,
+		Value:       val,
+		Dimensions:  make(map[string]string, len(dims)/2),
+	}
+	for i := 0; i+1 < len(dims); i += 2 {
+		m.Dimensions[dims[i]] = dims[i+1]
+	}
+
+	pendingMetrics.Lock()
+	mergePendingMetric(m)
+	pendingMetrics.Unlock()
+}
+
+// must be called with pendingMetrics locked
+func mergePendingMetric(m app.Metric) {
+	dimKeys := make([]string, 0, len(m.Dimensions))
+	for k := range m.Dimensions {
+		dimKeys = append(dimKeys, k)
+	}
+	sort.Strings(dimKeys)
+	key := m.Name
+	for _, k := range dimKeys {
+		key += "\x00" + k + "\x00" + m.Dimensions[k]
+	}
+
+	if cur, exists := pendingMetrics.entries[key]; exists {
+		cur.Value += m.Value
+	} else {
+		pendingMetrics.entries[key] = &m
+	}
+}
+
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		t0 := time.Now()
+		err := next(c)
+		tookMsecs := time.Since(t0).Milliseconds()
+
+		route := c.Path()
+		status := c.Response().Status
+		errSlug, _ := c.Get(metricsErrSlugKey).(string)
+		if err != nil {
+			status = http.StatusInternalServerError
+			if he, isHTTPErr := err.(*echo.HTTPError); isHTTPErr {
+				status = he.Code
+			}
+			errSlug = "UnhandledError"
+		}
+
+		addPendingMetric("webapi_requests_total", "Amount of handled API requests", app.MetricCounter, 1,
+			"route", route, "method", c.Request().Method, "status", strconv.Itoa(status),
+		)
+		if errSlug != "" {
+			addPendingMetric("webapi_errors_total", "Amount of API requests which failed, by error slug", app.MetricCounter, 1,
+				"route", route, "err_slug", errSlug,
+			)
+		}
+
+		const histDesc = "API request handling duration in milliseconds"
+		for _, b := range requestDurationBucketsMsecs {
+			if tookMsecs <= b {
+				addPendingMetric("webapi_request_duration_milliseconds_bucket", histDesc, app.MetricHistogram, 1, "route", route, "le", strconv.FormatInt(b, 10))
+			}
+		}
+		addPendingMetric("webapi_request_duration_milliseconds_bucket", histDesc, app.MetricHistogram, 1, "route", route, "le", "+Inf")
+		addPendingMetric("webapi_request_duration_milliseconds_sum", histDesc, app.MetricHistogram, tookMsecs, "route", route)
+		addPendingMetric("webapi_request_duration_milliseconds_count", histDesc, app.MetricHistogram, 1, "route", route)
+
+		return err
+	}
+}
+
+func flushPendingMetrics(ctx context.Context) error {
+	pendingMetrics.Lock()
+	took := time.Since(pendingMetrics.since)
+	toFlush := make([]app.Metric, 0, len(pendingMetrics.entries))
+	for _, m := range pendingMetrics.entries {
+		toFlush = append(toFlush, *m)
+	}
+	pendingMetrics.entries = make(map[string]*app.Metric, len(toFlush))
+	pendingMetrics.since = time.Now()
+	pendingMetrics.Unlock()
+
+	if err := app.RecordMetrics(ctx, took, toFlush...); err != nil {
+		// put everything back for the next attempt
+		pendingMetrics.Lock()
+		for _, m := range toFlush {
+			mergePendingMetric(m)
+		}
+		pendingMetrics.Unlock()
+		return err
+	}
+	return nil
+}
+
+func flushMetricsPeriodically(ctx context.Context) {
+	t := time.NewTicker(metricsFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := flushPendingMetrics(ctx); err != nil {
+				app.GetGlobalCtx(ctx).Logger.Warnf("failed to flush request metrics: %s", err)
+			}
+		}
+	}
+}
+
+func apiMetrics(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := flushPendingMetrics(ctx); err != nil {
+		return cmn.WrErr(err)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	return app.WriteMetricsExposition(ctx, c.Response())
+}
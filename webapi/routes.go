@@ -1,64 +1,388 @@
 package main
 
-import "github.com/labstack/echo/v4"
+import (
+	"fmt"
+	"net/http"
+	"strings"
 
-// This lists in one place all recognized routes & parameters
-// FIXME - we should make an openapi or something for this...
+	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
+	"github.com/labstack/echo/v4"
+)
+
+// This lists in one place all recognized routes & parameters. The same registry drives the
+// route registration, the validation of query parameters, and the OpenAPI document at /openapi.json
+//
+// Every response envelope is rendered according to the request Accept header: application/cbor,
+// or JSON otherwise. JSON is indented only for curl-like user agents not asking for application/json
+// explicitly, or when pretty=<boolean> says so.
+//
+// Besides a signed FIL-SPID-V0 header, /sp/* routes declaring a Scope also accept an
+// `Authorization: Bearer spd_...` token minted by the SP via /sp/mint_token.
 func registerRoutes(e *echo.Echo) {
-	spRoutes := e.Group("/sp", spidAuth)
+	for _, g := range routeRegistry() {
+		grp := e.Group(g.Prefix)
+		if g.Auth != nil {
+			grp.Use(g.Auth)
+		}
+		for _, r := range g.Routes {
+			if undeclared := undeclaredPathParam(r); undeclared != "" {
+				panic(fmt.Sprintf("path parameter '%s' of route %s%s is not declared", undeclared, g.Prefix, r.Path))
+			}
+			grp.Add(r.Method, r.Path, r.Handler, requireTokenScope(r.Scope), validateParams(r.Params))
+		}
+	}
 
 	//
-	// /status produces human and machine readable information about the system and the currently-authenticated SP
-	//
-	// Recognized parameters: none
+	// /openapi.json serves an OpenAPI 3 document describing every route above
 	//
-	spRoutes.GET("/status", apiSpStatus)
+	e.GET("/openapi.json", apiOpenAPI)
+}
 
-	//
-	// /eligible_pieces produces a listing of PieceCIDs that a storage provider is eligible to receive a deal for.
-	// The list is dynamic and offers a near-real-time view specific to the authenticated SP answering:
-	// "What can I reserve/request right this moment"
-	//
-	// Recognized parameters:
-	//
-	// - limit = <integer>
-	//   How many results to return at most
-	//   default=listEligibleDefaultSize
-	//
-	// - tenant = <integer>
-	//   Restrict the list to only pieces claimed by this numeric TenantID. No restriction if unspecified.
-	//
-	// - include-sourceless = <boolean>
-	//   When true the result includes eligible pieces without any known sources. Such pieces are omitted by default.
-	//
-	// - orglocal-only = <boolean>
-	//   When true restrict result only to pieces with active fil-network deals within your own Org.
-	//
-	spRoutes.GET("/eligible_pieces", apiSpListEligible)
+var tenantParam = apiParam{
+	Name: "tenant", In: paramInQuery, Type: paramInteger, Min: 1, Max: 1<<15 - 1,
+	Description: "Restrict to pieces claimed by this numeric TenantID. No restriction if unspecified.",
+}
 
-	//
-	// /pending_proposals produces a list of current outstanding reservations, recent errors and various statistics.
-	//
-	// Recognized parameters: none
-	//
-	spRoutes.GET("/pending_proposals", apiSpListPendingProposals)
+func routeRegistry() []apiRouteGroup {
+	return []apiRouteGroup{
+		{
+			Prefix:   "/sp",
+			Auth:     spidAuth,
+			Security: "spid",
+			Routes: []apiRoute{
+				{
+					Method:      http.MethodGet,
+					Path:        "/status",
+					Summary:     "Information about the system and the currently-authenticated SP",
+					Description: "Produces human and machine readable information about the system and the currently-authenticated SP",
+					Response:    responseSpStatus{},
+					Scope:       tokenScopeRead,
+					Handler:     apiSpStatus,
+				},
+				{
+					Method:  http.MethodGet,
+					Path:    "/eligible_pieces",
+					Summary: "PieceCIDs the SP is eligible to receive a deal for",
+					Description: strings.Join([]string{
+						"Produces a listing of PieceCIDs that a storage provider is eligible to receive a deal for.",
+						"The list is dynamic and offers a near-real-time view specific to the authenticated SP answering:",
+						`"What can I reserve/request right this moment"`,
+						"",
+						"When the request carries `Accept: application/x-ndjson` the result is streamed instead: one piece",
+						`object per line, terminated by a single { "stream_end": true, "entries": N, "next_cursor": "..." }`,
+						"line. In this mode limit defaults to listEligibleMaxSize.",
+					}, "\n"),
+					Params: []apiParam{
+						{
+							Name: "limit", In: paramInQuery, Type: paramInteger, Min: 1, Max: listEligibleMaxSize, Default: listEligibleDefaultSize,
+							Description: "How many results to return at most",
+						},
+						tenantParam,
+						{
+							Name: "include-sourceless", In: paramInQuery, Type: paramBoolean,
+							Description: "When true the result includes eligible pieces without any known sources. Such pieces are omitted by default.",
+						},
+						{
+							Name: "orglocal-only", In: paramInQuery, Type: paramBoolean,
+							Description: "When true restrict result only to pieces with active fil-network deals within your own Org.",
+						},
+						{
+							Name: "cursor", In: paramInQuery, Type: paramString,
+							Description: strings.Join([]string{
+								"Opaque value continuing a previous listing right after its last entry. It is returned in the",
+								listEligibleCursorHdr + " header whenever a result is truncated, and is only valid together with the",
+								"same tenant / include-sourceless / orglocal-only combination it was issued for.",
+							}, "\n"),
+						},
+						{
+							// secret flag to tune this in flight / figure out optimal values
+							Name: "internal-nolateral", In: paramInQuery, Type: paramBoolean, Internal: true,
+						},
+					},
+					Response: apitypes.ResponsePiecesEligible{},
+					Scope:    tokenScopeRead,
+					Handler:  apiSpListEligible,
+				},
+				{
+					Method:      http.MethodGet,
+					Path:        "/pending_proposals",
+					Summary:     "Outstanding reservations, recent errors and statistics",
+					Description: "Produces a list of current outstanding reservations, recent errors and various statistics.",
+					Response:    apitypes.ResponsePendingProposals{},
+					Scope:       tokenScopeRead,
+					Handler:     apiSpListPendingProposals,
+				},
 
-	//
-	// The following are actually logical POSTs, keep as GET for simplicity/redirectability
-	// ( plus we do have a rather tight auth-header timing + proper locking and all )
-	//
+				//
+				// The following are actually logical POSTs, keep as GET for simplicity/redirectability
+				// ( plus we do have a rather tight auth-header timing + proper locking and all )
+				//
 
-	//
-	// /request_piece/:pieceCID is used to request a deal proposal (and thus reservation) for a specific
-	// PieceCID. The call will fail with HTTP 403 + a corresponding internal error code if the SP
-	// is not eligible to receive a deal for this PieceCID. On success a deal proposal is queued and
-	// delivered to the SP by a periodic task, executed outside of this webapp.
-	//
-	// Recognized parameters:
-	//
-	// - tenant = <integer>
-	//   Restrict the deal proposal to a specific TenantID. The call will fail if the deal can not be granted by
-	//   the specified tenant even if it would be allowed by a different tenant with interest in the same piece.
-	//
-	spRoutes.GET("/request_piece/:pieceCID", apiSpRequestPiece)
+				{
+					Method:  http.MethodGet,
+					Path:    "/request_piece/:pieceCID",
+					Summary: "Request a deal proposal for a specific PieceCID",
+					Description: strings.Join([]string{
+						"Used to request a deal proposal (and thus reservation) for a specific PieceCID. The call will",
+						"fail with HTTP 403 + a corresponding internal error code if the SP is not eligible to receive a",
+						"deal for this PieceCID. On success a deal proposal is queued and delivered to the SP by a",
+						"periodic task, executed outside of this webapp.",
+					}, "\n"),
+					Params: []apiParam{
+						{Name: "pieceCID", In: paramInPath, Type: paramString, Description: "The PieceCID to request a deal for"},
+						{
+							Name: "tenant", In: paramInQuery, Type: paramInteger, Min: 1, Max: 1<<15 - 1,
+							Description: strings.Join([]string{
+								"Restrict the deal proposal to a specific TenantID. The call will fail if the deal can not be granted by",
+								"the specified tenant even if it would be allowed by a different tenant with interest in the same piece.",
+							}, "\n"),
+						},
+					},
+					Response: apitypes.ResponseDealRequest{},
+					Scope:    tokenScopeReserve,
+					Handler:  apiSpRequestPiece,
+				},
+				{
+					Method:  http.MethodGet,
+					Path:    "/cancel_proposal/:proposalUUID",
+					Summary: "Release an unpublished reservation",
+					Description: strings.Join([]string{
+						"Releases a reservation obtained via /request_piece which has not yet resulted in a published deal.",
+						`The proposal is marked as failed ( "cancelled by provider" ), and the in-flight quota it occupied`,
+						"becomes available again right away.",
+					}, "\n"),
+					Params: []apiParam{
+						{Name: "proposalUUID", In: paramInPath, Type: paramString, Format: paramFormatUUID, Description: "The proposal to cancel"},
+					},
+					Response: responseCancelledProposals{},
+					Scope:    tokenScopeReserve,
+					Handler:  apiSpCancelProposal,
+				},
+				{
+					Method:  http.MethodGet,
+					Path:    "/cancel_proposals",
+					Summary: "Release multiple unpublished reservations",
+					Description: strings.Join([]string{
+						"The bulk variant of /cancel_proposal. It cancels as many of the supplied proposals as possible,",
+						"and lists the reason why any of the rest could not be cancelled.",
+					}, "\n"),
+					Params: []apiParam{
+						{
+							Name: "ids", In: paramInQuery, Type: paramString,
+							Description: "Comma-separated list of proposal IDs to cancel, at most cancelProposalsMaxBulk",
+						},
+					},
+					Response: responseCancelledProposals{},
+					Scope:    tokenScopeReserve,
+					Handler:  apiSpCancelProposals,
+				},
+				{
+					Method:  http.MethodGet,
+					Path:    "/register_webhook",
+					Summary: "Register a lifecycle webhook",
+					Description: strings.Join([]string{
+						"Registers (or replaces) a URL notified on every lifecycle transition of a proposal made to the",
+						"authenticated SP. The URL is supplied as the signed argument of the Authorization header.",
+						"A fresh webhook_secret is returned with each registration.",
+					}, "\n"),
+					Response: responseWebhook{},
+					Handler:  apiSpRegisterWebhook,
+				},
+				{
+					Method:   http.MethodGet,
+					Path:     "/remove_webhook",
+					Summary:  "Remove the current webhook registration, if any",
+					Response: responseWebhook{},
+					Handler:  apiSpRemoveWebhook,
+				},
+				{
+					Method:  http.MethodGet,
+					Path:    "/mint_token",
+					Summary: "Mint a scoped, expiring bearer token",
+					Description: strings.Join([]string{
+						"Mints a token usable as `Authorization: Bearer spd_...` in place of a signed header, for automation",
+						"hosts that must not hold any key of the SP. The token is displayed only once. Scopes:",
+						"  read:    status, eligible_pieces, pending_proposals",
+						"  reserve: request_piece, cancel_proposal, cancel_proposals",
+						"Managing tokens and webhooks ( which reveal the webhook_secret ) always requires a signed header.",
+						"The entire query string must be supplied verbatim as the signed argument of the Authorization header.",
+					}, "\n"),
+					Params: []apiParam{
+						{
+							Name: "scope", In: paramInQuery, Type: paramString,
+							Description: "Comma-separated list of scopes granted to the token, required",
+						},
+						{
+							Name: "ttl-hours", In: paramInQuery, Type: paramInteger, Min: 1, Max: spTokenMaxTTLHours, Default: spTokenDefaultTTLHours,
+							Description: "How long the token remains valid",
+						},
+						{Name: "label", In: paramInQuery, Type: paramString, Description: "Free-form note identifying the token holder"},
+					},
+					Response: responseSpTokens{},
+					Handler:  apiSpMintToken,
+				},
+				{
+					Method:   http.MethodGet,
+					Path:     "/tokens",
+					Summary:  "List the active bearer tokens of the SP",
+					Response: responseSpTokens{},
+					Handler:  apiSpListTokens,
+				},
+				{
+					Method:  http.MethodGet,
+					Path:    "/revoke_token/:tokenID",
+					Summary: "Revoke a bearer token",
+					Params: []apiParam{
+						{Name: "tokenID", In: paramInPath, Type: paramString, Format: paramFormatUUID, Description: "The token_id to revoke"},
+					},
+					Response: responseSpTokens{},
+					Handler:  apiSpRevokeToken,
+				},
+				{
+					Method:   http.MethodGet,
+					Path:     "/webhook",
+					Summary:  "Show the current webhook registration and its most recent deliveries",
+					Response: responseWebhook{},
+					Handler:  apiSpShowWebhook,
+				},
+			},
+		},
+
+		{
+			Routes: []apiRoute{
+				{
+					Method:  http.MethodGet,
+					Path:    "/metrics",
+					Summary: "Prometheus metrics",
+					Description: strings.Join([]string{
+						"Serves the contents of spd.metrics ( populated by both the webapi and the cron tasks ) in the",
+						"Prometheus text exposition format. Like /admin below it is not exposed by the public frontend.",
+					}, "\n"),
+					Produces: "text/plain",
+					Handler:  apiMetrics,
+				},
+			},
+		},
+
+		//
+		// /admin/* is the operator-facing management interface. Every call must carry an
+		// `Authorization: Bearer {{webapi-admin-token}}` header, and the entire group is
+		// disabled when no token is configured. These routes are deliberately NOT proxied
+		// by the public nginx frontend: access them from within the deployment only.
+		//
+		// All mutating calls take a JSON body and return the resulting state of the
+		// modified object. Requests violating a DB constraint fail with HTTP 403 + ErrInvalidRequest
+		//
+		{
+			Prefix:   "/admin",
+			Auth:     adminAuth,
+			Security: "admin",
+			Routes: []apiRoute{
+				{Method: http.MethodGet, Path: "/tenants", Summary: "List tenants", Response: responseAdminTenants{}, Handler: apiAdminListTenants},
+				{
+					Method: http.MethodPost, Path: "/tenants", Summary: "Create a tenant",
+					Description: "Tenant deal parameters and replication limits are validated before storing",
+					Body:        `{ "tenant_name": "...", "tenant_meta": { ... } }`,
+					Response:    responseAdminTenants{}, Handler: apiAdminUpsertTenant,
+				},
+				{
+					Method: http.MethodGet, Path: "/tenants/:tenantID", Summary: "Show a tenant",
+					Params:   []apiParam{adminTenantIDParam},
+					Response: responseAdminTenants{}, Handler: apiAdminGetTenant,
+				},
+				{
+					Method: http.MethodPut, Path: "/tenants/:tenantID", Summary: "Create or replace a tenant",
+					Description: "Tenant deal parameters and replication limits are validated before storing",
+					Params:      []apiParam{adminTenantIDParam},
+					Body:        `{ "tenant_name": "...", "tenant_meta": { ... } }`,
+					Response:    responseAdminTenants{}, Handler: apiAdminUpsertTenant,
+				},
+				{
+					Method: http.MethodDelete, Path: "/tenants/:tenantID", Summary: "Delete a tenant",
+					Params:  []apiParam{adminTenantIDParam},
+					Handler: apiAdminDeleteTenant,
+				},
+				{
+					Method: http.MethodPut, Path: "/tenants/:tenantID/replication_limits", Summary: "Replace the replication limits of a tenant",
+					Description: "Replaces only the `max` portion of tenant_meta",
+					Params:      []apiParam{adminTenantIDParam},
+					Body:        `the new tenant_meta.max object`,
+					Response:    responseAdminTenants{}, Handler: apiAdminSetTenantReplicationLimits,
+				},
+				{
+					Method: http.MethodGet, Path: "/tenants/:tenantID/providers", Summary: "List SP registrations with a tenant",
+					Params:   []apiParam{adminTenantIDParam},
+					Response: responseAdminTenantProviders{}, Handler: apiAdminListTenantProviders,
+				},
+				{
+					Method: http.MethodPut, Path: "/tenants/:tenantID/providers/:spID", Summary: "Register an SP with a tenant",
+					Description: "The SP is added to the global provider list if not yet known",
+					Params:      []apiParam{adminTenantIDParam, adminSpIDParam},
+					Body:        `{ "tenant_provider_meta": { ... } }`,
+					Response:    responseAdminTenantProviders{}, Handler: apiAdminUpsertTenantProvider,
+				},
+				{
+					Method: http.MethodDelete, Path: "/tenants/:tenantID/providers/:spID", Summary: "Remove an SP registration with a tenant",
+					Params:  []apiParam{adminTenantIDParam, adminSpIDParam},
+					Handler: apiAdminDeleteTenantProvider,
+				},
+				{
+					Method: http.MethodPut, Path: "/tenants/:tenantID/datasets/:datasetID", Summary: "Link a dataset to a tenant",
+					Params:   []apiParam{adminTenantIDParam, adminDatasetIDParam},
+					Body:     `{ "tenant_dataset_meta": { ... } }`,
+					Response: responseAdminDatasets{}, Handler: apiAdminLinkTenantDataset,
+				},
+				{
+					Method: http.MethodDelete, Path: "/tenants/:tenantID/datasets/:datasetID", Summary: "Unlink a dataset from a tenant",
+					Params:   []apiParam{adminTenantIDParam, adminDatasetIDParam},
+					Response: responseAdminDatasets{}, Handler: apiAdminUnlinkTenantDataset,
+				},
+				{
+					Method: http.MethodGet, Path: "/tenants/:tenantID/webhook", Summary: "Show the lifecycle webhook of a tenant",
+					Params:   []apiParam{adminTenantIDParam},
+					Response: responseWebhook{}, Handler: apiAdminGetTenantWebhook,
+				},
+				{
+					Method: http.MethodPut, Path: "/tenants/:tenantID/webhook", Summary: "Register the lifecycle webhook of a tenant",
+					Description: "The URL is notified on lifecycle transitions of all proposals made on behalf of the tenant. Registering returns a fresh webhook_secret.",
+					Params:      []apiParam{adminTenantIDParam},
+					Body:        `{ "webhook_url": "https://..." }`,
+					Response:    responseWebhook{}, Handler: apiAdminSetTenantWebhook,
+				},
+				{
+					Method: http.MethodDelete, Path: "/tenants/:tenantID/webhook", Summary: "Remove the lifecycle webhook of a tenant",
+					Params:   []apiParam{adminTenantIDParam},
+					Response: responseWebhook{}, Handler: apiAdminDeleteTenantWebhook,
+				},
+				{Method: http.MethodGet, Path: "/datasets", Summary: "List datasets", Response: responseAdminDatasets{}, Handler: apiAdminListDatasets},
+				{
+					Method: http.MethodPost, Path: "/datasets", Summary: "Create a dataset",
+					Body:     `{ "dataset_slug": "...", "dataset_meta": { ... } }`,
+					Response: responseAdminDatasets{}, Handler: apiAdminUpsertDataset,
+				},
+				{
+					Method: http.MethodGet, Path: "/datasets/:datasetID", Summary: "Show a dataset",
+					Params:   []apiParam{adminDatasetIDParam},
+					Response: responseAdminDatasets{}, Handler: apiAdminGetDataset,
+				},
+				{
+					Method: http.MethodPut, Path: "/datasets/:datasetID", Summary: "Create or replace a dataset",
+					Params:   []apiParam{adminDatasetIDParam},
+					Body:     `{ "dataset_slug": "...", "dataset_meta": { ... } }`,
+					Response: responseAdminDatasets{}, Handler: apiAdminUpsertDataset,
+				},
+				{
+					Method: http.MethodDelete, Path: "/datasets/:datasetID", Summary: "Delete a dataset",
+					Params:  []apiParam{adminDatasetIDParam},
+					Handler: apiAdminDeleteDataset,
+				},
+			},
+		},
+	}
 }
+
+var (
+	adminTenantIDParam  = apiParam{Name: "tenantID", In: paramInPath, Type: paramInteger, Min: 1, Max: 1<<15 - 1}
+	adminDatasetIDParam = apiParam{Name: "datasetID", In: paramInPath, Type: paramInteger, Min: 1, Max: 1<<15 - 1}
+	adminSpIDParam      = apiParam{Name: "spID", In: paramInPath, Type: paramString, Format: paramFormatActorID, Description: "Storage provider actor ID, e.g. f01234"}
+)
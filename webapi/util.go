@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -12,6 +13,7 @@ import (
 
 	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
 	"github.com/dgraph-io/ristretto"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/ribasushi/go-toolbox-interplanetary/fil"
@@ -20,6 +22,13 @@ import (
 	"golang.org/x/xerrors"
 )
 
+// apitypes.ResponsePayload is a sealed interface: payloads which are not (yet)
+// part of the upstream apitypes package embed this to satisfy it, without
+// contributing anything to the serialized response
+type localResponsePayload struct {
+	apitypes.ResponsePiecesEligible `json:"-"`
+}
+
 func truthyBoolQueryParam(c echo.Context, pname string) bool {
 	if !c.QueryParams().Has(pname) {
 		return false
@@ -31,8 +40,7 @@ func truthyBoolQueryParam(c echo.Context, pname string) bool {
 	return false
 }
 
-func parseUIntQueryParam(c echo.Context, pname string, min, max uint64) (uint64, error) {
-	str := c.QueryParam(pname)
+func parseUIntParam(pname, str string, min, max uint64) (uint64, error) {
 	val, err := strconv.ParseUint(str, 10, 64)
 	if str == "" || err != nil {
 		return 0, xerrors.Errorf("provided '%s' value '%s' is not a valid integer", pname, str)
@@ -43,6 +51,28 @@ func parseUIntQueryParam(c echo.Context, pname string, min, max uint64) (uint64,
 	return val, nil
 }
 
+func parseJSONBody(c echo.Context, dst interface{}) error {
+	dec := json.NewDecoder(c.Request().Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return xerrors.Errorf("unable to decode JSON request body: %w", err)
+	}
+	if dec.More() {
+		return xerrors.New("unexpected trailing data after JSON request body")
+	}
+	return nil
+}
+
+// returns a non-nil error only if the supplied one is a violation of a DB
+// constraint, which in turn is a direct consequence of the request contents
+func pgConstraintViolation(err error) *pgconn.PgError {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && strings.HasPrefix(pgErr.Code, "23") { // Class 23 — Integrity Constraint Violation
+		return pgErr
+	}
+	return nil
+}
+
 func retPayloadAnnotated(c echo.Context, httpCode int, errCode apitypes.APIErrorCode, payload apitypes.ResponsePayload, fmsg string, args ...interface{}) error {
 	ctx, ctxMeta := unpackAuthedEchoContext(c)
 
@@ -86,6 +116,7 @@ func retPayloadAnnotated(c echo.Context, httpCode int, errCode apitypes.APIError
 	} else {
 		r.ErrCode = int(errCode)
 		r.ErrSlug = errCode.String()
+		c.Set(metricsErrSlugKey, r.ErrSlug)
 		r.ErrLines = lines
 
 		if r.RequestID != "" && (msg != "" || errCode != 0) {
@@ -117,8 +148,7 @@ func retPayloadAnnotated(c echo.Context, httpCode int, errCode apitypes.APIError
 		}
 	}
 
-	// FIXME - only prettify on curl and similar
-	return c.JSONPretty(httpCode, r, "  ")
+	return renderNegotiated(c, httpCode, r)
 }
 
 func curlAuthedForSP(c echo.Context, spID fil.ActorID, path string) string {
@@ -136,6 +166,24 @@ func curlAuthedForSP(c echo.Context, spID fil.ActorID, path string) string {
 	)
 }
 
+// curlAuthedForSPWithArg is curlAuthedForSP for calls binding their query as the signed argument
+func curlAuthedForSPWithArg(c echo.Context, spID fil.ActorID, path, query string) string {
+	prot := c.Request().Header.Get("X-Forwarded-Proto")
+	if prot == "" {
+		prot = "http"
+	}
+
+	return fmt.Sprintf(
+		`echo curl -sLH "Authorization: $( ./fil-spid.bash %s '%s' )" '%s://%s%s?%s' | sh`,
+		spID,
+		query,
+		prot,
+		c.Request().Host,
+		path,
+		query,
+	)
+}
+
 func retFail(c echo.Context, errCode apitypes.APIErrorCode, fMsg string, args ...interface{}) error {
 	return retPayloadAnnotated(
 		c,
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/ribasushi/go-toolbox/cmn"
+)
+
+const mimeCBOR = "application/cbor"
+
+// field names follow the json tags, so that both encodings of the envelope are structurally identical
+var cborEnc = func() cbor.EncMode {
+	em, err := cbor.EncOptions{
+		Time: cbor.TimeRFC3339Nano,
+	}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return em
+}()
+
+// user agents of tools where a human is likely staring at the output
+var prettyUserAgentPrefixes = []string{
+	"curl/",
+	"wget/",
+	"httpie/",
+}
+
+// negotiateResponseMime picks the first recognized media type from Accept, ignoring q-values:
+// every client we care about sends at most one concrete preference. Anything unrecognized
+// results in JSON, as it always has.
+func negotiateResponseMime(c echo.Context) (mimeType string, explicit bool) {
+	for _, part := range strings.Split(c.Request().Header.Get(echo.HeaderAccept), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case mimeCBOR:
+			return mimeCBOR, true
+		case echo.MIMEApplicationJSON:
+			return echo.MIMEApplicationJSON, true
+		}
+	}
+	return echo.MIMEApplicationJSON, false
+}
+
+func wantsPrettyJSON(c echo.Context, explicitJSON bool) bool {
+	if c.QueryParams().Has("pretty") {
+		return truthyBoolQueryParam(c, "pretty")
+	}
+	if explicitJSON {
+		return false
+	}
+	ua := strings.ToLower(c.Request().UserAgent())
+	for _, pref := range prettyUserAgentPrefixes {
+		if strings.HasPrefix(ua, pref) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderNegotiated writes any response payload in the format requested via Accept
+func renderNegotiated(c echo.Context, httpCode int, payload interface{}) error {
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+
+	mt, explicit := negotiateResponseMime(c)
+	if mt == mimeCBOR {
+		b, err := cborEnc.Marshal(payload)
+		if err != nil {
+			return cmn.WrErr(err)
+		}
+		return c.Blob(httpCode, mimeCBOR, b)
+	}
+
+	if wantsPrettyJSON(c, explicit) {
+		return c.JSONPretty(httpCode, payload, "  ")
+	}
+
+	// echo's c.JSON() honors ?pretty on its own, we already took care of that
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	c.Response().WriteHeader(httpCode)
+	return cmn.WrErr(json.NewEncoder(c.Response()).Encode(payload))
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 
 	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
@@ -11,10 +13,41 @@ import (
 	"github.com/ribasushi/go-toolbox/cmn"
 	"github.com/ribasushi/spade/internal/app"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
 )
 
 type piecePointers map[int64]pieceSources
 
+// dataSourceHTTP represents a complete .car retrievable from a plain HTTP(S) or S3-compatible endpoint
+// It is the stream-protocol counterpart of apitypes.FilSourceDAG, and is to be preferred when available
+type dataSourceHTTP struct {
+	SourceType        string `json:"source_type"`
+	URL               string `json:"url"`
+	Priority          int16  `json:"priority"`
+	SampleRetrieveCmd string `json:"sample_retrieve_cmd"`
+}
+
+func (s *dataSourceHTTP) SrcType() string { return s.SourceType }
+
+var _ apitypes.DataSource = &dataSourceHTTP{}
+
+func (s *dataSourceHTTP) initDerivedVals(pieceCid string) error {
+	if pieceCid == "" {
+		return xerrors.New("supplied PieceCID string can not be empty")
+	}
+
+	outFn := apitypes.TrimCidString(pieceCid) + ".car"
+	if strings.HasPrefix(s.URL, "s3://") {
+		s.SourceType = "S3"
+		s.SampleRetrieveCmd = fmt.Sprintf("aws s3 cp '%s' $(pwd)/%s", s.URL, outFn)
+	} else {
+		s.SourceType = "HTTP"
+		s.SampleRetrieveCmd = fmt.Sprintf("curl -sLo $(pwd)/%s '%s'", outFn, s.URL)
+	}
+
+	return nil
+}
+
 type pieceSources struct {
 	sourcesPointer      *[]apitypes.DataSource
 	pieceCid            string
@@ -32,14 +65,22 @@ func injectSources(ctx context.Context, toFill piecePointers, onlyOrg int16) err
 
 	pieceLocks := make(map[int64]*sync.Mutex, 128<<10)
 	filSrcIDs := make([]int64, 0, len(toFill))
+	httpSrcIDs := make([]int64, 0, len(toFill))
 	for pieceID, p := range toFill {
 		var useLock sync.Mutex
 		if p.HasSourcesFilActive {
 			filSrcIDs = append(filSrcIDs, pieceID)
 			pieceLocks[pieceID] = &useLock
 		}
+		if p.HasSourcesHTTP {
+			httpSrcIDs = append(httpSrcIDs, pieceID)
+			pieceLocks[pieceID] = &useLock
+		}
 	}
 
+	if len(httpSrcIDs) > 0 {
+		eg.Go(func() error { return injectHTTP(ctx, httpSrcIDs, toFill, pieceLocks) })
+	}
 	if len(filSrcIDs) > 0 {
 		eg.Go(func() error { return injectActiveFilDAG(ctx, filSrcIDs, toFill, onlyOrg, pieceLocks) })
 	}
@@ -48,6 +89,16 @@ func injectSources(ctx context.Context, toFill piecePointers, onlyOrg int16) err
 		return cmn.WrErr(err)
 	}
 
+	// stream-protocol sources go first, regardless of which query finished first
+	for pieceID := range pieceLocks {
+		srcs := *toFill[pieceID].sourcesPointer
+		sort.SliceStable(srcs, func(i, j int) bool {
+			_, iIsHTTP := srcs[i].(*dataSourceHTTP)
+			_, jIsHTTP := srcs[j].(*dataSourceHTTP)
+			return iIsHTTP && !jIsHTTP
+		})
+	}
+
 	return nil
 }
 
@@ -114,3 +165,76 @@ func injectActiveFilDAG(ctx context.Context, ids []int64, ptrs piecePointers, on
 
 	return cmn.WrErr(rows.Err())
 }
+
+func injectHTTP(ctx context.Context, ids []int64, ptrs piecePointers, pieceLocks map[int64]*sync.Mutex) error {
+
+	rows, err := app.GetGlobalCtx(ctx).Db[app.DbMain].Query(
+		ctx,
+		`
+		SELECT
+				piece_id,
+				source_url,
+				source_priority,
+				proposal_label
+			FROM (
+				(
+					SELECT p.piece_id, sh.source_url, sh.source_priority, sh.source_meta, p.proposal_label
+						FROM spd.sources_http sh
+						JOIN spd.pieces p ON ( p.piece_id = sh.piece_id )
+					WHERE
+						p.piece_id = ANY ( $1 )
+				)
+
+				UNION ALL
+
+				(
+					SELECT p.piece_id, sh.source_url, sh.source_priority, sh.source_meta, p.proposal_label
+						FROM spd.sources_http sh
+						JOIN spd.datasets_pieces dp ON ( dp.dataset_id = sh.dataset_id )
+						JOIN spd.pieces p ON ( p.piece_id = dp.piece_id )
+					WHERE
+						p.piece_id = ANY ( $1 )
+				)
+			) s
+		WHERE
+			NOT COALESCE( ( source_meta->'inactivated' )::BOOL, false )
+		ORDER BY
+			piece_id,
+			source_priority DESC,
+			source_url
+		`,
+		ids,
+	)
+	if err != nil {
+		return cmn.WrErr(err)
+	}
+	defer rows.Close()
+
+	var pieceID int64
+	for rows.Next() {
+		var srcEntry dataSourceHTTP
+		var payloadCid *string
+
+		if err := rows.Scan(&pieceID, &srcEntry.URL, &srcEntry.Priority, &payloadCid); err != nil {
+			return cmn.WrErr(err)
+		}
+		p := ptrs[pieceID]
+
+		if strings.Contains(srcEntry.URL, "{payloadCid}") {
+			if payloadCid == nil {
+				continue // can not expand a template without a payload
+			}
+			srcEntry.URL = strings.ReplaceAll(srcEntry.URL, "{payloadCid}", *payloadCid)
+		}
+		srcEntry.URL = strings.ReplaceAll(srcEntry.URL, "{pieceCid}", p.pieceCid)
+
+		if err := srcEntry.initDerivedVals(p.pieceCid); err != nil {
+			return cmn.WrErr(err)
+		}
+		pieceLocks[pieceID].Lock()
+		*p.sourcesPointer = append(*p.sourcesPointer, &srcEntry)
+		pieceLocks[pieceID].Unlock()
+	}
+
+	return cmn.WrErr(rows.Err())
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
+	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/xerrors"
+)
+
+const (
+	reservationHookDefaultTimeoutMsecs = 1500
+	reservationHookMaxTimeoutMsecs     = 5000 // the call is made while holding the request_piece lock
+	reservationHookBudgetMsecs         = 7500 // the same applies to all calls of a single request_piece combined
+	reservationHookMinSecretLen        = 32
+	reservationHookSignatureHeader     = "X-Spade-Signature"
+)
+
+// tenantReservationHook is the optional tenant_meta->'reservation_hook' object
+type tenantReservationHook struct {
+	URL          string `json:"url"`
+	TimeoutMsecs *int   `json:"timeout_msecs,omitempty"`
+	Secret       string `json:"secret,omitempty"`
+	FailOpen     bool   `json:"fail_open,omitempty"` // grant the reservation when the hook is unreachable or errors out
+}
+
+type reservationHookRequest struct {
+	RequestID           string                          `json:"request_id"`
+	TenantID            int16                           `json:"tenant_id"`
+	ProviderID          string                          `json:"provider_id"`
+	ProviderOrgID       int16                           `json:"provider_org_id"`
+	ProviderCityID      int16                           `json:"provider_city_id"`
+	ProviderCountryID   int16                           `json:"provider_country_id"`
+	ProviderContinentID int16                           `json:"provider_continent_id"`
+	PieceCid            string                          `json:"piece_cid"`
+	PaddedPieceSize     int64                           `json:"padded_piece_size"`
+	ProposalLabel       string                          `json:"proposal_label"`
+	ReplicationState    apitypes.TenantReplicationState `json:"replication_state"`
+}
+
+// reservationHookOutcome is recorded in request_meta, and for the granting tenant in proposal_meta
+type reservationHookOutcome struct {
+	TenantID   int16  `json:"tenant_id"`
+	URL        string `json:"url"`
+	Allowed    bool   `json:"allowed"`
+	Message    string `json:"message,omitempty"`
+	Error      string `json:"error,omitempty"`
+	HTTPStatus int    `json:"http_status,omitempty"`
+	TookMsecs  int64  `json:"took_msecs"`
+}
+
+var reservationHookClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+func validateReservationHook(raw json.RawMessage) error {
+	var h tenantReservationHook
+	if err := strictUnmarshal(raw, &h); err != nil {
+		return xerrors.Errorf("invalid 'reservation_hook' object: %w", err)
+	}
+	if err := validateWebhookURL(h.URL); err != nil {
+		return xerrors.Errorf("invalid 'reservation_hook.url': %w", err)
+	}
+	if h.TimeoutMsecs != nil && (*h.TimeoutMsecs < 1 || *h.TimeoutMsecs > reservationHookMaxTimeoutMsecs) {
+		return xerrors.Errorf("value 'reservation_hook.timeout_msecs' is out of bounds ( 1 ~ %d )", reservationHookMaxTimeoutMsecs)
+	}
+	if h.Secret != "" && len(h.Secret) < reservationHookMinSecretLen {
+		return xerrors.Errorf("value 'reservation_hook.secret' must be at least %d characters long", reservationHookMinSecretLen)
+	}
+	return nil
+}
+
+// returns nil when the tenant has no hook configured
+func tenantReservationHookFromMeta(tenantMeta []byte) (*tenantReservationHook, error) {
+	var tm struct {
+		Hook json.RawMessage `json:"reservation_hook"`
+	}
+	if err := json.Unmarshal(tenantMeta, &tm); err != nil {
+		return nil, xerrors.Errorf("unable to parse tenant_meta: %w", err)
+	}
+	if len(tm.Hook) == 0 || string(tm.Hook) == "null" {
+		return nil, nil
+	}
+	if err := validateReservationHook(tm.Hook); err != nil {
+		return nil, err
+	}
+	h := new(tenantReservationHook)
+	return h, json.Unmarshal(tm.Hook, h)
+}
+
+// callReservationHook never returns an error: every failure is reflected in the outcome,
+// and results in a refusal unless the hook is configured to fail open.
+//
+// The hook receives a POST with a JSON reservationHookRequest, and is expected to respond
+// with HTTP 200 + { "allow": <bool>, "message": "<optional explanation shown to the SP>" }
+func callReservationHook(ctx context.Context, h *tenantReservationHook, hr reservationHookRequest) (o reservationHookOutcome) {
+	o.TenantID = hr.TenantID
+	o.URL = h.URL
+
+	t0 := time.Now()
+	defer func() {
+		o.TookMsecs = time.Since(t0).Milliseconds()
+		if o.Error != "" {
+			o.Allowed = h.FailOpen
+			app.GetGlobalCtx(ctx).Logger.Warnw("reservation hook failed", "tenant", hr.TenantID, "url", h.URL, "error", o.Error, "failOpen", h.FailOpen)
+		}
+	}()
+
+	timeout := reservationHookDefaultTimeoutMsecs
+	if h.TimeoutMsecs != nil {
+		timeout = *h.TimeoutMsecs
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	body, err := json.Marshal(hr)
+	if err != nil {
+		o.Error = err.Error()
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		o.Error = err.Error()
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", app.AppName+"-reservation-hook")
+	if h.Secret != "" {
+		// same scheme as the proposal lifecycle webhooks: HMAC-SHA256( secret, "{timestamp}.{body}" )
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write([]byte(ts + ".")) //nolint:errcheck
+		mac.Write(body)             //nolint:errcheck
+		req.Header.Set(reservationHookSignatureHeader, fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil))))
+	}
+
+	resp, err := reservationHookClient.Do(req)
+	if err != nil {
+		o.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	o.HTTPStatus = resp.StatusCode
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<14))
+	if err != nil {
+		o.Error = err.Error()
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		o.Error = fmt.Sprintf("unexpected HTTP status %d", resp.StatusCode)
+		return
+	}
+
+	var res struct {
+		Allow   *bool  `json:"allow"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(respBody, &res); err != nil {
+		o.Error = fmt.Sprintf("unable to parse response: %s", err)
+		return
+	}
+	if res.Allow == nil {
+		o.Error = "response lacks the required 'allow' value"
+		return
+	}
+
+	o.Allowed = *res.Allow
+	o.Message = res.Message
+	return
+}
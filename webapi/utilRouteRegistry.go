@@ -0,0 +1,197 @@
+package main
+
+import (
+	"strings"
+
+	apitypes "github.com/data-preservation-programs/go-spade-apitypes"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/ribasushi/go-toolbox-interplanetary/fil"
+	"golang.org/x/xerrors"
+)
+
+type apiParamType string
+
+const (
+	paramInteger apiParamType = "integer"
+	paramBoolean apiParamType = "boolean"
+	paramString  apiParamType = "string"
+)
+
+const (
+	paramInQuery = "query"
+	paramInPath  = "path"
+)
+
+// formats of paramString which validateParams converts, in addition to checking them
+const (
+	paramFormatUUID    = "uuid"         // retrieved via uuidParam()
+	paramFormatActorID = "fil-actor-id" // retrieved via actorParam()
+)
+
+type apiParam struct {
+	Name        string
+	In          string
+	Type        apiParamType
+	Format      string // OpenAPI format hint, one of paramFormat* is also validated
+	Min, Max    uint64 // bounds of paramInteger
+	Default     interface{}
+	Description string
+	Internal    bool // accepted, but omitted from the OpenAPI document
+}
+
+type apiRoute struct {
+	Method      string
+	Path        string
+	Summary     string
+	Description string
+	Params      []apiParam
+	Body        string      // description of the JSON request body, empty when none is accepted
+	Response    interface{} // zero value of the response envelope payload, nil when there is none
+	Produces    string      // set for routes not responding with an apitypes.ResponseEnvelope
+	Scope       string      // token scope granting access, routes without one require a signed request
+	Handler     echo.HandlerFunc
+}
+
+type apiRouteGroup struct {
+	Prefix   string
+	Auth     echo.MiddlewareFunc
+	Security string // name of the OpenAPI security scheme matching Auth
+	Routes   []apiRoute
+}
+
+const validatedParamsKey = "validated-params"
+
+// validateParams parses every declared path parameter, and every declared query parameter present
+// on the request, and fails the request if any of them is invalid. Handlers retrieve the results via
+// the *Param() accessors. Undeclared query parameters are ignored, as they always have been.
+func validateParams(params []apiParam) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			vals := make(map[string]interface{}, len(params))
+			for _, p := range params {
+				var raw string
+				if p.In == paramInPath {
+					raw = c.Param(p.Name)
+				} else if c.QueryParams().Has(p.Name) {
+					raw = c.QueryParam(p.Name)
+				} else {
+					continue
+				}
+
+				switch p.Type {
+				case paramInteger:
+					v, err := parseUIntParam(p.Name, raw, p.Min, p.Max)
+					if err != nil {
+						return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+					}
+					vals[p.Name] = v
+				case paramBoolean:
+					vals[p.Name] = truthyBoolQueryParam(c, p.Name)
+				default:
+					v, err := parseStringParam(p, raw)
+					if err != nil {
+						return retFail(c, apitypes.ErrInvalidRequest, "%s", err)
+					}
+					vals[p.Name] = v
+				}
+			}
+			c.Set(validatedParamsKey, vals)
+			return next(c)
+		}
+	}
+}
+
+func validatedParam(c echo.Context, name string) (interface{}, bool) {
+	vals, _ := c.Get(validatedParamsKey).(map[string]interface{})
+	v, present := vals[name]
+	return v, present
+}
+
+// uintParam returns the value of a validated paramInteger, and whether it was supplied at all
+func uintParam(c echo.Context, name string) (uint64, bool) {
+	v, present := validatedParam(c, name)
+	u, _ := v.(uint64)
+	return u, present
+}
+
+// boolParam returns the value of a validated paramBoolean, false when not supplied
+func boolParam(c echo.Context, name string) bool {
+	v, _ := validatedParam(c, name)
+	b, _ := v.(bool)
+	return b
+}
+
+// stringParam returns the value of a validated paramString, and whether it was supplied at all
+func stringParam(c echo.Context, name string) (string, bool) {
+	v, present := validatedParam(c, name)
+	s, _ := v.(string)
+	return s, present
+}
+
+// uuidParam returns the value of a validated paramFormatUUID, and whether it was supplied at all
+func uuidParam(c echo.Context, name string) (uuid.UUID, bool) {
+	v, present := validatedParam(c, name)
+	u, _ := v.(uuid.UUID)
+	return u, present
+}
+
+// actorParam returns the value of a validated paramFormatActorID, and whether it was supplied at all
+func actorParam(c echo.Context, name string) (fil.ActorID, bool) {
+	v, present := validatedParam(c, name)
+	a, _ := v.(fil.ActorID)
+	return a, present
+}
+
+func parseStringParam(p apiParam, str string) (interface{}, error) {
+	if p.In == paramInPath && str == "" {
+		return nil, xerrors.Errorf("required '%s' value is missing", p.Name)
+	}
+	switch p.Format {
+	case paramFormatUUID:
+		u, err := uuid.Parse(str)
+		if err != nil {
+			return nil, xerrors.Errorf("provided '%s' value '%s' is not a valid UUID", p.Name, str)
+		}
+		return u, nil
+	case paramFormatActorID:
+		a, err := fil.ParseActorString(str)
+		if err != nil {
+			return nil, xerrors.Errorf("provided '%s' value '%s' is not a valid actor ID: %w", p.Name, str, err)
+		}
+		return a, nil
+	default:
+		return str, nil
+	}
+}
+
+// every :param of an echo path must be declared, as only declared ones are validated
+func undeclaredPathParam(r apiRoute) string {
+	for _, seg := range strings.Split(r.Path, "/") {
+		if !strings.HasPrefix(seg, ":") {
+			continue
+		}
+		declared := false
+		for _, p := range r.Params {
+			if p.In == paramInPath && p.Name == seg[1:] {
+				declared = true
+				break
+			}
+		}
+		if !declared {
+			return seg[1:]
+		}
+	}
+	return ""
+}
+
+// ":tenantID" => "{tenantID}"
+func openapiPath(echoPath string) string {
+	parts := strings.Split(echoPath, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") {
+			parts[i] = "{" + p[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/ribasushi/go-toolbox/cmn"
+	"github.com/ribasushi/spade/internal/app"
+	"golang.org/x/xerrors"
+)
+
+const webhookRecentDeliveries = 25
+
+type webhookDeliveryLog struct {
+	DeliveryID  int64           `json:"delivery_id"`
+	EventType   string          `json:"event"`
+	ProposalID  string          `json:"proposal_id" db:"proposal_uuid"`
+	Created     time.Time       `json:"created" db:"entry_created"`
+	Attempts    int16           `json:"attempts"`
+	NextAttempt *time.Time      `json:"next_attempt,omitempty"`
+	LastAttempt *time.Time      `json:"last_attempt,omitempty"`
+	Delivered   *time.Time      `json:"delivered,omitempty"`
+	Abandoned   *time.Time      `json:"abandoned,omitempty"`
+	Meta        json.RawMessage `json:"delivery_meta" db:"delivery_meta"`
+}
+
+type webhookRegistration struct {
+	WebhookID     int32                `json:"webhook_id"`
+	WebhookURL    string               `json:"webhook_url"`
+	WebhookSecret string               `json:"webhook_secret"`
+	Created       time.Time            `json:"created" db:"entry_created"`
+	LastUpdated   time.Time            `json:"last_updated" db:"entry_last_updated"`
+	IsActive      bool                 `json:"is_active"`
+	Deliveries    []webhookDeliveryLog `json:"recent_deliveries" db:"-"`
+}
+
+type responseWebhook struct {
+	localResponsePayload
+	Webhook *webhookRegistration `json:"webhook"`
+}
+
+func validateWebhookURL(u string) error {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return xerrors.Errorf("webhook URL '%s' is not valid: %w", u, err)
+	}
+	if (pu.Scheme != "https" && pu.Scheme != "http") || pu.Host == "" {
+		return xerrors.Errorf("webhook URL '%s' must be an absolute http(s):// URL", u)
+	}
+	if pu.User != nil {
+		return xerrors.Errorf("webhook URL '%s' must not contain credentials: use the signature header to authenticate deliveries", u)
+	}
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", cmn.WrErr(err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// exactly one of providerID / tenantID is expected to be non-zero
+func selectWebhook(ctx context.Context, gctx app.GlobalContext, providerID int64, tenantID int16) (*webhookRegistration, error) {
+	whs := make([]webhookRegistration, 0, 1)
+	if err := pgxscan.Select(
+		ctx,
+		gctx.Db[app.DbMain],
+		&whs,
+		`
+		SELECT
+				webhook_id,
+				webhook_url,
+				webhook_secret,
+				entry_created,
+				entry_last_updated,
+				NOT COALESCE( ( webhook_meta->'inactivated' )::BOOL, false ) AS is_active
+			FROM spd.webhooks
+		WHERE
+			( $1 != 0 AND provider_id = $1 )
+				OR
+			( $2 != 0 AND tenant_id = $2 )
+		`,
+		providerID,
+		tenantID,
+	); err != nil {
+		return nil, cmn.WrErr(err)
+	}
+	if len(whs) == 0 {
+		return nil, nil
+	}
+
+	wh := &whs[0]
+	wh.Deliveries = make([]webhookDeliveryLog, 0, webhookRecentDeliveries)
+	if err := pgxscan.Select(
+		ctx,
+		gctx.Db[app.DbMain],
+		&wh.Deliveries,
+		`
+		SELECT
+				delivery_id,
+				event_type,
+				proposal_uuid,
+				entry_created,
+				attempts,
+				( CASE WHEN delivered IS NULL AND abandoned IS NULL THEN next_attempt END ) AS next_attempt,
+				last_attempt,
+				delivered,
+				abandoned,
+				delivery_meta
+			FROM spd.webhook_deliveries
+		WHERE
+			webhook_id = $1
+		ORDER BY delivery_id DESC
+		LIMIT $2
+		`,
+		wh.WebhookID,
+		webhookRecentDeliveries,
+	); err != nil {
+		return nil, cmn.WrErr(err)
+	}
+
+	return wh, nil
+}